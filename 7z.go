@@ -3,14 +3,21 @@ package archives
 import (
 	"bytes"
 	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"io/fs"
 	"log"
+	"os"
 	"strings"
+	"time"
+	"unicode/utf16"
 
 	"github.com/bodgit/sevenzip"
+	"github.com/ulikunitz/xz/lzma"
+	"golang.org/x/text/unicode/norm"
 )
 
 func init() {
@@ -23,15 +30,61 @@ func init() {
 type SevenZip struct {
 	// If true, errors encountered during reading or writing
 	// a file within an archive will be logged and the
-	// operation will continue on remaining files.
+	// operation will continue on remaining files. Extract
+	// then returns EntryErrors listing the files that failed.
 	ContinueOnError bool
 
 	// The password, if dealing with an encrypted archive.
+	// If it is wrong or missing, reading the archive or its
+	// encrypted files fails with ErrWrongPassword; if it is
+	// missing and the header listing the files is encrypted
+	// too, the error also wraps ErrEncryptedHeader. Files that
+	// are encrypted but not compressed cannot be checked, so
+	// they may instead yield garbage.
 	Password string
+
+	// Globs selecting the entries to extract; see the package doc.
+	IncludePatterns []string
+	ExcludePatterns []string
+
+	// If true, macOS metadata is skipped; see the package doc.
+	SkipMacMetadata bool
+
+	// If true, names are normalized to NFC; see the package doc.
+	NormalizeNFC bool
+
+	// If set, reports reading progress; see the package doc.
+	OnProgress func(entryName string, bytesDone, bytesTotal int64)
+
+	// If set, wraps the contents of files; see the package doc.
+	Transform func(name string, r io.Reader) (io.Reader, error)
+
+	// The size in bytes of the buffer through which the contents
+	// of files are copied when archiving and extracting with
+	// ExtractToFS. Larger buffers can be faster on fast storage.
+	// If not positive, a default of 32 KiB is used.
+	CopyBufferSize int
+
+	// Limits on the bytes extracted; see the package doc.
+	MaxDecompressedSize int64
+	MaxEntrySize        int64
+
+	// If positive, the most entries allowed; see the package doc.
+	MaxEntries int
+
+	// If true, checksums are verified; see the package doc.
+	VerifyChecksums bool
+
+	// If set, the modification time of every file archived,
+	// instead of its own.
+	ModTime time.Time
 }
 
-func (SevenZip) Extension() string { return ".7z" }
-func (SevenZip) MediaType() string { return "application/x-7z-compressed" }
+func (SevenZip) Extension() string      { return ".7z" }
+func (SevenZip) MediaType() string      { return "application/x-7z-compressed" }
+func (SevenZip) magicNumbers() [][]byte { return [][]byte{sevenZipHeader} }
+
+func (z SevenZip) copyBufSize() int { return z.CopyBufferSize }
 
 func (z SevenZip) Match(_ context.Context, filename string, stream io.Reader) (MatchResult, error) {
 	var mr MatchResult
@@ -51,7 +104,327 @@ func (z SevenZip) Match(_ context.Context, filename string, stream io.Reader) (M
 	return mr, nil
 }
 
-// Archive is not implemented for 7z because I do not know of a pure-Go 7z writer.
+// Archive writes files to output as a 7z archive, implementing the
+// Archiver interface. The contents of all the files are compressed
+// together (solid) with LZMA2; symbolic links are stored with their
+// targets as contents, as 7-Zip does. Archives are never encrypted,
+// even if Password is set. Since the central header of a 7z archive
+// is located from the start of the file, the compressed contents are
+// written to a temporary file first.
+func (z SevenZip) Archive(ctx context.Context, output io.Writer, files []FileInfo) error {
+	packed, err := os.CreateTemp("", "archives-7z-*")
+	if err != nil {
+		return fmt.Errorf("creating temporary file: %w", err)
+	}
+	defer os.Remove(packed.Name())
+	defer packed.Close()
+
+	lw, err := lzma.Writer2Config{DictCap: sevenZipDictCap}.NewWriter2(packed)
+	if err != nil {
+		return fmt.Errorf("creating LZMA2 writer: %w", err)
+	}
+	entries := make([]sevenZipEntry, 0, len(files))
+	for i, file := range files {
+		if err := ctx.Err(); err != nil {
+			return err // honor context cancellation
+		}
+		entry, err := writeSevenZipFile(ctx, lw, file, z.CopyBufferSize)
+		if err != nil {
+			return fmt.Errorf("file %d: %s: %w", i, entry.name, err)
+		}
+		if !z.ModTime.IsZero() {
+			entry.modTime = z.ModTime
+		}
+		entries = append(entries, entry)
+	}
+	if err := lw.Close(); err != nil {
+		return fmt.Errorf("closing LZMA2 writer: %w", err)
+	}
+	packedSize, err := packed.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+
+	header := encodeSevenZipHeader(entries, packedSize)
+	start := make([]byte, 32)
+	copy(start, sevenZipHeader)
+	start[7] = 4 // format version 0.4
+	binary.LittleEndian.PutUint64(start[12:], uint64(packedSize))
+	binary.LittleEndian.PutUint64(start[20:], uint64(len(header)))
+	binary.LittleEndian.PutUint32(start[28:], crc32.ChecksumIEEE(header))
+	binary.LittleEndian.PutUint32(start[8:], crc32.ChecksumIEEE(start[12:]))
+
+	if _, err := output.Write(start); err != nil {
+		return err
+	}
+	if _, err := packed.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.Copy(output, packed); err != nil {
+		return err
+	}
+	_, err = output.Write(header)
+	return err
+}
+
+// sevenZipDictCap is the LZMA2 dictionary size used when archiving,
+// the default of 7-Zip at its normal level.
+const sevenZipDictCap = 16 << 20
+
+// sevenZipEntry is what the header of a 7z archive records about a
+// file written by Archive.
+type sevenZipEntry struct {
+	name    string
+	modTime time.Time
+	mode    fs.FileMode
+	size    int64
+	crc     uint32
+}
+
+// writeSevenZipFile writes the contents of file to w, through a buffer
+// of bufSize bytes, returning the entry for it.
+func writeSevenZipFile(ctx context.Context, w io.Writer, file FileInfo, bufSize int) (sevenZipEntry, error) {
+	entry := sevenZipEntry{
+		name:    strings.TrimSuffix(file.NameInArchive, "/"),
+		modTime: file.ModTime(),
+		mode:    file.Mode(),
+	}
+	if entry.name == "" {
+		entry.name = file.Name() // assume base name of file I guess
+	}
+	crc := crc32.NewIEEE()
+	cw := &countingWriter{w: io.MultiWriter(w, crc)}
+	switch {
+	case isSymlink(file):
+		if _, err := io.WriteString(cw, file.LinkTarget); err != nil {
+			return entry, err
+		}
+	case file.Mode().IsRegular():
+		if err := openAndCopyFile(ctx, file, cw, bufSize); err != nil {
+			return entry, err
+		}
+	}
+	entry.size, entry.crc = cw.n, crc.Sum32()
+	return entry, nil
+}
+
+// Property IDs of the 7z header.
+const (
+	sevenZipEnd              = 0x00
+	sevenZipHeaderID         = 0x01
+	sevenZipMainStreamsInfo  = 0x04
+	sevenZipFilesInfo        = 0x05
+	sevenZipPackInfo         = 0x06
+	sevenZipUnpackInfo       = 0x07
+	sevenZipSubStreamsInfo   = 0x08
+	sevenZipSize             = 0x09
+	sevenZipCRC              = 0x0A
+	sevenZipFolder           = 0x0B
+	sevenZipCodersUnpackSize = 0x0C
+	sevenZipNumUnpackStream  = 0x0D
+	sevenZipEmptyStream      = 0x0E
+	sevenZipEmptyFile        = 0x0F
+	sevenZipName             = 0x11
+	sevenZipMTime            = 0x14
+	sevenZipWinAttributes    = 0x15
+)
+
+// encodeSevenZipHeader returns the header of a 7z archive with the
+// given entries, whose non-empty contents were compressed together
+// into one LZMA2 stream of packedSize bytes.
+func encodeSevenZipHeader(entries []sevenZipEntry, packedSize int64) []byte {
+	var streams []sevenZipEntry
+	var unpackedSize int64
+	emptyStream := make([]bool, len(entries))
+	var emptyFile []bool
+	for i, entry := range entries {
+		if entry.size > 0 {
+			streams = append(streams, entry)
+			unpackedSize += entry.size
+			continue
+		}
+		emptyStream[i] = true
+		emptyFile = append(emptyFile, !entry.mode.IsDir())
+	}
+
+	var h bytes.Buffer
+	h.WriteByte(sevenZipHeaderID)
+
+	if len(streams) > 0 {
+		h.WriteByte(sevenZipMainStreamsInfo)
+
+		h.WriteByte(sevenZipPackInfo)
+		writeSevenZipNumber(&h, 0) // position of the packed stream
+		writeSevenZipNumber(&h, 1)
+		h.WriteByte(sevenZipSize)
+		writeSevenZipNumber(&h, uint64(packedSize))
+		h.WriteByte(sevenZipEnd)
+
+		h.WriteByte(sevenZipUnpackInfo)
+		h.WriteByte(sevenZipFolder)
+		writeSevenZipNumber(&h, 1)
+		h.WriteByte(0) // not external
+		writeSevenZipNumber(&h, 1)
+		h.WriteByte(0x21) // a simple coder with a 1-byte ID and properties
+		h.WriteByte(0x21) // LZMA2
+		writeSevenZipNumber(&h, 1)
+		h.WriteByte(lzma.EncodeDictCap(sevenZipDictCap))
+		h.WriteByte(sevenZipCodersUnpackSize)
+		writeSevenZipNumber(&h, uint64(unpackedSize))
+		h.WriteByte(sevenZipEnd)
+
+		h.WriteByte(sevenZipSubStreamsInfo)
+		h.WriteByte(sevenZipNumUnpackStream)
+		writeSevenZipNumber(&h, uint64(len(streams)))
+		if len(streams) > 1 {
+			h.WriteByte(sevenZipSize)
+			for _, entry := range streams[:len(streams)-1] {
+				writeSevenZipNumber(&h, uint64(entry.size))
+			}
+		}
+		h.WriteByte(sevenZipCRC)
+		h.WriteByte(1) // all defined
+		for _, entry := range streams {
+			h.Write(binary.LittleEndian.AppendUint32(nil, entry.crc))
+		}
+		h.WriteByte(sevenZipEnd)
+
+		h.WriteByte(sevenZipEnd)
+	}
+
+	if len(entries) > 0 {
+		h.WriteByte(sevenZipFilesInfo)
+		writeSevenZipNumber(&h, uint64(len(entries)))
+
+		if len(streams) < len(entries) {
+			writeSevenZipProperty(&h, sevenZipEmptyStream, sevenZipBits(emptyStream))
+			writeSevenZipProperty(&h, sevenZipEmptyFile, sevenZipBits(emptyFile))
+		}
+
+		names := []byte{0} // not external
+		for _, entry := range entries {
+			for _, c := range utf16.Encode([]rune(entry.name + "\x00")) {
+				names = binary.LittleEndian.AppendUint16(names, c)
+			}
+		}
+		writeSevenZipProperty(&h, sevenZipName, names)
+
+		defined := make([]bool, len(entries))
+		var times []byte
+		for i, entry := range entries {
+			if defined[i] = !entry.modTime.IsZero(); defined[i] {
+				times = binary.LittleEndian.AppendUint64(times, sevenZipTime(entry.modTime))
+			}
+		}
+		mtimes := sevenZipDefined(defined)
+		mtimes = append(mtimes, 0) // not external
+		writeSevenZipProperty(&h, sevenZipMTime, append(mtimes, times...))
+
+		attrs := []byte{1, 0} // all defined, not external
+		for _, entry := range entries {
+			attrs = binary.LittleEndian.AppendUint32(attrs, sevenZipAttributes(entry.mode))
+		}
+		writeSevenZipProperty(&h, sevenZipWinAttributes, attrs)
+
+		h.WriteByte(sevenZipEnd)
+	}
+
+	h.WriteByte(sevenZipEnd)
+	return h.Bytes()
+}
+
+// writeSevenZipNumber writes v in the variable-length encoding of
+// the 7z header, in which the number of leading 1 bits of the first
+// byte is the number of bytes that follow.
+func writeSevenZipNumber(buf *bytes.Buffer, v uint64) {
+	var first byte
+	mask := byte(0x80)
+	var i int
+	for i = 0; i < 8; i++ {
+		if v < 1<<(7*(i+1)) {
+			first |= byte(v >> (8 * i))
+			break
+		}
+		first |= mask
+		mask >>= 1
+	}
+	buf.WriteByte(first)
+	for ; i > 0; i-- {
+		buf.WriteByte(byte(v))
+		v >>= 8
+	}
+}
+
+func writeSevenZipProperty(buf *bytes.Buffer, id byte, data []byte) {
+	buf.WriteByte(id)
+	writeSevenZipNumber(buf, uint64(len(data)))
+	buf.Write(data)
+}
+
+// sevenZipBits packs bits into bytes, most significant bit first.
+func sevenZipBits(bits []bool) []byte {
+	packed := make([]byte, (len(bits)+7)/8)
+	for i, bit := range bits {
+		if bit {
+			packed[i/8] |= 0x80 >> (i % 8)
+		}
+	}
+	return packed
+}
+
+// sevenZipDefined encodes which of a list of values are defined.
+func sevenZipDefined(defined []bool) []byte {
+	for _, d := range defined {
+		if !d {
+			return append([]byte{0}, sevenZipBits(defined)...)
+		}
+	}
+	return []byte{1} // all defined
+}
+
+// sevenZipTime returns t as a Windows FILETIME, in 100-nanosecond
+// intervals since 1601.
+func sevenZipTime(t time.Time) uint64 {
+	const epochDiff = 116444736000000000 // from 1601 to 1970
+	return uint64(t.UnixNano()/100 + epochDiff)
+}
+
+// sevenZipAttributes returns the Windows attributes for mode, with
+// the Unix mode in the upper 16 bits as 7-Zip writes them on Unix.
+func sevenZipAttributes(mode fs.FileMode) uint32 {
+	const (
+		readOnly      = 0x01
+		directory     = 0x10
+		archive       = 0x20
+		unixExtension = 0x8000
+	)
+	attrs := uint32(unixExtension)
+	unixMode := uint32(mode.Perm())
+	switch {
+	case mode.IsDir():
+		attrs |= directory
+		unixMode |= 0o040000
+	case mode&fs.ModeSymlink != 0:
+		attrs |= archive
+		unixMode |= 0o120000
+	default:
+		attrs |= archive
+		unixMode |= 0o100000
+	}
+	if mode&fs.ModeSetuid != 0 {
+		unixMode |= 0o4000
+	}
+	if mode&fs.ModeSetgid != 0 {
+		unixMode |= 0o2000
+	}
+	if mode&fs.ModeSticky != 0 {
+		unixMode |= 0o1000
+	}
+	if mode.Perm()&0o222 == 0 {
+		attrs |= readOnly
+	}
+	return attrs | unixMode<<16
+}
 
 // Extract extracts files from z, implementing the Extractor interface. Uniquely, however,
 // sourceArchive must be an io.ReaderAt and io.Seeker, which are oddly disjoint interfaces
@@ -72,16 +445,37 @@ func (z SevenZip) Extract(ctx context.Context, sourceArchive io.Reader, handleFi
 
 	zr, err := sevenzip.NewReaderWithPassword(sra, size, z.Password)
 	if err != nil {
+		err = sevenZipError(err)
+		if z.Password == "" && errors.Is(err, ErrWrongPassword) {
+			// only the header is read so far
+			return fmt.Errorf("%w: %w", ErrEncryptedHeader, err)
+		}
 		return err
 	}
 
 	// important to initialize to non-nil, empty value due to how fileIsIncluded works
 	skipDirs := skipList{}
+	limits := newExtractLimits(z.MaxDecompressedSize, z.MaxEntrySize, z.MaxEntries)
+	filter, err := newPatternFilter(z.IncludePatterns, z.ExcludePatterns)
+	if err != nil {
+		return err
+	}
+	filter.skipMacMetadata = z.SkipMacMetadata
 
+	var failed EntryErrors
 	for i, f := range zr.File {
 		if err := ctx.Err(); err != nil {
 			return err // honor context cancellation
 		}
+		if err := limits.countEntry(); err != nil {
+			return err
+		}
+		if z.NormalizeNFC {
+			f.Name = norm.NFC.String(f.Name)
+		}
+		if !filter.includes(f.Name) {
+			continue
+		}
 
 		if fileIsIncluded(skipDirs, f.Name) {
 			continue
@@ -95,11 +489,16 @@ func (z SevenZip) Extract(ctx context.Context, sourceArchive io.Reader, handleFi
 			Open: func() (fs.File, error) {
 				openedFile, err := f.Open()
 				if err != nil {
-					return nil, err
+					return nil, sevenZipError(err)
 				}
-				return fileInArchive{openedFile, fi}, nil
+				return fileInArchive{sevenZipReader{openedFile}, fi}, nil
 			},
 		}
+		if z.VerifyChecksums && f.CRC32 != 0 {
+			file = verifyChecksum(file, crc32.NewIEEE, f.CRC32, nil)
+		}
+		file = reportProgress(limits.apply(file), int64(f.UncompressedSize), z.OnProgress)
+		file = transformContents(file, z.Transform)
 
 		err := handleFile(ctx, file)
 		if errors.Is(err, fs.SkipAll) {
@@ -109,17 +508,56 @@ func (z SevenZip) Extract(ctx context.Context, sourceArchive io.Reader, handleFi
 		} else if err != nil {
 			if z.ContinueOnError {
 				log.Printf("[ERROR] %s: %v", f.Name, err)
+				failed = append(failed, EntryError{Name: f.Name, Err: err})
 				continue
 			}
 			return fmt.Errorf("handling file %d: %s: %w", i, f.Name, err)
 		}
 	}
 
-	return nil
+	return failed.asError()
+}
+
+// Walk calls fn for each file in the archive, in order, without reading
+// their contents, since the entries are listed from the archive header.
+// If fn returns an error, the walk stops and the error is returned;
+// fs.SkipDir and fs.SkipAll work as they do for Extract.
+func (z SevenZip) Walk(ctx context.Context, sourceArchive io.Reader, fn func(info FileInfo) error) error {
+	z.ContinueOnError = false
+	return walkArchive(ctx, z, sourceArchive, fn)
+}
+
+// sevenZipReader reports decryption failures while reading
+// a file as ErrWrongPassword.
+type sevenZipReader struct {
+	io.ReadCloser
+}
+
+func (r sevenZipReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		err = sevenZipError(err)
+	}
+	return n, err
+}
+
+// sevenZipError wraps err with ErrWrongPassword if it is a read
+// error involving encryption, which is how the sevenzip package
+// reports that data could not be decrypted.
+func sevenZipError(err error) error {
+	var readErr *sevenzip.ReadError
+	if errors.As(err, &readErr) && readErr.Encrypted {
+		return fmt.Errorf("%w: %v", ErrWrongPassword, err)
+	}
+	return err
 }
 
 // https://py7zr.readthedocs.io/en/latest/archive_format.html#signature
 var sevenZipHeader = []byte("7z\xBC\xAF\x27\x1C")
 
-// Interface guard
-var _ Extractor = SevenZip{}
+// Interface guards
+var (
+	_ Archiver  = SevenZip{}
+	_ Extractor = SevenZip{}
+	_ Walker    = SevenZip{}
+)
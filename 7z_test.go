@@ -0,0 +1,141 @@
+package archives
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSevenZip_Password(t *testing.T) {
+	// testdata/test-encrypted*.7z come from the sevenzip package's test
+	// suite; both hold the files "foo" and "bar" and use the password
+	// "password", and test-encrypted-headers.7z also encrypts the names
+	for _, fname := range []string{"test-encrypted.7z", "test-encrypted-headers.7z"} {
+		extract := func(password string) (map[string]string, error) {
+			f, err := os.Open("testdata/" + fname)
+			checkErr(t, err, "opening %s", fname)
+			defer f.Close()
+
+			got := make(map[string]string)
+			err = SevenZip{Password: password, VerifyChecksums: true}.Extract(context.Background(), f, func(_ context.Context, info FileInfo) error {
+				rc, err := info.Open()
+				if err != nil {
+					return err
+				}
+				defer rc.Close()
+				data, err := io.ReadAll(rc)
+				if err != nil {
+					return err
+				}
+				got[info.NameInArchive] = string(data)
+				return nil
+			})
+			return got, err
+		}
+
+		got, err := extract("password")
+		checkErr(t, err, "%s: extracting with the right password", fname)
+		if got["foo"] != "foo\n" || got["bar"] != "bar\n" {
+			t.Errorf("%s: unexpected contents: %q", fname, got)
+		}
+
+		for _, password := range []string{"notpassword", ""} {
+			if _, err := extract(password); !errors.Is(err, ErrWrongPassword) {
+				t.Errorf("%s: expected ErrWrongPassword with password %q, got: %v", fname, password, err)
+			}
+		}
+
+		// only the archive whose names are encrypted can't be listed
+		_, err = extract("")
+		if encryptedHeader := fname == "test-encrypted-headers.7z"; errors.Is(err, ErrEncryptedHeader) != encryptedHeader {
+			t.Errorf("%s: expected ErrEncryptedHeader: %t, got: %v", fname, encryptedHeader, err)
+		}
+		f, err := os.Open("testdata/" + fname)
+		checkErr(t, err, "opening %s", fname)
+		var names []string
+		err = SevenZip{Password: "password"}.Walk(context.Background(), f, func(info FileInfo) error {
+			names = append(names, info.NameInArchive)
+			return nil
+		})
+		f.Close()
+		checkErr(t, err, "%s: listing with the right password", fname)
+		if len(names) != 2 {
+			t.Errorf("%s: expected to list foo and bar, got %q", fname, names)
+		}
+	}
+}
+
+func TestSevenZip_Archive(t *testing.T) {
+	src := t.TempDir()
+	mtime := time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)
+	contents := map[string]string{
+		"dir/a.txt":     strings.Repeat("solid compression ", 100),
+		"dir/sub/b.txt": "b contents",
+		"empty.txt":     "",
+	}
+	for name, data := range contents {
+		fpath := filepath.Join(src, filepath.FromSlash(name))
+		checkErr(t, os.MkdirAll(filepath.Dir(fpath), 0755), "making directory")
+		checkErr(t, os.WriteFile(fpath, []byte(data), 0640), "writing %s", name)
+		checkErr(t, os.Chtimes(fpath, mtime, mtime), "setting time of %s", name)
+	}
+	checkErr(t, os.Symlink("a.txt", filepath.Join(src, "dir", "link")), "making symlink")
+	files, err := FilesFromDisk(context.Background(), nil, map[string]string{src + string(filepath.Separator): ""})
+	checkErr(t, err, "getting files from disk")
+
+	var buf bytes.Buffer
+	checkErr(t, SevenZip{}.Archive(context.Background(), &buf, files), "archiving")
+
+	got := make(map[string]string)
+	modes := make(map[string]fs.FileMode)
+	err = SevenZip{VerifyChecksums: true}.Extract(context.Background(), bytes.NewReader(buf.Bytes()), func(_ context.Context, f FileInfo) error {
+		modes[f.NameInArchive] = f.Mode()
+		if f.IsDir() {
+			return nil
+		}
+		if !f.ModTime().Equal(mtime) && f.Mode().IsRegular() {
+			t.Errorf("%s: expected modification time %s, got %s", f.NameInArchive, mtime, f.ModTime())
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		data, err := io.ReadAll(rc)
+		got[f.NameInArchive] = string(data)
+		return err
+	})
+	checkErr(t, err, "extracting")
+
+	contents["dir/link"] = "a.txt"
+	if !reflect.DeepEqual(got, contents) {
+		t.Errorf("expected contents %q, got %q", contents, got)
+	}
+	for name, expect := range map[string]fs.FileMode{
+		"dir/":      fs.ModeDir | 0755,
+		"dir/a.txt": 0640,
+		"empty.txt": 0640,
+		"dir/link":  fs.ModeSymlink,
+	} {
+		if mode, ok := modes[name]; !ok || mode&^fs.ModePerm != expect&^fs.ModePerm || expect&fs.ModePerm != 0 && mode.Perm() != expect.Perm() {
+			t.Errorf("%s: expected mode %v, got %v (found=%t)", name, expect, mode, ok)
+		}
+	}
+
+	// an empty archive is valid too
+	buf.Reset()
+	checkErr(t, SevenZip{}.Archive(context.Background(), &buf, nil), "archiving nothing")
+	err = SevenZip{}.Extract(context.Background(), bytes.NewReader(buf.Bytes()), func(_ context.Context, f FileInfo) error {
+		t.Errorf("unexpected file %s in empty archive", f.NameInArchive)
+		return nil
+	})
+	checkErr(t, err, "extracting empty archive")
+}
@@ -1,15 +1,68 @@
+// Package archives reads and writes archive and compression formats.
+//
+// # Extraction options
+//
+// The archive formats share some options for extraction, which are
+// fields of the same names on each format type:
+//
+// IncludePatterns and ExcludePatterns select the entries extracted: only
+// those whose names (once decoded) match one of IncludePatterns, if set,
+// and none of ExcludePatterns. Patterns are globs as for path.Match,
+// except that a "**" component matches any number of components, so
+// "**/*.txt" matches text files in any directory and "secret/**"
+// matches everything in secret.
+//
+// SkipMacMetadata skips the metadata that macOS adds to archives it
+// creates: entries under "__MACOSX/" and AppleDouble files, whose names
+// start with "._".
+//
+// NormalizeNFC normalizes the names of files to Unicode NFC form once
+// decoded, so that names stored decomposed (NFD), as they are on macOS,
+// match composed names.
+//
+// OnProgress is called as the contents of each file are read, with the
+// number of bytes read so far and the uncompressed size of the file, or
+// -1 if unknown. It is called from the goroutine reading the file, so it
+// should return quickly and not do heavy work.
+//
+// Transform returns the reader through which the contents of each
+// regular file are read, for example to convert line endings; sizes,
+// limits, and checksums still apply to the contents as stored. If it
+// returns an error, opening the file fails with it.
+//
+// MaxDecompressedSize and MaxEntrySize limit the decompressed size of
+// the contents read during one extraction: of all the files together,
+// and of any one file. Once a limit is exceeded, reading fails with
+// ErrSizeLimitExceeded. Sizes are counted as the data is read, not taken
+// from headers, which can't be trusted. Zero means no limit.
+//
+// MaxEntries, if positive, makes extraction fail with ErrTooManyEntries
+// once the archive is found to have more entries than that, of any type,
+// to avoid exhausting inodes.
+//
+// VerifyChecksums checks the contents of each file against the checksum
+// stored in the archive as they are read, and reading to the end fails
+// with ErrChecksumMismatch if they differ.
 package archives
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"io/fs"
+	"math"
 	"os"
 	"path"
 	"path/filepath"
+	"slices"
 	"strings"
+	"sync/atomic"
 	"time"
+
+	"golang.org/x/text/encoding"
 )
 
 // FileInfo is a virtualized, generalized file abstraction for interacting with archives.
@@ -37,6 +90,25 @@ type FileInfo struct {
 	// by default to be the name in the archive.
 	NameInArchive string
 
+	// When extracting from formats that decode filenames to
+	// UTF-8 (zip and RAR), the name exactly as stored in the
+	// archive, and the encoding it was decoded from to get
+	// NameInArchive. If the name didn't need decoding, such
+	// as when it is flagged as UTF-8, NameEncoding is nil and
+	// RawName holds the name as stored, in UTF-8.
+	RawName      []byte
+	NameEncoding encoding.Encoding
+
+	// A comment on the file, for formats that support them
+	// (zip). When archiving, it is written to the archive;
+	// when extracting, it is decoded to UTF-8 like the name.
+	Comment string
+
+	// The PAX records of the file, for tar archives, such as
+	// extended attributes under "SCHILY.xattr." keys. When
+	// archiving, they are written to the header of the file.
+	PAXRecords map[string]string
+
 	// For symbolic and hard links, the target of the link.
 	// Not supported by all archive formats.
 	LinkTarget string
@@ -58,6 +130,9 @@ func (f FileInfo) Stat() (fs.FileInfo, error) { return f.FileInfo, nil }
 // platform's path separator (backslash on Windows; slash on everything else).
 // For convenience, map keys that end in a separator ('/', or '\' on Windows)
 // will enumerate contents only, without adding the folder itself to the archive.
+// Every directory walked is added as an entry of its own, so that empty
+// directories are recreated when the archive is extracted, unless
+// options.SkipEmptyDirs is set.
 //
 // Map values should typically use slash ('/') as the separator regardless of
 // the platform, as most archive formats standardize on that rune as the
@@ -89,8 +164,23 @@ func FilesFromDisk(ctx context.Context, options *FromDiskOptions, filenames map[
 			if err != nil {
 				return err
 			}
+			if options != nil && options.Filter != nil && !options.Filter(filename, info) {
+				if info.IsDir() {
+					return fs.SkipDir
+				}
+				return nil
+			}
 
 			nameInArchive := nameOnDiskToNameInArchive(filename, rootOnDisk, rootInArchive)
+			if options != nil && options.NameInArchive != nil {
+				nameInArchive, err = options.NameInArchive(filename)
+				if err != nil {
+					return fmt.Errorf("%s: naming file in archive: %w", filename, err)
+				}
+				if nameInArchive == "" {
+					return nil
+				}
+			}
 			// this is the root folder and we are adding its contents to target rootInArchive
 			if info.IsDir() && nameInArchive == "" {
 				return nil
@@ -139,9 +229,297 @@ func FilesFromDisk(ctx context.Context, options *FromDiskOptions, filenames map[
 			return nil, walkErr
 		}
 	}
+	if options != nil && options.SkipEmptyDirs {
+		files = withoutEmptyDirs(files)
+	}
 	return files, nil
 }
 
+// withoutEmptyDirs returns files without the directories that no
+// other file (other than a directory) is in.
+func withoutEmptyDirs(files []FileInfo) []FileInfo {
+	used := make(map[string]bool)
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		for dir := path.Dir(f.NameInArchive); dir != "." && dir != "/" && !used[dir]; dir = path.Dir(dir) {
+			used[dir] = true
+		}
+	}
+	kept := files[:0]
+	for _, f := range files {
+		if !f.IsDir() || used[path.Clean(f.NameInArchive)] {
+			kept = append(kept, f)
+		}
+	}
+	return kept
+}
+
+// FileFromReader returns a FileInfo for a file with the given name
+// in the archive and mode, with the contents read from r, so that
+// archives can be made without going through the disk. All of r is
+// read into memory up front, since archive formats generally need
+// to know the size of each file before writing it. The modification
+// time is the current time.
+func FileFromReader(nameInArchive string, mode fs.FileMode, r io.Reader) (FileInfo, error) {
+	contents, err := io.ReadAll(r)
+	if err != nil {
+		return FileInfo{}, fmt.Errorf("%s: reading contents: %w", nameInArchive, err)
+	}
+	info := memFileInfo{
+		name:    path.Base(nameInArchive),
+		size:    int64(len(contents)),
+		mode:    mode,
+		modTime: time.Now(),
+	}
+	return FileInfo{
+		FileInfo:      info,
+		NameInArchive: nameInArchive,
+		Open: func() (fs.File, error) {
+			return fileInArchive{io.NopCloser(bytes.NewReader(contents)), info}, nil
+		},
+	}, nil
+}
+
+// memFileInfo describes a file whose contents are in memory.
+type memFileInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func (m memFileInfo) Name() string       { return m.name }
+func (m memFileInfo) Size() int64        { return m.size }
+func (m memFileInfo) Mode() fs.FileMode  { return m.mode }
+func (m memFileInfo) ModTime() time.Time { return m.modTime }
+func (m memFileInfo) IsDir() bool        { return m.mode.IsDir() }
+func (memFileInfo) Sys() any             { return nil }
+
+// ArchiveToBytes creates an archive of the files with format in memory,
+// and returns its bytes. The files may come from disk (see FilesFromDisk)
+// or from memory (see FileFromReader).
+func ArchiveToBytes(ctx context.Context, format Archiver, files []FileInfo) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := format.Archive(ctx, &buf, files); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// CompressStream compresses src with comp into dst as it is read, so
+// that a stream of any length can be compressed with a small, fixed
+// amount of memory. The compressor is closed when src is exhausted so
+// that all of its output is written. The first error from reading src,
+// compressing, or writing dst is returned, and ctx is checked between
+// reads for cancellation. src is read through a buffer of bufSize bytes,
+// or 32 KiB if bufSize is not positive.
+func CompressStream(ctx context.Context, dst io.Writer, comp Compressor, src io.Reader, bufSize int) error {
+	w, err := comp.OpenWriter(dst)
+	if err != nil {
+		return fmt.Errorf("opening compressor: %w", err)
+	}
+	if _, err := copyWithContext(ctx, w, src, bufSize); err != nil {
+		w.Close()
+		return fmt.Errorf("compressing stream: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("closing compressor: %w", err)
+	}
+	return nil
+}
+
+// Convert re-archives the files extracted from src with srcFormat into
+// dst with dstFormat, keeping their names (decoded to UTF-8 as when
+// extracting), modes, modification times, and link targets. If dstFormat
+// is an ArchiverAsync, files are copied one at a time as they are
+// extracted, so memory use is bounded regardless of the size of the
+// archive; otherwise, the contents of all the files are read into memory
+// before the new archive is written.
+func Convert(ctx context.Context, src io.Reader, srcFormat Extractor, dstFormat Archiver, dst io.Writer) error {
+	async, ok := dstFormat.(ArchiverAsync)
+	if !ok {
+		var files []FileInfo
+		err := srcFormat.Extract(ctx, src, func(_ context.Context, f FileInfo) error {
+			if f.Mode().IsRegular() && f.LinkTarget == "" {
+				rc, err := f.Open()
+				if err != nil {
+					return err
+				}
+				contents, err := io.ReadAll(rc)
+				rc.Close()
+				if err != nil {
+					return fmt.Errorf("%s: reading contents: %w", f.NameInArchive, err)
+				}
+				info := f.FileInfo
+				f.Open = func() (fs.File, error) {
+					return fileInArchive{io.NopCloser(bytes.NewReader(contents)), info}, nil
+				}
+			}
+			files = append(files, f)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return dstFormat.Archive(ctx, dst, files)
+	}
+
+	jobs := make(chan ArchiveAsyncJob)
+	archived := make(chan struct{})
+	var archiveErr error
+	go func() {
+		archiveErr = async.ArchiveAsync(ctx, dst, jobs)
+		close(archived)
+	}()
+	// stoppedErr is the error for the archiver returning while files
+	// are still being sent to it, such as when it fails to start
+	stoppedErr := func() error {
+		if archiveErr != nil {
+			return fmt.Errorf("archiving: %w", archiveErr)
+		}
+		return fmt.Errorf("archiver stopped before all files were archived")
+	}
+
+	// the files must be archived before the handler returns, since
+	// they can't necessarily be read after that
+	err := srcFormat.Extract(ctx, src, func(ctx context.Context, f FileInfo) error {
+		result := make(chan error, 1)
+		select {
+		case jobs <- ArchiveAsyncJob{File: f, Result: result}:
+		case <-archived:
+			return stoppedErr()
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		select {
+		case err := <-result:
+			return err
+		case <-archived:
+			// the result may have been sent just before returning
+			select {
+			case err := <-result:
+				return err
+			default:
+				return stoppedErr()
+			}
+		}
+	})
+	close(jobs)
+	<-archived
+	if err == nil {
+		err = archiveErr
+	}
+	return err
+}
+
+// OpenDecompressed opens the file at path for reading its decompressed
+// contents. The compression format, if any, is identified from the file's
+// name and contents; files that aren't compressed, including archives that
+// aren't, are read as they are. For compressed archives such as .tar.gz,
+// only the compression is undone, so the archive itself is read. Closing
+// the returned reader closes the file.
+func OpenDecompressed(ctx context.Context, path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	format, stream, err := Identify(ctx, filepath.Base(path), f)
+	if err != nil && !errors.Is(err, NoMatch) {
+		f.Close()
+		return nil, fmt.Errorf("identifying %s: %w", path, err)
+	}
+
+	var decomp Decompressor
+	switch format := format.(type) {
+	case CompressedArchive:
+		decomp = format.Compression
+	case Extractor:
+		// not compressed
+	case Decompressor:
+		decomp = format
+	}
+	if decomp == nil {
+		return f, nil
+	}
+	rc, err := decomp.OpenReader(stream)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("opening decompressor for %s: %w", path, err)
+	}
+	return closeBothReaders{rc, f}, nil
+}
+
+// EstimateRatio compresses sample with comp and returns the ratio of
+// the compressed size to the size of sample, so that formats or levels
+// can be compared on representative data before committing to one.
+// Smaller is better; a ratio above 1 means the data grew.
+func EstimateRatio(comp Compressor, sample []byte) (float64, error) {
+	if len(sample) == 0 {
+		return 0, fmt.Errorf("empty sample")
+	}
+	cw := &countingWriter{w: io.Discard}
+	w, err := comp.OpenWriter(cw)
+	if err != nil {
+		return 0, fmt.Errorf("opening compressor: %w", err)
+	}
+	if _, err := w.Write(sample); err != nil {
+		w.Close()
+		return 0, fmt.Errorf("compressing sample: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return 0, fmt.Errorf("closing compressor: %w", err)
+	}
+	return float64(cw.n) / float64(len(sample)), nil
+}
+
+// Append adds files to the end of the tar or zip archive at archivePath,
+// without rewriting what is already in it, using the Insert method of
+// its format. The format is identified from the file's name and contents.
+// Tarballs must not be compressed, since a compressed stream can't be
+// appended to; doing so returns an error without changing the file.
+func Append(ctx context.Context, archivePath string, files []FileInfo) error {
+	f, err := os.OpenFile(archivePath, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	format, _, err := Identify(ctx, filepath.Base(archivePath), f)
+	if err != nil {
+		return fmt.Errorf("identifying archive: %w", err)
+	}
+	if _, ok := format.(CompressedArchive); ok {
+		return fmt.Errorf("can't append to compressed archive %s", format.Extension())
+	}
+	inserter, ok := format.(Inserter)
+	if !ok {
+		return fmt.Errorf("can't append to %s archives", format.Extension())
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := inserter.Insert(ctx, f, files); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// deterministicModTime is the modification time of every file in
+// deterministic archives: the earliest time that zip can represent.
+var deterministicModTime = time.Date(1980, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// sortedByName returns a copy of files sorted by name in the archive,
+// for writing deterministic archives.
+func sortedByName(files []FileInfo) []FileInfo {
+	sorted := slices.Clone(files)
+	slices.SortStableFunc(sorted, func(a, b FileInfo) int {
+		return strings.Compare(a.NameInArchive, b.NameInArchive)
+	})
+	return sorted
+}
+
 // nameOnDiskToNameInArchive converts a filename from disk to a name in an archive,
 // respecting rules defined by FilesFromDisk. nameOnDisk is the full filename on disk
 // which is expected to be prefixed by rootOnDisk (according to fs.WalkDirFunc godoc)
@@ -220,6 +598,25 @@ type FromDiskOptions struct {
 	// If true, some file attributes will not be preserved.
 	// Name, size, type, and permissions will still be preserved.
 	ClearAttributes bool
+
+	// If set, called with the name on disk and info of each
+	// file found while walking; if it returns false, the file
+	// is left out, and so is everything in it if it's a
+	// directory.
+	Filter func(path string, info fs.FileInfo) bool
+
+	// If set, called with the name on disk of each file found
+	// while walking to get its name in the archive, instead of
+	// deriving it from the filenames map. If it returns an
+	// empty name, the file is left out (but the contents of a
+	// directory are still walked); if it returns an error,
+	// gathering files stops with that error.
+	NameInArchive func(srcPath string) (string, error)
+
+	// If true, directories with no files in them, at any depth,
+	// are left out, rather than added so they are recreated
+	// when the archive is extracted.
+	SkipEmptyDirs bool
 }
 
 // FileHandler is a callback function that is used to handle files as they are read
@@ -236,8 +633,10 @@ type FromDiskOptions struct {
 type FileHandler func(ctx context.Context, info FileInfo) error
 
 // openAndCopyFile opens file for reading, copies its
-// contents to w, then closes file.
-func openAndCopyFile(file FileInfo, w io.Writer) error {
+// contents to w through a buffer of bufSize bytes (or
+// the default, if not positive), then closes file. The
+// copy stops early if ctx is cancelled.
+func openAndCopyFile(ctx context.Context, file FileInfo, w io.Writer, bufSize int) error {
 	fileReader, err := file.Open()
 	if err != nil {
 		return err
@@ -246,13 +645,420 @@ func openAndCopyFile(file FileInfo, w io.Writer) error {
 	// When file is in use and size is being written to, creating the compressed
 	// file will fail with "archive/tar: write too long." Using CopyN gracefully
 	// handles this.
-	_, err = io.Copy(w, fileReader)
+	_, err = copyWithContext(ctx, w, fileReader, bufSize)
 	if err != nil && err != io.EOF {
 		return err
 	}
 	return nil
 }
 
+// copyBufferSize is the default size of the buffer through
+// which contents are copied, which is how much copyWithContext
+// copies between checks for cancellation.
+const copyBufferSize = 32 * 1024
+
+// bufferSize returns size if it is positive, or else the
+// default copyBufferSize.
+func bufferSize(size int) int {
+	if size <= 0 {
+		return copyBufferSize
+	}
+	return size
+}
+
+// copyWithContext is like io.Copy, but checks ctx for
+// cancellation every bufSize bytes (or the default, if not
+// positive), returning ctx.Err() if it was cancelled.
+func copyWithContext(ctx context.Context, dst io.Writer, src io.Reader, bufSize int) (int64, error) {
+	buf := make([]byte, bufferSize(bufSize))
+	var written int64
+	for {
+		if err := ctx.Err(); err != nil {
+			return written, err
+		}
+		nr, err := src.Read(buf)
+		if nr > 0 {
+			nw, werr := dst.Write(buf[:nr])
+			written += int64(nw)
+			if werr != nil {
+				return written, werr
+			}
+			if nw != nr {
+				return written, io.ErrShortWrite
+			}
+		}
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+// entryReader reads the contents of a file extracted from an archive.
+// It implements io.WriterTo, so that io.Copy from it doesn't need a
+// buffer of its own, and copies through a buffer of bufSize bytes if
+// it needs one. Closing it closes closer, if set.
+type entryReader struct {
+	io.Reader
+	closer  io.Closer
+	bufSize int
+}
+
+func (er entryReader) WriteTo(w io.Writer) (int64, error) { return writeTo(w, er.Reader, er.bufSize) }
+
+func (er entryReader) Close() error {
+	if er.closer == nil {
+		return nil
+	}
+	return er.closer.Close()
+}
+
+// writeTo copies r to w as directly as they allow: with the WriteTo
+// method of r or the ReadFrom method of w, if they have them, or else
+// through a buffer of bufSize bytes (or the default, if not positive).
+func writeTo(w io.Writer, r io.Reader, bufSize int) (int64, error) {
+	if wt, ok := r.(io.WriterTo); ok {
+		return wt.WriteTo(w)
+	}
+	if rf, ok := w.(io.ReaderFrom); ok {
+		return rf.ReadFrom(r)
+	}
+	return io.CopyBuffer(w, r, make([]byte, bufferSize(bufSize)))
+}
+
+// reportProgress returns file with its Open function wrapped so that
+// onProgress is called as its contents are read. If onProgress is nil,
+// file is returned unchanged. A total of -1 means the size is unknown.
+func reportProgress(file FileInfo, total int64, onProgress func(entryName string, bytesDone, bytesTotal int64)) FileInfo {
+	if onProgress == nil || file.IsDir() {
+		return file
+	}
+	open := file.Open
+	file.Open = func() (fs.File, error) {
+		f, err := open()
+		if err != nil {
+			return nil, err
+		}
+		onProgress(file.NameInArchive, 0, total)
+		return &progressFile{File: f, name: file.NameInArchive, total: total, onProgress: onProgress}, nil
+	}
+	return file
+}
+
+// progressFile is a file that reports how much of it has been read.
+type progressFile struct {
+	fs.File
+	name       string
+	done       int64
+	total      int64
+	onProgress func(entryName string, bytesDone, bytesTotal int64)
+}
+
+func (pf *progressFile) Read(p []byte) (int, error) {
+	n, err := pf.File.Read(p)
+	if n > 0 {
+		pf.done += int64(n)
+		pf.onProgress(pf.name, pf.done, pf.total)
+	}
+	return n, err
+}
+
+// transformContents returns file with its Open function wrapped so
+// that its contents are read through the reader transform returns. If
+// transform is nil, or file isn't a regular file, file is returned
+// unchanged.
+func transformContents(file FileInfo, transform func(name string, r io.Reader) (io.Reader, error)) FileInfo {
+	if transform == nil || !file.Mode().IsRegular() {
+		return file
+	}
+	open := file.Open
+	file.Open = func() (fs.File, error) {
+		f, err := open()
+		if err != nil {
+			return nil, err
+		}
+		r, err := transform(file.NameInArchive, f)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("transforming %s: %w", file.NameInArchive, err)
+		}
+		return transformedFile{File: f, r: r}, nil
+	}
+	return file
+}
+
+// transformedFile is a file whose contents are read through r.
+type transformedFile struct {
+	fs.File
+	r io.Reader
+}
+
+func (tf transformedFile) Read(p []byte) (int, error) { return tf.r.Read(p) }
+
+// verifyChecksum returns file with its Open function wrapped so that
+// reading it to the end fails with ErrChecksumMismatch if its contents
+// don't match the checksum. If newHash is not nil, the contents are
+// hashed with a hash it returns and compared to want; formatErr, if
+// not nil, is the error with which the format itself reports a
+// mismatch, to be turned into one naming the file.
+func verifyChecksum(file FileInfo, newHash func() hash.Hash32, want uint32, formatErr error) FileInfo {
+	if file.IsDir() {
+		return file
+	}
+	open := file.Open
+	file.Open = func() (fs.File, error) {
+		f, err := open()
+		if err != nil {
+			return nil, err
+		}
+		cf := &checksumFile{File: f, name: file.NameInArchive, want: want, formatErr: formatErr}
+		if newHash != nil {
+			cf.sum = newHash()
+		}
+		return cf, nil
+	}
+	return file
+}
+
+// checksumFile is a file whose checksum is verified as it is read.
+type checksumFile struct {
+	fs.File
+	name      string
+	sum       hash.Hash32
+	want      uint32
+	formatErr error
+}
+
+func (cf *checksumFile) Read(p []byte) (int, error) {
+	n, err := cf.File.Read(p)
+	if cf.sum != nil {
+		cf.sum.Write(p[:n])
+		if err == io.EOF && cf.sum.Sum32() != cf.want {
+			return n, fmt.Errorf("%w: %s", ErrChecksumMismatch, cf.name)
+		}
+	}
+	if cf.formatErr != nil && errors.Is(err, cf.formatErr) {
+		return n, fmt.Errorf("%w: %s: %v", ErrChecksumMismatch, cf.name, err)
+	}
+	return n, err
+}
+
+// walkArchive calls fn for each file extracted from sourceArchive
+// by ex, without reading the contents of the files.
+func walkArchive(ctx context.Context, ex Extractor, sourceArchive io.Reader, fn func(info FileInfo) error) error {
+	return ex.Extract(ctx, sourceArchive, func(_ context.Context, info FileInfo) error {
+		return fn(info)
+	})
+}
+
+// extractLimits enforces limits on the number of entries in an
+// archive and on the size of the contents of the files read during
+// one extraction.
+type extractLimits struct {
+	maxTotal, maxEntry int64
+	total              atomic.Int64
+
+	maxEntries, entries int
+}
+
+func newExtractLimits(maxTotal, maxEntry int64, maxEntries int) *extractLimits {
+	return &extractLimits{maxTotal: maxTotal, maxEntry: maxEntry, maxEntries: maxEntries}
+}
+
+// countEntry counts an entry of the archive, returning an error
+// if there are more than the maximum number of entries.
+func (l *extractLimits) countEntry() error {
+	l.entries++
+	if l.maxEntries > 0 && l.entries > l.maxEntries {
+		return fmt.Errorf("%w: more than %d", ErrTooManyEntries, l.maxEntries)
+	}
+	return nil
+}
+
+// apply returns file with its Open function wrapped so that reading
+// fails once the limits are exceeded. If there are no limits, file
+// is returned unchanged.
+func (l *extractLimits) apply(file FileInfo) FileInfo {
+	if l.maxTotal <= 0 && l.maxEntry <= 0 || file.IsDir() {
+		return file
+	}
+	open := file.Open
+	file.Open = func() (fs.File, error) {
+		f, err := open()
+		if err != nil {
+			return nil, err
+		}
+		return &limitedFile{File: f, name: file.NameInArchive, limits: l}, nil
+	}
+	return file
+}
+
+// limitedFile is a file whose reads fail once it, or all the
+// files read with the same limits, exceed the size limits.
+type limitedFile struct {
+	fs.File
+	name   string
+	read   int64
+	limits *extractLimits
+}
+
+func (lf *limitedFile) Read(p []byte) (int, error) {
+	allowed := int64(math.MaxInt64)
+	if lf.limits.maxEntry > 0 {
+		allowed = lf.limits.maxEntry - lf.read
+	}
+	if lf.limits.maxTotal > 0 {
+		// only a hint when files are read concurrently; the bytes
+		// read are claimed from the total below
+		allowed = min(allowed, lf.limits.maxTotal-lf.limits.total.Load())
+	}
+	allowed = max(allowed, 0)
+	if allowed < int64(len(p)) {
+		p = p[:allowed+1] // one more byte tells if the limit is exceeded
+	}
+	n, err := lf.File.Read(p)
+	entryExceeded := lf.limits.maxEntry > 0 && lf.read+int64(n) > lf.limits.maxEntry
+	if entryExceeded {
+		n = int(lf.limits.maxEntry - lf.read)
+	}
+	totalExceeded := false
+	if lf.limits.maxTotal > 0 {
+		// claim the bytes from the total atomically, so that reads
+		// of several files at once can't together go over it
+		for {
+			total := lf.limits.total.Load()
+			claim := min(int64(n), max(lf.limits.maxTotal-total, 0))
+			if lf.limits.total.CompareAndSwap(total, total+claim) {
+				totalExceeded = claim < int64(n)
+				n = int(claim)
+				break
+			}
+		}
+	} else {
+		lf.limits.total.Add(int64(n))
+	}
+	lf.read += int64(n)
+	if entryExceeded {
+		return n, fmt.Errorf("%w: %s is larger than %d bytes", ErrSizeLimitExceeded, lf.name, lf.limits.maxEntry)
+	}
+	if totalExceeded {
+		return n, fmt.Errorf("%w: files are larger than %d bytes in total", ErrSizeLimitExceeded, lf.limits.maxTotal)
+	}
+	return n, err
+}
+
+// NewGuardedReader returns a reader that reads from r until max bytes
+// have been read, after which reading fails with an error wrapping
+// ErrSizeLimitExceeded if r has more. Unlike io.LimitReader, a stream
+// that is too long is an error rather than cut short, so it is safe
+// to wrap untrusted input with it before passing it to Identify or
+// extracting from it, to bound how much is read.
+func NewGuardedReader(r io.Reader, max int64) io.Reader {
+	return &guardedReader{r: r, remaining: max, max: max}
+}
+
+type guardedReader struct {
+	r         io.Reader
+	remaining int64
+	max       int64
+}
+
+func (gr *guardedReader) Read(p []byte) (int, error) {
+	if gr.remaining < int64(len(p)) {
+		p = p[:max(gr.remaining, 0)+1] // one more byte tells if the limit is exceeded
+	}
+	n, err := gr.r.Read(p)
+	if int64(n) > gr.remaining {
+		n = int(max(gr.remaining, 0))
+		gr.remaining = 0
+		return n, fmt.Errorf("%w: stream is larger than %d bytes", ErrSizeLimitExceeded, gr.max)
+	}
+	gr.remaining -= int64(n)
+	return n, err
+}
+
+// patternFilter decides which entries to extract by matching their
+// names against glob patterns, where "**" matches any number of path
+// components, including none, and other components are matched as
+// by path.Match. Excludes take precedence over includes, and without
+// includes, everything not excluded is included. If skipMacMetadata
+// is set, macOS metadata is excluded too.
+type patternFilter struct {
+	include, exclude []string
+	skipMacMetadata  bool
+}
+
+// newPatternFilter returns a filter for the given patterns, or an error
+// if any of them is malformed.
+func newPatternFilter(include, exclude []string) (patternFilter, error) {
+	for _, pattern := range slices.Concat(include, exclude) {
+		for _, part := range strings.Split(pattern, "/") {
+			if _, err := path.Match(part, ""); err != nil {
+				return patternFilter{}, fmt.Errorf("pattern %q: %w", pattern, err)
+			}
+		}
+	}
+	return patternFilter{include: include, exclude: exclude}, nil
+}
+
+// includes reports whether the entry with the given name is extracted.
+func (pf patternFilter) includes(name string) bool {
+	name = strings.Trim(name, "/")
+	if pf.skipMacMetadata && isMacMetadata(name) {
+		return false
+	}
+	for _, pattern := range pf.exclude {
+		if matchGlob(pattern, name) {
+			return false
+		}
+	}
+	if len(pf.include) == 0 {
+		return true
+	}
+	for _, pattern := range pf.include {
+		if matchGlob(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// isMacMetadata reports whether the entry with the given name holds
+// metadata added by macOS: resource forks and extended attributes in
+// the "__MACOSX" directory, or AppleDouble files named "._*".
+func isMacMetadata(name string) bool {
+	return name == "__MACOSX" || strings.HasPrefix(name, "__MACOSX/") || strings.HasPrefix(path.Base(name), "._")
+}
+
+// matchGlob reports whether name matches pattern, as described for
+// patternFilter. The pattern must be well-formed.
+func matchGlob(pattern, name string) bool {
+	return matchGlobParts(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchGlobParts(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := range len(name) + 1 {
+				if matchGlobParts(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
 // fileIsIncluded returns true if filename is included according to
 // filenameList; meaning it is in the list, its parent folder/path
 // is in the list, or the list is nil.
@@ -278,6 +1084,18 @@ func isSymlink(info fs.FileInfo) bool {
 	return info.Mode()&os.ModeSymlink != 0
 }
 
+// countingWriter counts the bytes written through it to w.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
 // streamSizeBySeeking determines the size of the stream by
 // seeking to the end, then back again, so the resulting
 // seek position upon returning is the same as when called
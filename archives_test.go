@@ -1,10 +1,29 @@
 package archives
 
 import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path/filepath"
 	"reflect"
 	"runtime"
+	"slices"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/klauspost/compress/zip"
+	"golang.org/x/text/encoding/japanese"
 )
 
 func TestTrimTopDir(t *testing.T) {
@@ -110,6 +129,29 @@ func TestFileIsIncluded(t *testing.T) {
 	}
 }
 
+func TestMatchGlob(t *testing.T) {
+	for i, tc := range []struct {
+		pattern, name string
+		expect        bool
+	}{
+		{"*.txt", "a.txt", true},
+		{"*.txt", "dir/a.txt", false},
+		{"**/*.txt", "a.txt", true},
+		{"**/*.txt", "dir/sub/a.txt", true},
+		{"**/*.txt", "dir/a.md", false},
+		{"secret/**", "secret", true},
+		{"secret/**", "secret/a/b", true},
+		{"secret/**", "secrets/a", false},
+		{"a/**/b", "a/b", true},
+		{"a/**/b", "a/x/y/b", true},
+		{"a/**/b", "a/x/y/c", false},
+	} {
+		if actual := matchGlob(tc.pattern, tc.name); actual != tc.expect {
+			t.Errorf("Test %d: expected %q matching %q to be %t", i, tc.pattern, tc.name, tc.expect)
+		}
+	}
+}
+
 func TestSkipList(t *testing.T) {
 	for i, tc := range []struct {
 		start  skipList
@@ -262,3 +304,604 @@ func TestNameOnDiskToNameInArchive(t *testing.T) {
 		}
 	}
 }
+
+func TestArchiveToBytes(t *testing.T) {
+	fname, _ := newTmpTextFile(t, "from disk")
+	defer os.Remove(fname)
+	files, err := FilesFromDisk(context.Background(), nil, map[string]string{fname: "disk.txt"})
+	checkErr(t, err, "gathering files from disk")
+	memFile, err := FileFromReader("dir/memory.txt", 0644, strings.NewReader("from memory"))
+	checkErr(t, err, "creating file from reader")
+	files = append(files, memFile)
+
+	format := CompressedArchive{Archival: Tar{}, Extraction: Tar{}, Compression: Gz{}}
+	archived, err := ArchiveToBytes(context.Background(), format, files)
+	checkErr(t, err, "archiving to bytes")
+
+	contents := make(map[string]string)
+	err = format.Extract(context.Background(), bytes.NewReader(archived), func(_ context.Context, f FileInfo) error {
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		b, err := io.ReadAll(rc)
+		contents[f.NameInArchive] = string(b)
+		return err
+	})
+	checkErr(t, err, "extracting")
+	expected := map[string]string{"disk.txt": "from disk", "dir/memory.txt": "from memory"}
+	if !reflect.DeepEqual(contents, expected) {
+		t.Errorf("expected %v, got %v", expected, contents)
+	}
+}
+
+func TestFilesFromDiskFilter(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{"a.txt", "b.tmp", "node_modules/x.js", "node_modules/y/z.js", "sub/c.txt"} {
+		name = filepath.Join(root, filepath.FromSlash(name))
+		checkErr(t, os.MkdirAll(filepath.Dir(name), 0755), "making directory")
+		checkErr(t, os.WriteFile(name, []byte("contents"), 0644), "writing %s", name)
+	}
+
+	var visited []string
+	options := &FromDiskOptions{
+		Filter: func(path string, info fs.FileInfo) bool {
+			visited = append(visited, path)
+			if info.IsDir() {
+				return info.Name() != "node_modules"
+			}
+			return filepath.Ext(path) != ".tmp"
+		},
+	}
+	files, err := FilesFromDisk(context.Background(), options, map[string]string{root + string(filepath.Separator): ""})
+	checkErr(t, err, "gathering files")
+
+	var names []string
+	for _, f := range files {
+		names = append(names, f.NameInArchive)
+	}
+	sort.Strings(names)
+	if expected := []string{"a.txt", "sub", "sub/c.txt"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected %q, got %q", expected, names)
+	}
+	for _, path := range visited {
+		if strings.Contains(path, "x.js") || strings.Contains(path, "z.js") {
+			t.Errorf("expected excluded directory to be pruned, but visited %s", path)
+		}
+	}
+}
+
+func TestFilesFromDiskEmptyDirs(t *testing.T) {
+	root := t.TempDir()
+	checkErr(t, os.WriteFile(filepath.Join(root, "a.txt"), []byte("contents"), 0644), "writing file")
+	for _, dir := range []string{"empty", "sub/nested-empty"} {
+		checkErr(t, os.MkdirAll(filepath.Join(root, filepath.FromSlash(dir)), 0755), "making directory")
+	}
+	files, err := FilesFromDisk(context.Background(), nil, map[string]string{root: "tree"})
+	checkErr(t, err, "gathering files")
+
+	// directories are archived as entries of their own, so empty
+	// ones are recreated on extraction
+	archive, err := ArchiveToBytes(context.Background(), Tar{}, files)
+	checkErr(t, err, "archiving")
+	dest := t.TempDir()
+	checkErr(t, Tar{}.SecureExtract(context.Background(), bytes.NewReader(archive), dest), "extracting")
+	for _, dir := range []string{"tree/empty", "tree/sub/nested-empty"} {
+		info, err := os.Stat(filepath.Join(dest, filepath.FromSlash(dir)))
+		if err != nil || !info.IsDir() {
+			t.Errorf("expected empty directory %s to be extracted, got %v", dir, err)
+		}
+	}
+
+	// and in zip archives too
+	archive, err = ArchiveToBytes(context.Background(), Zip{}, files)
+	checkErr(t, err, "archiving zip")
+	var dirs []string
+	err = Zip{}.Extract(context.Background(), bytes.NewReader(archive), func(_ context.Context, f FileInfo) error {
+		if f.IsDir() {
+			dirs = append(dirs, f.NameInArchive)
+		}
+		return nil
+	})
+	checkErr(t, err, "extracting zip")
+	sort.Strings(dirs)
+	if expected := []string{"tree/", "tree/empty/", "tree/sub/", "tree/sub/nested-empty/"}; !reflect.DeepEqual(dirs, expected) {
+		t.Errorf("expected directories %q, got %q", expected, dirs)
+	}
+
+	// unless they are skipped, along with directories of empty ones
+	files, err = FilesFromDisk(context.Background(), &FromDiskOptions{SkipEmptyDirs: true}, map[string]string{root: "tree"})
+	checkErr(t, err, "gathering files without empty directories")
+	var names []string
+	for _, f := range files {
+		names = append(names, f.NameInArchive)
+	}
+	sort.Strings(names)
+	if expected := []string{"tree", "tree/a.txt"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected %q, got %q", expected, names)
+	}
+}
+
+func TestFilesFromDiskNameInArchive(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{"a.txt", "one/b.txt", "one/two/c.txt"} {
+		name = filepath.Join(root, filepath.FromSlash(name))
+		checkErr(t, os.MkdirAll(filepath.Dir(name), 0755), "making directory")
+		checkErr(t, os.WriteFile(name, []byte("contents"), 0644), "writing %s", name)
+	}
+
+	// flatten the tree, leaving out the directories
+	options := &FromDiskOptions{
+		NameInArchive: func(srcPath string) (string, error) {
+			info, err := os.Stat(srcPath)
+			if err != nil || info.IsDir() {
+				return "", err
+			}
+			return filepath.Base(srcPath), nil
+		},
+	}
+	files, err := FilesFromDisk(context.Background(), options, map[string]string{root: "ignored"})
+	checkErr(t, err, "gathering files")
+	archived, err := ArchiveToBytes(context.Background(), Zip{}, files)
+	checkErr(t, err, "archiving")
+
+	var names []string
+	err = Zip{}.Extract(context.Background(), bytes.NewReader(archived), func(_ context.Context, f FileInfo) error {
+		names = append(names, f.NameInArchive)
+		return nil
+	})
+	checkErr(t, err, "extracting")
+	sort.Strings(names)
+	if expected := []string{"a.txt", "b.txt", "c.txt"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected %q, got %q", expected, names)
+	}
+
+	// errors abort gathering
+	nameErr := errors.New("no name")
+	options.NameInArchive = func(string) (string, error) { return "", nameErr }
+	if _, err := FilesFromDisk(context.Background(), options, map[string]string{root: ""}); !errors.Is(err, nameErr) {
+		t.Errorf("expected naming error, got %v", err)
+	}
+}
+
+func TestDeterministicArchive(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{"b.txt", "a/c.txt", "a/d.txt", "e.txt"} {
+		name = filepath.Join(root, filepath.FromSlash(name))
+		checkErr(t, os.MkdirAll(filepath.Dir(name), 0755), "making directory")
+		checkErr(t, os.WriteFile(name, []byte("contents of "+name), 0644), "writing %s", name)
+	}
+	build := func(format Archiver, mtime time.Time) []byte {
+		// change the times on disk, which must not matter
+		err := filepath.WalkDir(root, func(path string, _ fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			return os.Chtimes(path, mtime, mtime)
+		})
+		checkErr(t, err, "changing times")
+		files, err := FilesFromDisk(context.Background(), nil, map[string]string{root: "root"})
+		checkErr(t, err, "gathering files")
+		slices.Reverse(files)
+		archived, err := ArchiveToBytes(context.Background(), format, files)
+		checkErr(t, err, "archiving")
+		return archived
+	}
+
+	for _, format := range []Archiver{Tar{Deterministic: true}, Zip{Deterministic: true, Compression: zip.Deflate}} {
+		first := build(format, time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC))
+		second := build(format, time.Date(2024, 6, 7, 8, 9, 10, 0, time.UTC))
+		if !bytes.Equal(first, second) {
+			t.Errorf("%T: expected identical archives", format)
+		}
+	}
+}
+
+func TestArchiveModTime(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{"a.txt", "dir/b.txt"} {
+		name = filepath.Join(root, filepath.FromSlash(name))
+		checkErr(t, os.MkdirAll(filepath.Dir(name), 0755), "making directory")
+		checkErr(t, os.WriteFile(name, []byte("contents of "+name), 0644), "writing %s", name)
+	}
+	files, err := FilesFromDisk(context.Background(), nil, map[string]string{root: "root"})
+	checkErr(t, err, "gathering files")
+
+	stamp := time.Date(2021, 3, 4, 5, 6, 8, 0, time.UTC)
+	for _, format := range []interface {
+		Archiver
+		Extractor
+	}{
+		Tar{ModTime: stamp},
+		Tar{ModTime: stamp, Deterministic: true},
+		Zip{ModTime: stamp},
+		SevenZip{ModTime: stamp},
+	} {
+		archived, err := ArchiveToBytes(context.Background(), format, files)
+		checkErr(t, err, "%T: archiving", format)
+		var count int
+		err = format.Extract(context.Background(), bytes.NewReader(archived), func(_ context.Context, f FileInfo) error {
+			count++
+			if !f.ModTime().Equal(stamp) {
+				t.Errorf("%T: %s: expected modification time %s, got %s", format, f.NameInArchive, stamp, f.ModTime())
+			}
+			return nil
+		})
+		checkErr(t, err, "%T: extracting", format)
+		if count != len(files) {
+			t.Errorf("%T: expected %d entries, got %d", format, len(files), count)
+		}
+	}
+}
+
+func TestTotalUncompressedSize(t *testing.T) {
+	var files []FileInfo
+	for name, contents := range map[string]string{"a.txt": "12345", "dir/b.txt": "1234567890", "dir/empty.txt": ""} {
+		file, err := FileFromReader(name, 0644, strings.NewReader(contents))
+		checkErr(t, err, "creating %s", name)
+		files = append(files, file)
+	}
+
+	for _, tc := range []struct {
+		format interface {
+			Archiver
+			Walker
+		}
+		exact bool
+	}{
+		{Zip{}, true},
+		{SevenZip{}, true},
+		{CompressedArchive{Archival: Tar{}, Extraction: Tar{}, Compression: Gz{}}, false},
+	} {
+		archived, err := ArchiveToBytes(context.Background(), tc.format, files)
+		checkErr(t, err, "%T: archiving", tc.format)
+		archive := io.Reader(bytes.NewReader(archived))
+		if !tc.exact {
+			archive = io.MultiReader(archive) // not seekable, as when streamed
+		}
+		total, exact, err := TotalUncompressedSize(context.Background(), tc.format, archive)
+		checkErr(t, err, "%T: getting total size", tc.format)
+		if total != 15 || exact != tc.exact {
+			t.Errorf("%T: expected total 15 (exact: %t), got %d (exact: %t)", tc.format, tc.exact, total, exact)
+		}
+	}
+}
+
+func TestExtractOneWriterTo(t *testing.T) {
+	content := strings.Repeat("copied without a buffer of its own\n", 1000)
+	file, err := FileFromReader("dir/file.txt", 0644, strings.NewReader(content))
+	checkErr(t, err, "creating file")
+
+	for _, format := range []interface {
+		Archiver
+		SingleExtractor
+	}{
+		Zip{Compression: zip.Deflate},
+		Tar{},
+		CompressedArchive{Archival: Tar{}, Extraction: Tar{}, Compression: Gz{}},
+	} {
+		archived, err := ArchiveToBytes(context.Background(), format, []FileInfo{file})
+		checkErr(t, err, "%T: archiving", format)
+		rc, _, err := format.ExtractOne(context.Background(), bytes.NewReader(archived), "dir/file.txt")
+		checkErr(t, err, "%T: extracting", format)
+		wt, ok := rc.(io.WriterTo)
+		if !ok {
+			t.Fatalf("%T: expected an io.WriterTo, got %T", format, rc)
+		}
+		var buf bytes.Buffer
+		n, err := wt.WriteTo(&buf)
+		checkErr(t, err, "%T: copying", format)
+		checkErr(t, rc.Close(), "%T: closing", format)
+		if n != int64(len(content)) || buf.String() != content {
+			t.Errorf("%T: copied %d bytes that differ from the original", format, n)
+		}
+
+		if z, ok := format.(Zip); ok {
+			r, _, _, err := z.OpenRaw(context.Background(), bytes.NewReader(archived), "dir/file.txt")
+			checkErr(t, err, "opening raw file")
+			if _, ok := r.(io.WriterTo); !ok {
+				t.Errorf("expected raw file to be an io.WriterTo, got %T", r)
+			}
+		}
+	}
+}
+
+func TestEstimateRatio(t *testing.T) {
+	compressible := bytes.Repeat([]byte("the same line over and over\n"), 1000)
+	ratio, err := EstimateRatio(Gz{}, compressible)
+	checkErr(t, err, "estimating ratio")
+	if ratio <= 0 || ratio > 0.1 {
+		t.Errorf("expected a ratio well below 1 for compressible data, got %f", ratio)
+	}
+
+	random := make([]byte, 4096)
+	rand.New(rand.NewSource(1)).Read(random)
+	ratio, err = EstimateRatio(Gz{}, random)
+	checkErr(t, err, "estimating ratio of random data")
+	if ratio < 1 {
+		t.Errorf("expected random data not to compress, got ratio %f", ratio)
+	}
+
+	if _, err := EstimateRatio(Gz{}, nil); err == nil {
+		t.Errorf("expected error for an empty sample")
+	}
+}
+
+func TestOpenDecompressed(t *testing.T) {
+	content := bytes.Repeat([]byte("decompressed transparently\n"), 100)
+	dir := t.TempDir()
+	for _, tc := range []struct {
+		filename string
+		data     []byte
+	}{
+		{"test.txt", content},
+		{"test.txt.gz", compress(t, ".gz", content, Gz{}.OpenWriter)},
+		{"test.txt.xz", compress(t, ".xz", content, Xz{}.OpenWriter)},
+		{"test.txt.zst", compress(t, ".zst", content, Zstd{}.OpenWriter)},
+		{"test.txt.bz2", compress(t, ".bz2", content, Bz2{}.OpenWriter)},
+		// identified by contents alone
+		{"unnamed", compress(t, ".gz", content, Gz{}.OpenWriter)},
+	} {
+		t.Run(tc.filename, func(t *testing.T) {
+			filename := filepath.Join(dir, tc.filename)
+			checkErr(t, os.WriteFile(filename, tc.data, 0644), "writing file")
+			rc, err := OpenDecompressed(context.Background(), filename)
+			checkErr(t, err, "opening")
+			decompressed, err := io.ReadAll(rc)
+			checkErr(t, err, "reading")
+			checkErr(t, rc.Close(), "closing")
+			if !bytes.Equal(decompressed, content) {
+				t.Errorf("expected original contents, got %d bytes", len(decompressed))
+			}
+		})
+	}
+
+	// compressed archives are only decompressed
+	tarball := newTestTar(t, &tar.Header{Name: "a.txt", Typeflag: tar.TypeReg})
+	tarData, err := io.ReadAll(tarball)
+	checkErr(t, err, "reading tarball")
+	filename := filepath.Join(dir, "test.tar.gz")
+	checkErr(t, os.WriteFile(filename, compress(t, ".gz", tarData, Gz{}.OpenWriter), 0644), "writing file")
+	rc, err := OpenDecompressed(context.Background(), filename)
+	checkErr(t, err, "opening")
+	defer rc.Close()
+	decompressed, err := io.ReadAll(rc)
+	checkErr(t, err, "reading")
+	if !bytes.Equal(decompressed, tarData) {
+		t.Errorf("expected the tarball, got %d bytes", len(decompressed))
+	}
+}
+
+// syncArchiver hides the ArchiveAsync method of an Archiver.
+type syncArchiver struct{ Archiver }
+
+func TestConvert(t *testing.T) {
+	names := []string{"テスト.txt", "日本語/ファイル.txt"}
+	var raw []string
+	for _, name := range names {
+		raw = append(raw, string(mustEncode(t, japanese.ShiftJIS, name)))
+	}
+
+	for _, dstFormat := range []Archiver{Tar{}, syncArchiver{Tar{}}} {
+		var converted bytes.Buffer
+		err := Convert(context.Background(), newTestZip(t, false, raw...), Zip{}, dstFormat, &converted)
+		checkErr(t, err, "converting with %T", dstFormat)
+
+		tr := tar.NewReader(&converted)
+		var got []string
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			checkErr(t, err, "reading tar")
+			contents, err := io.ReadAll(tr)
+			checkErr(t, err, "reading %s", hdr.Name)
+			if string(contents) != "contents" {
+				t.Errorf("%s: expected original contents, got %q", hdr.Name, contents)
+			}
+			got = append(got, hdr.Name)
+		}
+		if !reflect.DeepEqual(got, names) {
+			t.Errorf("%T: expected decoded names %q, got %q", dstFormat, names, got)
+		}
+	}
+}
+
+func TestConvert_ArchiverFails(t *testing.T) {
+	// the archiver fails before taking any files
+	dstFormat := Zip{ArchiveComment: strings.Repeat("x", 70000)}
+	done := make(chan error, 1)
+	go func() {
+		done <- Convert(context.Background(), newTestZip(t, true, "a.txt", "b.txt"), Zip{}, dstFormat, io.Discard)
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("expected error from failing archiver")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Convert did not return after the archiver failed")
+	}
+}
+
+type errWriter struct{ err error }
+
+type readFunc func([]byte) (int, error)
+
+func (f readFunc) Read(p []byte) (int, error) { return f(p) }
+
+func (w errWriter) Write([]byte) (int, error) { return 0, w.err }
+
+func TestCompressStream(t *testing.T) {
+	// several megabytes of somewhat compressible data
+	rng := rand.New(rand.NewSource(1))
+	src := make([]byte, 5<<20)
+	for i := range src {
+		src[i] = byte('a' + rng.Intn(16))
+	}
+
+	var compressed bytes.Buffer
+	err := CompressStream(context.Background(), &compressed, Gz{}, bytes.NewReader(src), 0)
+	checkErr(t, err, "compressing stream")
+	if compressed.Len() >= len(src) {
+		t.Errorf("expected compressed stream to be smaller: %d >= %d", compressed.Len(), len(src))
+	}
+	r, err := Gz{}.OpenReader(&compressed)
+	checkErr(t, err, "opening decompressor")
+	decompressed, err := io.ReadAll(r)
+	checkErr(t, err, "decompressing")
+	checkErr(t, r.Close(), "closing decompressor")
+	if !bytes.Equal(decompressed, src) {
+		t.Error("decompressed stream doesn't match the original")
+	}
+
+	// src is read through a buffer of the given size
+	var largest int
+	sized := readFunc(func(p []byte) (int, error) {
+		largest = max(largest, len(p))
+		return 0, io.EOF
+	})
+	checkErr(t, CompressStream(context.Background(), io.Discard, Gz{}, sized, 1024), "compressing with a buffer size")
+	if largest != 1024 {
+		t.Errorf("expected reads into a buffer of 1024 bytes, got %d", largest)
+	}
+
+	// errors from either side are returned
+	readErr, writeErr := errors.New("read failed"), errors.New("write failed")
+	err = CompressStream(context.Background(), io.Discard, Gz{}, io.MultiReader(bytes.NewReader(src[:100]), iotest.ErrReader(readErr)), 0)
+	if !errors.Is(err, readErr) {
+		t.Errorf("expected read error, got: %v", err)
+	}
+	err = CompressStream(context.Background(), errWriter{writeErr}, Gz{}, bytes.NewReader(src), 0)
+	if !errors.Is(err, writeErr) {
+		t.Errorf("expected write error, got: %v", err)
+	}
+}
+
+func TestAppend(t *testing.T) {
+	memFile := func(name, contents string) FileInfo {
+		f, err := FileFromReader(name, 0644, strings.NewReader(contents))
+		checkErr(t, err, "creating file %s", name)
+		return f
+	}
+	for _, format := range []Archival{Tar{}, Zip{}} {
+		t.Run(format.Extension(), func(t *testing.T) {
+			archived, err := ArchiveToBytes(context.Background(), format, []FileInfo{memFile("a.txt", "first")})
+			checkErr(t, err, "archiving")
+			archivePath := filepath.Join(t.TempDir(), "test"+format.Extension())
+			checkErr(t, os.WriteFile(archivePath, archived, 0644), "writing archive")
+
+			files := []FileInfo{memFile("dir/b.txt", "second"), memFile("c.txt", "third")}
+			checkErr(t, Append(context.Background(), archivePath, files), "appending")
+
+			f, err := os.Open(archivePath)
+			checkErr(t, err, "opening archive")
+			defer f.Close()
+			contents := make(map[string]string)
+			err = format.Extract(context.Background(), f, func(_ context.Context, f FileInfo) error {
+				rc, err := f.Open()
+				if err != nil {
+					return err
+				}
+				defer rc.Close()
+				b, err := io.ReadAll(rc)
+				contents[f.NameInArchive] = string(b)
+				return err
+			})
+			checkErr(t, err, "extracting")
+			expected := map[string]string{"a.txt": "first", "dir/b.txt": "second", "c.txt": "third"}
+			if !reflect.DeepEqual(contents, expected) {
+				t.Errorf("expected %v, got %v", expected, contents)
+			}
+		})
+	}
+
+	// compressed tarballs can't be appended to, and are left alone
+	format := CompressedArchive{Archival: Tar{}, Extraction: Tar{}, Compression: Gz{}}
+	archived, err := ArchiveToBytes(context.Background(), format, []FileInfo{memFile("a.txt", "first")})
+	checkErr(t, err, "archiving")
+	archivePath := filepath.Join(t.TempDir(), "test.tar.gz")
+	checkErr(t, os.WriteFile(archivePath, archived, 0644), "writing archive")
+	if err := Append(context.Background(), archivePath, []FileInfo{memFile("b.txt", "second")}); err == nil {
+		t.Error("expected error appending to compressed tarball")
+	}
+	after, err := os.ReadFile(archivePath)
+	checkErr(t, err, "reading archive")
+	if !bytes.Equal(after, archived) {
+		t.Error("compressed tarball was modified")
+	}
+}
+
+func TestExtractLimitsConcurrently(t *testing.T) {
+	const workers, limit = 8, 100
+	limits := newExtractLimits(limit, 0, 0)
+
+	// every read waits until all the files are being read, so that
+	// they all check the total before any of them adds to it
+	var started sync.WaitGroup
+	started.Add(workers)
+	var read atomic.Int64
+	var wg sync.WaitGroup
+	for i := range workers {
+		file := limits.apply(FileInfo{
+			FileInfo:      memFileInfo{name: "file", size: 1000},
+			NameInArchive: fmt.Sprintf("file%d", i),
+			Open: func() (fs.File, error) {
+				return fileInArchive{io.NopCloser(barrierReader{&started}), nil}, nil
+			},
+		})
+		f, err := file.Open()
+		checkErr(t, err, "opening file %d", i)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			n, _ := f.Read(make([]byte, 1000))
+			read.Add(int64(n))
+		}()
+	}
+	wg.Wait()
+	if read.Load() > limit {
+		t.Errorf("read %d bytes in total, more than the limit of %d", read.Load(), limit)
+	}
+}
+
+// barrierReader reads zeros once all the readers sharing wg are reading.
+type barrierReader struct{ wg *sync.WaitGroup }
+
+func (br barrierReader) Read(p []byte) (int, error) {
+	br.wg.Done()
+	br.wg.Wait()
+	clear(p)
+	return len(p), nil
+}
+
+func TestNewGuardedReader(t *testing.T) {
+	data := []byte("0123456789")
+
+	// up to the limit, the stream is read as it is
+	got, err := io.ReadAll(NewGuardedReader(bytes.NewReader(data), int64(len(data))))
+	checkErr(t, err, "reading stream at the limit")
+	if !bytes.Equal(got, data) {
+		t.Errorf("expected %q, got %q", data, got)
+	}
+
+	// past it, reading fails after the allowed bytes
+	got, err = io.ReadAll(NewGuardedReader(iotest.OneByteReader(bytes.NewReader(data)), 4))
+	if !errors.Is(err, ErrSizeLimitExceeded) {
+		t.Errorf("expected ErrSizeLimitExceeded, got %v", err)
+	}
+	if string(got) != "0123" {
+		t.Errorf("expected the first 4 bytes, got %q", got)
+	}
+
+	// and it bounds identifying and extracting an untrusted stream
+	archive := newTestTar(t, &tar.Header{Name: strings.Repeat("long name ", 20), Typeflag: tar.TypeReg})
+	format, stream, err := Identify(context.Background(), "", NewGuardedReader(archive, 2048))
+	checkErr(t, err, "identifying")
+	err = format.(Extractor).Extract(context.Background(), stream, func(context.Context, FileInfo) error { return nil })
+	if !errors.Is(err, ErrSizeLimitExceeded) {
+		t.Errorf("expected extraction to exceed the limit, got %v", err)
+	}
+}
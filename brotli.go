@@ -13,8 +13,15 @@ func init() {
 	RegisterFormat(Brotli{})
 }
 
+// DefaultBrotliQuality is the default quality of the brotli
+// library. Unlike the levels of other formats, a Quality of 0
+// is not replaced by it.
+const DefaultBrotliQuality = brotli.DefaultCompression
+
 // Brotli facilitates brotli compression.
 type Brotli struct {
+	// Brotli quality (compression level), from 0 (fastest)
+	// to 11 (best). Levels out of range are clamped.
 	Quality int
 }
 
@@ -86,7 +93,8 @@ func (br Brotli) Match(_ context.Context, filename string, stream io.Reader) (Ma
 }
 
 func (br Brotli) OpenWriter(w io.Writer) (io.WriteCloser, error) {
-	return brotli.NewWriterLevel(w, br.Quality), nil
+	quality := max(brotli.BestSpeed, min(br.Quality, brotli.BestCompression))
+	return brotli.NewWriterLevel(w, quality), nil
 }
 
 func (Brotli) OpenReader(r io.Reader) (io.ReadCloser, error) {
@@ -3,6 +3,8 @@ package archives
 import (
 	"bytes"
 	"context"
+	"os"
+	"strings"
 	"testing"
 )
 
@@ -101,3 +103,33 @@ func TestBrotli_Match_Stream(t *testing.T) {
 		})
 	}
 }
+
+func TestBrotli_TarRoundTrip(t *testing.T) {
+	fname, info := newTmpTextFile(t, strings.Repeat("brotli compressed tarball contents\n", 100))
+	defer os.Remove(fname)
+
+	for _, quality := range []int{0, 5, 11} {
+		format := CompressedArchive{Archival: Tar{}, Extraction: Tar{}, Compression: Brotli{Quality: quality}}
+		archived := archive(t, format, fname, info)
+
+		identified, stream, err := Identify(context.Background(), "test.tar.br", bytes.NewReader(archived))
+		checkErr(t, err, "identifying quality %d", quality)
+		if identified.Extension() != ".tar.br" {
+			t.Fatalf("quality %d: expected .tar.br, got %s", quality, identified.Extension())
+		}
+
+		var names []string
+		err = identified.(Extractor).Extract(context.Background(), stream, func(_ context.Context, f FileInfo) error {
+			names = append(names, f.NameInArchive)
+			return nil
+		})
+		checkErr(t, err, "extracting quality %d", quality)
+		if len(names) != 1 || names[0] != "tmp.txt" {
+			t.Errorf("quality %d: unexpected files %v", quality, names)
+		}
+	}
+
+	if !PathIsArchive("test.tar.br") {
+		t.Errorf("expected .tar.br to be recognized as an archive extension")
+	}
+}
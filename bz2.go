@@ -13,13 +13,21 @@ func init() {
 	RegisterFormat(Bz2{})
 }
 
+// DefaultBz2Level is the bzip2 compression level used
+// when Bz2.CompressionLevel is 0.
+const DefaultBz2Level = bzip2.DefaultCompression
+
 // Bz2 facilitates bzip2 compression.
 type Bz2 struct {
+	// Bzip2 compression level, from 1 (fastest) to 9 (best).
+	// If 0, DefaultBz2Level is used. Levels out of range are
+	// clamped.
 	CompressionLevel int
 }
 
-func (Bz2) Extension() string { return ".bz2" }
-func (Bz2) MediaType() string { return "application/x-bzip2" }
+func (Bz2) Extension() string      { return ".bz2" }
+func (Bz2) MediaType() string      { return "application/x-bzip2" }
+func (Bz2) magicNumbers() [][]byte { return [][]byte{bzip2Header} }
 
 func (bz Bz2) Match(_ context.Context, filename string, stream io.Reader) (MatchResult, error) {
 	var mr MatchResult
@@ -40,8 +48,12 @@ func (bz Bz2) Match(_ context.Context, filename string, stream io.Reader) (Match
 }
 
 func (bz Bz2) OpenWriter(w io.Writer) (io.WriteCloser, error) {
+	level := bz.CompressionLevel
+	if level != 0 {
+		level = max(bzip2.BestSpeed, min(level, bzip2.BestCompression))
+	}
 	return bzip2.NewWriter(w, &bzip2.WriterConfig{
-		Level: bz.CompressionLevel,
+		Level: level,
 	})
 }
 
@@ -0,0 +1,50 @@
+package archives
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"context"
+	"io"
+	"testing"
+)
+
+func TestBz2_CompressedTar(t *testing.T) {
+	tmp, info := newTmpTextFile(t, "contents of a .tar.bz2")
+	tarBz2 := CompressedArchive{Compression: Bz2{}, Archival: Tar{}, Extraction: Tar{}}
+	data := archive(t, tarBz2, tmp, info)
+
+	// what we write is readable by the standard library
+	tarball, err := io.ReadAll(bzip2.NewReader(bytes.NewReader(data)))
+	checkErr(t, err, "decompressing with compress/bzip2")
+
+	var contents []byte
+	err = Tar{}.Extract(context.Background(), bytes.NewReader(tarball), func(_ context.Context, f FileInfo) error {
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		contents, err = io.ReadAll(rc)
+		return err
+	})
+	checkErr(t, err, "extracting")
+	if string(contents) != "contents of a .tar.bz2" {
+		t.Errorf("expected original contents, got %q", contents)
+	}
+
+	// and by our own decompressor, through identification
+	format, stream, err := Identify(context.Background(), "test.tar.bz2", bytes.NewReader(data))
+	checkErr(t, err, "identifying")
+	if format.Extension() != ".tar.bz2" {
+		t.Fatalf("expected .tar.bz2, got %s", format.Extension())
+	}
+	var names []string
+	err = format.(Extractor).Extract(context.Background(), stream, func(_ context.Context, f FileInfo) error {
+		names = append(names, f.NameInArchive)
+		return nil
+	})
+	checkErr(t, err, "extracting identified archive")
+	if len(names) != 1 || names[0] != "tmp.txt" {
+		t.Errorf("expected tmp.txt, got %q", names)
+	}
+}
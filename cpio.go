@@ -0,0 +1,533 @@
+package archives
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+func init() {
+	RegisterFormat(Cpio{})
+}
+
+// Cpio facilitates cpio archive extraction, as used by
+// initramfs images and RPM payloads. The newc format ("070701"),
+// with or without checksums ("070702"), and the portable odc
+// format ("070707") are supported; archives cannot be written.
+// Hard links of the newc format, whose contents are stored with the
+// last of their names, are extracted as links to that one.
+type Cpio struct {
+	// If true, errors encountered during reading a file
+	// within an archive will be logged and the operation
+	// will continue on remaining files. Extract then
+	// returns EntryErrors listing the files that failed.
+	ContinueOnError bool
+
+	// Globs selecting the entries to extract; see the package doc.
+	IncludePatterns []string
+	ExcludePatterns []string
+
+	// If true, macOS metadata is skipped; see the package doc.
+	SkipMacMetadata bool
+
+	// If true, names are normalized to NFC; see the package doc.
+	NormalizeNFC bool
+
+	// If set, reports reading progress; see the package doc.
+	OnProgress func(entryName string, bytesDone, bytesTotal int64)
+
+	// If set, wraps the contents of files; see the package doc.
+	Transform func(name string, r io.Reader) (io.Reader, error)
+
+	// The size in bytes of the buffer through which the contents
+	// of files are copied when extracting with ExtractToFS, and
+	// copying from the reader of ExtractOne. Larger buffers can be
+	// faster on fast storage. If not positive, a default of 32 KiB
+	// is used.
+	CopyBufferSize int
+
+	// Limits on the bytes extracted; see the package doc.
+	MaxDecompressedSize int64
+	MaxEntrySize        int64
+
+	// If positive, the most entries allowed; see the package doc.
+	MaxEntries int
+}
+
+func (Cpio) Extension() string { return ".cpio" }
+func (Cpio) MediaType() string { return "application/x-cpio" }
+func (Cpio) magicNumbers() [][]byte {
+	return [][]byte{[]byte("070701"), []byte("070702"), []byte("070707")}
+}
+
+func (c Cpio) copyBufSize() int { return c.CopyBufferSize }
+
+func (c Cpio) Match(_ context.Context, filename string, stream io.Reader) (MatchResult, error) {
+	var mr MatchResult
+
+	// match filename
+	if strings.Contains(strings.ToLower(filename), c.Extension()) {
+		mr.ByName = true
+	}
+
+	// match file header
+	buf, err := readAtMost(stream, cpioMagicLen)
+	if err != nil {
+		return mr, err
+	}
+	_, mr.ByStream = cpioFormats[string(buf)]
+
+	return mr, nil
+}
+
+func (c Cpio) Extract(ctx context.Context, sourceArchive io.Reader, handleFile FileHandler) error {
+	cr := &cpioReader{r: sourceArchive}
+
+	// important to initialize to non-nil, empty value due to how fileIsIncluded works
+	skipDirs := skipList{}
+	limits := newExtractLimits(c.MaxDecompressedSize, c.MaxEntrySize, c.MaxEntries)
+	filter, err := newPatternFilter(c.IncludePatterns, c.ExcludePatterns)
+	if err != nil {
+		return err
+	}
+	filter.skipMacMetadata = c.SkipMacMetadata
+
+	var failed EntryErrors
+	for {
+		if err := ctx.Err(); err != nil {
+			return err // honor context cancellation
+		}
+
+		hdr, err := cr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if c.ContinueOnError && ctx.Err() == nil {
+				// the cpio reader can't go on past a bad header
+				log.Printf("[ERROR] Advancing to next file in cpio archive: %v", err)
+				failed = append(failed, EntryError{Err: fmt.Errorf("advancing to next file: %w", err)})
+				break
+			}
+			return err
+		}
+		if err := limits.countEntry(); err != nil {
+			return err
+		}
+		if c.NormalizeNFC {
+			hdr.Name = norm.NFC.String(hdr.Name)
+			if hdr.Mode&cpioTypeMask == cpioTypeRegular {
+				hdr.Linkname = norm.NFC.String(hdr.Linkname) // hard link
+			}
+		}
+		if !filter.includes(hdr.Name) {
+			continue
+		}
+		if fileIsIncluded(skipDirs, hdr.Name) {
+			continue
+		}
+
+		info := hdr.FileInfo()
+		file := FileInfo{
+			FileInfo:      info,
+			Header:        hdr,
+			NameInArchive: hdr.Name,
+			LinkTarget:    hdr.Linkname,
+			Open: func() (fs.File, error) {
+				return fileInArchive{io.NopCloser(cr), info}, nil
+			},
+		}
+
+		file = reportProgress(limits.apply(file), hdr.Size, c.OnProgress)
+		file = transformContents(file, c.Transform)
+
+		err = handleFile(ctx, file)
+		if errors.Is(err, fs.SkipAll) {
+			break
+		} else if errors.Is(err, fs.SkipDir) && file.IsDir() {
+			skipDirs.add(hdr.Name)
+		} else if err != nil {
+			if c.ContinueOnError && ctx.Err() == nil {
+				log.Printf("[ERROR] %s: %v", hdr.Name, err)
+				failed = append(failed, EntryError{Name: hdr.Name, Err: err})
+				continue
+			}
+			return fmt.Errorf("handling file: %s: %w", hdr.Name, err)
+		}
+	}
+
+	return failed.asError()
+}
+
+// Walk calls fn for each file in the archive, in order, without reading
+// their contents: they are skipped unless fn opens the file. If fn
+// returns an error, the walk stops and the error is returned; fs.SkipDir
+// and fs.SkipAll work as they do for Extract.
+func (c Cpio) Walk(ctx context.Context, sourceArchive io.Reader, fn func(info FileInfo) error) error {
+	c.ContinueOnError = false
+	return walkArchive(ctx, c, sourceArchive, fn)
+}
+
+// ExtractOne streams through sourceArchive until it reaches the file
+// named name, implementing the SingleExtractor interface.
+func (c Cpio) ExtractOne(ctx context.Context, sourceArchive io.Reader, name string) (io.ReadCloser, fs.FileInfo, error) {
+	name = path.Clean(name)
+	if c.NormalizeNFC {
+		name = norm.NFC.String(name)
+	}
+	cr := &cpioReader{r: sourceArchive}
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, nil, err // honor context cancellation
+		}
+
+		hdr, err := cr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if c.NormalizeNFC {
+			hdr.Name = norm.NFC.String(hdr.Name)
+		}
+		if path.Clean(hdr.Name) == name {
+			return entryReader{Reader: cr, bufSize: c.CopyBufferSize}, hdr.FileInfo(), nil
+		}
+	}
+	return nil, nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+}
+
+// CpioHeader is the header of an entry in a cpio archive, which
+// is the Header of the files extracted from one.
+type CpioHeader struct {
+	Name     string
+	Mode     uint32 // file type and permission bits, as in st_mode
+	Uid      int
+	Gid      int
+	Nlink    int
+	Inode    int64
+	ModTime  time.Time
+	Size     int64
+	Linkname string // target of a symbolic or hard link
+	Check    uint32 // checksum of the contents, in the "070702" format
+}
+
+// FileInfo returns an fs.FileInfo for the entry.
+func (h *CpioHeader) FileInfo() fs.FileInfo { return cpioFileInfo{h} }
+
+// file type bits of the mode of cpio entries
+const (
+	cpioTypeMask    = 0170000
+	cpioTypeSocket  = 0140000
+	cpioTypeSymlink = 0120000
+	cpioTypeRegular = 0100000
+	cpioTypeBlock   = 0060000
+	cpioTypeDir     = 0040000
+	cpioTypeChar    = 0020000
+	cpioTypeFifo    = 0010000
+)
+
+// cpioFileInfo satisfies the fs.FileInfo interface for cpio entries.
+type cpioFileInfo struct {
+	hdr *CpioHeader
+}
+
+func (cfi cpioFileInfo) Name() string       { return path.Base(cfi.hdr.Name) }
+func (cfi cpioFileInfo) Size() int64        { return cfi.hdr.Size }
+func (cfi cpioFileInfo) ModTime() time.Time { return cfi.hdr.ModTime }
+func (cfi cpioFileInfo) IsDir() bool        { return cfi.Mode().IsDir() }
+func (cfi cpioFileInfo) Sys() any           { return cfi.hdr }
+
+func (cfi cpioFileInfo) Mode() fs.FileMode {
+	m := cfi.hdr.Mode
+	mode := fs.FileMode(m & 0777)
+	if m&04000 != 0 {
+		mode |= fs.ModeSetuid
+	}
+	if m&02000 != 0 {
+		mode |= fs.ModeSetgid
+	}
+	if m&01000 != 0 {
+		mode |= fs.ModeSticky
+	}
+	switch m & cpioTypeMask {
+	case cpioTypeDir:
+		mode |= fs.ModeDir
+	case cpioTypeSymlink:
+		mode |= fs.ModeSymlink
+	case cpioTypeBlock:
+		mode |= fs.ModeDevice
+	case cpioTypeChar:
+		mode |= fs.ModeDevice | fs.ModeCharDevice
+	case cpioTypeFifo:
+		mode |= fs.ModeNamedPipe
+	case cpioTypeSocket:
+		mode |= fs.ModeSocket
+	}
+	return mode
+}
+
+// cpioFormat describes the layout of the header of a cpio format:
+// its fields are fixed-width numbers in the given base, followed
+// by the name, and names and contents are padded to align.
+type cpioFormat struct {
+	headerLen int
+	base      int
+	align     int64
+}
+
+const cpioMagicLen = 6
+
+var cpioFormats = map[string]cpioFormat{
+	"070701": {headerLen: 110, base: 16, align: 4}, // newc
+	"070702": {headerLen: 110, base: 16, align: 4}, // newc with checksums
+	"070707": {headerLen: 76, base: 8, align: 1},   // odc
+}
+
+// the name of the entry that ends a cpio archive
+const cpioTrailer = "TRAILER!!!"
+
+// the longest symbolic link target read from an archive
+const cpioMaxLinkname = 64 << 10
+
+// cpioReader reads the entries of a cpio archive in sequence,
+// like tar.Reader.
+//
+// In the newc format, the contents of a file with several hard links
+// are stored only with the last of its names; the entries for the
+// others are empty. They are held back until that last one is read,
+// and then returned after it as hard links to it.
+type cpioReader struct {
+	r      io.Reader
+	offset int64 // bytes read from r, for alignment
+	remain int64 // bytes of the contents of the current entry left
+	pad    int64 // padding after the contents of the current entry
+
+	held    map[cpioFileID][]*CpioHeader // empty entries of hard-linked files
+	heldIDs []cpioFileID                 // the files in held, in order
+	links   []*CpioHeader                // entries to return before reading more
+}
+
+// cpioFileID identifies a file in a cpio archive, which
+// all the entries for its hard links share.
+type cpioFileID struct {
+	devMajor, devMinor, inode int64
+}
+
+// Next advances to the next entry, returning io.EOF at the trailer.
+func (cr *cpioReader) Next() (*CpioHeader, error) {
+	if err := cr.skip(cr.remain + cr.pad); err != nil {
+		return nil, err
+	}
+	cr.remain, cr.pad = 0, 0
+
+	if len(cr.links) > 0 {
+		hdr := cr.links[0]
+		cr.links = cr.links[1:]
+		return hdr, nil
+	}
+
+	for {
+		hdr, id, err := cr.next()
+		if err == io.EOF && len(cr.held) > 0 {
+			// the files were empty after all
+			for _, id := range cr.heldIDs {
+				cr.links = append(cr.links, cr.held[id]...)
+				delete(cr.held, id)
+			}
+			cr.held, cr.heldIDs = nil, nil
+			return cr.Next()
+		}
+		if err != nil {
+			return nil, err
+		}
+		if id == nil {
+			return hdr, nil
+		}
+		if hdr.Size == 0 {
+			if cr.held == nil {
+				cr.held = make(map[cpioFileID][]*CpioHeader)
+			}
+			if _, ok := cr.held[*id]; !ok {
+				cr.heldIDs = append(cr.heldIDs, *id)
+			}
+			cr.held[*id] = append(cr.held[*id], hdr)
+			continue
+		}
+		for _, link := range cr.held[*id] {
+			link.Linkname = hdr.Name
+			cr.links = append(cr.links, link)
+		}
+		delete(cr.held, *id)
+		return hdr, nil
+	}
+}
+
+// next reads the next header, returning the identity of the file
+// too if it is a regular file of the newc format with hard links.
+func (cr *cpioReader) next() (*CpioHeader, *cpioFileID, error) {
+	magic := make([]byte, cpioMagicLen)
+	if err := cr.readFull(magic); err != nil {
+		if err == io.EOF {
+			// some writers leave out the trailer
+			return nil, nil, io.EOF
+		}
+		return nil, nil, fmt.Errorf("reading cpio header: %w", err)
+	}
+	format, ok := cpioFormats[string(magic)]
+	if !ok {
+		return nil, nil, fmt.Errorf("invalid cpio header magic %q", magic)
+	}
+	buf := make([]byte, format.headerLen-cpioMagicLen)
+	if err := cr.readFull(buf); err != nil {
+		return nil, nil, fmt.Errorf("reading cpio header: %w", noEOF(err))
+	}
+	fields := cpioFields{buf: buf, base: format.base}
+
+	hdr := new(CpioHeader)
+	var nameSize, devMajor, devMinor int64
+	if format.base == 16 {
+		hdr.Inode = fields.next(8)
+		hdr.Mode = uint32(fields.next(8))
+		hdr.Uid = int(fields.next(8))
+		hdr.Gid = int(fields.next(8))
+		hdr.Nlink = int(fields.next(8))
+		hdr.ModTime = time.Unix(fields.next(8), 0)
+		hdr.Size = fields.next(8)
+		devMajor, devMinor = fields.next(8), fields.next(8)
+		fields.skip(8 * 2) // device numbers of special files
+		nameSize = fields.next(8)
+		hdr.Check = uint32(fields.next(8))
+	} else {
+		fields.skip(6) // device
+		hdr.Inode = fields.next(6)
+		hdr.Mode = uint32(fields.next(6))
+		hdr.Uid = int(fields.next(6))
+		hdr.Gid = int(fields.next(6))
+		hdr.Nlink = int(fields.next(6))
+		fields.skip(6) // device number
+		hdr.ModTime = time.Unix(fields.next(11), 0)
+		nameSize = fields.next(6)
+		hdr.Size = fields.next(11)
+	}
+	if fields.err != nil {
+		return nil, nil, fields.err
+	}
+	if nameSize < 1 || nameSize > cpioMaxLinkname || hdr.Size < 0 {
+		return nil, nil, fmt.Errorf("invalid cpio header: name size %d, file size %d", nameSize, hdr.Size)
+	}
+
+	name := make([]byte, nameSize)
+	if err := cr.readFull(name); err != nil {
+		return nil, nil, fmt.Errorf("reading cpio file name: %w", noEOF(err))
+	}
+	hdr.Name = string(bytes.TrimRight(name, "\x00"))
+	if err := cr.skip(cr.padding(format.align)); err != nil {
+		return nil, nil, err
+	}
+	if hdr.Name == cpioTrailer {
+		return nil, nil, io.EOF
+	}
+	hdr.Name = strings.TrimPrefix(hdr.Name, "./")
+
+	cr.remain = hdr.Size
+	cr.pad = (format.align - (cr.offset+hdr.Size)%format.align) % format.align
+	if hdr.Mode&cpioTypeMask == cpioTypeSymlink {
+		// the target is stored as the contents
+		if hdr.Size > cpioMaxLinkname {
+			return nil, nil, fmt.Errorf("cpio symbolic link %s: target too long: %d bytes", hdr.Name, hdr.Size)
+		}
+		target, err := io.ReadAll(cr)
+		if err != nil {
+			return nil, nil, fmt.Errorf("reading cpio symbolic link %s: %w", hdr.Name, err)
+		}
+		hdr.Linkname = string(target)
+		hdr.Size = 0
+	}
+	if format.base == 16 && hdr.Nlink > 1 && hdr.Mode&cpioTypeMask == cpioTypeRegular {
+		return hdr, &cpioFileID{devMajor, devMinor, hdr.Inode}, nil
+	}
+	return hdr, nil, nil
+}
+
+// Read reads the contents of the current entry.
+func (cr *cpioReader) Read(p []byte) (int, error) {
+	if cr.remain <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > cr.remain {
+		p = p[:cr.remain]
+	}
+	n, err := cr.r.Read(p)
+	cr.offset += int64(n)
+	cr.remain -= int64(n)
+	if err == io.EOF && cr.remain > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (cr *cpioReader) readFull(p []byte) error {
+	n, err := io.ReadFull(cr.r, p)
+	cr.offset += int64(n)
+	return err
+}
+
+func (cr *cpioReader) skip(n int64) error {
+	if n <= 0 {
+		return nil
+	}
+	skipped, err := io.CopyN(io.Discard, cr.r, n)
+	cr.offset += skipped
+	if err != nil {
+		return fmt.Errorf("skipping to next cpio header: %w", noEOF(err))
+	}
+	return nil
+}
+
+// padding returns the number of bytes from the current offset to
+// the next multiple of align.
+func (cr *cpioReader) padding(align int64) int64 {
+	return (align - cr.offset%align) % align
+}
+
+// cpioFields parses the fixed-width numeric fields of a cpio header.
+type cpioFields struct {
+	buf  []byte
+	base int
+	err  error
+}
+
+func (f *cpioFields) next(width int) int64 {
+	field := f.buf[:width]
+	f.skip(width)
+	if f.err != nil {
+		return 0
+	}
+	n, err := strconv.ParseInt(string(field), f.base, 64)
+	if err != nil {
+		f.err = fmt.Errorf("invalid cpio header field %q: %w", field, err)
+	}
+	return n
+}
+
+// skip skips a field that isn't needed.
+func (f *cpioFields) skip(width int) { f.buf = f.buf[width:] }
+
+// Interface guards
+var (
+	_ Extractor       = (*Cpio)(nil)
+	_ SingleExtractor = (*Cpio)(nil)
+	_ Walker          = (*Cpio)(nil)
+)
@@ -0,0 +1,183 @@
+package archives
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCpio_Extract(t *testing.T) {
+	type entry struct {
+		mode       fs.FileMode
+		contents   string
+		linkTarget string
+	}
+	expected := map[string]entry{
+		"dir":           {mode: fs.ModeDir | 0755},
+		"dir/hello.txt": {mode: 0644, contents: "Hello, cpio!\n"},
+		"dir/empty":     {mode: 0600},
+		"link":          {mode: fs.ModeSymlink | 0777, linkTarget: "dir/hello.txt"},
+	}
+	modTime := time.Unix(1600000000, 0)
+
+	for _, fixture := range []string{"testdata/test-newc.cpio", "testdata/test-odc.cpio"} {
+		archive, err := os.ReadFile(fixture)
+		checkErr(t, err, "reading %s", fixture)
+
+		format, stream, err := Identify(context.Background(), "", bytes.NewReader(archive))
+		checkErr(t, err, "%s: identifying", fixture)
+		if _, ok := format.(Cpio); !ok {
+			t.Fatalf("%s: expected Cpio, got %T", fixture, format)
+		}
+
+		actual := make(map[string]entry)
+		err = format.(Extractor).Extract(context.Background(), stream, func(_ context.Context, f FileInfo) error {
+			if !f.ModTime().Equal(modTime) {
+				t.Errorf("%s: %s: expected modification time %s, got %s", fixture, f.NameInArchive, modTime, f.ModTime())
+			}
+			if hdr := f.Header.(*CpioHeader); hdr.Uid != 1000 || hdr.Gid != 1000 {
+				t.Errorf("%s: %s: expected owner 1000:1000, got %d:%d", fixture, f.NameInArchive, hdr.Uid, hdr.Gid)
+			}
+			e := entry{mode: f.Mode(), linkTarget: f.LinkTarget}
+			if f.Mode().IsRegular() {
+				rc, err := f.Open()
+				if err != nil {
+					return err
+				}
+				defer rc.Close()
+				b, err := io.ReadAll(rc)
+				if err != nil {
+					return err
+				}
+				e.contents = string(b)
+			}
+			actual[f.NameInArchive] = e
+			return nil
+		})
+		checkErr(t, err, "%s: extracting", fixture)
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("%s: expected %v, got %v", fixture, expected, actual)
+		}
+
+		// walking skips the contents
+		var walked []string
+		err = Cpio{}.Walk(context.Background(), bytes.NewReader(archive), func(f FileInfo) error {
+			walked = append(walked, f.NameInArchive)
+			return nil
+		})
+		checkErr(t, err, "%s: walking", fixture)
+		if expected := []string{"dir", "dir/hello.txt", "dir/empty", "link"}; !reflect.DeepEqual(walked, expected) {
+			t.Errorf("%s: expected to walk %q, got %q", fixture, expected, walked)
+		}
+
+		rc, info, err := Cpio{}.ExtractOne(context.Background(), bytes.NewReader(archive), "./dir/hello.txt")
+		checkErr(t, err, "%s: extracting one file", fixture)
+		b, err := io.ReadAll(rc)
+		checkErr(t, err, "%s: reading one file", fixture)
+		if string(b) != "Hello, cpio!\n" || info.Size() != int64(len(b)) {
+			t.Errorf("%s: unexpected file %q of size %d", fixture, b, info.Size())
+		}
+	}
+
+	// a truncated archive is an error, not the end
+	archive, err := os.ReadFile("testdata/test-newc.cpio")
+	checkErr(t, err, "reading test file")
+	err = Cpio{}.Extract(context.Background(), bytes.NewReader(archive[:200]), func(context.Context, FileInfo) error { return nil })
+	if err == nil {
+		t.Errorf("expected error for a truncated archive")
+	}
+}
+
+// cpioTestEntry is an entry for newTestCpio.
+type cpioTestEntry struct {
+	name         string
+	mode         uint32
+	inode, nlink int
+	contents     string
+}
+
+// newTestCpio returns a newc cpio archive of entries.
+func newTestCpio(entries ...cpioTestEntry) *bytes.Reader {
+	var buf bytes.Buffer
+	pad := func() {
+		for buf.Len()%4 != 0 {
+			buf.WriteByte(0)
+		}
+	}
+	for _, e := range append(entries, cpioTestEntry{name: "TRAILER!!!", nlink: 1}) {
+		fmt.Fprintf(&buf, "070701%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x",
+			e.inode, e.mode, 0, 0, e.nlink, 0, len(e.contents), 0, 0, 0, 0, len(e.name)+1, 0)
+		buf.WriteString(e.name + "\x00")
+		pad()
+		buf.WriteString(e.contents)
+		pad()
+	}
+	return bytes.NewReader(buf.Bytes())
+}
+
+func TestCpio_NormalizeNFC(t *testing.T) {
+	const nfd, nfc = "cafe\u0301.txt", "caf\u00e9.txt"
+	archive := newTestCpio(cpioTestEntry{name: nfd, mode: cpioTypeRegular | 0644, inode: 1, nlink: 1, contents: "contents"})
+	rc, info, err := Cpio{NormalizeNFC: true}.ExtractOne(context.Background(), archive, nfc)
+	checkErr(t, err, "extracting one file by its composed name")
+	rc.Close()
+	if info.Name() != nfc {
+		t.Errorf("expected composed name %q, got %q", nfc, info.Name())
+	}
+}
+
+func TestCpio_HardLinks(t *testing.T) {
+	// as written by GNU cpio and rpm: the contents are stored with
+	// the last name of the file, and its other entries are empty
+	const regular = cpioTypeRegular | 0644
+	archive := newTestCpio(
+		cpioTestEntry{name: "a.txt", mode: regular, inode: 5, nlink: 3},
+		cpioTestEntry{name: "other.txt", mode: regular, inode: 6, nlink: 1, contents: "other"},
+		cpioTestEntry{name: "b.txt", mode: regular, inode: 5, nlink: 3},
+		cpioTestEntry{name: "c.txt", mode: regular, inode: 5, nlink: 3, contents: "shared"},
+		cpioTestEntry{name: "empty1", mode: regular, inode: 7, nlink: 2},
+		cpioTestEntry{name: "empty2", mode: regular, inode: 7, nlink: 2},
+	)
+
+	var names, links []string
+	err := Cpio{}.Walk(context.Background(), archive, func(f FileInfo) error {
+		names = append(names, f.NameInArchive)
+		links = append(links, f.LinkTarget)
+		return nil
+	})
+	checkErr(t, err, "walking")
+	if expected := []string{"other.txt", "c.txt", "a.txt", "b.txt", "empty1", "empty2"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected entries %q, got %q", expected, names)
+	}
+	if expected := []string{"", "", "c.txt", "c.txt", "", ""}; !reflect.DeepEqual(links, expected) {
+		t.Errorf("expected link targets %q, got %q", expected, links)
+	}
+
+	archive.Seek(0, io.SeekStart)
+	dest := t.TempDir()
+	checkErr(t, ExtractToFS(context.Background(), Cpio{}, archive, OSWritableFS(dest)), "extracting")
+	for name, expected := range map[string]string{"a.txt": "shared", "b.txt": "shared", "c.txt": "shared", "other.txt": "other", "empty1": "", "empty2": ""} {
+		b, err := os.ReadFile(filepath.Join(dest, name))
+		checkErr(t, err, "reading %s", name)
+		if string(b) != expected {
+			t.Errorf("%s: expected contents %q, got %q", name, expected, b)
+		}
+	}
+}
+
+func TestCpio_Match(t *testing.T) {
+	for _, name := range []string{"archive.cpio", "initrd.cpio.gz", "ARCHIVE.CPIO"} {
+		mr, err := Cpio{}.Match(context.Background(), name, bytes.NewReader(nil))
+		checkErr(t, err, "matching %s", name)
+		if !mr.ByName {
+			t.Errorf("expected %s to match by name", name)
+		}
+	}
+}
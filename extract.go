@@ -0,0 +1,731 @@
+package archives
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/bodgit/sevenzip"
+	"github.com/klauspost/compress/zip"
+)
+
+// ErrUnsafePath is returned when an entry in an archive would be
+// written outside of the extraction destination, for example because
+// its name is absolute, contains "..", or it is a link whose target
+// escapes the destination. Errors wrapping it name the offending entry.
+var ErrUnsafePath = errors.New("unsafe path in archive")
+
+// diskWriter writes files extracted from an archive into a
+// directory on disk.
+type diskWriter struct {
+	// the destination directory; an absolute, clean path
+	dest string
+
+	// apply the mode, modification time, and (if running
+	// as root) the ownership of each file from the archive
+	restoreMetadata bool
+
+	// apply the user.* and security.* extended attributes
+	// recorded in the PAX records of each file
+	restoreXattrs bool
+
+	// write all files directly into dest, skipping directories;
+	// onCollision, if set, renames files whose names are taken
+	flatten     bool
+	onCollision func(name string) string
+
+	// when flattening, the names taken in dest, and the name
+	// each entry was written as, for resolving hard links
+	taken     map[string]bool
+	flatNames map[string]string
+
+	// directories whose metadata is restored after all
+	// their contents have been written
+	dirs []restoredDir
+
+	// the size of the buffer through which contents are
+	// copied, or 0 for the default
+	bufSize int
+}
+
+type restoredDir struct {
+	path string
+	file FileInfo
+}
+
+// extractToDisk extracts all the files from sourceArchive into the
+// dest directory, refusing any entry that would be written outside
+// of it.
+func extractToDisk(ctx context.Context, ex Extractor, sourceArchive io.Reader, dest string, dw diskWriter) error {
+	dest, err := filepath.Abs(dest)
+	if err != nil {
+		return fmt.Errorf("resolving destination: %w", err)
+	}
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return fmt.Errorf("creating destination: %w", err)
+	}
+	dw.dest = dest
+	err = ex.Extract(ctx, sourceArchive, func(ctx context.Context, f FileInfo) error {
+		return dw.writeFile(ctx, f)
+	})
+	if err != nil {
+		return err
+	}
+	return dw.restoreDirs()
+}
+
+// writeFile writes the file f into the destination directory. If
+// writing the contents fails, including because ctx was cancelled,
+// the partial file is removed.
+func (dw *diskWriter) writeFile(ctx context.Context, f FileInfo) error {
+	if dw.flatten {
+		if f.IsDir() {
+			return nil
+		}
+		name, ok := dw.flatName(f.NameInArchive)
+		if !ok {
+			return nil
+		}
+		if f.LinkTarget != "" && !isSymlink(f) {
+			if flat, ok := dw.flatNames[path.Clean(f.LinkTarget)]; ok {
+				f.LinkTarget = flat
+			}
+		}
+		dw.flatNames[path.Clean(f.NameInArchive)] = name
+		f.NameInArchive = name
+	}
+
+	dest := dw.dest
+	target, err := securePath(dest, f.NameInArchive)
+	if err != nil {
+		return err
+	}
+	if target == dest {
+		return nil // the root of the archive
+	}
+
+	// the path within dest, whose components are walked without
+	// following links, so that a directory extracted earlier can't
+	// have been replaced by a link to elsewhere, whether by the
+	// archive or by someone else
+	rel, err := filepath.Rel(dest, target)
+	if err != nil {
+		return err
+	}
+	rel = filepath.ToSlash(rel)
+
+	if f.IsDir() {
+		if err := mkdirNoFollow(dest, rel); err != nil {
+			return err
+		}
+		if xattrs := restorableXattrs(f); dw.restoreXattrs && len(xattrs) > 0 {
+			if err := setDirXattrsNoFollow(dest, rel, xattrs); err != nil {
+				return fmt.Errorf("restoring extended attributes of %s: %w", f.NameInArchive, err)
+			}
+		}
+		if dw.restoreMetadata {
+			// writing the contents would change the modification
+			// time, and a read-only mode could prevent it
+			dw.dirs = append(dw.dirs, restoredDir{target, f})
+		}
+		return nil
+	}
+
+	switch {
+	case isSymlink(f):
+		linkTarget := filepath.FromSlash(f.LinkTarget)
+		if !filepath.IsAbs(linkTarget) {
+			// don't clean the path before resolving it, since ".."
+			// after a link to a directory leads to that directory's
+			// parent, not to the parent of the link
+			linkTarget = filepath.Dir(target) + string(filepath.Separator) + linkTarget
+		}
+		if !withinDir(resolveExisting(dest), resolveExisting(linkTarget)) {
+			return fmt.Errorf("%w: %s: link target %s is outside destination", ErrUnsafePath, f.NameInArchive, f.LinkTarget)
+		}
+		if err := symlinkNoFollow(dest, f.LinkTarget, rel); err != nil {
+			return err
+		}
+		if dw.restoreMetadata {
+			return restoreOwner(target, f, os.Lchown)
+		}
+		return nil
+
+	case f.LinkTarget != "": // hard link; the target is relative to the archive root
+		linkTarget, err := securePath(dest, f.LinkTarget)
+		if err != nil || !withinDir(resolveExisting(dest), resolveExisting(linkTarget)) {
+			return fmt.Errorf("%w: %s: link target %s is outside destination", ErrUnsafePath, f.NameInArchive, f.LinkTarget)
+		}
+		linkRel, err := filepath.Rel(dest, linkTarget)
+		if err != nil || linkRel == "." {
+			return fmt.Errorf("%w: %s: link target %s is outside destination", ErrUnsafePath, f.NameInArchive, f.LinkTarget)
+		}
+		if err := linkNoFollow(dest, filepath.ToSlash(linkRel), rel); err != nil {
+			return fmt.Errorf("linking to %s: %w", f.LinkTarget, err)
+		}
+		return nil
+
+	case f.Mode().IsRegular():
+		out, err := createNoFollow(dest, rel, f.Mode().Perm())
+		if err != nil {
+			return err
+		}
+		var w io.Writer = out
+		var sw *sparseWriter
+		if isSparse(f) {
+			sw = &sparseWriter{f: out}
+			w = sw
+		}
+		err = openAndCopyFile(ctx, f, w, dw.bufSize)
+		if err == nil && sw != nil {
+			err = sw.finish()
+		}
+		if xattrs := restorableXattrs(f); err == nil && dw.restoreXattrs && len(xattrs) > 0 {
+			if err = setXattrs(out, xattrs); err != nil {
+				err = fmt.Errorf("restoring extended attributes: %w", err)
+			}
+		}
+		if err != nil {
+			out.Close()
+			os.Remove(target)
+			return fmt.Errorf("writing %s: %w", f.NameInArchive, err)
+		}
+		if err := out.Close(); err != nil {
+			return err
+		}
+		if dw.restoreMetadata {
+			return restoreMetadata(target, f)
+		}
+		return nil
+	}
+
+	// devices, named pipes, and the like are not extracted
+	return nil
+}
+
+// flatName returns the name in dest of the file named name in the
+// archive when flattening: its base name, or if that is already taken
+// by another file from the archive, the name given by onCollision or
+// else the base name with a counter appended. It returns false if the
+// file should be skipped.
+func (dw *diskWriter) flatName(name string) (string, bool) {
+	if dw.taken == nil {
+		dw.taken = make(map[string]bool)
+		dw.flatNames = make(map[string]string)
+	}
+	base := path.Base(strings.ReplaceAll(name, `\`, "/"))
+	if base == "." || base == ".." || base == "/" {
+		return "", false
+	}
+	flat := base
+	for i := 1; dw.taken[flat]; i++ {
+		if dw.onCollision == nil {
+			ext := path.Ext(base)
+			flat = fmt.Sprintf("%s-%d%s", strings.TrimSuffix(base, ext), i, ext)
+			continue
+		}
+		renamed := dw.onCollision(flat)
+		if renamed == "" {
+			return "", false
+		}
+		if renamed == flat {
+			break // overwrite
+		}
+		flat = renamed
+	}
+	dw.taken[flat] = true
+	return flat, true
+}
+
+// noFollowError returns an error wrapping ErrUnsafePath if the
+// directory dir within dest, on the path rel, is a link, which is why
+// walking rel failed with err; otherwise it returns err.
+func noFollowError(dest, rel, dir string, err error) error {
+	if info, lerr := os.Lstat(filepath.Join(dest, filepath.FromSlash(dir))); lerr == nil && info.Mode()&fs.ModeSymlink != 0 {
+		return fmt.Errorf("%w: %s: %s is a link", ErrUnsafePath, rel, dir)
+	}
+	return err
+}
+
+// xattrPAXPrefix is the prefix of the PAX records that hold extended
+// attributes, as written by GNU tar and others.
+const xattrPAXPrefix = "SCHILY.xattr."
+
+// restorableXattrs returns the user.* and security.* extended
+// attributes in the PAX records of f, by name. Other namespaces,
+// like trusted.* and system.*, are not restored from archives.
+func restorableXattrs(f FileInfo) map[string]string {
+	var xattrs map[string]string
+	for key, value := range f.PAXRecords {
+		name, ok := strings.CutPrefix(key, xattrPAXPrefix)
+		if !ok || !(strings.HasPrefix(name, "user.") || strings.HasPrefix(name, "security.")) {
+			continue
+		}
+		if xattrs == nil {
+			xattrs = make(map[string]string)
+		}
+		xattrs[name] = value
+	}
+	return xattrs
+}
+
+// isSparse reports whether f is a sparse file in a tarball, in
+// either the old GNU format or the GNU PAX format.
+func isSparse(f FileInfo) bool {
+	hdr, ok := f.Header.(*tar.Header)
+	if !ok {
+		return false
+	}
+	if hdr.Typeflag == tar.TypeGNUSparse {
+		return true
+	}
+	for key := range hdr.PAXRecords {
+		if strings.HasPrefix(key, "GNU.sparse.") {
+			return true
+		}
+	}
+	return false
+}
+
+// sparseBlockSize is the granularity of the holes that
+// sparseWriter makes; the block size of most file systems.
+const sparseBlockSize = 4096
+
+// sparseWriter writes to a file, but seeks past blocks of zeros
+// instead of writing them, so that they become holes in the file
+// on file systems that support them. The holes of sparse files in
+// tarballs read as zeros.
+type sparseWriter struct {
+	f   *os.File
+	pos int64
+}
+
+func (sw *sparseWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		n := min(len(p), sparseBlockSize-int(sw.pos%sparseBlockSize))
+		if isZeros(p[:n]) {
+			if _, err := sw.f.Seek(int64(n), io.SeekCurrent); err != nil {
+				return written, err
+			}
+		} else if _, err := sw.f.Write(p[:n]); err != nil {
+			return written, err
+		}
+		sw.pos += int64(n)
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// finish sets the size of the file, which a hole at the end
+// of the file didn't extend it to.
+func (sw *sparseWriter) finish() error {
+	return sw.f.Truncate(sw.pos)
+}
+
+func isZeros(p []byte) bool {
+	for _, b := range p {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// restoreDirs restores the metadata of the extracted directories,
+// deepest first so that restoring one doesn't affect its parent.
+func (dw *diskWriter) restoreDirs() error {
+	for i := len(dw.dirs) - 1; i >= 0; i-- {
+		if err := restoreMetadata(dw.dirs[i].path, dw.dirs[i].file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreMetadata applies the mode, modification time, and ownership
+// of f to the file at target.
+func restoreMetadata(target string, f FileInfo) error {
+	if err := restoreOwner(target, f, os.Chown); err != nil {
+		return err
+	}
+	mode := f.Mode() & (fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky)
+	if err := os.Chmod(target, mode); err != nil {
+		return fmt.Errorf("restoring mode of %s: %w", f.NameInArchive, err)
+	}
+	if mtime := f.ModTime(); !mtime.IsZero() {
+		if err := os.Chtimes(target, mtime, mtime); err != nil {
+			return fmt.Errorf("restoring modification time of %s: %w", f.NameInArchive, err)
+		}
+	}
+	return nil
+}
+
+// restoreOwner sets the owner of the file at target to that recorded
+// in the archive, if any, using chown. It does nothing unless running
+// as root, since only root can give files away.
+func restoreOwner(target string, f FileInfo, chown func(string, int, int) error) error {
+	if os.Geteuid() != 0 {
+		return nil
+	}
+	hdr, ok := f.Header.(*tar.Header)
+	if !ok {
+		return nil
+	}
+	if err := chown(target, hdr.Uid, hdr.Gid); err != nil {
+		return fmt.Errorf("restoring owner of %s: %w", f.NameInArchive, err)
+	}
+	return nil
+}
+
+// WritableFS is a file system that archives can be extracted into
+// with ExtractToFS. Names are slash-separated paths relative to the
+// root of the file system, valid according to fs.ValidPath.
+//
+// If a WritableFS also has a method Link(oldname, newname string)
+// error, it is used to create hard links; otherwise they are created
+// as symbolic links.
+type WritableFS interface {
+	// Create creates or truncates the named file for writing.
+	Create(name string, perm fs.FileMode) (io.WriteCloser, error)
+
+	// Mkdir creates the named directory along with any
+	// parents needed, succeeding if it already exists.
+	Mkdir(name string, perm fs.FileMode) error
+
+	// Symlink creates newname as a symbolic link to oldname.
+	Symlink(oldname, newname string) error
+}
+
+// linkFS is a WritableFS that can create hard links.
+type linkFS interface {
+	Link(oldname, newname string) error
+}
+
+// ExtractToFS extracts all the files in sourceArchive into wfs. Like
+// extracting to disk, it refuses any entry with an absolute path, or
+// whose name or link target would be outside of the root of wfs,
+// returning an error wrapping ErrUnsafePath. Devices, named pipes,
+// and the like are not extracted.
+func ExtractToFS(ctx context.Context, ex Extractor, sourceArchive io.Reader, wfs WritableFS) error {
+	var bufSize int
+	if cb, ok := ex.(copyBuffered); ok {
+		bufSize = cb.copyBufSize()
+	}
+	return ex.Extract(ctx, sourceArchive, func(ctx context.Context, f FileInfo) error {
+		return writeToFS(ctx, wfs, f, bufSize)
+	})
+}
+
+// copyBuffered is implemented by the formats with a CopyBufferSize
+// option, which sets the size of the buffer for copying their files.
+type copyBuffered interface {
+	copyBufSize() int
+}
+
+// writeToFS writes the file f into wfs, copying its contents through
+// a buffer of bufSize bytes.
+func writeToFS(ctx context.Context, wfs WritableFS, f FileInfo, bufSize int) error {
+	// links can't be resolved in wfs, so only the names are
+	// checked, against a stand-in for its root
+	root := filepath.Join(string(filepath.Separator), "root")
+	if err := checkSafe(root, f); err != nil {
+		return err
+	}
+	name := path.Clean(strings.ReplaceAll(f.NameInArchive, `\`, "/"))
+	if name == "." {
+		return nil // the root of the archive
+	}
+
+	if f.IsDir() {
+		return wfs.Mkdir(name, 0755)
+	}
+	if dir := path.Dir(name); dir != "." {
+		if err := wfs.Mkdir(dir, 0755); err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case isSymlink(f):
+		return wfs.Symlink(f.LinkTarget, name)
+
+	case f.LinkTarget != "": // hard link; the target is relative to the archive root
+		linkTarget := path.Clean(strings.ReplaceAll(f.LinkTarget, `\`, "/"))
+		if l, ok := wfs.(linkFS); ok {
+			return l.Link(linkTarget, name)
+		}
+		rel, err := filepath.Rel(filepath.FromSlash(path.Dir(name)), filepath.FromSlash(linkTarget))
+		if err != nil {
+			return fmt.Errorf("linking to %s: %w", f.LinkTarget, err)
+		}
+		return wfs.Symlink(filepath.ToSlash(rel), name)
+
+	case f.Mode().IsRegular():
+		w, err := wfs.Create(name, f.Mode().Perm())
+		if err != nil {
+			return err
+		}
+		if err := openAndCopyFile(ctx, f, w, bufSize); err != nil {
+			w.Close()
+			return fmt.Errorf("writing %s: %w", f.NameInArchive, err)
+		}
+		return w.Close()
+	}
+
+	return nil
+}
+
+// OSWritableFS is a WritableFS that writes into the directory on disk
+// that it names. Besides checking the names of the files it writes,
+// it refuses to write through links that lead outside the directory.
+type OSWritableFS string
+
+// Create creates or truncates the named file for writing.
+func (d OSWritableFS) Create(name string, perm fs.FileMode) (io.WriteCloser, error) {
+	target, err := d.path(name, "create")
+	if err != nil {
+		return nil, err
+	}
+	// never write through an existing link, it could point anywhere
+	if info, err := os.Lstat(target); err == nil && info.Mode()&fs.ModeSymlink != 0 {
+		if err := os.Remove(target); err != nil {
+			return nil, err
+		}
+	}
+	return os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+}
+
+// Mkdir creates the named directory along with any parents needed.
+func (d OSWritableFS) Mkdir(name string, perm fs.FileMode) error {
+	target, err := d.path(name, "mkdir")
+	if err != nil {
+		return err
+	}
+	return os.MkdirAll(target, perm)
+}
+
+// Symlink creates newname as a symbolic link to oldname, which
+// must not lead outside the directory.
+func (d OSWritableFS) Symlink(oldname, newname string) error {
+	target, err := d.path(newname, "symlink")
+	if err != nil {
+		return err
+	}
+	linkTarget := filepath.FromSlash(oldname)
+	if !filepath.IsAbs(linkTarget) {
+		linkTarget = filepath.Dir(target) + string(filepath.Separator) + linkTarget
+	}
+	if !withinDir(resolveExisting(string(d)), resolveExisting(linkTarget)) {
+		return &fs.PathError{Op: "symlink", Path: newname, Err: ErrUnsafePath}
+	}
+	_ = os.Remove(target)
+	return os.Symlink(oldname, target)
+}
+
+// Link creates newname as a hard link to the file oldname.
+func (d OSWritableFS) Link(oldname, newname string) error {
+	source, err := d.path(oldname, "link")
+	if err != nil {
+		return err
+	}
+	target, err := d.path(newname, "link")
+	if err != nil {
+		return err
+	}
+	_ = os.Remove(target)
+	return os.Link(source, target)
+}
+
+// path returns the path on disk of the named file, or an error if
+// name is invalid or its parent directory leads outside of d.
+func (d OSWritableFS) path(name, op string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	target := filepath.Join(string(d), filepath.FromSlash(name))
+	if !withinDir(resolveExisting(string(d)), resolveExisting(filepath.Dir(target))) {
+		return "", &fs.PathError{Op: op, Path: name, Err: ErrUnsafePath}
+	}
+	return target, nil
+}
+
+// ExtractionPlan describes what extracting an archive would do,
+// as returned by Plan.
+type ExtractionPlan struct {
+	// All the entries in the archive, in order.
+	Entries []PlannedEntry
+
+	// The total size of the regular files, according to the
+	// headers in the archive, which can't always be trusted.
+	TotalSize int64
+
+	// The entries that extracting to disk would refuse, with
+	// Err set to the reason, which wraps ErrUnsafePath.
+	Unsafe []PlannedEntry
+}
+
+// PlannedEntry is an entry of an archive in an ExtractionPlan.
+type PlannedEntry struct {
+	Name       string
+	Size       int64
+	Mode       fs.FileMode
+	LinkTarget string
+
+	// Why the entry would not be extracted, or nil.
+	Err error
+}
+
+// Plan lists the entries in archive, without extracting anything, so
+// that an untrusted archive can be previewed; entries whose names or
+// link targets would be written outside of the destination, and those
+// whose paths go through a symbolic link made by an earlier entry, are
+// listed as unsafe, since they would be refused by extraction to disk.
+func Plan(ctx context.Context, w Walker, archive io.Reader) (*ExtractionPlan, error) {
+	// a stand-in for the destination, which is never written to
+	dest := filepath.Join(string(filepath.Separator), "dest")
+
+	// the symbolic links the entries so far would make, by name
+	links := make(map[string]bool)
+
+	plan := new(ExtractionPlan)
+	err := w.Walk(ctx, archive, func(f FileInfo) error {
+		entry := PlannedEntry{
+			Name:       f.NameInArchive,
+			Size:       f.Size(),
+			Mode:       f.Mode(),
+			LinkTarget: f.LinkTarget,
+			Err:        checkSafe(dest, f),
+		}
+		name := path.Clean(f.NameInArchive)
+		if entry.Err == nil {
+			entry.Err = checkNotThroughLink(links, name)
+		}
+		switch {
+		case isSymlink(f):
+			links[name] = true
+		case f.Mode().IsRegular():
+			delete(links, name) // the link would be replaced
+		}
+		if f.Mode().IsRegular() && f.LinkTarget == "" {
+			plan.TotalSize += f.Size()
+		}
+		plan.Entries = append(plan.Entries, entry)
+		if entry.Err != nil {
+			plan.Unsafe = append(plan.Unsafe, entry)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
+
+// TotalUncompressedSize returns the total size of the regular files in
+// archive according to its headers, without extracting anything, for
+// progress reporting or checking for free space. The total is exact if
+// it was read from an index of the whole archive, as zip and 7z archives
+// have; otherwise, as for tar, it is gathered by scanning the headers of
+// the entries throughout the archive, and unknown sizes count as zero.
+// Headers can't always be trusted, so it can be wrong either way.
+func TotalUncompressedSize(ctx context.Context, w Walker, archive io.Reader) (int64, bool, error) {
+	var total int64
+	exact := true
+	err := w.Walk(ctx, archive, func(f FileInfo) error {
+		switch f.Header.(type) {
+		case zip.FileHeader, sevenzip.FileHeader:
+		default:
+			exact = false
+		}
+		if f.Mode().IsRegular() && f.LinkTarget == "" && f.Size() > 0 {
+			total += f.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, false, err
+	}
+	return total, exact, nil
+}
+
+// checkSafe returns an error wrapping ErrUnsafePath if extracting f
+// into dest would write outside of dest, judging only from the names
+// in the archive.
+func checkSafe(dest string, f FileInfo) error {
+	target, err := securePath(dest, f.NameInArchive)
+	if err != nil {
+		return err
+	}
+	switch {
+	case isSymlink(f):
+		linkTarget := filepath.FromSlash(f.LinkTarget)
+		if !filepath.IsAbs(linkTarget) {
+			linkTarget = filepath.Join(filepath.Dir(target), linkTarget)
+		}
+		if !withinDir(dest, linkTarget) {
+			return fmt.Errorf("%w: %s: link target %s is outside destination", ErrUnsafePath, f.NameInArchive, f.LinkTarget)
+		}
+	case f.LinkTarget != "":
+		if _, err := securePath(dest, f.LinkTarget); err != nil {
+			return fmt.Errorf("%w: %s: link target %s is outside destination", ErrUnsafePath, f.NameInArchive, f.LinkTarget)
+		}
+	}
+	return nil
+}
+
+// checkNotThroughLink returns an error wrapping ErrUnsafePath if any
+// of the directories on the path name, which is clean, is one of links.
+func checkNotThroughLink(links map[string]bool, name string) error {
+	for dir := path.Dir(name); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		if links[dir] {
+			return fmt.Errorf("%w: %s: %s is a link", ErrUnsafePath, name, dir)
+		}
+	}
+	return nil
+}
+
+// securePath returns the path on disk within dest for the given
+// name in an archive, or an error wrapping ErrUnsafePath if the
+// name is absolute or would resolve to a path outside of dest.
+func securePath(dest, nameInArchive string) (string, error) {
+	slashed := strings.ReplaceAll(nameInArchive, `\`, "/")
+	if path.IsAbs(slashed) || filepath.IsAbs(nameInArchive) || filepath.VolumeName(nameInArchive) != "" {
+		return "", fmt.Errorf("%w: %s: absolute path", ErrUnsafePath, nameInArchive)
+	}
+	target := filepath.Join(dest, filepath.FromSlash(slashed))
+	if !withinDir(dest, target) {
+		return "", fmt.Errorf("%w: %s: path is outside destination", ErrUnsafePath, nameInArchive)
+	}
+	return target, nil
+}
+
+// resolveExisting returns p with the links in it evaluated, for as
+// much of p as exists on disk; the rest is appended as-is.
+func resolveExisting(p string) string {
+	if resolved, err := filepath.EvalSymlinks(p); err == nil {
+		return resolved
+	}
+	dir, base := filepath.Dir(p), filepath.Base(p)
+	if dir == p {
+		return p
+	}
+	return filepath.Join(resolveExisting(dir), base)
+}
+
+// withinDir reports whether the path target is dir or inside of it.
+func withinDir(dir, target string) bool {
+	rel, err := filepath.Rel(dir, filepath.Clean(target))
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
@@ -0,0 +1,202 @@
+//go:build linux
+
+package archives
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// openDirNoFollow opens the directory rel, a clean slash-separated
+// path relative to dest, creating it and its parents if create is
+// true. Each component is opened relative to the one before it and
+// without following links, so a directory can't be swapped for a
+// link to elsewhere while it is being resolved; a component that is
+// a link is refused with an error wrapping ErrUnsafePath.
+func openDirNoFollow(dest, rel string, create bool) (int, error) {
+	fd, err := syscall.Open(dest, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, &fs.PathError{Op: "open", Path: dest, Err: err}
+	}
+	if rel == "." {
+		return fd, nil
+	}
+	const flags = syscall.O_RDONLY | syscall.O_DIRECTORY | syscall.O_NOFOLLOW | syscall.O_CLOEXEC
+	components := strings.Split(rel, "/")
+	for i, name := range components {
+		next, err := syscall.Openat(fd, name, flags, 0)
+		if err == syscall.ENOENT && create {
+			if err = syscall.Mkdirat(fd, name, 0755); err == nil || err == syscall.EEXIST {
+				next, err = syscall.Openat(fd, name, flags, 0)
+			}
+		}
+		if err != nil {
+			syscall.Close(fd)
+			dir := path.Join(components[:i+1]...)
+			return -1, noFollowError(dest, rel, dir, &fs.PathError{Op: "open", Path: filepath.Join(dest, filepath.FromSlash(dir)), Err: err})
+		}
+		syscall.Close(fd)
+		fd = next
+	}
+	return fd, nil
+}
+
+// mkdirNoFollow creates the directory rel within dest, and its
+// parents, without following links.
+func mkdirNoFollow(dest, rel string) error {
+	fd, err := openDirNoFollow(dest, rel, true)
+	if err != nil {
+		return err
+	}
+	return syscall.Close(fd)
+}
+
+// createNoFollow creates or truncates the file rel within dest for
+// writing, creating its parent directories, without following links.
+// An existing link in its place is replaced.
+func createNoFollow(dest, rel string, perm fs.FileMode) (*os.File, error) {
+	dir, base := path.Dir(rel), path.Base(rel)
+	dirfd, err := openDirNoFollow(dest, dir, true)
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.Close(dirfd)
+	const flags = syscall.O_CREAT | syscall.O_WRONLY | syscall.O_TRUNC | syscall.O_NOFOLLOW | syscall.O_CLOEXEC
+	fd, err := syscall.Openat(dirfd, base, flags, uint32(perm.Perm()))
+	if err == syscall.ELOOP {
+		// never write through an existing link, it could point anywhere
+		if err = syscall.Unlinkat(dirfd, base); err == nil {
+			fd, err = syscall.Openat(dirfd, base, flags, uint32(perm.Perm()))
+		}
+	}
+	name := filepath.Join(dest, filepath.FromSlash(rel))
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return os.NewFile(uintptr(fd), name), nil
+}
+
+// symlinkNoFollow creates rel within dest as a symbolic link to
+// oldname, replacing any file but a directory in its place.
+func symlinkNoFollow(dest, oldname, rel string) error {
+	dirfd, err := openDirNoFollow(dest, path.Dir(rel), true)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(dirfd)
+	base := path.Base(rel)
+	err = symlinkat(oldname, dirfd, base)
+	if err == syscall.EEXIST {
+		if err = syscall.Unlinkat(dirfd, base); err == nil {
+			err = symlinkat(oldname, dirfd, base)
+		}
+	}
+	if err != nil {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: filepath.Join(dest, filepath.FromSlash(rel)), Err: err}
+	}
+	return nil
+}
+
+// linkNoFollow creates rel within dest as a hard link to the file
+// oldrel within dest, replacing any file but a directory in its place.
+func linkNoFollow(dest, oldrel, rel string) error {
+	olddirfd, err := openDirNoFollow(dest, path.Dir(oldrel), false)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(olddirfd)
+	dirfd, err := openDirNoFollow(dest, path.Dir(rel), true)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(dirfd)
+	base := path.Base(rel)
+	err = linkat(olddirfd, path.Base(oldrel), dirfd, base)
+	if errors.Is(err, syscall.EEXIST) {
+		if err = syscall.Unlinkat(dirfd, base); err == nil {
+			err = linkat(olddirfd, path.Base(oldrel), dirfd, base)
+		}
+	}
+	if err != nil {
+		return &os.LinkError{Op: "link", Old: filepath.Join(dest, filepath.FromSlash(oldrel)), New: filepath.Join(dest, filepath.FromSlash(rel)), Err: err}
+	}
+	return nil
+}
+
+// setXattrs sets the extended attributes of the open file f.
+func setXattrs(f *os.File, xattrs map[string]string) error {
+	for name, value := range xattrs {
+		if err := fsetxattr(int(f.Fd()), name, []byte(value)); err != nil {
+			return &fs.PathError{Op: "setxattr", Path: f.Name(), Err: err}
+		}
+	}
+	return nil
+}
+
+// setDirXattrsNoFollow sets the extended attributes of the directory
+// rel within dest, opened without following links.
+func setDirXattrsNoFollow(dest, rel string, xattrs map[string]string) error {
+	fd, err := openDirNoFollow(dest, rel, false)
+	if err != nil {
+		return err
+	}
+	dir := os.NewFile(uintptr(fd), filepath.Join(dest, filepath.FromSlash(rel)))
+	defer dir.Close()
+	return setXattrs(dir, xattrs)
+}
+
+// The syscall package has no wrappers for these.
+
+func symlinkat(oldname string, newdirfd int, newname string) error {
+	oldp, err := syscall.BytePtrFromString(oldname)
+	if err != nil {
+		return err
+	}
+	newp, err := syscall.BytePtrFromString(newname)
+	if err != nil {
+		return err
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_SYMLINKAT, uintptr(unsafe.Pointer(oldp)), uintptr(newdirfd), uintptr(unsafe.Pointer(newp)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func linkat(olddirfd int, oldname string, newdirfd int, newname string) error {
+	oldp, err := syscall.BytePtrFromString(oldname)
+	if err != nil {
+		return err
+	}
+	newp, err := syscall.BytePtrFromString(newname)
+	if err != nil {
+		return err
+	}
+	_, _, errno := syscall.Syscall6(syscall.SYS_LINKAT, uintptr(olddirfd), uintptr(unsafe.Pointer(oldp)), uintptr(newdirfd), uintptr(unsafe.Pointer(newp)), 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func fsetxattr(fd int, name string, value []byte) error {
+	namep, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return err
+	}
+	var valuep unsafe.Pointer
+	if len(value) > 0 {
+		valuep = unsafe.Pointer(&value[0])
+	}
+	_, _, errno := syscall.Syscall6(syscall.SYS_FSETXATTR, uintptr(fd), uintptr(unsafe.Pointer(namep)), uintptr(valuep), uintptr(len(value)), 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+//go:build linux
+
+package archives
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestTar_SecureExtractRestoreXattrs(t *testing.T) {
+	dest := t.TempDir()
+	if err := syscall.Setxattr(dest, "user.probe", []byte("x"), 0); errors.Is(err, syscall.ENOTSUP) {
+		t.Skip("file system doesn't support user extended attributes")
+	}
+
+	records := map[string]string{"SCHILY.xattr.user.comment": "hello"}
+	archive := newTestTar(t,
+		&tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755, PAXRecords: records, Format: tar.FormatPAX},
+		&tar.Header{Name: "dir/file.txt", Typeflag: tar.TypeReg, PAXRecords: records, Format: tar.FormatPAX},
+	)
+	err := Tar{RestoreXattrs: true}.SecureExtract(context.Background(), archive, dest)
+	checkErr(t, err, "extracting")
+
+	for _, name := range []string{"dir", "dir/file.txt"} {
+		value := make([]byte, 64)
+		n, err := syscall.Getxattr(filepath.Join(dest, name), "user.comment", value)
+		checkErr(t, err, "getting xattr of %s", name)
+		if string(value[:n]) != "hello" {
+			t.Errorf("%s: expected xattr %q, got %q", name, "hello", value[:n])
+		}
+	}
+}
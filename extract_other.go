@@ -0,0 +1,108 @@
+//go:build !linux
+
+package archives
+
+import (
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Without openat(2) and related calls in the syscall package, each
+// component of a path is checked before it is used, which leaves a
+// window in which it could be swapped for a link.
+
+// mkdirNoFollow creates the directory rel within dest, and its
+// parents, without following links.
+func mkdirNoFollow(dest, rel string) error {
+	return walkNoFollow(dest, rel, true)
+}
+
+// walkNoFollow checks that each component of the directory rel within
+// dest is a directory and not a link, creating the missing ones if
+// create is true; a component that is a link is refused with an error
+// wrapping ErrUnsafePath.
+func walkNoFollow(dest, rel string, create bool) error {
+	if rel == "." {
+		return nil
+	}
+	components := strings.Split(rel, "/")
+	for i := range components {
+		dir := path.Join(components[:i+1]...)
+		p := filepath.Join(dest, filepath.FromSlash(dir))
+		info, err := os.Lstat(p)
+		if os.IsNotExist(err) && create {
+			if err := os.Mkdir(p, 0755); err != nil && !os.IsExist(err) {
+				return err
+			}
+			info, err = os.Lstat(p)
+		}
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return noFollowError(dest, rel, dir, &fs.PathError{Op: "mkdir", Path: p, Err: fs.ErrExist})
+		}
+	}
+	return nil
+}
+
+// createNoFollow creates or truncates the file rel within dest for
+// writing, creating its parent directories, without following links.
+// An existing link in its place is replaced.
+func createNoFollow(dest, rel string, perm fs.FileMode) (*os.File, error) {
+	target, err := replaceNoFollow(dest, rel)
+	if err != nil {
+		return nil, err
+	}
+	return os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+}
+
+// symlinkNoFollow creates rel within dest as a symbolic link to
+// oldname, replacing any file but a directory in its place.
+func symlinkNoFollow(dest, oldname, rel string) error {
+	target, err := replaceNoFollow(dest, rel)
+	if err != nil {
+		return err
+	}
+	_ = os.Remove(target)
+	return os.Symlink(oldname, target)
+}
+
+// linkNoFollow creates rel within dest as a hard link to the file
+// oldrel within dest, replacing any file but a directory in its place.
+func linkNoFollow(dest, oldrel, rel string) error {
+	if err := walkNoFollow(dest, path.Dir(oldrel), false); err != nil {
+		return err
+	}
+	target, err := replaceNoFollow(dest, rel)
+	if err != nil {
+		return err
+	}
+	_ = os.Remove(target)
+	return os.Link(filepath.Join(dest, filepath.FromSlash(oldrel)), target)
+}
+
+// replaceNoFollow creates the parent directories of rel within dest
+// and removes any link in its place, returning its path on disk.
+func replaceNoFollow(dest, rel string) (string, error) {
+	if err := mkdirNoFollow(dest, path.Dir(rel)); err != nil {
+		return "", err
+	}
+	target := filepath.Join(dest, filepath.FromSlash(rel))
+	// never write through an existing link, it could point anywhere
+	if info, err := os.Lstat(target); err == nil && info.Mode()&fs.ModeSymlink != 0 {
+		if err := os.Remove(target); err != nil {
+			return "", err
+		}
+	}
+	return target, nil
+}
+
+// Extended attributes are only restored on Linux.
+
+func setXattrs(*os.File, map[string]string) error { return nil }
+
+func setDirXattrsNoFollow(string, string, map[string]string) error { return nil }
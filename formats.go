@@ -3,11 +3,16 @@ package archives
 import (
 	"bytes"
 	"context"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"log"
+	"mime"
 	"path"
 	"path/filepath"
+	"slices"
 	"strings"
 )
 
@@ -21,11 +26,153 @@ func RegisterFormat(format Format) {
 	formats[name] = format
 }
 
+// RegisterCompression registers a compression format that Identify
+// recognizes by the magic bytes at the start of its streams, so that
+// new compression formats can be added without implementing Format.
+// To be identified in a stream, the compressor made by factory must
+// also be a Decompressor; if it implements Compression, it is what
+// Identify returns. Like RegisterFormat, it should be called during
+// init, and registering the same magic bytes twice panics.
+func RegisterCompression(magic []byte, factory func() Compressor) {
+	if len(magic) == 0 {
+		panic("compression must have magic bytes")
+	}
+	name := magicCompressionName(magic)
+	if _, ok := formats[name]; ok {
+		panic("compression with magic bytes " + name + " is already registered")
+	}
+	formats[name] = magicCompression{magic: bytes.Clone(magic), factory: factory}
+}
+
+// magicCompressionName returns the name in the registered formats
+// of the compression registered with the given magic bytes.
+func magicCompressionName(magic []byte) string {
+	return fmt.Sprintf("magic:%x", magic)
+}
+
+// magicCompression is a compression format registered with
+// RegisterCompression, which matches streams by their magic bytes.
+type magicCompression struct {
+	magic   []byte
+	factory func() Compressor
+}
+
+// compression returns the registered compressor if it implements
+// Compression, or else mc.
+func (mc magicCompression) compression() Compression {
+	if c, ok := mc.factory().(Compression); ok {
+		return c
+	}
+	return mc
+}
+
+func (mc magicCompression) Extension() string {
+	if f, ok := mc.factory().(Format); ok {
+		return f.Extension()
+	}
+	return ""
+}
+
+func (mc magicCompression) MediaType() string {
+	if f, ok := mc.factory().(Format); ok {
+		return f.MediaType()
+	}
+	return ""
+}
+
+func (mc magicCompression) Match(_ context.Context, filename string, stream io.Reader) (MatchResult, error) {
+	var mr MatchResult
+	if ext := mc.Extension(); ext != "" && strings.Contains(strings.ToLower(filename), ext) {
+		mr.ByName = true
+	}
+	buf, err := readAtMost(stream, len(mc.magic))
+	if err != nil {
+		return mr, err
+	}
+	mr.ByStream = bytes.Equal(buf, mc.magic)
+	return mr, nil
+}
+
+func (mc magicCompression) OpenWriter(w io.Writer) (io.WriteCloser, error) {
+	return mc.factory().OpenWriter(w)
+}
+
+func (mc magicCompression) OpenReader(r io.Reader) (io.ReadCloser, error) {
+	d, ok := mc.factory().(Decompressor)
+	if !ok {
+		return nil, fmt.Errorf("compression with magic bytes %x can't decompress", mc.magic)
+	}
+	return d.OpenReader(r)
+}
+
+func (mc magicCompression) magicNumbers() [][]byte { return [][]byte{mc.magic} }
+
+// FormatInfo describes a registered format, as listed by
+// SupportedFormats.
+type FormatInfo struct {
+	// The name under which the format is registered, such as "zip".
+	Name string
+
+	// The file extensions of the format, such as ".zip".
+	Extensions []string
+
+	// Whether files of the format can be read (extracted or
+	// decompressed) and written (archived or compressed).
+	CanRead  bool
+	CanWrite bool
+
+	// The magic numbers at the start of files of the format, in
+	// hex and separated by commas, or empty if it has none, as
+	// for tar and brotli.
+	MagicHex string
+}
+
+// magicNumbered is implemented by formats whose files start with one
+// of a few fixed sequences of bytes.
+type magicNumbered interface {
+	magicNumbers() [][]byte
+}
+
+// SupportedFormats lists the registered formats, sorted by name,
+// including any added with RegisterFormat or RegisterCompression.
+// Compressed archives, such as .tar.gz, combine an archive format
+// with a compression format, so they are not listed themselves.
+func SupportedFormats() []FormatInfo {
+	infos := make([]FormatInfo, 0, len(formats))
+	for name, format := range formats {
+		info := FormatInfo{Name: name}
+		if ext := format.Extension(); ext != "" {
+			info.Extensions = []string{ext}
+		}
+		capabilities := any(format)
+		if mc, ok := format.(magicCompression); ok {
+			capabilities = mc.factory()
+		}
+		_, isExtractor := capabilities.(Extractor)
+		_, isDecompressor := capabilities.(Decompressor)
+		_, isArchiver := capabilities.(Archiver)
+		_, isCompressor := capabilities.(Compressor)
+		info.CanRead = isExtractor || isDecompressor
+		info.CanWrite = isArchiver || isCompressor
+		if mn, ok := format.(magicNumbered); ok {
+			var magics []string
+			for _, magic := range mn.magicNumbers() {
+				magics = append(magics, hex.EncodeToString(magic))
+			}
+			info.MagicHex = strings.Join(magics, ",")
+		}
+		infos = append(infos, info)
+	}
+	slices.SortFunc(infos, func(a, b FormatInfo) int { return strings.Compare(a.Name, b.Name) })
+	return infos
+}
+
 // Identify iterates the registered formats and returns the one that
 // matches the given filename and/or stream. It is capable of identifying
 // compressed files (.gz, .xz...), archive files (.tar, .zip...), and
-// compressed archive files (tar.gz, tar.bz2...). The returned Format
-// value can be type-asserted to ascertain its capabilities.
+// compressed archive files (tar.gz, tar.bz2...), including by their
+// short extensions (.tgz, .tlz4). The returned Format value can be
+// type-asserted to ascertain its capabilities.
 //
 // If no matching formats were found, special error NoMatch is returned.
 //
@@ -42,7 +189,7 @@ func Identify(ctx context.Context, filename string, stream io.Reader) (Format, i
 	var archival Archival
 	var extraction Extraction
 
-	filename = path.Base(filepath.ToSlash(filename))
+	filename = expandShortExtension(path.Base(filepath.ToSlash(filename)))
 
 	rewindableStream, err := newRewindReader(stream)
 	if err != nil {
@@ -65,6 +212,9 @@ func Identify(ctx context.Context, filename string, stream io.Reader) (Format, i
 		// so we can see if it contains an archive within
 		if matchResult.Matched() {
 			compression = cf
+			if mc, ok := cf.(magicCompression); ok {
+				compression = mc.compression()
+			}
 			break
 		}
 	}
@@ -111,6 +261,186 @@ func Identify(ctx context.Context, filename string, stream io.Reader) (Format, i
 	}
 }
 
+// shortExtensions maps the short extensions of compressed archives to
+// the compound extensions that the formats match by name.
+var shortExtensions = map[string]string{
+	".tgz":  ".tar.gz",
+	".tlz4": ".tar.lz4",
+}
+
+// expandShortExtension returns filename with a short extension of a
+// compressed archive, like .tgz, replaced by its compound extension.
+func expandShortExtension(filename string) string {
+	ext := path.Ext(filename)
+	if long, ok := shortExtensions[strings.ToLower(ext)]; ok {
+		return strings.TrimSuffix(filename, ext) + long
+	}
+	return filename
+}
+
+// IdentifyWithHint is like Identify, but it also takes a MIME type for
+// the input, such as the Content-Type of an HTTP response, which is
+// trusted when the input can't be identified otherwise, as with a short
+// stream, or when the format it names also matches the input. If the
+// contents clearly belong to a different format, that format is returned
+// and the mismatch is logged as a warning. Parameters in the MIME type
+// are ignored; an empty or unknown MIME type is no hint at all.
+func IdentifyWithHint(ctx context.Context, filename, mimeType string, stream io.Reader) (Format, io.Reader, error) {
+	hinted := formatByMediaType(mimeType)
+	format, stream, err := Identify(ctx, filename, stream)
+	if hinted == nil {
+		return format, stream, err
+	}
+	if errors.Is(err, NoMatch) {
+		return hinted, stream, nil
+	}
+	if err != nil {
+		return nil, stream, err
+	}
+	if hasMediaType(format, hinted.MediaType()) {
+		return format, stream, nil
+	}
+
+	// if the hinted format also matches the contents, it is
+	// as good a match as the one that happened to be found
+	rewindableStream, err := newRewindReader(stream)
+	if err != nil {
+		return nil, stream, err
+	}
+	mr, err := identifyOne(ctx, hinted, path.Base(filepath.ToSlash(filename)), rewindableStream, nil)
+	stream = rewindableStream.reader()
+	if err != nil {
+		return nil, stream, fmt.Errorf("matching %s: %w", hinted.MediaType(), err)
+	}
+	if mr.ByStream || (stream == nil && mr.ByName) {
+		return hinted, stream, nil
+	}
+	log.Printf("[WARNING] input of type %s was identified as %s", mimeType, format.MediaType())
+	return format, stream, nil
+}
+
+// formatByMediaType returns the registered format with the given
+// MIME type, or nil if there is none.
+func formatByMediaType(mimeType string) Format {
+	mediaType, _, err := mime.ParseMediaType(mimeType)
+	if err != nil {
+		return nil
+	}
+	if alias, ok := mediaTypeAliases[mediaType]; ok {
+		mediaType = alias
+	}
+	for _, format := range formats {
+		if format.MediaType() == mediaType {
+			return format
+		}
+	}
+	return nil
+}
+
+// hasMediaType returns whether format, or either part of it if it is
+// a compressed archive, has the given MIME type.
+func hasMediaType(format Format, mediaType string) bool {
+	if ca, ok := format.(CompressedArchive); ok {
+		if archive := ca.archive(); archive != nil && archive.MediaType() == mediaType {
+			return true
+		}
+		return ca.Compression.MediaType() == mediaType
+	}
+	return format.MediaType() == mediaType
+}
+
+// mediaTypeAliases maps MIME types that are commonly used, but not by
+// any of the formats, to the ones used by the formats.
+var mediaTypeAliases = map[string]string{
+	"application/x-gzip":           "application/gzip",
+	"application/x-zip-compressed": "application/zip",
+	"application/x-zip":            "application/zip",
+	"application/x-rar-compressed": "application/vnd.rar",
+	"application/x-rar":            "application/vnd.rar",
+	"application/x-zstd":           "application/zstd",
+	"application/x-bzip":           "application/x-bzip2",
+}
+
+// MaxCompressionLayers is the most compression layers IdentifyDeep
+// will look through.
+const MaxCompressionLayers = 8
+
+// IdentifyDeep is like Identify, but it looks through any number of
+// layers of compression, as in a tar file that was accidentally gzipped
+// twice. It returns the compression formats from the outermost layer
+// inwards and the format within them, if any: usually an archive format,
+// which can be type-asserted for its capabilities, or nil if the
+// innermost layer is compressed data of an unrecognized format. An error
+// is returned if there are more than MaxCompressionLayers layers.
+//
+// Since a filename often describes only some of the layers, formats are
+// identified by the contents of the stream alone; the filename is used
+// only if stream is nil, in which case this is the same as Identify.
+// As with Identify, the returned io.Reader reads the stream from the
+// position it was in before IdentifyDeep was called.
+func IdentifyDeep(ctx context.Context, filename string, stream io.Reader) ([]Compression, Format, io.Reader, error) {
+	if stream == nil {
+		format, _, err := Identify(ctx, filename, nil)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if ca, ok := format.(CompressedArchive); ok {
+			return []Compression{ca.Compression}, ca.archive(), nil, nil
+		}
+		if comp, ok := format.(Compression); ok {
+			return []Compression{comp}, nil, nil, nil
+		}
+		return nil, format, nil, nil
+	}
+
+	rewindableStream, err := newRewindReader(stream)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	var layers []Compression
+	for {
+		format, err := identifyLayer(ctx, rewindableStream, layers)
+		rewindableStream.rewind()
+		if errors.Is(err, NoMatch) && len(layers) > 0 {
+			return layers, nil, rewindableStream.reader(), nil
+		}
+		if err != nil {
+			return nil, nil, rewindableStream.reader(), err
+		}
+
+		_, isCompressed := format.(Compression) // including CompressedArchive
+		if isCompressed && len(layers) == MaxCompressionLayers {
+			return nil, nil, rewindableStream.reader(), fmt.Errorf("more than %d layers of compression", MaxCompressionLayers)
+		}
+
+		switch f := format.(type) {
+		case CompressedArchive:
+			return append(layers, f.Compression), f.archive(), rewindableStream.reader(), nil
+		case Compression:
+			layers = append(layers, f)
+		default:
+			return layers, format, rewindableStream.reader(), nil
+		}
+	}
+}
+
+// identifyLayer identifies the format of the contents of stream
+// after decompressing it through the given layers of compression.
+func identifyLayer(ctx context.Context, stream io.Reader, layers []Compression) (Format, error) {
+	r := stream
+	for _, comp := range layers {
+		rc, err := comp.OpenReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("opening %s decompressor: %w", strings.TrimPrefix(comp.Extension(), "."), err)
+		}
+		defer rc.Close()
+		r = rc
+	}
+	format, _, err := Identify(ctx, "", r)
+	return format, err
+}
+
 func identifyOne(ctx context.Context, format Format, filename string, stream *rewindReader, comp Compression) (mr MatchResult, err error) {
 	defer stream.rewind()
 
@@ -147,6 +477,17 @@ func identifyOne(ctx context.Context, format Format, filename string, stream *re
 	return mr, err
 }
 
+// seekableStream returns the stream given to Match as an io.ReadSeeker,
+// if the stream it reads from can seek, for formats whose headers may
+// not be at the start.
+func seekableStream(stream io.Reader) (io.ReadSeeker, bool) {
+	if rr, ok := stream.(*rewindReader); ok && rr != nil {
+		stream = rr.Reader
+	}
+	rs, ok := stream.(io.ReadSeeker)
+	return rs, ok
+}
+
 // readAtMost reads at most n bytes from the stream. A nil, empty, or short
 // stream is not an error. The returned slice of bytes may have length < n
 // without an error.
@@ -187,6 +528,15 @@ type CompressedArchive struct {
 	Compression
 }
 
+// archive returns the archive format of ca, preferring the
+// Extraction, since compressed archives are identified for reading.
+func (ca CompressedArchive) archive() Format {
+	if ca.Extraction != nil {
+		return ca.Extraction
+	}
+	return ca.Archival
+}
+
 // Name returns a concatenation of the archive and compression format extensions.
 func (ca CompressedArchive) Extension() string {
 	var name string
@@ -295,6 +645,61 @@ func (ca CompressedArchive) Extract(ctx context.Context, sourceArchive io.Reader
 	return ca.Extraction.Extract(ctx, sourceArchive, handleFile)
 }
 
+// Walk decompresses sourceArchive and calls fn for each file in the
+// archive within it, without reading their contents. Since the
+// archive is compressed, skipping the contents still means
+// decompressing them.
+func (ca CompressedArchive) Walk(ctx context.Context, sourceArchive io.Reader, fn func(info FileInfo) error) error {
+	return walkArchive(ctx, ca, sourceArchive, fn)
+}
+
+// ExtractOne decompresses sourceArchive and extracts the file named name
+// from the archive within it. The archive format must implement the
+// SingleExtractor interface.
+func (ca CompressedArchive) ExtractOne(ctx context.Context, sourceArchive io.Reader, name string) (io.ReadCloser, fs.FileInfo, error) {
+	se, ok := ca.Extraction.(SingleExtractor)
+	if !ok {
+		return nil, nil, fmt.Errorf("extraction format %T can't extract a single file", ca.Extraction)
+	}
+	if ca.Compression == nil {
+		return se.ExtractOne(ctx, sourceArchive, name)
+	}
+	decomp, err := ca.Compression.OpenReader(sourceArchive)
+	if err != nil {
+		return nil, nil, err
+	}
+	rc, info, err := se.ExtractOne(ctx, decomp, name)
+	if err != nil {
+		decomp.Close()
+		return nil, nil, err
+	}
+	return closeBothReaders{rc, decomp}, info, nil
+}
+
+func (ca CompressedArchive) copyBufSize() int {
+	if cb, ok := ca.Extraction.(copyBuffered); ok {
+		return cb.copyBufSize()
+	}
+	return 0
+}
+
+// closeBothReaders is a reader that also closes the
+// decompressor it reads from when it is closed.
+type closeBothReaders struct {
+	io.ReadCloser
+	decomp io.Closer
+}
+
+func (c closeBothReaders) WriteTo(w io.Writer) (int64, error) { return writeTo(w, c.ReadCloser, 0) }
+
+func (c closeBothReaders) Close() error {
+	err := c.ReadCloser.Close()
+	if err2 := c.decomp.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
 // MatchResult returns true if the format was matched either
 // by name, stream, or both. Name usually refers to matching
 // by file extension, and stream usually refers to reading
@@ -426,15 +831,84 @@ func (rr *rewindReader) reader() io.Reader {
 // NoMatch is a special error returned if there are no matching formats.
 var NoMatch = fmt.Errorf("no formats matched")
 
+// ErrWrongPassword is returned when an encrypted archive or file
+// cannot be decrypted because the password is missing or incorrect.
+var ErrWrongPassword = errors.New("wrong or missing password")
+
+// ErrEncryptedHeader is returned when the list of files in an archive
+// is encrypted, so it can't be read without a password, which callers
+// can prompt for. Errors wrapping it also wrap ErrWrongPassword.
+var ErrEncryptedHeader = errors.New("archive header is encrypted")
+
+// ErrSizeLimitExceeded is returned when the contents extracted from
+// an archive exceed a configured size limit.
+var ErrSizeLimitExceeded = errors.New("size limit exceeded")
+
+// ErrChecksumMismatch is returned when the contents of a file in an
+// archive don't match the checksum stored for it.
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// ErrTooManyEntries is returned when an archive has more entries
+// than the configured maximum.
+var ErrTooManyEntries = errors.New("too many entries in archive")
+
+// EntryError is the error for a file in an archive that failed to be
+// extracted while extraction went on with the other files, because
+// ContinueOnError was set.
+type EntryError struct {
+	Name string // the name of the file in the archive, if known
+	Err  error
+}
+
+func (e EntryError) Error() string {
+	if e.Name == "" {
+		return e.Err.Error()
+	}
+	return e.Name + ": " + e.Err.Error()
+}
+
+func (e EntryError) Unwrap() error { return e.Err }
+
+// EntryErrors is returned by Extract when ContinueOnError is set and
+// any files failed to be extracted. It lists them in the order they
+// are in the archive, and errors.Is and errors.As match the error of
+// any of them.
+type EntryErrors []EntryError
+
+func (e EntryErrors) Error() string {
+	if len(e) == 1 {
+		return "1 file failed to extract: " + e[0].Error()
+	}
+	return fmt.Sprintf("%d files failed to extract; first: %v", len(e), e[0])
+}
+
+func (e EntryErrors) Unwrap() []error {
+	errs := make([]error, len(e))
+	for i, err := range e {
+		errs[i] = err
+	}
+	return errs
+}
+
+// asError returns e, or nil if it is empty.
+func (e EntryErrors) asError() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
 // Registered formats.
 var formats = make(map[string]Format)
 
 // Interface guards
 var (
-	_ Format        = (*CompressedArchive)(nil)
-	_ Archiver      = (*CompressedArchive)(nil)
-	_ ArchiverAsync = (*CompressedArchive)(nil)
-	_ Extractor     = (*CompressedArchive)(nil)
-	_ Compressor    = (*CompressedArchive)(nil)
-	_ Decompressor  = (*CompressedArchive)(nil)
+	_ Format          = (*CompressedArchive)(nil)
+	_ Archiver        = (*CompressedArchive)(nil)
+	_ ArchiverAsync   = (*CompressedArchive)(nil)
+	_ Extractor       = (*CompressedArchive)(nil)
+	_ SingleExtractor = (*CompressedArchive)(nil)
+	_ Walker          = (*CompressedArchive)(nil)
+	_ Compressor      = (*CompressedArchive)(nil)
+	_ Decompressor    = (*CompressedArchive)(nil)
 )
@@ -1,15 +1,20 @@
 package archives
 
 import (
+	"archive/tar"
 	"bytes"
 	"context"
 	"errors"
+	"fmt"
 	"io"
 	"io/fs"
 	"math/rand"
 	"os"
+	"reflect"
+	"slices"
 	"strings"
 	"testing"
+	"testing/iotest"
 	"time"
 )
 
@@ -430,6 +435,45 @@ func TestIdentifyAndOpenZip(t *testing.T) {
 	checkErr(t, err, "extracting zip")
 }
 
+func TestIdentifySelfExtracting(t *testing.T) {
+	// a stand-in for the executable stub, which doesn't start with
+	// a header any format matches
+	stub := append([]byte("MZ\x90\x00"), bytes.Repeat([]byte("not an archive "), 1000)...)
+
+	zipped, err := os.ReadFile("testdata/test.zip")
+	checkErr(t, err, "reading zip")
+	sfx := bytes.NewReader(append(slices.Clip(stub), zipped...))
+	format, stream, err := Identify(context.Background(), "setup.exe", sfx)
+	checkErr(t, err, "identifying self-extracting zip")
+	if _, ok := format.(Zip); !ok {
+		t.Fatalf("expected Zip, got %T", format)
+	}
+	var count int
+	err = format.(Extractor).Extract(context.Background(), stream, func(_ context.Context, f FileInfo) error {
+		count++
+		return nil
+	})
+	checkErr(t, err, "extracting self-extracting zip")
+	if count == 0 {
+		t.Errorf("expected files in the self-extracting zip")
+	}
+
+	// found by its header after the stub, even when streamed
+	rar, err := os.ReadFile("testdata/test.part01.rar")
+	checkErr(t, err, "reading rar")
+	format, _, err = Identify(context.Background(), "setup.exe", io.MultiReader(bytes.NewReader(append(slices.Clip(stub), rar...))))
+	checkErr(t, err, "identifying self-extracting rar")
+	if _, ok := format.(Rar); !ok {
+		t.Fatalf("expected Rar, got %T", format)
+	}
+
+	// but not in anything else
+	_, _, err = Identify(context.Background(), "setup.exe", bytes.NewReader(stub))
+	if !errors.Is(err, NoMatch) {
+		t.Errorf("expected no match for the stub alone, got %v", err)
+	}
+}
+
 func TestIdentifyASCIIFileStartingWithX(t *testing.T) {
 	// Create a temporary file starting with the letter 'x'
 	tmpFile, err := os.CreateTemp("", "TestIdentifyASCIIFileStartingWithX-tmp-*.txt")
@@ -464,3 +508,338 @@ func TestIdentifyStreamNil(t *testing.T) {
 		t.Errorf("unexpected format found: expected=.tar.zst actual=%s", format.Extension())
 	}
 }
+
+func TestIdentifyShortExtensions(t *testing.T) {
+	for _, tc := range []struct {
+		filename    string
+		compression Compression
+	}{
+		{"test.tar.lz4", Lz4{}},
+		{"test.tlz4", Lz4{}},
+		{"TEST.TLZ4", Lz4{}},
+		{"test.tgz", Gz{}},
+	} {
+		format, _, err := Identify(context.Background(), tc.filename, nil)
+		checkErr(t, err, "identifying %s", tc.filename)
+		ca, ok := format.(CompressedArchive)
+		if !ok {
+			t.Errorf("%s: expected compressed archive, got %T", tc.filename, format)
+			continue
+		}
+		if ca.Compression.Extension() != tc.compression.Extension() || ca.Extraction.Extension() != ".tar" {
+			t.Errorf("%s: expected tar compressed with %T, got %s", tc.filename, tc.compression, format.Extension())
+		}
+	}
+}
+
+func TestIdentifyMagicBytesReplaysStream(t *testing.T) {
+	text := []byte("some text to compress")
+	for _, tc := range []struct {
+		content []byte
+		ext     string
+	}{
+		{[]byte("PK\x03\x04 and some trailing bytes"), ".zip"},
+		{[]byte("Rar!\x1a\x07\x01\x00 and some trailing bytes"), ".rar"},
+		{[]byte("7z\xbc\xaf\x27\x1c and some trailing bytes"), ".7z"},
+		{compress(t, ".gz", text, Gz{}.OpenWriter), ".gz"},
+		{compress(t, ".xz", text, Xz{}.OpenWriter), ".xz"},
+		{compress(t, ".zst", text, Zstd{}.OpenWriter), ".zst"},
+		{compress(t, ".bz2", text, Bz2{}.OpenWriter), ".bz2"},
+		{[]byte("not an archive, just some text"), ""},
+	} {
+		// hide any Seek method so the bytes have to be buffered for replay
+		stream := io.MultiReader(bytes.NewReader(tc.content))
+
+		format, replay, err := Identify(context.Background(), "", stream)
+		if tc.ext == "" {
+			if !errors.Is(err, NoMatch) {
+				t.Errorf("expected NoMatch, got format=%v err=%v", format, err)
+			}
+		} else {
+			checkErr(t, err, "identifying %s", tc.ext)
+			if format.Extension() != tc.ext {
+				t.Errorf("expected %s, got %s", tc.ext, format.Extension())
+			}
+		}
+
+		replayed, err := io.ReadAll(replay)
+		checkErr(t, err, "reading replayed stream")
+		if !bytes.Equal(replayed, tc.content) {
+			t.Errorf("%s: expected replayed stream %q, got %q", tc.ext, tc.content, replayed)
+		}
+	}
+}
+
+func TestCompressionLevels(t *testing.T) {
+	var payload []byte
+	for i := 0; i < 2000; i++ {
+		payload = append(payload, fmt.Sprintf("line %d of a fairly compressible payload, %d\n", i, i%7)...)
+	}
+	for _, tc := range []struct {
+		name      string
+		low, high Compressor
+	}{
+		{"gz", Gz{CompressionLevel: 1}, Gz{CompressionLevel: 9}},
+		{"zlib", Zlib{CompressionLevel: 1}, Zlib{CompressionLevel: 9}},
+		{"bz2", Bz2{CompressionLevel: 1}, Bz2{CompressionLevel: 9}},
+		{"xz", Xz{CompressionLevel: 1}, Xz{CompressionLevel: 9}},
+		{"zstd", Zstd{CompressionLevel: 1}, Zstd{CompressionLevel: 19}},
+		{"brotli", Brotli{Quality: 0}, Brotli{Quality: 11}},
+		{"lz4", Lz4{CompressionLevel: 0}, Lz4{CompressionLevel: 9}},
+		// out of range levels are clamped rather than rejected
+		{"gz clamped", Gz{CompressionLevel: -100}, Gz{CompressionLevel: 100}},
+		{"xz clamped", Xz{CompressionLevel: -100}, Xz{CompressionLevel: 100}},
+		{"zstd clamped", Zstd{CompressionLevel: -100}, Zstd{CompressionLevel: 100}},
+		{"brotli clamped", Brotli{Quality: -100}, Brotli{Quality: 100}},
+		{"lz4 clamped", Lz4{CompressionLevel: -100}, Lz4{CompressionLevel: 100}},
+	} {
+		low := compress(t, tc.name, payload, tc.low.OpenWriter)
+		high := compress(t, tc.name, payload, tc.high.OpenWriter)
+		if len(high) > len(low) {
+			t.Errorf("%s: expected higher level to be at least as small: %d > %d bytes", tc.name, len(high), len(low))
+		}
+	}
+}
+
+func TestIdentifyOneByteReaderLosesNothing(t *testing.T) {
+	fname, info := newTmpTextFile(t, "contents read one byte at a time")
+	defer os.Remove(fname)
+	format := CompressedArchive{Archival: Tar{}, Extraction: Tar{}, Compression: Gz{}}
+	archived := archive(t, format, fname, info)
+
+	// a non-seekable reader that returns one byte per read
+	stream := iotest.OneByteReader(bytes.NewReader(archived))
+	identified, replay, err := Identify(context.Background(), "", stream)
+	checkErr(t, err, "identifying")
+	if identified.Extension() != ".tar.gz" {
+		t.Fatalf("expected .tar.gz, got %s", identified.Extension())
+	}
+
+	var contents string
+	err = identified.(Extractor).Extract(context.Background(), iotest.OneByteReader(replay), func(_ context.Context, f FileInfo) error {
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		b, err := io.ReadAll(rc)
+		contents = string(b)
+		return err
+	})
+	checkErr(t, err, "extracting")
+	if contents != "contents read one byte at a time" {
+		t.Errorf("unexpected contents %q", contents)
+	}
+}
+
+func TestIdentifyDeep(t *testing.T) {
+	ctx := context.Background()
+	compressAll := func(data []byte, layers ...Compressor) []byte {
+		for _, comp := range layers {
+			var buf bytes.Buffer
+			checkErr(t, CompressStream(ctx, &buf, comp, bytes.NewReader(data), 0), "compressing")
+			data = buf.Bytes()
+		}
+		return data
+	}
+	file, err := FileFromReader("file.txt", 0644, strings.NewReader("contents"))
+	checkErr(t, err, "creating file")
+	tarball, err := ArchiveToBytes(ctx, Tar{}, []FileInfo{file})
+	checkErr(t, err, "creating tar")
+
+	// gzipped twice, then compressed with zstd; the name is misleading
+	input := compressAll(tarball, Gz{}, Gz{}, Zstd{})
+	layers, base, stream, err := IdentifyDeep(ctx, "backup.tar.gz", bytes.NewReader(input))
+	checkErr(t, err, "identifying")
+	var got []string
+	for _, comp := range layers {
+		got = append(got, comp.Extension())
+	}
+	if strings.Join(got, "") != ".zst.gz.gz" {
+		t.Errorf("expected layers .zst, .gz, .gz; got %v", got)
+	}
+	if _, ok := base.(Tar); !ok {
+		t.Errorf("expected tar within the layers, got %T", base)
+	}
+	if b, err := io.ReadAll(stream); err != nil || !bytes.Equal(b, input) {
+		t.Errorf("expected the returned stream to replay the whole input (err: %v)", err)
+	}
+
+	// compressed non-archive data
+	layers, base, _, err = IdentifyDeep(ctx, "", iotest.OneByteReader(bytes.NewReader(compressAll([]byte("plain text"), Gz{}, Gz{}))))
+	checkErr(t, err, "identifying compressed text")
+	if len(layers) != 2 || base != nil {
+		t.Errorf("expected 2 layers and no base format, got %d and %T", len(layers), base)
+	}
+
+	// too many layers
+	var tooDeep []Compressor
+	for range MaxCompressionLayers + 1 {
+		tooDeep = append(tooDeep, Gz{})
+	}
+	if _, _, _, err := IdentifyDeep(ctx, "", bytes.NewReader(compressAll(tarball, tooDeep...))); err == nil {
+		t.Error("expected error with too many layers of compression")
+	}
+}
+
+func TestIdentifyWithHint(t *testing.T) {
+	ctx := context.Background()
+	var gzipped bytes.Buffer
+	checkErr(t, CompressStream(ctx, &gzipped, Gz{}, strings.NewReader("some text"), 0), "compressing")
+
+	for i, test := range []struct {
+		filename, mimeType string
+		stream             io.Reader
+		expected           string
+	}{
+		// too short to identify, so the hint is trusted
+		{"", "application/zip", iotest.OneByteReader(strings.NewReader("PK\x03")), ".zip"},
+		{"download", "application/x-zip-compressed; charset=binary", strings.NewReader("PK"), ".zip"},
+		// the contents contradict the hint
+		{"", "application/zip", bytes.NewReader(gzipped.Bytes()), ".gz"},
+		// the name matches another format, but the contents match the hint
+		{"archive.tar", "application/x-7z-compressed", strings.NewReader("7z\xbc\xaf\x27\x1c and more"), ".7z"},
+		// no hint
+		{"", "", bytes.NewReader(gzipped.Bytes()), ".gz"},
+		{"", "text/plain", bytes.NewReader(gzipped.Bytes()), ".gz"},
+	} {
+		format, stream, err := IdentifyWithHint(ctx, test.filename, test.mimeType, test.stream)
+		checkErr(t, err, "test %d: identifying", i)
+		if format.Extension() != test.expected {
+			t.Errorf("test %d: expected %s, got %s", i, test.expected, format.Extension())
+		}
+		if stream == nil {
+			t.Errorf("test %d: expected stream to be returned", i)
+		}
+	}
+}
+
+func TestResettableWriter(t *testing.T) {
+	for _, comp := range []Compression{Brotli{}, Gz{}, Gz{Multithreaded: true}, Lz4{}, MinLZ{}, Sz{}, Zlib{}, Zstd{}} {
+		var first bytes.Buffer
+		wc, err := comp.OpenWriter(&first)
+		checkErr(t, err, "%s: opening writer", comp.Extension())
+		rw, ok := wc.(ResettableWriter)
+		if !ok {
+			t.Errorf("%s: expected writer to be resettable, got %T", comp.Extension(), wc)
+			continue
+		}
+		_, err = io.WriteString(rw, "first stream")
+		checkErr(t, err, "%s: writing", comp.Extension())
+		checkErr(t, rw.Close(), "%s: closing", comp.Extension())
+
+		// a reset writer compresses a new, independent stream
+		var second bytes.Buffer
+		rw.Reset(&second)
+		_, err = io.WriteString(rw, "second stream")
+		checkErr(t, err, "%s: writing after reset", comp.Extension())
+		checkErr(t, rw.Close(), "%s: closing after reset", comp.Extension())
+
+		r, err := comp.OpenReader(&second)
+		checkErr(t, err, "%s: opening reader", comp.Extension())
+		data, err := io.ReadAll(r)
+		checkErr(t, err, "%s: decompressing", comp.Extension())
+		r.Close()
+		if string(data) != "second stream" {
+			t.Errorf("%s: expected second stream, got %q", comp.Extension(), data)
+		}
+	}
+}
+
+func BenchmarkResettableWriter(b *testing.B) {
+	payload := bytes.Repeat([]byte("a small buffer to compress "), 40)
+	for _, comp := range []Compressor{Gz{}, Zstd{}} {
+		name := fmt.Sprintf("%T", comp)
+		b.Run(name+"/open", func(b *testing.B) {
+			b.ReportAllocs()
+			for range b.N {
+				w, err := comp.OpenWriter(io.Discard)
+				if err != nil {
+					b.Fatal(err)
+				}
+				w.Write(payload)
+				w.Close()
+			}
+		})
+		b.Run(name+"/reset", func(b *testing.B) {
+			b.ReportAllocs()
+			w, err := comp.OpenWriter(io.Discard)
+			if err != nil {
+				b.Fatal(err)
+			}
+			rw := w.(ResettableWriter)
+			for range b.N {
+				rw.Reset(io.Discard)
+				rw.Write(payload)
+				rw.Close()
+			}
+		})
+	}
+}
+
+// fakeCompression "compresses" by prefixing the data with its magic bytes.
+type fakeCompression struct{}
+
+var fakeMagic = []byte("\x00FAKE\x01")
+
+func (fakeCompression) OpenWriter(w io.Writer) (io.WriteCloser, error) {
+	if _, err := w.Write(fakeMagic); err != nil {
+		return nil, err
+	}
+	return nopWriteCloser{w}, nil
+}
+
+func (fakeCompression) OpenReader(r io.Reader) (io.ReadCloser, error) {
+	if _, err := io.CopyN(io.Discard, r, int64(len(fakeMagic))); err != nil {
+		return nil, err
+	}
+	return io.NopCloser(r), nil
+}
+
+func TestRegisterCompression(t *testing.T) {
+	RegisterCompression(fakeMagic, func() Compressor { return fakeCompression{} })
+	defer delete(formats, magicCompressionName(fakeMagic))
+
+	// a compressed stream is identified by its magic bytes
+	data := compress(t, "fake", []byte("some data"), fakeCompression{}.OpenWriter)
+	format, stream, err := Identify(context.Background(), "", bytes.NewReader(data))
+	checkErr(t, err, "identifying")
+	decomp, ok := format.(Decompressor)
+	if !ok {
+		t.Fatalf("expected a decompressor, got %T", format)
+	}
+	r, err := decomp.OpenReader(stream)
+	checkErr(t, err, "opening reader")
+	got, err := io.ReadAll(r)
+	checkErr(t, err, "decompressing")
+	if string(got) != "some data" {
+		t.Errorf("expected decompressed data, got %q", got)
+	}
+
+	// and so is a tarball compressed with it
+	tarball, err := io.ReadAll(newTestTar(t, &tar.Header{Name: "file.txt", Typeflag: tar.TypeReg}))
+	checkErr(t, err, "reading tarball")
+	data = compress(t, "fake", tarball, fakeCompression{}.OpenWriter)
+	format, _, err = Identify(context.Background(), "", bytes.NewReader(data))
+	checkErr(t, err, "identifying tarball")
+	if ca, ok := format.(CompressedArchive); !ok || ca.Extraction.Extension() != ".tar" {
+		t.Errorf("expected compressed tarball, got %T", format)
+	}
+}
+
+func TestSupportedFormats(t *testing.T) {
+	supported := make(map[string]FormatInfo)
+	for _, info := range SupportedFormats() {
+		supported[info.Name] = info
+	}
+	for _, expected := range []FormatInfo{
+		{Name: "zip", Extensions: []string{".zip"}, CanRead: true, CanWrite: true, MagicHex: "504b0304,504b0506"},
+		{Name: "tar", Extensions: []string{".tar"}, CanRead: true, CanWrite: true},
+		{Name: "gz", Extensions: []string{".gz"}, CanRead: true, CanWrite: true, MagicHex: "1f8b"},
+		{Name: "rar", Extensions: []string{".rar"}, CanRead: true, MagicHex: "526172211a0700,526172211a070100"},
+	} {
+		if actual := supported[expected.Name]; !reflect.DeepEqual(actual, expected) {
+			t.Errorf("expected %+v, got %+v", expected, actual)
+		}
+	}
+}
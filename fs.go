@@ -1,6 +1,7 @@
 package archives
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
@@ -740,7 +741,10 @@ func (f *ArchiveFS) Sub(dir string) (fs.FS, error) {
 // for accessing data in an "ordinary" walk of the disk, without needing to
 // first extract all the archives and use more disk space.
 //
-// Archives within archives are not supported.
+// Archives within archives are traversed the same way, up to MaxDepth
+// levels: a path like "outer.tar.gz/inner.zip/foo.txt" resolves to the
+// file foo.txt in inner.zip, which is in outer.tar.gz. Nested archives
+// are read into memory when first accessed.
 //
 // The listing of archive entries is retained for the lifetime of the
 // DeepFS value for efficiency, but this can use more memory if archives
@@ -756,11 +760,23 @@ type DeepFS struct {
 	// An optional context, mainly for cancellation.
 	Context context.Context
 
+	// The maximum number of archives a path may traverse,
+	// counting the outermost one; archives nested deeper
+	// are treated as regular files. This also stops a walk
+	// from descending forever into an archive that contains
+	// itself. Default is DefaultDeepFSMaxDepth. Set to 1 to
+	// not traverse into nested archives at all.
+	MaxDepth int
+
 	// remember archive file systems for efficiency
 	inners map[string]fs.FS
 	mu     sync.Mutex
 }
 
+// DefaultDeepFSMaxDepth is the default maximum number of archives
+// a path in a DeepFS may traverse.
+const DefaultDeepFSMaxDepth = 8
+
 func (fsys *DeepFS) Open(name string) (fs.File, error) {
 	if !fs.ValidPath(name) {
 		return nil, &fs.PathError{Op: "open", Path: name, Err: fmt.Errorf("%w: %s", fs.ErrInvalid, name)}
@@ -768,7 +784,7 @@ func (fsys *DeepFS) Open(name string) (fs.File, error) {
 	name = path.Join(filepath.ToSlash(fsys.Root), name)
 	realPath, innerPath := fsys.SplitPath(name)
 	if innerPath != "" {
-		if innerFsys := fsys.getInnerFsys(realPath); innerFsys != nil {
+		if innerFsys, innerPath, _ := fsys.resolveInner(realPath, innerPath); innerFsys != nil {
 			return innerFsys.Open(innerPath)
 		}
 	}
@@ -782,7 +798,7 @@ func (fsys *DeepFS) Stat(name string) (fs.FileInfo, error) {
 	name = path.Join(filepath.ToSlash(fsys.Root), name)
 	realPath, innerPath := fsys.SplitPath(name)
 	if innerPath != "" {
-		if innerFsys := fsys.getInnerFsys(realPath); innerFsys != nil {
+		if innerFsys, innerPath, _ := fsys.resolveInner(realPath, innerPath); innerFsys != nil {
 			return fs.Stat(innerFsys, innerPath)
 		}
 	}
@@ -800,14 +816,22 @@ func (fsys *DeepFS) ReadDir(name string) ([]fs.DirEntry, error) {
 	}
 	name = path.Join(filepath.ToSlash(fsys.Root), name)
 	realPath, innerPath := fsys.SplitPath(name)
+	var entries []fs.DirEntry
+	var err error
 	if innerPath != "" {
-		if innerFsys := fsys.getInnerFsys(realPath); innerFsys != nil {
-			return fs.ReadDir(innerFsys, innerPath)
+		innerFsys, innerPath, depth := fsys.resolveInner(realPath, innerPath)
+		if innerFsys != nil {
+			entries, err = fs.ReadDir(innerFsys, innerPath)
+			if err != nil || depth >= fsys.maxDepth() {
+				return entries, err
+			}
 		}
 	}
-	entries, err := os.ReadDir(realPath)
-	if err != nil {
-		return nil, err
+	if entries == nil {
+		entries, err = os.ReadDir(realPath)
+		if err != nil {
+			return nil, err
+		}
 	}
 	// make sure entries that appear to be archive files indicate they are a directory
 	// so the fs package will try to walk them
@@ -819,6 +843,56 @@ func (fsys *DeepFS) ReadDir(name string) ([]fs.DirEntry, error) {
 	return entries, nil
 }
 
+// resolveInner returns the file system of the innermost archive that
+// innerPath, a path within the archive at realPath, traverses into, along
+// with the remaining path within that archive and the number of archives
+// traversed. If the archive at realPath can't be read, innerFsys is nil.
+func (fsys *DeepFS) resolveInner(realPath, innerPath string) (innerFsys fs.FS, remaining string, depth int) {
+	innerFsys = fsys.getInnerFsys(realPath)
+	if innerFsys == nil {
+		return nil, "", 0
+	}
+	key := filepath.Clean(realPath)
+	for depth = 1; depth < fsys.maxDepth(); depth++ {
+		archivePath, rest := splitArchivePath(innerPath)
+		if archivePath == "" {
+			break
+		}
+		nested := fsys.getNestedFsys(key, innerFsys, archivePath)
+		if nested == nil {
+			break // not actually an archive
+		}
+		key += "/" + archivePath
+		innerFsys, innerPath = nested, rest
+	}
+	return innerFsys, innerPath, depth
+}
+
+// splitArchivePath splits p, a slash-separated path within an archive,
+// after its first component that has an archive extension. If there is
+// none, archivePath is empty. If p ends with that component, rest is ".".
+func splitArchivePath(p string) (archivePath, rest string) {
+	for i := 0; i <= len(p); i++ {
+		if i < len(p) && p[i] != '/' {
+			continue
+		}
+		if PathIsArchive(strings.TrimRight(p[:i], " ")) {
+			if i == len(p) {
+				return p, "."
+			}
+			return p[:i], p[i+1:]
+		}
+	}
+	return "", ""
+}
+
+func (fsys *DeepFS) maxDepth() int {
+	if fsys.MaxDepth > 0 {
+		return fsys.MaxDepth
+	}
+	return DefaultDeepFSMaxDepth
+}
+
 // getInnerFsys reuses "inner" file systems, because for example, archives.ArchiveFS
 // amortizes directory entries with the first call to ReadDir; if we don't reuse the
 // file systems then they have to rescan the same archive multiple times.
@@ -841,6 +915,40 @@ func (fsys *DeepFS) getInnerFsys(realPath string) fs.FS {
 	return nil
 }
 
+// getNestedFsys returns the file system of the archive at name within
+// outer, the file system of the archive identified by key; it returns
+// nil if that file is not an archive. Like getInnerFsys, it reuses the
+// file systems. Since files in archives generally can't be read at
+// random, the nested archive is read into memory.
+func (fsys *DeepFS) getNestedFsys(key string, outer fs.FS, name string) fs.FS {
+	key += "/" + name
+
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	if innerFsys, ok := fsys.inners[key]; ok {
+		return innerFsys
+	}
+	f, err := outer.Open(name)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil
+	}
+	innerFsys, err := FileSystem(fsys.context(), path.Base(name), bytes.NewReader(data))
+	if err != nil {
+		return nil
+	}
+	if _, ok := innerFsys.(*ArchiveFS); !ok {
+		return nil
+	}
+	fsys.inners[key] = innerFsys
+	return innerFsys
+}
+
 // SplitPath splits a file path into the "real" path and the "inner" path components,
 // where the split point is the first extension of an archive filetype like ".zip" or
 // ".tar.gz" that occurs in the path.
@@ -931,10 +1039,13 @@ var archiveExtensions = []string{
 	".tar.bz2",
 	".tar.zst",
 	".tar.lz4",
+	".tlz4",
 	".tar.xz",
 	".tar.sz",
 	".tar.s2",
 	".tar.lz",
+	".tar.br",
+	".cpio",
 }
 
 // PathIsArchive returns true if the path ends with an archive file (i.e.
@@ -360,3 +360,65 @@ func TestFileSystem(t *testing.T) {
 		checkFS(t, fsys)
 	})
 }
+
+func TestDeepFS_NestedArchives(t *testing.T) {
+	ctx := context.Background()
+	archiveBytes := func(format Archiver, name string, contents []byte) []byte {
+		file, err := FileFromReader(name, 0644, bytes.NewReader(contents))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ArchiveToBytes(ctx, format, []FileInfo{file})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+
+	// outer.tar.gz/middle.zip/inner.tar/foo.txt
+	inner := archiveBytes(Tar{}, "foo.txt", []byte("hello from three levels down"))
+	middle := archiveBytes(Zip{}, "inner.tar", inner)
+	outer := archiveBytes(CompressedArchive{Compression: Gz{}, Archival: Tar{}}, "middle.zip", middle)
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "outer.tar.gz"), outer, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fsys := &DeepFS{Root: dir, Context: ctx}
+	b, err := fs.ReadFile(fsys, "outer.tar.gz/middle.zip/inner.tar/foo.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "hello from three levels down" {
+		t.Errorf("unexpected contents: %q", b)
+	}
+
+	var walked []string
+	err = fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		walked = append(walked, path)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{".", "outer.tar.gz", "outer.tar.gz/middle.zip", "outer.tar.gz/middle.zip/inner.tar", "outer.tar.gz/middle.zip/inner.tar/foo.txt"}
+	if !reflect.DeepEqual(walked, expected) {
+		t.Errorf("expected walk %q, got %q", expected, walked)
+	}
+
+	// beyond the maximum depth, nested archives are regular files
+	shallow := &DeepFS{Root: dir, Context: ctx, MaxDepth: 2}
+	if _, err := fs.ReadFile(shallow, "outer.tar.gz/middle.zip/inner.tar/foo.txt"); err == nil {
+		t.Error("expected error reading file beyond maximum depth")
+	}
+	b, err = fs.ReadFile(shallow, "outer.tar.gz/middle.zip/inner.tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, inner) {
+		t.Error("expected archive beyond maximum depth to be read as a regular file")
+	}
+}
@@ -14,14 +14,22 @@ func init() {
 	RegisterFormat(Gz{})
 }
 
+// DefaultGzLevel is the gzip compression level used
+// when Gz.CompressionLevel is 0.
+const DefaultGzLevel = 6
+
 // Gz facilitates gzip compression.
 type Gz struct {
 	// Gzip compression level. See https://pkg.go.dev/compress/flate#pkg-constants
-	// for some predefined constants. If 0, DefaultCompression is assumed rather
-	// than no compression.
+	// for some predefined constants. If 0 or DefaultCompression (-1),
+	// DefaultGzLevel is used rather than no compression. HuffmanOnly (-2),
+	// and any lower level, selects Huffman-only encoding; levels above
+	// BestCompression are clamped to it.
 	CompressionLevel int
 
 	// DisableMultistream controls whether the reader supports multistream files.
+	// By default, concatenated gzip members (as made by `cat a.gz b.gz`) are
+	// read to the end as one stream; if true, reading stops after the first.
 	// See https://pkg.go.dev/compress/gzip#example-Reader.Multistream
 	DisableMultistream bool
 
@@ -30,8 +38,9 @@ type Gz struct {
 	Multithreaded bool
 }
 
-func (Gz) Extension() string { return ".gz" }
-func (Gz) MediaType() string { return "application/gzip" }
+func (Gz) Extension() string      { return ".gz" }
+func (Gz) MediaType() string      { return "application/gzip" }
+func (Gz) magicNumbers() [][]byte { return [][]byte{gzHeader} }
 
 func (gz Gz) Match(_ context.Context, filename string, stream io.Reader) (MatchResult, error) {
 	var mr MatchResult
@@ -55,9 +64,9 @@ func (gz Gz) OpenWriter(w io.Writer) (io.WriteCloser, error) {
 	// assume default compression level if 0, rather than no
 	// compression, since no compression on a gzipped file
 	// doesn't make any sense in our use cases
-	level := gz.CompressionLevel
-	if level == 0 {
-		level = gzip.DefaultCompression
+	level := max(gzip.HuffmanOnly, min(gz.CompressionLevel, gzip.BestCompression))
+	if level == 0 || level == gzip.DefaultCompression {
+		level = DefaultGzLevel
 	}
 
 	var wc io.WriteCloser
@@ -0,0 +1,49 @@
+package archives
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestGz_Multistream(t *testing.T) {
+	first, second := []byte("first member\n"), bytes.Repeat([]byte("second member\n"), 1000)
+	// as with `cat a.gz b.gz`
+	concatenated := append(compress(t, ".gz", first, Gz{}.OpenWriter), compress(t, ".gz", second, Gz{}.OpenWriter)...)
+
+	for _, tc := range []struct {
+		name   string
+		gz     Gz
+		expect []byte
+	}{
+		{"default", Gz{}, append(bytes.Clone(first), second...)},
+		{"multithreaded", Gz{Multithreaded: true}, append(bytes.Clone(first), second...)},
+		{"multistream disabled", Gz{DisableMultistream: true}, first},
+		{"multithreaded with multistream disabled", Gz{Multithreaded: true, DisableMultistream: true}, first},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := tc.gz.OpenReader(bytes.NewReader(concatenated))
+			checkErr(t, err, "opening reader")
+			defer r.Close()
+			decompressed, err := io.ReadAll(r)
+			checkErr(t, err, "decompressing")
+			if !bytes.Equal(decompressed, tc.expect) {
+				t.Errorf("expected %d bytes, got %d", len(tc.expect), len(decompressed))
+			}
+		})
+	}
+}
+
+func TestGz_DefaultLevel(t *testing.T) {
+	payload := bytes.Repeat([]byte("the default level is the documented constant\n"), 1000)
+	expected := compress(t, ".gz", payload, Gz{CompressionLevel: DefaultGzLevel}.OpenWriter)
+	for _, level := range []int{0, -1} {
+		if actual := compress(t, ".gz", payload, Gz{CompressionLevel: level}.OpenWriter); !bytes.Equal(actual, expected) {
+			t.Errorf("level %d: expected the output of level %d", level, DefaultGzLevel)
+		}
+	}
+	expected = compress(t, ".zz", payload, Zlib{CompressionLevel: DefaultZlibLevel}.OpenWriter)
+	if actual := compress(t, ".zz", payload, Zlib{}.OpenWriter); !bytes.Equal(actual, expected) {
+		t.Errorf("zlib: expected the output of level %d", DefaultZlibLevel)
+	}
+}
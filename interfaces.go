@@ -3,6 +3,7 @@ package archives
 import (
 	"context"
 	"io"
+	"io/fs"
 )
 
 // Format represents a way of getting data out of something else.
@@ -55,6 +56,18 @@ type Compressor interface {
 	OpenWriter(w io.Writer) (io.WriteCloser, error)
 }
 
+// ResettableWriter is implemented by the writers returned by the
+// OpenWriter methods of Brotli, Gz, Lz4, MinLZ, Sz, Zlib, and Zstd.
+// Reset discards any state and makes the writer compress a new stream
+// to w, with the same options, reusing its buffers and encoder rather
+// than allocating new ones, which is much cheaper when compressing
+// many small streams. A writer is not safe for concurrent use, so
+// one shouldn't be shared between goroutines without synchronization.
+type ResettableWriter interface {
+	io.WriteCloser
+	Reset(w io.Writer)
+}
+
 // Decompressor can decompress data by wrapping a reader.
 type Decompressor interface {
 	// OpenReader wraps r with a new reader that decompresses what is read.
@@ -106,6 +119,30 @@ type Extractor interface {
 	Extract(ctx context.Context, archive io.Reader, handleFile FileHandler) error
 }
 
+// SingleExtractor can extract one file from an archive, stopping as soon
+// as it is found; formats with an index go straight to the file's entry.
+type SingleExtractor interface {
+	// ExtractOne returns the contents and info of the file with the given
+	// name in archive, which is compared to entry names after they are
+	// decoded to UTF-8 and cleaned. If there is no such file, the error
+	// wraps fs.ErrNotExist. The returned reader must be closed when done,
+	// and archive must not be read from until then. The readers returned
+	// by the formats in this package implement io.WriterTo.
+	//
+	// Context cancellation must be honored.
+	ExtractOne(ctx context.Context, archive io.Reader, name string) (io.ReadCloser, fs.FileInfo, error)
+}
+
+// Walker can list the files in an archive without extracting them.
+type Walker interface {
+	// Walk calls fn for each entry in archive, without reading the
+	// contents of the files unless fn opens them. If fn returns an
+	// error, the walk stops and the error is returned.
+	//
+	// Context cancellation must be honored.
+	Walk(ctx context.Context, archive io.Reader, fn func(info FileInfo) error) error
+}
+
 // Inserter can insert files into an existing archive.
 // EXPERIMENTAL: Subject to change.
 type Inserter interface {
@@ -13,13 +13,22 @@ func init() {
 	RegisterFormat(Lz4{})
 }
 
+// DefaultLz4Level is the lz4 compression level used
+// when Lz4.CompressionLevel is 0, which is the fast mode.
+const DefaultLz4Level = 0
+
 // Lz4 facilitates LZ4 compression.
 type Lz4 struct {
+	// Lz4 compression level, from 1 (fastest high compression
+	// level) to 9 (best). If 0, the fast mode is used, which is
+	// the default. The lz4.CompressionLevel constants may also
+	// be used. Levels out of range are clamped.
 	CompressionLevel int
 }
 
-func (Lz4) Extension() string { return ".lz4" }
-func (Lz4) MediaType() string { return "application/x-lz4" }
+func (Lz4) Extension() string      { return ".lz4" }
+func (Lz4) MediaType() string      { return "application/x-lz4" }
+func (Lz4) magicNumbers() [][]byte { return [][]byte{lz4Header} }
 
 func (lz Lz4) Match(_ context.Context, filename string, stream io.Reader) (MatchResult, error) {
 	var mr MatchResult
@@ -42,7 +51,7 @@ func (lz Lz4) Match(_ context.Context, filename string, stream io.Reader) (Match
 func (lz Lz4) OpenWriter(w io.Writer) (io.WriteCloser, error) {
 	lzw := lz4.NewWriter(w)
 	options := []lz4.Option{
-		lz4.CompressionLevelOption(lz4.CompressionLevel(lz.CompressionLevel)),
+		lz4.CompressionLevelOption(lz4Level(lz.CompressionLevel)),
 	}
 	if err := lzw.Apply(options...); err != nil {
 		return nil, err
@@ -55,3 +64,16 @@ func (Lz4) OpenReader(r io.Reader) (io.ReadCloser, error) {
 }
 
 var lz4Header = []byte{0x04, 0x22, 0x4d, 0x18}
+
+// lz4Level maps level, from 0 to 9, to the library's compression
+// level; values that already are one of its levels are kept as-is.
+func lz4Level(level int) lz4.CompressionLevel {
+	if level >= int(lz4.Level1) && level <= int(lz4.Level9) && level&(level-1) == 0 {
+		return lz4.CompressionLevel(level)
+	}
+	level = max(0, min(level, 9))
+	if level == 0 {
+		return lz4.Fast
+	}
+	return lz4.CompressionLevel(1 << (8 + level))
+}
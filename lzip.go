@@ -17,8 +17,9 @@ func init() {
 // Lzip facilitates lzip compression.
 type Lzip struct{}
 
-func (Lzip) Extension() string { return ".lz" }
-func (Lzip) MediaType() string { return "application/x-lzip" }
+func (Lzip) Extension() string      { return ".lz" }
+func (Lzip) MediaType() string      { return "application/x-lzip" }
+func (Lzip) magicNumbers() [][]byte { return [][]byte{lzipHeader} }
 
 func (lz Lzip) Match(_ context.Context, filename string, stream io.Reader) (MatchResult, error) {
 	var mr MatchResult
@@ -0,0 +1,63 @@
+package archives
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestLzip_DecompressReferenceMember(t *testing.T) {
+	// written by the lzip tool; from the test suite of lzd, the
+	// reference lzip decompressor
+	compressed, err := os.ReadFile("testdata/fox.lz")
+	checkErr(t, err, "reading test file")
+
+	format, stream, err := Identify(context.Background(), "", bytes.NewReader(compressed))
+	checkErr(t, err, "identifying lzip stream")
+	if _, ok := format.(Lzip); !ok {
+		t.Fatalf("expected Lzip, got %T", format)
+	}
+
+	r, err := format.(Decompressor).OpenReader(stream)
+	checkErr(t, err, "opening reader")
+	defer r.Close()
+	decompressed, err := io.ReadAll(r)
+	checkErr(t, err, "decompressing")
+	if expected := "The quick brown fox jumps over the lazy dog.\n"; string(decompressed) != expected {
+		t.Errorf("expected %q, got %q", expected, decompressed)
+	}
+}
+
+func TestLzip_TarLz(t *testing.T) {
+	file, err := FileFromReader("dir/file.txt", 0644, strings.NewReader("compressed with lzip"))
+	checkErr(t, err, "creating file")
+	archived, err := ArchiveToBytes(context.Background(), CompressedArchive{Archival: Tar{}, Compression: Lzip{}}, []FileInfo{file})
+	checkErr(t, err, "archiving")
+	if !bytes.HasPrefix(archived, lzipHeader) {
+		t.Fatalf("expected lzip header, got %q", archived[:4])
+	}
+
+	format, stream, err := Identify(context.Background(), "test.tar.lz", bytes.NewReader(archived))
+	checkErr(t, err, "identifying")
+	if ext := format.Extension(); ext != ".tar.lz" {
+		t.Fatalf("expected .tar.lz, got %s", ext)
+	}
+	var contents string
+	err = format.(Extractor).Extract(context.Background(), stream, func(_ context.Context, f FileInfo) error {
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		b, err := io.ReadAll(rc)
+		contents = string(b)
+		return err
+	})
+	checkErr(t, err, "extracting")
+	if contents != "compressed with lzip" {
+		t.Errorf("unexpected contents %q", contents)
+	}
+}
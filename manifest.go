@@ -0,0 +1,154 @@
+package archives
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sync"
+
+	"github.com/bodgit/sevenzip"
+	"github.com/klauspost/compress/zip"
+)
+
+// Manifest records which entries of an archive have been extracted,
+// in a file of JSON lines, one appended for each entry as it is
+// extracted, so that an interrupted extraction can be resumed without
+// extracting them again. Entries are identified by their name, size,
+// and the CRC-32 of their contents where the format records it (zip
+// and 7-Zip), so an entry that changed is extracted again. A Manifest
+// is safe for concurrent use; call Close when done with it.
+type Manifest struct {
+	path string
+
+	mu      sync.Mutex
+	entries map[string]manifestEntry
+	file    *os.File // opened to append on the first record
+}
+
+type manifestEntry struct {
+	Size  int64  `json:"size"`
+	CRC32 uint32 `json:"crc32,omitempty"`
+}
+
+// manifestRecord is a line of the manifest file.
+type manifestRecord struct {
+	Name string `json:"name"`
+	manifestEntry
+}
+
+// ResumeFrom loads the progress of a previous extraction from the
+// manifest file at manifestPath, or starts with no progress if the
+// file doesn't exist yet. Progress is saved to the same file. A last
+// line cut short, as by a crash while it was written, is discarded.
+func ResumeFrom(manifestPath string) (*Manifest, error) {
+	m := &Manifest{path: manifestPath, entries: make(map[string]manifestEntry)}
+	data, err := os.ReadFile(manifestPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// drop an incomplete last line, so new records start on a line
+	// of their own
+	if complete := bytes.LastIndexByte(data, '\n') + 1; complete < len(data) {
+		if err := os.Truncate(manifestPath, int64(complete)); err != nil {
+			return nil, fmt.Errorf("truncating manifest %s: %w", manifestPath, err)
+		}
+		data = data[:complete]
+	}
+	for i, line := range bytes.Split(bytes.TrimSuffix(data, []byte("\n")), []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		var rec manifestRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return nil, fmt.Errorf("reading manifest %s: line %d: %w", manifestPath, i+1, err)
+		}
+		m.entries[rec.Name] = rec.manifestEntry // the last record of a name wins
+	}
+	return m, nil
+}
+
+// Handler returns a FileHandler that calls handleFile for each entry
+// that hasn't already been extracted, and records the entries for
+// which it returns nil as extracted. Entries already extracted are
+// skipped.
+func (m *Manifest) Handler(handleFile FileHandler) FileHandler {
+	return func(ctx context.Context, f FileInfo) error {
+		entry := newManifestEntry(f)
+		if m.done(f.NameInArchive, entry) {
+			return nil
+		}
+		if err := handleFile(ctx, f); err != nil {
+			return err
+		}
+		return m.record(f.NameInArchive, entry)
+	}
+}
+
+// done reports whether the entry with the given name and identity
+// is recorded as extracted.
+func (m *Manifest) done(name string, entry manifestEntry) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	done, ok := m.entries[name]
+	return ok && done == entry
+}
+
+// record records the entry as extracted by appending it to the
+// manifest file.
+func (m *Manifest) record(name string, entry manifestEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries[name] = entry
+	line, err := json.Marshal(manifestRecord{Name: name, manifestEntry: entry})
+	if err != nil {
+		return err
+	}
+	if m.file == nil {
+		m.file, err = os.OpenFile(m.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return fmt.Errorf("saving manifest: %w", err)
+		}
+	}
+	if _, err := m.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("saving manifest: %w", err)
+	}
+	return nil
+}
+
+// Close flushes the manifest file to stable storage and closes it.
+func (m *Manifest) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.file == nil {
+		return nil
+	}
+	err := m.file.Sync()
+	if cerr := m.file.Close(); err == nil {
+		err = cerr
+	}
+	m.file = nil
+	if err != nil {
+		return fmt.Errorf("saving manifest: %w", err)
+	}
+	return nil
+}
+
+// newManifestEntry returns the identity of f recorded in a manifest.
+func newManifestEntry(f FileInfo) manifestEntry {
+	entry := manifestEntry{Size: f.Size()}
+	switch hdr := f.Header.(type) {
+	case zip.FileHeader:
+		entry.CRC32 = hdr.CRC32
+	case sevenzip.FileHeader:
+		entry.CRC32 = hdr.CRC32
+	}
+	return entry
+}
@@ -0,0 +1,81 @@
+package archives
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestManifest_Resume(t *testing.T) {
+	var hdrs []*tar.Header
+	for i := range 5 {
+		hdrs = append(hdrs, &tar.Header{Name: fmt.Sprintf("file%d.txt", i), Typeflag: tar.TypeReg})
+	}
+	manifestPath := filepath.Join(t.TempDir(), "manifest.json")
+
+	// interrupted after extracting two files
+	m, err := ResumeFrom(manifestPath)
+	checkErr(t, err, "loading new manifest")
+	interrupted := errors.New("interrupted")
+	var extracted []string
+	err = Tar{}.Extract(context.Background(), newTestTar(t, hdrs...), m.Handler(func(_ context.Context, f FileInfo) error {
+		if len(extracted) == 2 {
+			return interrupted
+		}
+		extracted = append(extracted, f.NameInArchive)
+		return nil
+	}))
+	if !errors.Is(err, interrupted) {
+		t.Fatalf("expected interruption, got %v", err)
+	}
+	checkErr(t, m.Close(), "closing manifest")
+
+	// as if a crash cut the next record short
+	f, err := os.OpenFile(manifestPath, os.O_WRONLY|os.O_APPEND, 0)
+	checkErr(t, err, "opening manifest")
+	_, err = f.WriteString(`{"name":"file2.t`)
+	checkErr(t, err, "writing partial record")
+	checkErr(t, f.Close(), "closing manifest file")
+
+	// resuming only extracts the rest
+	m, err = ResumeFrom(manifestPath)
+	checkErr(t, err, "loading manifest")
+	extracted = nil
+	err = Tar{}.Extract(context.Background(), newTestTar(t, hdrs...), m.Handler(func(_ context.Context, f FileInfo) error {
+		extracted = append(extracted, f.NameInArchive)
+		return nil
+	}))
+	checkErr(t, err, "resuming")
+	checkErr(t, m.Close(), "closing manifest")
+	if expected := []string{"file2.txt", "file3.txt", "file4.txt"}; !reflect.DeepEqual(extracted, expected) {
+		t.Errorf("expected to extract %q, got %q", expected, extracted)
+	}
+
+	// a changed entry is extracted again
+	changed := &tar.Header{Name: "file0.txt", Typeflag: tar.TypeSymlink, Linkname: "elsewhere"}
+	m, err = ResumeFrom(manifestPath)
+	checkErr(t, err, "loading manifest")
+	extracted = nil
+	err = Tar{}.Extract(context.Background(), newTestTar(t, changed), m.Handler(func(_ context.Context, f FileInfo) error {
+		extracted = append(extracted, f.NameInArchive)
+		return nil
+	}))
+	checkErr(t, err, "extracting changed entry")
+	checkErr(t, m.Close(), "closing manifest")
+	if expected := []string{"file0.txt"}; !reflect.DeepEqual(extracted, expected) {
+		t.Errorf("expected to extract changed %q, got %q", expected, extracted)
+	}
+
+	// records are only ever appended, one line each
+	data, err := os.ReadFile(manifestPath)
+	checkErr(t, err, "reading manifest")
+	if lines := strings.Count(string(data), "\n"); lines != 6 {
+		t.Errorf("expected 6 records, got %d:\n%s", lines, data)
+	}
+}
@@ -20,8 +20,9 @@ func init() {
 // https://blog.min.io/minlz-compression-algorithm/.
 type MinLZ struct{}
 
-func (MinLZ) Extension() string { return ".mz" }
-func (MinLZ) MediaType() string { return "application/x-minlz-compressed" }
+func (MinLZ) Extension() string      { return ".mz" }
+func (MinLZ) MediaType() string      { return "application/x-minlz-compressed" }
+func (MinLZ) magicNumbers() [][]byte { return [][]byte{mzHeader} }
 
 func (mz MinLZ) Match(_ context.Context, filename string, stream io.Reader) (MatchResult, error) {
 	var mr MatchResult
@@ -12,8 +12,11 @@ import (
 	"path"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/nwaples/rardecode/v2"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/unicode/norm"
 )
 
 func init() {
@@ -29,7 +32,8 @@ type rarReader interface {
 type Rar struct {
 	// If true, errors encountered during reading or writing
 	// a file within an archive will be logged and the
-	// operation will continue on remaining files.
+	// operation will continue on remaining files. Extract
+	// then returns EntryErrors listing the files that failed.
 	ContinueOnError bool
 
 	// Password to open archives.
@@ -39,7 +43,10 @@ type Rar struct {
 	// the named file is extracted (rather than any io.Reader that
 	// may be passed to Extract). If the archive is a multi-volume
 	// archive, this name will also be used by the decoder to derive
-	// the filename of the next volume in the volume set.
+	// the filename of the next volume in the volume set. If a
+	// volume is missing, reading the file that continues into it
+	// fails with an error that names the volume and wraps
+	// fs.ErrNotExist.
 	Name string
 
 	// FS is an fs.FS exposing the files of the archive. Unless Name is
@@ -51,10 +58,52 @@ type Rar struct {
 	// Typically this should be a DirFS pointing at the directory containing
 	// the volumes of the archive.
 	FS fs.FS
+
+	// If set, filenames that are not stored as Unicode are always
+	// decoded with this encoding instead of being auto-detected.
+	// An error is returned if a filename can't be decoded. RAR5
+	// archives always store Unicode names, so this only affects
+	// older archives.
+	FilenameEncoding encoding.Encoding
+
+	// Globs selecting the entries to extract; see the package doc.
+	IncludePatterns []string
+	ExcludePatterns []string
+
+	// If true, macOS metadata is skipped; see the package doc.
+	SkipMacMetadata bool
+
+	// If true, names are normalized to NFC; see the package doc.
+	NormalizeNFC bool
+
+	// If set, reports reading progress; see the package doc.
+	OnProgress func(entryName string, bytesDone, bytesTotal int64)
+
+	// If set, wraps the contents of files; see the package doc.
+	Transform func(name string, r io.Reader) (io.Reader, error)
+
+	// The size in bytes of the buffer through which the contents
+	// of files are copied when extracting with ExtractToFS. Larger
+	// buffers can be faster on fast storage. If not positive, a
+	// default of 32 KiB is used.
+	CopyBufferSize int
+
+	// Limits on the bytes extracted; see the package doc.
+	MaxDecompressedSize int64
+	MaxEntrySize        int64
+
+	// If positive, the most entries allowed; see the package doc.
+	MaxEntries int
+
+	// If true, checksums are verified; see the package doc.
+	VerifyChecksums bool
 }
 
-func (Rar) Extension() string { return ".rar" }
-func (Rar) MediaType() string { return "application/vnd.rar" }
+func (Rar) Extension() string      { return ".rar" }
+func (Rar) MediaType() string      { return "application/vnd.rar" }
+func (Rar) magicNumbers() [][]byte { return [][]byte{rarHeaderV1_5, rarHeaderV5_0} }
+
+func (r Rar) copyBufSize() int { return r.CopyBufferSize }
 
 func (r Rar) Match(_ context.Context, filename string, stream io.Reader) (MatchResult, error) {
 	var mr MatchResult
@@ -77,6 +126,17 @@ func (r Rar) Match(_ context.Context, filename string, stream io.Reader) (MatchR
 
 	mr.ByStream = matchedV1_5 || matchedV5_0
 
+	// self-extracting archives start with an executable stub,
+	// which the archive follows within the first MiB or so
+	if !mr.ByStream && (bytes.HasPrefix(buf, exeHeaderPE) || bytes.HasPrefix(buf, exeHeaderELF)) {
+		rest, err := readAtMost(stream, rarMaxSFXSize-len(buf))
+		if err != nil {
+			return mr, err
+		}
+		buf = append(buf, rest...)
+		mr.ByStream = bytes.Contains(buf, rarHeaderV1_5) || bytes.Contains(buf, rarHeaderV5_0)
+	}
+
 	return mr, nil
 }
 
@@ -114,6 +174,15 @@ func (r Rar) Extract(ctx context.Context, sourceArchive io.Reader, handleFile Fi
 
 	// important to initialize to non-nil, empty value due to how fileIsIncluded works
 	skipDirs := skipList{}
+	limits := newExtractLimits(r.MaxDecompressedSize, r.MaxEntrySize, r.MaxEntries)
+	filter, err := newPatternFilter(r.IncludePatterns, r.ExcludePatterns)
+	if err != nil {
+		return err
+	}
+	filter.skipMacMetadata = r.SkipMacMetadata
+
+	var failed EntryErrors
+	var names rarNames
 
 	for {
 		if err := ctx.Err(); err != nil {
@@ -126,11 +195,28 @@ func (r Rar) Extract(ctx context.Context, sourceArchive io.Reader, handleFile Fi
 		}
 		if err != nil {
 			if r.ContinueOnError {
+				// the rar reader can't go on past a bad header
 				log.Printf("[ERROR] Advancing to next file in rar archive: %v", err)
-				continue
+				failed = append(failed, EntryError{Err: fmt.Errorf("advancing to next file: %w", err)})
+				break
 			}
 			return err
 		}
+		if err := limits.countEntry(); err != nil {
+			return err
+		}
+		rawName := []byte(hdr.Name)
+		var nameEnc encoding.Encoding
+		hdr.Name, nameEnc, err = r.decodeName(hdr.Name, &names)
+		if err != nil {
+			return fmt.Errorf("decoding filename: %w", err)
+		}
+		if r.NormalizeNFC {
+			hdr.Name = norm.NFC.String(hdr.Name)
+		}
+		if !filter.includes(hdr.Name) {
+			continue
+		}
 		if fileIsIncluded(skipDirs, hdr.Name) {
 			continue
 		}
@@ -140,10 +226,21 @@ func (r Rar) Extract(ctx context.Context, sourceArchive io.Reader, handleFile Fi
 			FileInfo:      info,
 			Header:        hdr,
 			NameInArchive: hdr.Name,
+			RawName:       rawName,
+			NameEncoding:  nameEnc,
 			Open: func() (fs.File, error) {
 				return fileInArchive{io.NopCloser(rr), info}, nil
 			},
 		}
+		size := hdr.UnPackedSize
+		if hdr.UnKnownSize {
+			size = -1
+		}
+		if r.VerifyChecksums {
+			file = verifyChecksum(file, nil, 0, rardecode.ErrBadFileChecksum)
+		}
+		file = reportProgress(limits.apply(file), size, r.OnProgress)
+		file = transformContents(file, r.Transform)
 
 		err = handleFile(ctx, file)
 		if errors.Is(err, fs.SkipAll) {
@@ -151,13 +248,76 @@ func (r Rar) Extract(ctx context.Context, sourceArchive io.Reader, handleFile Fi
 		} else if errors.Is(err, fs.SkipDir) && file.IsDir() {
 			skipDirs.add(hdr.Name)
 		} else if err != nil {
+			if r.ContinueOnError {
+				log.Printf("[ERROR] %s: %v", hdr.Name, err)
+				failed = append(failed, EntryError{Name: hdr.Name, Err: err})
+				continue
+			}
 			return fmt.Errorf("handling file: %s: %w", hdr.Name, err)
 		}
 	}
 
-	return nil
+	return failed.asError()
+}
+
+// Walk calls fn for each file in the archive, in order, without
+// returning their contents (though the contents of solid archives
+// must still be decompressed to get to the next file). If fn returns
+// an error, the walk stops and the error is returned; fs.SkipDir and
+// fs.SkipAll work as they do for Extract.
+func (r Rar) Walk(ctx context.Context, sourceArchive io.Reader, fn func(info FileInfo) error) error {
+	r.ContinueOnError = false
+	return walkArchive(ctx, r, sourceArchive, fn)
+}
+
+// decodeName decodes a filename from a RAR header into UTF-8, returning
+// the encoding it was decoded from, or nil if it wasn't. The decoder
+// already converts names stored as Unicode (as in all RAR5 archives) to
+// UTF-8, so only names that aren't valid UTF-8 are decoded, either with
+// r.FilenameEncoding or else with the encoding of names, which is
+// detected from the names seen so far, since the archive is read as a
+// stream, and reused for the rest of the archive once found.
+func (r Rar) decodeName(name string, names *rarNames) (string, encoding.Encoding, error) {
+	if utf8.ValidString(name) {
+		return name, nil, nil
+	}
+	if r.FilenameEncoding != nil {
+		decoded, err := DecodeFilename([]byte(name), r.FilenameEncoding)
+		if err != nil {
+			return "", nil, fmt.Errorf("%q: %w", name, err)
+		}
+		return decoded, r.FilenameEncoding, nil
+	}
+	if names.decoder != nil {
+		decoded, enc := names.decoder.decode([]byte(name), false)
+		return decoded, enc, nil
+	}
+	// an earlier name may be what spoils the sample, so the name is
+	// tried alone too; an encoding is kept once one decodes a name
+	names.sample = append(names.sample, []byte(name))
+	for _, sample := range [][][]byte{names.sample, {[]byte(name)}} {
+		decoder := NewFilenameDecoder(sample)
+		if decoded, enc := decoder.decode([]byte(name), false); enc != nil {
+			names.decoder, names.sample = decoder, nil
+			return decoded, enc, nil
+		}
+	}
+	if len(names.sample) >= rarMaxNameSample {
+		names.decoder, names.sample = &FilenameDecoder{}, nil
+	}
+	return name, nil, nil
+}
+
+// rarNames is what decodeName knows of the encoding of the names of
+// an archive that aren't valid UTF-8.
+type rarNames struct {
+	decoder *FilenameDecoder // once an encoding is found, or given up on
+	sample  [][]byte         // the names seen until then
 }
 
+// the most names that the encoding of names is detected from
+const rarMaxNameSample = 64
+
 // rarFileInfo satisfies the fs.FileInfo interface for RAR entries.
 type rarFileInfo struct {
 	fh *rardecode.FileHeader
@@ -175,5 +335,18 @@ var (
 	rarHeaderV5_0 = []byte("Rar!\x1a\x07\x01\x00") // v5.0
 )
 
-// Interface guard
-var _ Extractor = Rar{}
+// how far into a self-extracting archive its header is searched
+// for, as by the RAR decoder
+const rarMaxSFXSize = 1 << 20
+
+// magic numbers at the beginning of executables
+var (
+	exeHeaderPE  = []byte("MZ")
+	exeHeaderELF = []byte("\x7fELF")
+)
+
+// Interface guards
+var (
+	_ Extractor = Rar{}
+	_ Walker    = Rar{}
+)
@@ -4,8 +4,17 @@ import (
 	"context"
 	"crypto/sha1"
 	"encoding/hex"
+	"errors"
 	"io"
+	"io/fs"
+	"os"
+	"strings"
 	"testing"
+	"testing/fstest"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/simplifiedchinese"
 )
 
 func TestRarExtractMultiVolume(t *testing.T) {
@@ -38,3 +47,78 @@ func TestRarExtractMultiVolume(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestRarExtractMissingVolume(t *testing.T) {
+	first, err := os.ReadFile("testdata/test.part01.rar")
+	checkErr(t, err, "reading first volume")
+	rar := Rar{
+		Name: "test.part01.rar",
+		FS:   fstest.MapFS{"test.part01.rar": {Data: first}},
+	}
+
+	err = rar.Extract(context.Background(), nil, func(_ context.Context, info FileInfo) error {
+		f, err := info.Open()
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(io.Discard, f)
+		return err
+	})
+	if !errors.Is(err, fs.ErrNotExist) || !strings.Contains(err.Error(), "test.part02.rar") {
+		t.Errorf("expected error naming the missing volume, got %v", err)
+	}
+}
+
+func TestRarDecodeName(t *testing.T) {
+	sjis, err := japanese.ShiftJIS.NewEncoder().String("日本語のファイル名.txt")
+	checkErr(t, err, "encoding name")
+
+	for i, tc := range []struct {
+		rar    Rar
+		input  string
+		expect string
+		enc    encoding.Encoding
+		err    bool
+	}{
+		// Unicode names are never decoded, even with an override
+		{rar: Rar{FilenameEncoding: simplifiedchinese.GBK}, input: "日本語.txt", expect: "日本語.txt"},
+		{rar: Rar{}, input: sjis, expect: "日本語のファイル名.txt", enc: japanese.ShiftJIS},
+		{rar: Rar{FilenameEncoding: japanese.ShiftJIS}, input: sjis, expect: "日本語のファイル名.txt", enc: japanese.ShiftJIS},
+		{rar: Rar{FilenameEncoding: japanese.ShiftJIS}, input: "\xa0bad.txt", err: true},
+	} {
+		var names rarNames
+		actual, enc, err := tc.rar.decodeName(tc.input, &names)
+		if tc.err {
+			if err == nil {
+				t.Errorf("Test %d: expected error, got %q", i, actual)
+			}
+			continue
+		}
+		checkErr(t, err, "test %d: decoding name", i)
+		if actual != tc.expect {
+			t.Errorf("Test %d: expected %q, got %q", i, tc.expect, actual)
+		}
+		if enc != tc.enc {
+			t.Errorf("Test %d: expected encoding %v, got %v", i, tc.enc, enc)
+		}
+	}
+
+	// names are sampled until their encoding can be detected
+	defer func(enc encoding.Encoding) { DefaultFallbackEncoding = enc }(DefaultFallbackEncoding)
+	DefaultFallbackEncoding = nil
+	var names rarNames
+	actual, enc, err := Rar{}.decodeName("\xff", &names)
+	checkErr(t, err, "decoding undetectable name")
+	if actual != "\xff" || enc != nil {
+		t.Errorf("expected undetectable name to be left as is, got %q (encoding %v)", actual, enc)
+	}
+	actual, enc, err = Rar{}.decodeName(sjis, &names)
+	checkErr(t, err, "decoding name after undetectable one")
+	if actual != "日本語のファイル名.txt" || enc != japanese.ShiftJIS {
+		t.Errorf("expected name to be decoded as Shift JIS, got %q (encoding %v)", actual, enc)
+	}
+	if names.decoder == nil || names.decoder.Encoding() != japanese.ShiftJIS {
+		t.Error("expected detected encoding to be kept")
+	}
+}
@@ -44,8 +44,9 @@ type S2 struct {
 	SnappyIncompatible bool
 }
 
-func (Sz) Extension() string { return ".sz" }
-func (Sz) MediaType() string { return "application/x-snappy-framed" }
+func (Sz) Extension() string      { return ".sz" }
+func (Sz) MediaType() string      { return "application/x-snappy-framed" }
+func (Sz) magicNumbers() [][]byte { return [][]byte{snappyHeader} }
 
 func (sz Sz) Match(_ context.Context, filename string, stream io.Reader) (MatchResult, error) {
 	var mr MatchResult
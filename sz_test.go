@@ -0,0 +1,69 @@
+package archives
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/snappy"
+)
+
+func TestSz_SnappyFraming(t *testing.T) {
+	original := []byte(strings.Repeat("snappy framing format interoperability\n", 1000))
+
+	// a stream written by a plain Snappy implementation
+	var framed bytes.Buffer
+	sw := snappy.NewBufferedWriter(&framed)
+	_, err := sw.Write(original)
+	checkErr(t, err, "writing snappy stream")
+	checkErr(t, sw.Close(), "closing snappy writer")
+
+	format, stream, err := Identify(context.Background(), "", bytes.NewReader(framed.Bytes()))
+	checkErr(t, err, "identifying snappy stream")
+	if _, ok := format.(Sz); !ok {
+		t.Fatalf("expected Sz, got %T", format)
+	}
+	r, err := format.(Decompressor).OpenReader(stream)
+	checkErr(t, err, "opening reader")
+	decompressed, err := io.ReadAll(r)
+	checkErr(t, err, "decompressing")
+	if !bytes.Equal(decompressed, original) {
+		t.Errorf("decompressed contents differ from original (%d vs %d bytes)", len(decompressed), len(original))
+	}
+
+	// and what we write can be read by it
+	compressed := compress(t, ".sz", original, Sz{}.OpenWriter)
+	decompressed, err = io.ReadAll(snappy.NewReader(bytes.NewReader(compressed)))
+	checkErr(t, err, "decompressing with snappy")
+	if !bytes.Equal(decompressed, original) {
+		t.Errorf("snappy decompressed contents differ from original (%d vs %d bytes)", len(decompressed), len(original))
+	}
+}
+
+func TestSz_CompressedTar(t *testing.T) {
+	tmp, info := newTmpTextFile(t, "contents of a .tar.sz")
+	tarSz := CompressedArchive{Compression: Sz{}, Archival: Tar{}, Extraction: Tar{}}
+	data := archive(t, tarSz, tmp, info)
+
+	format, stream, err := Identify(context.Background(), "test.tar.sz", bytes.NewReader(data))
+	checkErr(t, err, "identifying")
+	if format.Extension() != ".tar.sz" {
+		t.Fatalf("expected .tar.sz, got %s", format.Extension())
+	}
+	var contents []byte
+	err = format.(Extractor).Extract(context.Background(), stream, func(_ context.Context, f FileInfo) error {
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		contents, err = io.ReadAll(rc)
+		return err
+	})
+	checkErr(t, err, "extracting")
+	if string(contents) != "contents of a .tar.sz" {
+		t.Errorf("expected original contents, got %q", contents)
+	}
+}
@@ -3,12 +3,18 @@ package archives
 import (
 	"archive/tar"
 	"context"
+	"crypto/sha256"
 	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"log"
+	"os"
+	"path"
 	"strings"
+	"time"
+
+	"golang.org/x/text/unicode/norm"
 )
 
 func init() {
@@ -16,7 +22,17 @@ func init() {
 }
 
 type Tar struct {
-	// If true, use GNU header format
+	// The header format to write: tar.FormatUSTAR, tar.FormatPAX,
+	// or tar.FormatGNU. If unset, PAX is used (or GNU, if FormatGNU
+	// is true). Files with names or other fields that the format
+	// can't represent result in an error rather than truncation.
+	// Names and link targets longer than 100 bytes are stored in
+	// PAX records, or GNU long name and long link entries, and
+	// both are read back when extracting.
+	Format tar.Format
+
+	// If true, use GNU header format; same as setting Format to
+	// tar.FormatGNU, which takes precedence
 	FormatGNU bool
 
 	// If true, preserve only numeric user and group id
@@ -24,7 +40,8 @@ type Tar struct {
 
 	// If true, errors encountered during reading or writing
 	// a file within an archive will be logged and the
-	// operation will continue on remaining files.
+	// operation will continue on remaining files. Extract
+	// then returns EntryErrors listing the files that failed.
 	ContinueOnError bool
 
 	// User ID of the file owner
@@ -38,11 +55,95 @@ type Tar struct {
 
 	// Group name of the file owner
 	Gname string
+
+	// If true, the archive is reproducible: identical inputs
+	// give byte-identical output. Files are sorted by name
+	// (except by ArchiveAsync, which writes them as they come)
+	// and their modification times are set to 1980-01-01 UTC.
+	// Owners are set to 0 and their names cleared, unless
+	// set by the fields above.
+	Deterministic bool
+
+	// If set, the modification time of every file archived,
+	// instead of its own; unlike Deterministic, it leaves the
+	// owners and order of the files alone. Access and change
+	// times are not stored. It takes precedence over the time
+	// set by Deterministic.
+	ModTime time.Time
+
+	// If true, regular files whose contents are identical to
+	// those of a file already written are stored as hard links
+	// to it, so their contents are stored only once. Since the
+	// header comes before the contents, each file is copied to
+	// a temporary file as it is hashed, so it is only opened
+	// once. Insert doesn't deduplicate.
+	Dedupe bool
+
+	// Globs selecting the entries to extract; see the package doc.
+	IncludePatterns []string
+	ExcludePatterns []string
+
+	// If true, macOS metadata is skipped; see the package doc.
+	SkipMacMetadata bool
+
+	// If true, names are normalized to NFC; see the package doc.
+	NormalizeNFC bool
+
+	// If set, reports reading progress; see the package doc.
+	OnProgress func(entryName string, bytesDone, bytesTotal int64)
+
+	// If set, wraps the contents of files; see the package doc.
+	Transform func(name string, r io.Reader) (io.Reader, error)
+
+	// The size in bytes of the buffer through which the contents
+	// of files are copied when archiving, inserting, extracting
+	// to disk or with ExtractToFS, and copying from the reader of
+	// ExtractOne. Larger buffers can be faster on fast storage.
+	// If not positive, a default of 32 KiB is used.
+	CopyBufferSize int
+
+	// Limits on the bytes extracted; see the package doc.
+	MaxDecompressedSize int64
+	MaxEntrySize        int64
+
+	// If positive, the most entries allowed; see the package doc.
+	MaxEntries int
+
+	// Has no effect, since tar archives store no checksums.
+	VerifyChecksums bool
+
+	// If true, SecureExtract applies the mode bits and
+	// modification time of each file from the archive, and
+	// its owner too when running as root (otherwise the
+	// owner is left alone).
+	RestoreMetadata bool
+
+	// If true, SecureExtract writes every file directly into
+	// the destination under its base name, ignoring the
+	// directories in the archive.
+	Flatten bool
+
+	// When flattening, OnCollision is called with the name of a
+	// file whose name is already taken by another file from the
+	// archive, and returns its new name: the same name to
+	// overwrite the other file, or empty to skip it. If the new
+	// name is taken too, it is called again. By default, a
+	// counter is appended to the name, as in "x-1.txt".
+	OnCollision func(name string) string
+
+	// If true, SecureExtract applies the user.* and security.*
+	// extended attributes recorded in the PAX records of each
+	// file and directory (as "SCHILY.xattr." keys), which
+	// security.* ones usually need root for. It only has an
+	// effect on Linux.
+	RestoreXattrs bool
 }
 
 func (Tar) Extension() string { return ".tar" }
 func (Tar) MediaType() string { return "application/x-tar" }
 
+func (t Tar) copyBufSize() int { return t.CopyBufferSize }
+
 func (t Tar) Match(_ context.Context, filename string, stream io.Reader) (MatchResult, error) {
 	var mr MatchResult
 
@@ -65,8 +166,13 @@ func (t Tar) Archive(ctx context.Context, output io.Writer, files []FileInfo) er
 	tw := tar.NewWriter(output)
 	defer tw.Close()
 
+	if t.Deterministic {
+		files = sortedByName(files)
+	}
+
+	seen := t.newDedupeSet()
 	for _, file := range files {
-		if err := t.writeFileToArchive(ctx, tw, file); err != nil {
+		if err := t.writeFileToArchive(ctx, tw, file, seen); err != nil {
 			if t.ContinueOnError && ctx.Err() == nil { // context errors should always abort
 				log.Printf("[ERROR] %v", err)
 				continue
@@ -82,14 +188,28 @@ func (t Tar) ArchiveAsync(ctx context.Context, output io.Writer, jobs <-chan Arc
 	tw := tar.NewWriter(output)
 	defer tw.Close()
 
+	seen := t.newDedupeSet()
 	for job := range jobs {
-		job.Result <- t.writeFileToArchive(ctx, tw, job.File)
+		job.Result <- t.writeFileToArchive(ctx, tw, job.File, seen)
 	}
 
 	return nil
 }
 
-func (t Tar) writeFileToArchive(ctx context.Context, tw *tar.Writer, file FileInfo) error {
+// newDedupeSet returns the set of hashes of the files written, for
+// writeFileToArchive, or nil if t doesn't deduplicate files.
+func (t Tar) newDedupeSet() map[[sha256.Size]byte]string {
+	if !t.Dedupe {
+		return nil
+	}
+	return make(map[[sha256.Size]byte]string)
+}
+
+// writeFileToArchive writes file to tw. If seen is non-nil, it maps
+// the hashes of the contents of the files written so far to their
+// names, and file is written as a hard link if its contents are
+// already in the archive.
+func (t Tar) writeFileToArchive(ctx context.Context, tw *tar.Writer, file FileInfo, seen map[[sha256.Size]byte]string) error {
 	if err := ctx.Err(); err != nil {
 		return err // honor context cancellation
 	}
@@ -102,8 +222,31 @@ func (t Tar) writeFileToArchive(ctx context.Context, tw *tar.Writer, file FileIn
 	if hdr.Name == "" {
 		hdr.Name = file.Name() // assume base name of file I guess
 	}
-	if t.FormatGNU {
+	if !t.ModTime.IsZero() {
+		hdr.ModTime = t.ModTime
+		hdr.AccessTime, hdr.ChangeTime = time.Time{}, time.Time{}
+	}
+	switch {
+	case t.Format != tar.FormatUnknown:
+		hdr.Format = t.Format
+	case t.FormatGNU:
 		hdr.Format = tar.FormatGNU
+	default:
+		hdr.Format = tar.FormatPAX
+	}
+	if hdr.Format == tar.FormatUSTAR || (t.Format == tar.FormatUnknown && !t.FormatGNU) {
+		// keep the times as they were written before the format
+		// was configurable, which is all that USTAR can hold anyway
+		hdr.ModTime = hdr.ModTime.Round(time.Second)
+		hdr.AccessTime, hdr.ChangeTime = time.Time{}, time.Time{}
+	}
+	if t.Deterministic {
+		if t.ModTime.IsZero() {
+			hdr.ModTime = deterministicModTime
+		}
+		hdr.AccessTime, hdr.ChangeTime = time.Time{}, time.Time{}
+		hdr.Uid, hdr.Gid = 0, 0
+		hdr.Uname, hdr.Gname = "", ""
 	}
 	if t.NumericUIDGID {
 		hdr.Uname = ""
@@ -121,6 +264,29 @@ func (t Tar) writeFileToArchive(ctx context.Context, tw *tar.Writer, file FileIn
 	if t.Gname != "" {
 		hdr.Gname = t.Gname
 	}
+	if len(file.PAXRecords) > 0 {
+		if hdr.PAXRecords == nil {
+			hdr.PAXRecords = make(map[string]string, len(file.PAXRecords))
+		}
+		for key, value := range file.PAXRecords {
+			hdr.PAXRecords[key] = value
+		}
+	}
+
+	var spooled io.Reader // the contents, if already read
+	if seen != nil && hdr.Typeflag == tar.TypeReg && hdr.Size > 0 {
+		spool, sum, err := spoolFile(ctx, file, t.CopyBufferSize)
+		if err != nil {
+			return fmt.Errorf("file %s: hashing data: %w", file.NameInArchive, err)
+		}
+		defer spool.Close()
+		if original, ok := seen[sum]; ok {
+			hdr.Typeflag, hdr.Linkname, hdr.Size = tar.TypeLink, original, 0
+		} else {
+			seen[sum] = hdr.Name
+			spooled = spool
+		}
+	}
 
 	if err := tw.WriteHeader(hdr); err != nil {
 		return fmt.Errorf("file %s: writing header: %w", file.NameInArchive, err)
@@ -132,13 +298,50 @@ func (t Tar) writeFileToArchive(ctx context.Context, tw *tar.Writer, file FileIn
 		return nil
 	}
 
-	if err := openAndCopyFile(file, tw); err != nil {
+	if spooled != nil {
+		if _, err := copyWithContext(ctx, tw, spooled, t.CopyBufferSize); err != nil {
+			return fmt.Errorf("file %s: writing data: %w", file.NameInArchive, err)
+		}
+		return nil
+	}
+	if err := openAndCopyFile(ctx, file, tw, t.CopyBufferSize); err != nil {
 		return fmt.Errorf("file %s: writing data: %w", file.NameInArchive, err)
 	}
 
 	return nil
 }
 
+// spooledFile is a temporary file holding the contents of a file
+// being archived, which is deleted when closed.
+type spooledFile struct{ *os.File }
+
+func (sf spooledFile) Close() error {
+	err := sf.File.Close()
+	os.Remove(sf.Name())
+	return err
+}
+
+// spoolFile copies the contents of file to a temporary file, hashing
+// them with SHA-256 on the way, and returns the temporary file, read
+// from the start, and the hash.
+func spoolFile(ctx context.Context, file FileInfo, bufSize int) (spooledFile, [sha256.Size]byte, error) {
+	tmp, err := os.CreateTemp("", "archives-spool-*")
+	if err != nil {
+		return spooledFile{}, [sha256.Size]byte{}, err
+	}
+	spool := spooledFile{tmp}
+	h := sha256.New()
+	if err := openAndCopyFile(ctx, file, io.MultiWriter(spool, h), bufSize); err != nil {
+		spool.Close()
+		return spooledFile{}, [sha256.Size]byte{}, err
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		spool.Close()
+		return spooledFile{}, [sha256.Size]byte{}, err
+	}
+	return spool, [sha256.Size]byte(h.Sum(nil)), nil
+}
+
 func (t Tar) Insert(ctx context.Context, into io.ReadWriteSeeker, files []FileInfo) error {
 	// Tar files may end with some, none, or a lot of zero-byte padding. The spec says
 	// it should end with two 512-byte trailer records consisting solely of null/0
@@ -196,7 +399,7 @@ func (t Tar) Insert(ctx context.Context, into io.ReadWriteSeeker, files []FileIn
 		if err := ctx.Err(); err != nil {
 			return err // honor context cancellation
 		}
-		err = t.writeFileToArchive(ctx, tw, file)
+		err = t.writeFileToArchive(ctx, tw, file, nil)
 		if err != nil {
 			if t.ContinueOnError && ctx.Err() == nil {
 				log.Printf("[ERROR] appending file %d into archive: %s: %v", i, file.Name(), err)
@@ -214,7 +417,14 @@ func (t Tar) Extract(ctx context.Context, sourceArchive io.Reader, handleFile Fi
 
 	// important to initialize to non-nil, empty value due to how fileIsIncluded works
 	skipDirs := skipList{}
+	limits := newExtractLimits(t.MaxDecompressedSize, t.MaxEntrySize, t.MaxEntries)
+	filter, err := newPatternFilter(t.IncludePatterns, t.ExcludePatterns)
+	if err != nil {
+		return err
+	}
+	filter.skipMacMetadata = t.SkipMacMetadata
 
+	var failed EntryErrors
 	for {
 		if err := ctx.Err(); err != nil {
 			return err // honor context cancellation
@@ -226,11 +436,22 @@ func (t Tar) Extract(ctx context.Context, sourceArchive io.Reader, handleFile Fi
 		}
 		if err != nil {
 			if t.ContinueOnError && ctx.Err() == nil {
+				// the tar reader can't go on past a bad header
 				log.Printf("[ERROR] Advancing to next file in tar archive: %v", err)
-				continue
+				failed = append(failed, EntryError{Err: fmt.Errorf("advancing to next file: %w", err)})
+				break
 			}
 			return err
 		}
+		if err := limits.countEntry(); err != nil {
+			return err
+		}
+		if t.NormalizeNFC {
+			hdr.Name = norm.NFC.String(hdr.Name)
+		}
+		if !filter.includes(hdr.Name) {
+			continue
+		}
 		if fileIsIncluded(skipDirs, hdr.Name) {
 			continue
 		}
@@ -245,11 +466,15 @@ func (t Tar) Extract(ctx context.Context, sourceArchive io.Reader, handleFile Fi
 			Header:        hdr,
 			NameInArchive: hdr.Name,
 			LinkTarget:    hdr.Linkname,
+			PAXRecords:    hdr.PAXRecords,
 			Open: func() (fs.File, error) {
 				return fileInArchive{io.NopCloser(tr), info}, nil
 			},
 		}
 
+		file = reportProgress(limits.apply(file), hdr.Size, t.OnProgress)
+		file = transformContents(file, t.Transform)
+
 		err = handleFile(ctx, file)
 		if errors.Is(err, fs.SkipAll) {
 			// At first, I wasn't sure if fs.SkipAll implied that the rest of the entries
@@ -262,17 +487,83 @@ func (t Tar) Extract(ctx context.Context, sourceArchive io.Reader, handleFile Fi
 		} else if errors.Is(err, fs.SkipDir) && file.IsDir() {
 			skipDirs.add(hdr.Name)
 		} else if err != nil {
+			if t.ContinueOnError && ctx.Err() == nil {
+				log.Printf("[ERROR] %s: %v", hdr.Name, err)
+				failed = append(failed, EntryError{Name: hdr.Name, Err: err})
+				continue
+			}
 			return fmt.Errorf("handling file: %s: %w", hdr.Name, err)
 		}
 	}
 
-	return nil
+	return failed.asError()
+}
+
+// Walk calls fn for each file in the archive, in order, without reading
+// their contents: they are skipped unless fn opens the file, by seeking
+// if sourceArchive is an io.Seeker. If fn returns an error, the walk
+// stops and the error is returned; fs.SkipDir and fs.SkipAll work as
+// they do for Extract.
+func (t Tar) Walk(ctx context.Context, sourceArchive io.Reader, fn func(info FileInfo) error) error {
+	t.ContinueOnError = false
+	return walkArchive(ctx, t, sourceArchive, fn)
+}
+
+// ExtractOne streams through sourceArchive until it reaches the file
+// named name, implementing the SingleExtractor interface.
+func (t Tar) ExtractOne(ctx context.Context, sourceArchive io.Reader, name string) (io.ReadCloser, fs.FileInfo, error) {
+	name = path.Clean(name)
+	if t.NormalizeNFC {
+		name = norm.NFC.String(name)
+	}
+	tr := tar.NewReader(sourceArchive)
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, nil, err // honor context cancellation
+		}
+
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if t.NormalizeNFC {
+			hdr.Name = norm.NFC.String(hdr.Name)
+		}
+		if path.Clean(hdr.Name) == name && hdr.Typeflag != tar.TypeXGlobalHeader {
+			return entryReader{Reader: tr, bufSize: t.CopyBufferSize}, hdr.FileInfo(), nil
+		}
+	}
+	return nil, nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+}
+
+// SecureExtract extracts all the files in sourceArchive into the
+// dest directory, which is created if it doesn't exist. Unlike
+// writing files out from Extract, it refuses any entry that has an
+// absolute path, would be written outside of dest, or is a link
+// whose target is outside of dest, returning an error that wraps
+// ErrUnsafePath. Files are never written through links: an entry
+// whose path goes through a link, whether made by the archive or
+// swapped in during extraction, is refused too. It is the
+// recommended way to extract untrusted tar archives to disk.
+func (t Tar) SecureExtract(ctx context.Context, sourceArchive io.Reader, dest string) error {
+	return extractToDisk(ctx, t, sourceArchive, dest, diskWriter{
+		restoreMetadata: t.RestoreMetadata,
+		restoreXattrs:   t.RestoreXattrs,
+		flatten:         t.Flatten,
+		onCollision:     t.OnCollision,
+		bufSize:         t.CopyBufferSize,
+	})
 }
 
 // Interface guards
 var (
-	_ Archiver      = (*Tar)(nil)
-	_ ArchiverAsync = (*Tar)(nil)
-	_ Extractor     = (*Tar)(nil)
-	_ Inserter      = (*Tar)(nil)
+	_ Archiver        = (*Tar)(nil)
+	_ ArchiverAsync   = (*Tar)(nil)
+	_ Extractor       = (*Tar)(nil)
+	_ Inserter        = (*Tar)(nil)
+	_ SingleExtractor = (*Tar)(nil)
+	_ Walker          = (*Tar)(nil)
 )
@@ -0,0 +1,978 @@
+package archives
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestTar returns a tar archive containing the given headers;
+// regular files get their name as contents.
+func newTestTar(t *testing.T, hdrs ...*tar.Header) *bytes.Reader {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range hdrs {
+		if hdr.Typeflag == tar.TypeReg {
+			hdr.Size = int64(len(hdr.Name))
+		}
+		if hdr.Mode == 0 {
+			hdr.Mode = 0644
+		}
+		checkErr(t, tw.WriteHeader(hdr), "writing header %s", hdr.Name)
+		if hdr.Typeflag == tar.TypeReg {
+			_, err := tw.Write([]byte(hdr.Name))
+			checkErr(t, err, "writing file %s", hdr.Name)
+		}
+	}
+	checkErr(t, tw.Close(), "closing tar writer")
+	return bytes.NewReader(buf.Bytes())
+}
+
+func TestTar_SecureExtract(t *testing.T) {
+	dest := t.TempDir()
+	archive := newTestTar(t,
+		&tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755},
+		&tar.Header{Name: "dir/file.txt", Typeflag: tar.TypeReg},
+		&tar.Header{Name: "dir/link", Typeflag: tar.TypeSymlink, Linkname: "file.txt"},
+		&tar.Header{Name: "hardlink", Typeflag: tar.TypeLink, Linkname: "dir/file.txt"},
+	)
+	checkErr(t, Tar{}.SecureExtract(context.Background(), archive, dest), "extracting")
+
+	for _, name := range []string{"dir/file.txt", "dir/link", "hardlink"} {
+		contents, err := os.ReadFile(filepath.Join(dest, filepath.FromSlash(name)))
+		checkErr(t, err, "reading %s", name)
+		if string(contents) != "dir/file.txt" {
+			t.Errorf("%s: unexpected contents %q", name, contents)
+		}
+	}
+
+	// links are created as links, not copies
+	info, err := os.Lstat(filepath.Join(dest, "dir", "link"))
+	checkErr(t, err, "statting symlink")
+	if info.Mode()&fs.ModeSymlink == 0 {
+		t.Errorf("expected dir/link to be a symlink, got mode %v", info.Mode())
+	}
+	if target, err := os.Readlink(filepath.Join(dest, "dir", "link")); err != nil || target != "file.txt" {
+		t.Errorf("expected symlink to file.txt, got %q (%v)", target, err)
+	}
+	original, err := os.Stat(filepath.Join(dest, "dir", "file.txt"))
+	checkErr(t, err, "statting file")
+	hardlink, err := os.Stat(filepath.Join(dest, "hardlink"))
+	checkErr(t, err, "statting hard link")
+	if !os.SameFile(original, hardlink) {
+		t.Errorf("expected hardlink to be the same file as dir/file.txt")
+	}
+}
+
+func TestTar_SecureExtractFlatten(t *testing.T) {
+	hdrs := []*tar.Header{
+		{Name: "a/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "a/x.txt", Typeflag: tar.TypeReg},
+		{Name: "b/x.txt", Typeflag: tar.TypeReg},
+		{Name: "b/y.txt", Typeflag: tar.TypeLink, Linkname: "b/x.txt"},
+	}
+
+	for _, tc := range []struct {
+		name        string
+		onCollision func(string) string
+		expect      map[string]string
+	}{
+		{
+			name:   "default",
+			expect: map[string]string{"x.txt": "a/x.txt", "x-1.txt": "b/x.txt", "y.txt": "b/x.txt"},
+		},
+		{
+			name:        "renamed",
+			onCollision: func(name string) string { return "other-" + name },
+			expect:      map[string]string{"x.txt": "a/x.txt", "other-x.txt": "b/x.txt", "y.txt": "b/x.txt"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dest := t.TempDir()
+			format := Tar{Flatten: true, OnCollision: tc.onCollision}
+			checkErr(t, format.SecureExtract(context.Background(), newTestTar(t, hdrs...), dest), "extracting")
+
+			entries, err := os.ReadDir(dest)
+			checkErr(t, err, "reading destination")
+			if len(entries) != len(tc.expect) {
+				t.Errorf("expected %d files in destination, got %d", len(tc.expect), len(entries))
+			}
+			for name, expect := range tc.expect {
+				contents, err := os.ReadFile(filepath.Join(dest, name))
+				checkErr(t, err, "reading %s", name)
+				if string(contents) != expect {
+					t.Errorf("%s: expected contents of %s, got %q", name, expect, contents)
+				}
+			}
+		})
+	}
+}
+
+// memFS is an in-memory WritableFS.
+type memFS struct {
+	files map[string]*bytes.Buffer
+	dirs  map[string]bool
+	links map[string]string
+}
+
+func (m *memFS) Create(name string, _ fs.FileMode) (io.WriteCloser, error) {
+	m.files[name] = new(bytes.Buffer)
+	return nopWriteCloser{m.files[name]}, nil
+}
+
+func (m *memFS) Mkdir(name string, _ fs.FileMode) error {
+	m.dirs[name] = true
+	return nil
+}
+
+func (m *memFS) Symlink(oldname, newname string) error {
+	m.links[newname] = oldname
+	return nil
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+func TestExtractToFS(t *testing.T) {
+	hdrs := []*tar.Header{
+		{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "dir/file.txt", Typeflag: tar.TypeReg},
+		{Name: "dir/sub/other.txt", Typeflag: tar.TypeReg},
+		{Name: "dir/link", Typeflag: tar.TypeSymlink, Linkname: "file.txt"},
+		{Name: "hardlink", Typeflag: tar.TypeLink, Linkname: "dir/file.txt"},
+	}
+	mem := &memFS{files: make(map[string]*bytes.Buffer), dirs: make(map[string]bool), links: make(map[string]string)}
+	checkErr(t, ExtractToFS(context.Background(), Tar{}, newTestTar(t, hdrs...), mem), "extracting")
+
+	for _, name := range []string{"dir/file.txt", "dir/sub/other.txt"} {
+		if buf, ok := mem.files[name]; !ok || buf.String() != name {
+			t.Errorf("%s: expected contents %q, got %v", name, name, buf)
+		}
+	}
+	if !mem.dirs["dir"] || !mem.dirs["dir/sub"] {
+		t.Errorf("expected directories to be created, got %v", mem.dirs)
+	}
+	expectLinks := map[string]string{"dir/link": "file.txt", "hardlink": "dir/file.txt"}
+	if !reflect.DeepEqual(mem.links, expectLinks) {
+		t.Errorf("expected links %v, got %v", expectLinks, mem.links)
+	}
+
+	// names are checked
+	unsafe := newTestTar(t, &tar.Header{Name: "../evil.txt", Typeflag: tar.TypeReg})
+	if err := ExtractToFS(context.Background(), Tar{}, unsafe, mem); !errors.Is(err, ErrUnsafePath) {
+		t.Errorf("expected ErrUnsafePath, got %v", err)
+	}
+
+	// and on disk, hard links are links
+	dest := t.TempDir()
+	checkErr(t, ExtractToFS(context.Background(), Tar{}, newTestTar(t, hdrs...), OSWritableFS(dest)), "extracting to disk")
+	for _, name := range []string{"dir/file.txt", "dir/link", "hardlink"} {
+		contents, err := os.ReadFile(filepath.Join(dest, filepath.FromSlash(name)))
+		checkErr(t, err, "reading %s", name)
+		if string(contents) != "dir/file.txt" {
+			t.Errorf("%s: unexpected contents %q", name, contents)
+		}
+	}
+	original, err := os.Stat(filepath.Join(dest, "dir", "file.txt"))
+	checkErr(t, err, "statting file")
+	hardlink, err := os.Stat(filepath.Join(dest, "hardlink"))
+	checkErr(t, err, "statting hard link")
+	if !os.SameFile(original, hardlink) {
+		t.Errorf("expected hardlink to be the same file as dir/file.txt")
+	}
+}
+
+func TestTar_ArchiveDedupe(t *testing.T) {
+	same, sameInfo := newTmpTextFile(t, "identical asset")
+	other, otherInfo := newTmpTextFile(t, "something else")
+	defer os.Remove(same)
+	defer os.Remove(other)
+	// like the files from Extract, each can only be opened once
+	file := func(name, fname string, info fs.FileInfo) FileInfo {
+		var opened bool
+		return FileInfo{FileInfo: info, NameInArchive: name,
+			Open: func() (fs.File, error) {
+				if opened {
+					return nil, fmt.Errorf("%s opened twice", name)
+				}
+				opened = true
+				return os.Open(fname)
+			}}
+	}
+	files := []FileInfo{
+		file("a/asset.png", same, sameInfo),
+		file("other.txt", other, otherInfo),
+		file("b/asset.png", same, sameInfo),
+	}
+
+	var buf bytes.Buffer
+	checkErr(t, Tar{Dedupe: true}.Archive(context.Background(), &buf, files), "archiving")
+
+	tr := tar.NewReader(&buf)
+	var hdrs []*tar.Header
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		checkErr(t, err, "reading archive")
+		hdrs = append(hdrs, hdr)
+		contents, err := io.ReadAll(tr)
+		checkErr(t, err, "reading %s", hdr.Name)
+		if hdr.Name == "other.txt" && string(contents) != "something else" {
+			t.Errorf("unexpected contents of %s: %q", hdr.Name, contents)
+		}
+	}
+	if len(hdrs) != 3 {
+		t.Fatalf("expected 3 entries, got %d", len(hdrs))
+	}
+	for i, expect := range []byte{tar.TypeReg, tar.TypeReg, tar.TypeLink} {
+		if hdrs[i].Typeflag != expect {
+			t.Errorf("%s: expected type %c, got %c", hdrs[i].Name, expect, hdrs[i].Typeflag)
+		}
+	}
+	if hdrs[2].Linkname != "a/asset.png" || hdrs[2].Size != 0 {
+		t.Errorf("expected b/asset.png to link to a/asset.png without contents, got link %q and size %d", hdrs[2].Linkname, hdrs[2].Size)
+	}
+}
+
+func TestTar_SecureExtractUnsafePaths(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		hdr  *tar.Header
+	}{
+		{"parent traversal", &tar.Header{Name: "../../etc/passwd", Typeflag: tar.TypeReg}},
+		{"nested traversal", &tar.Header{Name: "dir/../../escape.txt", Typeflag: tar.TypeReg}},
+		{"absolute path", &tar.Header{Name: "/etc/passwd", Typeflag: tar.TypeReg}},
+		{"backslash traversal", &tar.Header{Name: `..\escape.txt`, Typeflag: tar.TypeReg}},
+		{"symlink outside", &tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "../outside"}},
+		{"absolute symlink", &tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd"}},
+		{"hard link outside", &tar.Header{Name: "link", Typeflag: tar.TypeLink, Linkname: "../outside"}},
+		// "a" is the destination itself, so "a/.." is its parent
+		{"symlink through symlink", &tar.Header{Name: "b", Typeflag: tar.TypeSymlink, Linkname: "a/.."}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			root := t.TempDir()
+			dest := filepath.Join(root, "dest")
+			archive := newTestTar(t,
+				&tar.Header{Name: "a", Typeflag: tar.TypeSymlink, Linkname: "."},
+				tc.hdr,
+			)
+			err := Tar{}.SecureExtract(context.Background(), archive, dest)
+			if !errors.Is(err, ErrUnsafePath) {
+				t.Fatalf("expected ErrUnsafePath, got %v", err)
+			}
+			if !strings.Contains(err.Error(), tc.hdr.Name) {
+				t.Errorf("expected error to name entry %q, got %v", tc.hdr.Name, err)
+			}
+			entries, err := os.ReadDir(root)
+			checkErr(t, err, "reading root")
+			if len(entries) != 1 {
+				t.Errorf("expected nothing written outside destination, found %d entries", len(entries))
+			}
+		})
+	}
+}
+
+func TestTar_SecureExtractSwappedDirectory(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symbolic links need privileges on Windows")
+	}
+
+	t.Run("by the archive", func(t *testing.T) {
+		root := t.TempDir()
+		dest := filepath.Join(root, "dest")
+		outside := filepath.Join(root, "outside")
+		checkErr(t, os.Mkdir(outside, 0755), "making outside directory")
+		// a points to x/../outside, which is inside dest
+		// until x turns out to be dest itself
+		archive := newTestTar(t,
+			&tar.Header{Name: "a", Typeflag: tar.TypeSymlink, Linkname: "x/../outside"},
+			&tar.Header{Name: "x", Typeflag: tar.TypeSymlink, Linkname: "."},
+			&tar.Header{Name: "a/evil.txt", Typeflag: tar.TypeReg},
+		)
+		err := Tar{}.SecureExtract(context.Background(), archive, dest)
+		if !errors.Is(err, ErrUnsafePath) {
+			t.Errorf("expected ErrUnsafePath, got %v", err)
+		}
+		if entries, _ := os.ReadDir(outside); len(entries) != 0 {
+			t.Errorf("expected nothing written outside destination, found %d entries", len(entries))
+		}
+	})
+
+	t.Run("during extraction", func(t *testing.T) {
+		root := t.TempDir()
+		dest := filepath.Join(root, "dest")
+		outside := filepath.Join(root, "outside")
+		checkErr(t, os.Mkdir(outside, 0755), "making outside directory")
+		archive := newTestTar(t,
+			&tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755},
+			&tar.Header{Name: "dir/first.txt", Typeflag: tar.TypeReg},
+			&tar.Header{Name: "dir/second.txt", Typeflag: tar.TypeReg},
+		)
+		var swapped bool
+		format := Tar{OnProgress: func(name string, _, _ int64) {
+			if name != "dir/first.txt" || swapped {
+				return
+			}
+			// swap the directory for a link while its first file is written
+			swapped = true
+			checkErr(t, os.Rename(filepath.Join(dest, "dir"), filepath.Join(root, "moved")), "moving directory")
+			checkErr(t, os.Symlink(outside, filepath.Join(dest, "dir")), "replacing directory with link")
+		}}
+		err := format.SecureExtract(context.Background(), archive, dest)
+		if !swapped {
+			t.Fatal("expected the directory to be swapped")
+		}
+		if !errors.Is(err, ErrUnsafePath) || !strings.Contains(err.Error(), "dir/second.txt") {
+			t.Errorf("expected ErrUnsafePath for dir/second.txt, got %v", err)
+		}
+		if entries, _ := os.ReadDir(outside); len(entries) != 0 {
+			t.Errorf("expected nothing written outside destination, found %d entries", len(entries))
+		}
+	})
+}
+
+func TestTar_OnProgress(t *testing.T) {
+	contents := strings.Repeat("progress", 1024)
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	checkErr(t, tw.WriteHeader(&tar.Header{Name: "big.txt", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(contents))}), "writing header")
+	_, err := tw.Write([]byte(contents))
+	checkErr(t, err, "writing file")
+	checkErr(t, tw.Close(), "closing tar writer")
+
+	var calls int
+	var last int64 = -1
+	tarFormat := Tar{OnProgress: func(entryName string, bytesDone, bytesTotal int64) {
+		calls++
+		if entryName != "big.txt" {
+			t.Errorf("unexpected entry name %q", entryName)
+		}
+		if bytesTotal != int64(len(contents)) {
+			t.Errorf("expected total %d, got %d", len(contents), bytesTotal)
+		}
+		if bytesDone < last {
+			t.Errorf("bytes done went backwards from %d to %d", last, bytesDone)
+		}
+		last = bytesDone
+	}}
+	err = tarFormat.Extract(context.Background(), &buf, func(_ context.Context, f FileInfo) error {
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		// read in small chunks so that progress is reported several times
+		p := make([]byte, 512)
+		for {
+			if _, err := rc.Read(p); err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+		}
+	})
+	checkErr(t, err, "extracting")
+	if last != int64(len(contents)) {
+		t.Errorf("expected final progress of %d bytes, got %d", len(contents), last)
+	}
+	if calls < len(contents)/512 {
+		t.Errorf("expected at least %d progress calls, got %d", len(contents)/512, calls)
+	}
+}
+
+func TestTar_SecureExtractCancel(t *testing.T) {
+	contents := strings.Repeat("x", 4*copyBufferSize)
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	checkErr(t, tw.WriteHeader(&tar.Header{Name: "big.txt", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(contents))}), "writing header")
+	_, err := tw.Write([]byte(contents))
+	checkErr(t, err, "writing file")
+	checkErr(t, tw.Close(), "closing tar writer")
+
+	// cancel as soon as the first bytes of the file are copied
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tarFormat := Tar{OnProgress: func(_ string, bytesDone, _ int64) {
+		if bytesDone > 0 {
+			cancel()
+		}
+	}}
+
+	dest := t.TempDir()
+	err = tarFormat.SecureExtract(ctx, &buf, dest)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dest, "big.txt")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected partial file to be removed, got %v", err)
+	}
+}
+
+func TestTar_ExtractOne(t *testing.T) {
+	archive := newTestTar(t,
+		&tar.Header{Name: "a.txt", Typeflag: tar.TypeReg},
+		&tar.Header{Name: "dir/b.txt", Typeflag: tar.TypeReg},
+		&tar.Header{Name: "c.txt", Typeflag: tar.TypeReg},
+	)
+	rc, info, err := Tar{}.ExtractOne(context.Background(), archive, "./dir/b.txt")
+	checkErr(t, err, "extracting one file")
+	defer rc.Close()
+	contents, err := io.ReadAll(rc)
+	checkErr(t, err, "reading file")
+	if string(contents) != "dir/b.txt" || info.Name() != "b.txt" {
+		t.Errorf("unexpected file %s with contents %q", info.Name(), contents)
+	}
+
+	// compressed archives are decompressed transparently
+	var compressed bytes.Buffer
+	w, err := Gz{}.OpenWriter(&compressed)
+	checkErr(t, err, "opening gzip writer")
+	_, err = archive.Seek(0, io.SeekStart)
+	checkErr(t, err, "rewinding archive")
+	_, err = io.Copy(w, archive)
+	checkErr(t, err, "compressing archive")
+	checkErr(t, w.Close(), "closing gzip writer")
+	format := CompressedArchive{Compression: Gz{}, Extraction: Tar{}}
+	rc, _, err = format.ExtractOne(context.Background(), bytes.NewReader(compressed.Bytes()), "c.txt")
+	checkErr(t, err, "extracting one file from compressed archive")
+	contents, err = io.ReadAll(rc)
+	checkErr(t, err, "reading file")
+	checkErr(t, rc.Close(), "closing file")
+	if string(contents) != "c.txt" {
+		t.Errorf("unexpected contents %q", contents)
+	}
+
+	_, _, err = format.ExtractOne(context.Background(), bytes.NewReader(compressed.Bytes()), "missing.txt")
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected fs.ErrNotExist, got %v", err)
+	}
+}
+
+func TestTar_ArchiveFormat(t *testing.T) {
+	fname, info := newTmpTextFile(t, "contents")
+	defer os.Remove(fname)
+	archiveName := func(format tar.Format, name string) ([]byte, error) {
+		var buf bytes.Buffer
+		err := Tar{Format: format}.Archive(context.Background(), &buf, []FileInfo{{
+			FileInfo:      info,
+			NameInArchive: name,
+			Open:          func() (fs.File, error) { return os.Open(fname) },
+		}})
+		return buf.Bytes(), err
+	}
+
+	long := strings.Repeat("n", 200)
+	longPath := strings.Repeat("d", 99) + "/" + strings.Repeat("n", 100) // can be split into USTAR prefix and name
+	for _, tc := range []struct {
+		format tar.Format
+		name   string
+		ok     bool
+	}{
+		{tar.FormatGNU, long, true},
+		{tar.FormatPAX, long, true},
+		{tar.FormatUnknown, long, true}, // PAX by default
+		{tar.FormatUSTAR, long, false},
+		{tar.FormatUSTAR, longPath, true},
+	} {
+		archived, err := archiveName(tc.format, tc.name)
+		if !tc.ok {
+			if err == nil {
+				t.Errorf("%v: expected error for name that doesn't fit the format", tc.format)
+			}
+			continue
+		}
+		checkErr(t, err, "archiving in format %v", tc.format)
+
+		hdr, err := tar.NewReader(bytes.NewReader(archived)).Next()
+		checkErr(t, err, "reading header")
+		if hdr.Name != tc.name {
+			t.Errorf("%v: expected name of %d chars, got %q", tc.format, len(tc.name), hdr.Name)
+		}
+		if want := tc.format; want != tar.FormatUnknown && hdr.Format&want == 0 {
+			t.Errorf("expected format %v, got %v", want, hdr.Format)
+		}
+	}
+}
+
+func TestTar_SecureExtractRestoreMetadata(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("mode bits are not fully supported on Windows")
+	}
+	mtime := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	dirMtime := time.Date(2002, 3, 4, 5, 6, 7, 0, time.UTC)
+	archive := func() *bytes.Reader {
+		return newTestTar(t,
+			&tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0750, ModTime: dirMtime},
+			&tar.Header{Name: "dir/file.txt", Typeflag: tar.TypeReg, Mode: 0604, ModTime: mtime,
+				Uid: os.Getuid(), Gid: os.Getgid()},
+		)
+	}
+
+	dest := t.TempDir()
+	checkErr(t, Tar{RestoreMetadata: true}.SecureExtract(context.Background(), archive(), dest), "extracting")
+	for _, tc := range []struct {
+		name  string
+		mode  fs.FileMode
+		mtime time.Time
+	}{
+		{"dir", fs.ModeDir | 0750, dirMtime},
+		{"dir/file.txt", 0604, mtime},
+	} {
+		info, err := os.Stat(filepath.Join(dest, filepath.FromSlash(tc.name)))
+		checkErr(t, err, "statting %s", tc.name)
+		if info.Mode() != tc.mode {
+			t.Errorf("%s: expected mode %v, got %v", tc.name, tc.mode, info.Mode())
+		}
+		if !info.ModTime().Equal(tc.mtime) {
+			t.Errorf("%s: expected modification time %v, got %v", tc.name, tc.mtime, info.ModTime())
+		}
+	}
+
+	// without the option, the modification time is when it was extracted
+	dest = t.TempDir()
+	checkErr(t, Tar{}.SecureExtract(context.Background(), archive(), dest), "extracting")
+	info, err := os.Stat(filepath.Join(dest, "dir", "file.txt"))
+	checkErr(t, err, "statting file")
+	if info.ModTime().Equal(mtime) {
+		t.Errorf("expected modification time not to be restored")
+	}
+}
+
+func TestTar_MaxEntries(t *testing.T) {
+	const numEntries = 10000
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for i := 0; i < numEntries; i++ {
+		hdr := &tar.Header{Name: fmt.Sprintf("empty%d", i), Typeflag: tar.TypeReg, Mode: 0644}
+		checkErr(t, tw.WriteHeader(hdr), "writing header %s", hdr.Name)
+	}
+	checkErr(t, tw.Close(), "closing tar writer")
+
+	for _, test := range []struct {
+		maxEntries int
+		tooMany    bool
+	}{
+		{maxEntries: 0},
+		{maxEntries: numEntries},
+		{maxEntries: 1000, tooMany: true},
+	} {
+		var handled int
+		err := Tar{MaxEntries: test.maxEntries}.Extract(context.Background(), bytes.NewReader(buf.Bytes()), func(context.Context, FileInfo) error {
+			handled++
+			return nil
+		})
+		if test.tooMany {
+			if !errors.Is(err, ErrTooManyEntries) {
+				t.Errorf("MaxEntries=%d: expected ErrTooManyEntries, got: %v", test.maxEntries, err)
+			}
+			if handled != test.maxEntries {
+				t.Errorf("MaxEntries=%d: expected %d entries to be handled, got %d", test.maxEntries, test.maxEntries, handled)
+			}
+			continue
+		}
+		checkErr(t, err, "MaxEntries=%d: extracting", test.maxEntries)
+		if handled != numEntries {
+			t.Errorf("MaxEntries=%d: expected all %d entries to be handled, got %d", test.maxEntries, numEntries, handled)
+		}
+	}
+}
+
+// countingReadSeeker counts the bytes read from it.
+type countingReadSeeker struct {
+	*bytes.Reader
+	read int64
+}
+
+func (c *countingReadSeeker) Read(p []byte) (int, error) {
+	n, err := c.Reader.Read(p)
+	c.read += int64(n)
+	return n, err
+}
+
+func TestTar_Walk(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	body := bytes.Repeat([]byte("x"), 1<<20)
+	var expected []string
+	for i := 0; i < 10; i++ {
+		hdr := &tar.Header{Name: fmt.Sprintf("file%d.bin", i), Typeflag: tar.TypeReg, Mode: 0600, Size: int64(len(body))}
+		checkErr(t, tw.WriteHeader(hdr), "writing header")
+		_, err := tw.Write(body)
+		checkErr(t, err, "writing body")
+		expected = append(expected, hdr.Name)
+	}
+	checkErr(t, tw.Close(), "closing tar writer")
+
+	input := &countingReadSeeker{Reader: bytes.NewReader(buf.Bytes())}
+	var got []string
+	err := Tar{}.Walk(context.Background(), input, func(info FileInfo) error {
+		if info.Size() != int64(len(body)) || info.Mode().Perm() != 0600 {
+			t.Errorf("%s: unexpected size %d or mode %v", info.Name(), info.Size(), info.Mode())
+		}
+		got = append(got, info.NameInArchive)
+		return nil
+	})
+	checkErr(t, err, "walking")
+	if strings.Join(got, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+	if input.read > int64(buf.Len())/10 {
+		t.Errorf("expected file bodies to be skipped, but read %d of %d bytes", input.read, buf.Len())
+	}
+
+	// an error stops the walk
+	stop := errors.New("stop")
+	var walked int
+	err = Tar{ContinueOnError: true}.Walk(context.Background(), bytes.NewReader(buf.Bytes()), func(info FileInfo) error {
+		walked++
+		return stop
+	})
+	if !errors.Is(err, stop) || walked != 1 {
+		t.Errorf("expected walk to stop at the first file with its error, got %v after %d files", err, walked)
+	}
+}
+
+func TestTar_NormalizeNFC(t *testing.T) {
+	const nfd = "cafe\u0301/re\u0301sume\u0301.txt" // as stored by macOS
+	const nfc = "caf\u00e9/r\u00e9sum\u00e9.txt"
+
+	for _, tc := range []struct {
+		normalize bool
+		expect    string
+	}{
+		{normalize: true, expect: nfc},
+		{normalize: false, expect: nfd},
+	} {
+		dest := t.TempDir()
+		archive := newTestTar(t, &tar.Header{Name: nfd, Typeflag: tar.TypeReg})
+		err := Tar{NormalizeNFC: tc.normalize}.SecureExtract(context.Background(), archive, dest)
+		checkErr(t, err, "extracting")
+
+		var names []string
+		err = filepath.WalkDir(dest, func(path string, d fs.DirEntry, err error) error {
+			if err == nil && !d.IsDir() {
+				rel, _ := filepath.Rel(dest, path)
+				names = append(names, filepath.ToSlash(rel))
+			}
+			return err
+		})
+		checkErr(t, err, "walking destination")
+		if len(names) != 1 || names[0] != tc.expect {
+			t.Errorf("normalize=%t: expected %q on disk, got %q", tc.normalize, tc.expect, names)
+		}
+	}
+
+	// the file is found by the name Extract gives it
+	archive := newTestTar(t, &tar.Header{Name: nfd, Typeflag: tar.TypeReg})
+	rc, info, err := Tar{NormalizeNFC: true}.ExtractOne(context.Background(), archive, nfc)
+	checkErr(t, err, "extracting one file by its composed name")
+	rc.Close()
+	if info.Name() != path.Base(nfc) {
+		t.Errorf("expected composed name %q, got %q", path.Base(nfc), info.Name())
+	}
+}
+
+func TestTar_Patterns(t *testing.T) {
+	dest := t.TempDir()
+	archive := newTestTar(t,
+		&tar.Header{Name: "a.txt", Typeflag: tar.TypeReg},
+		&tar.Header{Name: "docs/", Typeflag: tar.TypeDir},
+		&tar.Header{Name: "docs/b.txt", Typeflag: tar.TypeReg},
+		&tar.Header{Name: "docs/c.md", Typeflag: tar.TypeReg},
+		&tar.Header{Name: "docs/old/d.txt", Typeflag: tar.TypeReg},
+		&tar.Header{Name: "secret/", Typeflag: tar.TypeDir},
+		&tar.Header{Name: "secret/key.txt", Typeflag: tar.TypeReg},
+	)
+	format := Tar{IncludePatterns: []string{"**/*.txt"}, ExcludePatterns: []string{"secret/**"}}
+	checkErr(t, format.SecureExtract(context.Background(), archive, dest), "extracting")
+
+	var names []string
+	err := filepath.WalkDir(dest, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && path != dest {
+			rel, _ := filepath.Rel(dest, path)
+			names = append(names, filepath.ToSlash(rel))
+		}
+		return err
+	})
+	checkErr(t, err, "walking destination")
+	expected := []string{"a.txt", "docs", "docs/b.txt", "docs/old", "docs/old/d.txt"}
+	if !slices.Equal(names, expected) {
+		t.Errorf("expected %q on disk, got %q", expected, names)
+	}
+
+	format = Tar{IncludePatterns: []string{"[.txt"}}
+	if err := format.Extract(context.Background(), archive, nil); !errors.Is(err, path.ErrBadPattern) {
+		t.Errorf("expected bad pattern error, got %v", err)
+	}
+}
+
+func TestPlan(t *testing.T) {
+	archive := newTestTar(t,
+		&tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755},
+		&tar.Header{Name: "dir/ok.txt", Typeflag: tar.TypeReg},
+		&tar.Header{Name: "../evil", Typeflag: tar.TypeReg},
+		&tar.Header{Name: "dir/link", Typeflag: tar.TypeSymlink, Linkname: "../ok.txt"},
+		&tar.Header{Name: "dir/escape", Typeflag: tar.TypeSymlink, Linkname: "../../outside"},
+	)
+	plan, err := Plan(context.Background(), Tar{}, archive)
+	checkErr(t, err, "planning")
+
+	if len(plan.Entries) != 5 {
+		t.Errorf("expected 5 entries, got %d", len(plan.Entries))
+	}
+	if want := int64(len("dir/ok.txt") + len("../evil")); plan.TotalSize != want {
+		t.Errorf("expected total size %d, got %d", want, plan.TotalSize)
+	}
+	var unsafe []string
+	for _, entry := range plan.Unsafe {
+		if !errors.Is(entry.Err, ErrUnsafePath) {
+			t.Errorf("%s: expected ErrUnsafePath, got %v", entry.Name, entry.Err)
+		}
+		unsafe = append(unsafe, entry.Name)
+	}
+	if expected := []string{"../evil", "dir/escape"}; !slices.Equal(unsafe, expected) {
+		t.Errorf("expected %q to be unsafe, got %q", expected, unsafe)
+	}
+	if entry := plan.Entries[3]; entry.LinkTarget != "../ok.txt" || entry.Mode&fs.ModeSymlink == 0 {
+		t.Errorf("expected symlink to ../ok.txt, got %q with mode %v", entry.LinkTarget, entry.Mode)
+	}
+
+	// as in TestTar_SecureExtractSwappedDirectory, which is refused
+	archive = newTestTar(t,
+		&tar.Header{Name: "a", Typeflag: tar.TypeSymlink, Linkname: "x/../outside"},
+		&tar.Header{Name: "x", Typeflag: tar.TypeSymlink, Linkname: "."},
+		&tar.Header{Name: "a/evil.txt", Typeflag: tar.TypeReg},
+	)
+	plan, err = Plan(context.Background(), Tar{}, archive)
+	checkErr(t, err, "planning")
+	if len(plan.Unsafe) != 1 || plan.Unsafe[0].Name != "a/evil.txt" || !errors.Is(plan.Unsafe[0].Err, ErrUnsafePath) {
+		t.Errorf("expected a/evil.txt to be unsafe, got %+v", plan.Unsafe)
+	}
+}
+
+func TestTar_SecureExtractSparse(t *testing.T) {
+	// Test files testdata/test-sparse*.tar were created by:
+	//   truncate -s 8M sparse.img
+	//   printf start | dd of=sparse.img conv=notrunc
+	//   printf middle | dd of=sparse.img bs=1 seek=3145728 conv=notrunc
+	//   tar --sparse --format=posix -cf test-sparse.tar sparse.img
+	//   tar --sparse --format=gnu -cf test-sparse-gnu.tar sparse.img
+	expected := make([]byte, 8<<20)
+	copy(expected, "start")
+	copy(expected[3<<20:], "middle")
+
+	for _, name := range []string{"test-sparse.tar", "test-sparse-gnu.tar"} {
+		archive, err := os.Open(filepath.Join("testdata", name))
+		checkErr(t, err, "opening %s", name)
+		defer archive.Close()
+		dest := t.TempDir()
+		checkErr(t, Tar{}.SecureExtract(context.Background(), archive, dest), "extracting %s", name)
+
+		extracted := filepath.Join(dest, "sparse.img")
+		contents, err := os.ReadFile(extracted)
+		checkErr(t, err, "reading extracted file")
+		if !bytes.Equal(contents, expected) {
+			t.Errorf("%s: extracted file differs from original (%d vs %d bytes)", name, len(contents), len(expected))
+		}
+
+		// where the size on disk is known, the holes must not take space
+		info, err := os.Stat(extracted)
+		checkErr(t, err, "statting extracted file")
+		if sys := reflect.ValueOf(info.Sys()); sys.Kind() == reflect.Pointer {
+			if blocks := sys.Elem().FieldByName("Blocks"); blocks.CanInt() && blocks.Int()*512 >= 1<<20 {
+				t.Errorf("%s: expected holes in extracted file, but it uses %d bytes on disk", name, blocks.Int()*512)
+			}
+		}
+	}
+}
+
+func TestTar_PAXRecords(t *testing.T) {
+	records := map[string]string{
+		"SCHILY.xattr.user.comment":       "hello",
+		"SCHILY.xattr.security.selinux":   "system_u:object_r:tmp_t:s0",
+		"SCHILY.xattr.trusted.overlay.ok": "y",
+	}
+	archive := newTestTar(t, &tar.Header{Name: "file.txt", Typeflag: tar.TypeReg, PAXRecords: records, Format: tar.FormatPAX})
+
+	var got map[string]string
+	err := Tar{}.Extract(context.Background(), archive, func(_ context.Context, f FileInfo) error {
+		got = f.PAXRecords
+		return nil
+	})
+	checkErr(t, err, "extracting")
+	if !reflect.DeepEqual(got, records) {
+		t.Errorf("expected PAX records %v, got %v", records, got)
+	}
+
+	// only the user and security namespaces are restored
+	expected := map[string]string{"user.comment": "hello", "security.selinux": "system_u:object_r:tmp_t:s0"}
+	if xattrs := restorableXattrs(FileInfo{PAXRecords: got}); !reflect.DeepEqual(xattrs, expected) {
+		t.Errorf("expected restorable xattrs %v, got %v", expected, xattrs)
+	}
+
+	// and the records are written when archiving
+	fname, info := newTmpTextFile(t, "contents")
+	defer os.Remove(fname)
+	var buf bytes.Buffer
+	err = Tar{}.Archive(context.Background(), &buf, []FileInfo{{
+		FileInfo:      info,
+		NameInArchive: "file.txt",
+		PAXRecords:    map[string]string{"SCHILY.xattr.user.comment": "hello"},
+		Open:          func() (fs.File, error) { return os.Open(fname) },
+	}})
+	checkErr(t, err, "archiving")
+	hdr, err := tar.NewReader(&buf).Next()
+	checkErr(t, err, "reading header")
+	if hdr.PAXRecords["SCHILY.xattr.user.comment"] != "hello" {
+		t.Errorf("expected PAX record to be archived, got %v", hdr.PAXRecords)
+	}
+}
+
+func TestTar_Transform(t *testing.T) {
+	hdrs := []*tar.Header{
+		{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "dir/file.txt", Typeflag: tar.TypeReg},
+		{Name: "dir/file.bin", Typeflag: tar.TypeReg},
+	}
+	upper := func(name string, r io.Reader) (io.Reader, error) {
+		if path.Ext(name) != ".txt" {
+			return r, nil
+		}
+		b, err := io.ReadAll(r)
+		return bytes.NewReader(bytes.ToUpper(b)), err
+	}
+	dest := t.TempDir()
+	checkErr(t, Tar{Transform: upper}.SecureExtract(context.Background(), newTestTar(t, hdrs...), dest), "extracting")
+	for name, expected := range map[string]string{"dir/file.txt": "DIR/FILE.TXT", "dir/file.bin": "dir/file.bin"} {
+		contents, err := os.ReadFile(filepath.Join(dest, filepath.FromSlash(name)))
+		checkErr(t, err, "reading %s", name)
+		if string(contents) != expected {
+			t.Errorf("%s: expected contents %q, got %q", name, expected, contents)
+		}
+	}
+
+	// an error aborts the entry
+	refused := errors.New("refused")
+	format := Tar{ContinueOnError: true, Transform: func(name string, r io.Reader) (io.Reader, error) {
+		if name == "dir/file.bin" {
+			return nil, refused
+		}
+		return r, nil
+	}}
+	err := format.SecureExtract(context.Background(), newTestTar(t, hdrs...), t.TempDir())
+	var entryErrs EntryErrors
+	if !errors.As(err, &entryErrs) || len(entryErrs) != 1 || entryErrs[0].Name != "dir/file.bin" || !errors.Is(err, refused) {
+		t.Errorf("expected dir/file.bin to fail with the transform's error, got %v", err)
+	}
+}
+
+func TestTar_LongLinkTargets(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symbolic links need privileges on Windows")
+	}
+	root := t.TempDir()
+	longName := strings.Repeat("n", 120)
+	longTarget := strings.Repeat("t", 150) + ".txt"
+	checkErr(t, os.Symlink(longTarget, filepath.Join(root, longName)), "creating symlink")
+	files, err := FilesFromDisk(context.Background(), nil, map[string]string{filepath.Join(root, longName): longName})
+	checkErr(t, err, "gathering files")
+
+	for _, format := range []Tar{{FormatGNU: true}, {}} {
+		var buf bytes.Buffer
+		checkErr(t, format.Archive(context.Background(), &buf, files), "archiving")
+		if format.FormatGNU {
+			// GNU long link entries, then the symlink
+			archived := buf.Bytes()
+			var typeflags []byte
+			for off := 0; off+512 <= len(archived) && archived[off] != 0; {
+				block := archived[off : off+512]
+				typeflags = append(typeflags, block[156])
+				size, err := strconv.ParseInt(strings.Trim(string(block[124:136]), "\x00 "), 8, 64)
+				checkErr(t, err, "parsing size")
+				off += 512 + int(size+511)/512*512
+			}
+			if expected := []byte{tar.TypeGNULongName, tar.TypeGNULongLink, tar.TypeSymlink}; !bytes.Equal(typeflags, expected) {
+				t.Errorf("expected GNU headers of types %q, got %q", expected, typeflags)
+			}
+		}
+
+		dest := t.TempDir()
+		checkErr(t, format.SecureExtract(context.Background(), bytes.NewReader(buf.Bytes()), dest), "extracting")
+		target, err := os.Readlink(filepath.Join(dest, longName))
+		checkErr(t, err, "reading symlink")
+		if target != longTarget {
+			t.Errorf("GNU=%t: expected target of %d chars, got %q", format.FormatGNU, len(longTarget), target)
+		}
+	}
+}
+
+// maxWriteRecorder records the size of the largest write to it.
+type maxWriteRecorder struct {
+	max int
+}
+
+func (mw *maxWriteRecorder) Write(p []byte) (int, error) {
+	mw.max = max(mw.max, len(p))
+	return len(p), nil
+}
+
+func TestTar_CopyBufferSize(t *testing.T) {
+	file, err := FileFromReader("big.bin", 0644, bytes.NewReader(make([]byte, 4<<20)))
+	checkErr(t, err, "creating file")
+	for _, tc := range []struct {
+		size, expected int
+	}{
+		{0, copyBufferSize},
+		{-1, copyBufferSize},
+		{1 << 20, 1 << 20},
+	} {
+		var output maxWriteRecorder
+		checkErr(t, Tar{CopyBufferSize: tc.size}.Archive(context.Background(), &output, []FileInfo{file}), "archiving")
+		if output.max != tc.expected {
+			t.Errorf("CopyBufferSize=%d: expected writes of up to %d bytes, got %d", tc.size, tc.expected, output.max)
+		}
+	}
+}
+
+func BenchmarkTar_CopyBufferSize(b *testing.B) {
+	data := make([]byte, 64<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+	file, err := FileFromReader("big.bin", 0644, bytes.NewReader(data))
+	if err != nil {
+		b.Fatal(err)
+	}
+	archived, err := ArchiveToBytes(context.Background(), Tar{}, []FileInfo{file})
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, size := range []int{0, 256 << 10, 1 << 20} {
+		b.Run(fmt.Sprintf("size=%d", size), func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for range b.N {
+				dest := b.TempDir()
+				if err := (Tar{CopyBufferSize: size}).SecureExtract(context.Background(), bytes.NewReader(archived), dest); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
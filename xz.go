@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"io"
+	"runtime"
 	"strings"
 
 	fastxz "github.com/therootcompany/xz"
@@ -14,11 +15,30 @@ func init() {
 	RegisterFormat(Xz{})
 }
 
+// DefaultXzLevel is the xz compression level used
+// when Xz.CompressionLevel is 0.
+const DefaultXzLevel = 6
+
 // Xz facilitates xz compression.
-type Xz struct{}
+type Xz struct {
+	// Xz compression level, from 1 (fastest) to 9 (best),
+	// which sets the dictionary size like the presets of
+	// the xz command. If 0, DefaultXzLevel is used rather
+	// than preset 0. Levels out of range are clamped.
+	CompressionLevel int
+
+	// The number of goroutines compressing at once. The input
+	// is split into blocks of three times the dictionary size
+	// (as with the xz command), which are compressed in parallel
+	// as separate xz streams and then concatenated, which any
+	// xz decompressor reads as one stream. If 0, GOMAXPROCS is
+	// used; if 1, the input is compressed as one stream.
+	Threads int
+}
 
-func (Xz) Extension() string { return ".xz" }
-func (Xz) MediaType() string { return "application/x-xz" }
+func (Xz) Extension() string      { return ".xz" }
+func (Xz) MediaType() string      { return "application/x-xz" }
+func (Xz) magicNumbers() [][]byte { return [][]byte{xzHeader} }
 
 func (x Xz) Match(_ context.Context, filename string, stream io.Reader) (MatchResult, error) {
 	var mr MatchResult
@@ -38,8 +58,116 @@ func (x Xz) Match(_ context.Context, filename string, stream io.Reader) (MatchRe
 	return mr, nil
 }
 
-func (Xz) OpenWriter(w io.Writer) (io.WriteCloser, error) {
-	return xz.NewWriter(w)
+func (x Xz) OpenWriter(w io.Writer) (io.WriteCloser, error) {
+	level := max(1, min(x.CompressionLevel, 9))
+	if x.CompressionLevel == 0 {
+		level = DefaultXzLevel
+	}
+	cfg := xz.WriterConfig{DictCap: xzDictCaps[level]}
+	threads := x.Threads
+	if threads == 0 {
+		threads = runtime.GOMAXPROCS(0)
+	}
+	if threads <= 1 {
+		return cfg.NewWriter(w)
+	}
+	if err := cfg.Verify(); err != nil {
+		return nil, err
+	}
+	return &xzParallelWriter{
+		w:         w,
+		cfg:       cfg,
+		blockSize: max(3*cfg.DictCap, 1<<20),
+		threads:   threads,
+	}, nil
+}
+
+// xzParallelWriter compresses blocks of its input concurrently, each
+// into a separate xz stream, and writes the streams in order.
+type xzParallelWriter struct {
+	w         io.Writer
+	cfg       xz.WriterConfig
+	blockSize int
+	threads   int
+
+	buf     []byte                   // the input not yet compressed
+	pending []chan xzCompressedBlock // blocks being compressed, in order
+	written bool                     // whether any block was compressed
+	err     error
+}
+
+type xzCompressedBlock struct {
+	data []byte
+	err  error
+}
+
+func (xw *xzParallelWriter) Write(p []byte) (int, error) {
+	if xw.err != nil {
+		return 0, xw.err
+	}
+	xw.buf = append(xw.buf, p...)
+	for len(xw.buf) >= xw.blockSize {
+		xw.compress(xw.buf[:xw.blockSize])
+		xw.buf = xw.buf[xw.blockSize:]
+		if xw.err != nil {
+			return 0, xw.err
+		}
+	}
+	return len(p), nil
+}
+
+// compress starts compressing block, after writing the oldest
+// pending block if as many blocks as threads are pending already.
+func (xw *xzParallelWriter) compress(block []byte) {
+	xw.written = true
+	if len(xw.pending) == xw.threads {
+		xw.writeOldest()
+	}
+	block = bytes.Clone(block)
+	result := make(chan xzCompressedBlock, 1)
+	xw.pending = append(xw.pending, result)
+	go func() {
+		var out bytes.Buffer
+		w, err := xw.cfg.NewWriter(&out)
+		if err == nil {
+			_, err = w.Write(block)
+		}
+		if err == nil {
+			err = w.Close()
+		}
+		result <- xzCompressedBlock{out.Bytes(), err}
+	}()
+}
+
+// writeOldest waits for the oldest pending block and writes it.
+func (xw *xzParallelWriter) writeOldest() {
+	result := <-xw.pending[0]
+	xw.pending = xw.pending[1:]
+	if xw.err != nil {
+		return
+	}
+	xw.err = result.err
+	if xw.err == nil {
+		_, xw.err = xw.w.Write(result.data)
+	}
+}
+
+func (xw *xzParallelWriter) Close() error {
+	if len(xw.buf) > 0 || !xw.written {
+		// an empty input still needs a stream
+		xw.compress(xw.buf)
+		xw.buf = nil
+	}
+	for len(xw.pending) > 0 {
+		xw.writeOldest()
+	}
+	return xw.err
+}
+
+// xzDictCaps are the dictionary sizes of the xz presets.
+var xzDictCaps = [...]int{
+	256 << 10, 1 << 20, 2 << 20, 4 << 20, 4 << 20,
+	8 << 20, 8 << 20, 16 << 20, 32 << 20, 64 << 20,
 }
 
 func (Xz) OpenReader(r io.Reader) (io.ReadCloser, error) {
@@ -0,0 +1,82 @@
+package archives
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/ulikunitz/xz"
+)
+
+// xzTestData returns n bytes of somewhat compressible data.
+func xzTestData(n int) []byte {
+	rng := rand.New(rand.NewSource(1))
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte('a' + rng.Intn(16))
+	}
+	return data
+}
+
+func TestXz_Threads(t *testing.T) {
+	data := xzTestData(1 << 20)
+
+	for _, threads := range []int{1, 4} {
+		for _, input := range [][]byte{data, nil} {
+			format := Xz{CompressionLevel: 1, Threads: threads}
+			var buf bytes.Buffer
+			w, err := format.OpenWriter(&buf)
+			checkErr(t, err, "opening writer")
+			if pw, ok := w.(*xzParallelWriter); ok {
+				pw.blockSize = 100 << 10 // several blocks
+			}
+			_, err = w.Write(input)
+			checkErr(t, err, "compressing")
+			checkErr(t, w.Close(), "closing writer")
+			compressed := buf.Bytes()
+			if streams := bytes.Count(compressed, xzHeader); threads > 1 && len(input) > 0 && streams < 2 {
+				t.Errorf("threads=%d: expected several streams, got %d", threads, streams)
+			}
+
+			r, err := format.OpenReader(bytes.NewReader(compressed))
+			checkErr(t, err, "opening reader")
+			decompressed, err := io.ReadAll(r)
+			checkErr(t, err, "decompressing")
+			if !bytes.Equal(decompressed, input) {
+				t.Errorf("threads=%d: decompressed %d bytes, expected %d", threads, len(decompressed), len(input))
+			}
+
+			// and with a different decoder
+			xr, err := xz.NewReader(bytes.NewReader(compressed))
+			checkErr(t, err, "opening other reader")
+			decompressed, err = io.ReadAll(xr)
+			checkErr(t, err, "decompressing with other reader")
+			if !bytes.Equal(decompressed, input) {
+				t.Errorf("threads=%d: other decoder decompressed %d bytes, expected %d", threads, len(decompressed), len(input))
+			}
+		}
+	}
+}
+
+func BenchmarkXz_Compress(b *testing.B) {
+	data := xzTestData(16 << 20)
+	for _, threads := range []int{1, 0} {
+		b.Run(fmt.Sprintf("threads=%d", threads), func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for range b.N {
+				w, err := Xz{Threads: threads}.OpenWriter(io.Discard)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := w.Write(data); err != nil {
+					b.Fatal(err)
+				}
+				if err := w.Close(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -3,19 +3,24 @@ package archives
 import (
 	"bytes"
 	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"log"
+	"math"
 	"os"
 	"path"
+	"sort"
 	"strings"
 	"sync"
+	"time"
+	"unicode/utf8"
 
 	szip "github.com/STARRY-S/zip"
 	"golang.org/x/text/encoding"
-	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/unicode/norm"
 
 	"github.com/dsnet/compress/bzip2"
 	"github.com/klauspost/compress/zip"
@@ -37,27 +42,35 @@ func init() {
 		return xz.NewWriter(out)
 	})
 
-	zip.RegisterDecompressor(ZipMethodBzip2, func(r io.Reader) io.ReadCloser {
+	for method, decomp := range zipDecompressors {
+		zip.RegisterDecompressor(method, decomp)
+	}
+}
+
+// zipDecompressors are the decompressors for the additional
+// compression methods, keyed by method.
+var zipDecompressors = map[uint16]zip.Decompressor{
+	ZipMethodBzip2: func(r io.Reader) io.ReadCloser {
 		bz2r, err := bzip2.NewReader(r, nil)
 		if err != nil {
 			return nil
 		}
 		return bz2r
-	})
-	zip.RegisterDecompressor(ZipMethodZstd, func(r io.Reader) io.ReadCloser {
+	},
+	ZipMethodZstd: func(r io.Reader) io.ReadCloser {
 		zr, err := zstd.NewReader(r)
 		if err != nil {
 			return nil
 		}
 		return zr.IOReadCloser()
-	})
-	zip.RegisterDecompressor(ZipMethodXz, func(r io.Reader) io.ReadCloser {
+	},
+	ZipMethodXz: func(r io.Reader) io.ReadCloser {
 		xr, err := xz.NewReader(r)
 		if err != nil {
 			return nil
 		}
 		return io.NopCloser(xr)
-	})
+	},
 }
 
 // zipEncodingCache provides caching for ZIP file encoding detection
@@ -69,22 +82,133 @@ type Zip struct {
 	// file extension).
 	SelectiveCompression bool
 
+	// Files whose names end with one of these extensions,
+	// such as ".jpg" or ".mp4", are stored without compression
+	// when archiving. Matching is case-insensitive, and the
+	// leading dot is optional.
+	StoreExtensions []string
+
+	// If true, the archive is reproducible: identical inputs
+	// give byte-identical output. Files are sorted by name
+	// (except by ArchiveAsync, which writes them as they come)
+	// and their modification times are set to 1980-01-01 UTC.
+	Deterministic bool
+
+	// If set, the modification time of every file archived,
+	// instead of its own; unlike Deterministic, it leaves the
+	// order of the files alone. It takes precedence over the
+	// time set by Deterministic.
+	ModTime time.Time
+
+	// If set, replaces the "version made by" field of each
+	// entry written, whose upper byte is the host system and
+	// lower byte the version of the ZIP specification, as 10 *
+	// major + minor; for example 0x033F is 6.3 on Unix. If
+	// that version isn't 2.0, each file is compressed into a
+	// temporary file first, and copied from there.
+	VersionMadeBy uint16
+
+	// If set, replaces the host system in the "version made
+	// by" field, which determines how readers interpret the
+	// external file attributes. By default it is 3 (Unix), and
+	// since MS-DOS is 0, use VersionMadeBy for that instead.
+	HostOS byte
+
 	// The method or algorithm for compressing stored files.
 	Compression uint16
 
 	// If true, errors encountered during reading or writing
 	// a file within an archive will be logged and the
-	// operation will continue on remaining files.
+	// operation will continue on remaining files. Extract
+	// then returns EntryErrors listing the files that failed.
 	ContinueOnError bool
 
 	// For files in zip archives that do not have UTF-8
 	// encoded filenames and comments, specify the character
 	// encoding here.
 	TextEncoding encoding.Encoding
+
+	// If set, non-UTF-8 filenames are always decoded with
+	// this encoding, bypassing auto-detection entirely. It
+	// takes precedence over TextEncoding. Entries that have
+	// the UTF-8 flag set are never decoded with it. Unlike
+	// TextEncoding, an error is returned if a filename can
+	// not be decoded.
+	//
+	// When archiving, entry names are encoded with it and
+	// the UTF-8 flag is cleared, for tools that expect names
+	// in a legacy encoding. An error is returned if a name
+	// contains characters the encoding can't represent.
+	FilenameEncoding encoding.Encoding
+
+	// If true, the UTF-8 flag (bit 11 of the general purpose
+	// flags) is set on every entry written, even when its name
+	// is plain ASCII, for tools that otherwise don't trust the
+	// name. It has no effect with FilenameEncoding.
+	ForceUTF8Flag bool
+
+	// A comment on the whole archive, written at the end of
+	// the central directory; at most 65535 bytes. It can be
+	// read back with Comment.
+	ArchiveComment string
+
+	// Globs selecting the entries to extract; see the package doc.
+	IncludePatterns []string
+	ExcludePatterns []string
+
+	// If true, macOS metadata is skipped; see the package doc.
+	SkipMacMetadata bool
+
+	// If true, names are normalized to NFC; see the package doc.
+	NormalizeNFC bool
+
+	// If set, reports reading progress; see the package doc.
+	OnProgress func(entryName string, bytesDone, bytesTotal int64)
+
+	// If set, wraps the contents of files; see the package doc.
+	Transform func(name string, r io.Reader) (io.Reader, error)
+
+	// The size in bytes of the buffer through which the contents
+	// of files are copied when archiving, inserting, extracting
+	// with ExtractToFS, and copying from the readers of ExtractOne
+	// and OpenRaw. Larger buffers can be faster on fast storage.
+	// If not positive, a default of 32 KiB is used.
+	CopyBufferSize int
+
+	// Limits on the bytes extracted; see the package doc.
+	MaxDecompressedSize int64
+	MaxEntrySize        int64
+
+	// If greater than 1, Extract handles this many files
+	// concurrently, which can be much faster for large
+	// archives on fast storage. Directories are handled
+	// first, one at a time, and then the other files, in
+	// no particular order; so the FileHandler must be safe
+	// for concurrent use, and the input must support
+	// concurrent calls to ReadAt (as os.File does). If any
+	// files fail, the error for the earliest in the archive
+	// is returned.
+	Concurrency int
+
+	// If positive, the most entries allowed; see the package doc.
+	MaxEntries int
+
+	// If true, checksums are verified; see the package doc.
+	VerifyChecksums bool
+
+	// The password for extracting encrypted entries, which
+	// may use traditional PKWARE encryption (ZipCrypto) or
+	// WinZip AES. Entries that are not encrypted are read
+	// normally. If it is wrong or missing, opening or reading
+	// an encrypted entry fails with ErrWrongPassword.
+	Password string
 }
 
-func (Zip) Extension() string { return ".zip" }
-func (Zip) MediaType() string { return "application/zip" }
+func (Zip) Extension() string      { return ".zip" }
+func (Zip) MediaType() string      { return "application/zip" }
+func (Zip) magicNumbers() [][]byte { return zipHeaders }
+
+func (z Zip) copyBufSize() int { return z.CopyBufferSize }
 
 func (z Zip) Match(_ context.Context, filename string, stream io.Reader) (MatchResult, error) {
 	var mr MatchResult
@@ -106,9 +230,51 @@ func (z Zip) Match(_ context.Context, filename string, stream io.Reader) (MatchR
 		}
 	}
 
+	// the archive may follow other data, such as the stub of a
+	// self-extracting archive, if the end can be read
+	if rs, ok := seekableStream(stream); ok && !mr.ByStream {
+		found, err := hasZipEndRecord(rs)
+		if err != nil {
+			return mr, err
+		}
+		mr.ByStream = found
+	}
+
 	return mr, nil
 }
 
+// hasZipEndRecord reports whether rs ends with the end of central
+// directory record of a zip archive and its comment, wherever the
+// archive starts. The position of rs is restored.
+func hasZipEndRecord(rs io.ReadSeeker) (bool, error) {
+	pos, err := rs.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return false, err
+	}
+	defer rs.Seek(pos, io.SeekStart)
+	size, err := rs.Seek(0, io.SeekEnd)
+	if err != nil {
+		return false, err
+	}
+
+	// the record is at the end, followed by a comment of up to 64 KiB
+	bufSize := min(size, zipEndLen+0xffff)
+	if _, err := rs.Seek(size-bufSize, io.SeekStart); err != nil {
+		return false, err
+	}
+	buf := make([]byte, bufSize)
+	if _, err := io.ReadFull(rs, buf); err != nil {
+		return false, err
+	}
+	for i := len(buf) - zipEndLen; i >= 0; i-- {
+		if binary.LittleEndian.Uint32(buf[i:]) == zipEndSignature &&
+			int(binary.LittleEndian.Uint16(buf[i+20:])) == len(buf)-i-zipEndLen {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
 // AutoDetectEncoding tries to detect the text encoding used in a ZIP file
 // by examining file names in the central directory. This avoids full extraction.
 func (z *Zip) AutoDetectEncoding(ctx context.Context, sr *io.SectionReader) encoding.Encoding {
@@ -142,8 +308,12 @@ func (z *Zip) AutoDetectEncoding(ctx context.Context, sr *io.SectionReader) enco
 	}
 
 	// For non-UTF8 files, we default to Shift-JIS as most common encoding for ZIP files
+	// (unless changed via DefaultFallbackEncoding)
 	// We don't try to analyze the bytes since we don't have access to the raw bytes
-	fallbackEncoding := japanese.ShiftJIS
+	fallbackEncoding := DefaultFallbackEncoding
+	if fallbackEncoding == nil {
+		return nil
+	}
 
 	// Cache the result for future use
 	zipEncodingCache.Store(cacheKey, fallbackEncoding)
@@ -153,6 +323,13 @@ func (z *Zip) AutoDetectEncoding(ctx context.Context, sr *io.SectionReader) enco
 func (z Zip) Archive(ctx context.Context, output io.Writer, files []FileInfo) error {
 	zw := zip.NewWriter(output)
 	defer zw.Close()
+	if err := z.setArchiveComment(zw); err != nil {
+		return err
+	}
+
+	if z.Deterministic {
+		files = sortedByName(files)
+	}
 
 	for i, file := range files {
 		if err := z.archiveOneFile(ctx, zw, i, file); err != nil {
@@ -160,12 +337,22 @@ func (z Zip) Archive(ctx context.Context, output io.Writer, files []FileInfo) er
 		}
 	}
 
+	// closing writes the central directory, including the ZIP64
+	// records if there are too many files or they are too large
+	// for the original format, so the archive is incomplete if
+	// it fails
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("closing zip writer: %w", err)
+	}
 	return nil
 }
 
 func (z Zip) ArchiveAsync(ctx context.Context, output io.Writer, jobs <-chan ArchiveAsyncJob) error {
 	zw := zip.NewWriter(output)
 	defer zw.Close()
+	if err := z.setArchiveComment(zw); err != nil {
+		return err
+	}
 
 	var i int
 	for job := range jobs {
@@ -173,6 +360,46 @@ func (z Zip) ArchiveAsync(ctx context.Context, output io.Writer, jobs <-chan Arc
 		i++
 	}
 
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("closing zip writer: %w", err)
+	}
+	return nil
+}
+
+// StreamingZipWriter writes a zip archive one file at a time, for
+// archives that grow as they are written, such as to a multipart
+// upload. It never seeks: the size and CRC-32 of each file are
+// written after its contents, in a data descriptor (flag 0x08), and
+// the central directory is written by Close.
+type StreamingZipWriter struct {
+	z   Zip
+	zw  *zip.Writer
+	idx int
+}
+
+// NewStreamingZipWriter returns a StreamingZipWriter that writes to w,
+// with the options of format, except Deterministic, which only sorts
+// the files given to Archive.
+func NewStreamingZipWriter(w io.Writer, format Zip) *StreamingZipWriter {
+	return &StreamingZipWriter{z: format, zw: zip.NewWriter(w)}
+}
+
+// Add writes file to the archive; its contents are read and
+// written entirely before it returns.
+func (sw *StreamingZipWriter) Add(ctx context.Context, file FileInfo) error {
+	sw.idx++
+	return sw.z.archiveOneFile(ctx, sw.zw, sw.idx-1, file)
+}
+
+// Close writes the central directory, which completes the archive.
+// It does not close the underlying writer.
+func (sw *StreamingZipWriter) Close() error {
+	if err := sw.z.setArchiveComment(sw.zw); err != nil {
+		return err
+	}
+	if err := sw.zw.Close(); err != nil {
+		return fmt.Errorf("closing zip writer: %w", err)
+	}
 	return nil
 }
 
@@ -189,6 +416,13 @@ func (z Zip) archiveOneFile(ctx context.Context, zw *zip.Writer, idx int, file F
 	if hdr.Name == "" {
 		hdr.Name = file.Name() // assume base name of file I guess
 	}
+	switch {
+	case !z.ModTime.IsZero():
+		hdr.Modified = z.ModTime
+	case z.Deterministic:
+		hdr.Modified = deterministicModTime
+	}
+	hdr.Comment = file.Comment
 
 	// customize header based on file properties
 	if file.IsDir() {
@@ -196,6 +430,8 @@ func (z Zip) archiveOneFile(ctx context.Context, zw *zip.Writer, idx int, file F
 			hdr.Name += "/" // required
 		}
 		hdr.Method = zip.Store
+	} else if z.storeExtension(hdr.Name) {
+		hdr.Method = zip.Store
 	} else if z.SelectiveCompression {
 		// only enable compression on compressable files
 		ext := strings.ToLower(path.Ext(hdr.Name))
@@ -208,6 +444,39 @@ func (z Zip) archiveOneFile(ctx context.Context, zw *zip.Writer, idx int, file F
 		hdr.Method = z.Compression
 	}
 
+	if z.FilenameEncoding != nil {
+		name, err := EncodeFilename(hdr.Name, z.FilenameEncoding)
+		if err != nil {
+			return fmt.Errorf("encoding name of file %d: %s: %w", idx, hdr.Name, err)
+		}
+		hdr.Name = string(name)
+		if hdr.Comment != "" {
+			comment, err := EncodeFilename(hdr.Comment, z.FilenameEncoding)
+			if err != nil {
+				return fmt.Errorf("encoding comment of file %d: %s: %w", idx, file.NameInArchive, err)
+			}
+			hdr.Comment = string(comment)
+		}
+		hdr.NonUTF8 = true // keeps the writer from setting the UTF-8 flag
+		hdr.Flags &^= 0x800
+	} else if z.ForceUTF8Flag {
+		hdr.Flags |= 0x800 // the writer only sets it for non-ASCII names
+	}
+	if len(hdr.Comment) > math.MaxUint16 {
+		return fmt.Errorf("file %d: %s: comment is %d bytes, more than the maximum of %d", idx, file.NameInArchive, len(hdr.Comment), math.MaxUint16)
+	}
+
+	// the writer keeps the upper byte (the host system) of the
+	// version made by, but always sets the lower byte to 2.0
+	version := z.versionMadeBy(hdr.CreatorVersion)
+	hdr.CreatorVersion = version
+	if z.VersionMadeBy != 0 && version&0xff != zipDefaultVersion {
+		if err := z.copyWithVersionMadeBy(ctx, zw, file, hdr, version); err != nil {
+			return fmt.Errorf("writing file %d: %s: %w", idx, file.Name(), err)
+		}
+		return nil
+	}
+
 	w, err := zw.CreateHeader(hdr)
 	if err != nil {
 		return fmt.Errorf("creating header for file %d: %s: %w", idx, file.Name(), err)
@@ -217,13 +486,100 @@ func (z Zip) archiveOneFile(ctx context.Context, zw *zip.Writer, idx int, file F
 	if file.IsDir() {
 		return nil
 	}
-	if err := openAndCopyFile(file, w); err != nil {
+	if err := openAndCopyFile(ctx, file, w, z.CopyBufferSize); err != nil {
 		return fmt.Errorf("writing file %d: %s: %w", idx, file.Name(), err)
 	}
 
 	return nil
 }
 
+// setArchiveComment sets the comment of zw to ArchiveComment,
+// encoded with FilenameEncoding if set.
+func (z Zip) setArchiveComment(zw *zip.Writer) error {
+	comment := z.ArchiveComment
+	if z.FilenameEncoding != nil && comment != "" {
+		encoded, err := EncodeFilename(comment, z.FilenameEncoding)
+		if err != nil {
+			return fmt.Errorf("encoding archive comment: %w", err)
+		}
+		comment = string(encoded)
+	}
+	if err := zw.SetComment(comment); err != nil {
+		return fmt.Errorf("setting archive comment: %w", err)
+	}
+	return nil
+}
+
+// zipDefaultVersion is the version of the specification that the
+// zip writer puts in the "version made by" field: 2.0.
+const zipDefaultVersion = 20
+
+// versionMadeBy returns version with VersionMadeBy and HostOS applied.
+func (z Zip) versionMadeBy(version uint16) uint16 {
+	if z.VersionMadeBy != 0 {
+		version = z.VersionMadeBy
+	}
+	if z.HostOS != 0 {
+		version = version&0xff | uint16(z.HostOS)<<8
+	}
+	return version
+}
+
+// copyWithVersionMadeBy writes file with the header hdr to zw with the
+// given "version made by", which the writer can't be told to use when
+// it compresses the file itself: so the file is written to a temporary
+// archive first, and copied from there as is.
+func (z Zip) copyWithVersionMadeBy(ctx context.Context, zw *zip.Writer, file FileInfo, hdr *zip.FileHeader, version uint16) error {
+	tmp, err := os.CreateTemp("", "archives-spool-*")
+	if err != nil {
+		return err
+	}
+	spool := spooledFile{tmp}
+	defer spool.Close()
+
+	tw := zip.NewWriter(spool)
+	w, err := tw.CreateHeader(hdr)
+	if err != nil {
+		return fmt.Errorf("creating header: %w", err)
+	}
+	if !file.IsDir() {
+		if err := openAndCopyFile(ctx, file, w, z.CopyBufferSize); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	size, err := spool.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	zr, err := zip.NewReader(spool, size)
+	if err != nil {
+		return err
+	}
+	f := zr.File[0]
+	f.CreatorVersion = version
+	return zw.Copy(f)
+}
+
+// storeExtension reports whether name ends with one of z.StoreExtensions.
+func (z Zip) storeExtension(name string) bool {
+	name = strings.ToLower(name)
+	for _, ext := range z.StoreExtensions {
+		if ext == "" {
+			continue
+		}
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		if strings.HasSuffix(name, strings.ToLower(ext)) {
+			return true
+		}
+	}
+	return false
+}
+
 // Extract extracts files from z, implementing the Extractor interface.
 // The implementation is updated to auto-detect filename encoding if not specified.
 func (z Zip) Extract(ctx context.Context, sourceArchive io.Reader, handleFile FileHandler) error {
@@ -238,7 +594,7 @@ func (z Zip) Extract(ctx context.Context, sourceArchive io.Reader, handleFile Fi
 	}
 
 	// Automatically detect encoding if none is specified
-	if z.TextEncoding == nil {
+	if z.TextEncoding == nil && z.FilenameEncoding == nil {
 		sr := io.NewSectionReader(sra, 0, size)
 		z.TextEncoding = z.AutoDetectEncoding(ctx, sr)
 	}
@@ -250,14 +606,41 @@ func (z Zip) Extract(ctx context.Context, sourceArchive io.Reader, handleFile Fi
 
 	// important to initialize to non-nil, empty value due to how fileIsIncluded works
 	skipDirs := skipList{}
+	limits := newExtractLimits(z.MaxDecompressedSize, z.MaxEntrySize, z.MaxEntries)
+	filter, err := newPatternFilter(z.IncludePatterns, z.ExcludePatterns)
+	if err != nil {
+		return err
+	}
+	filter.skipMacMetadata = z.SkipMacMetadata
 
-	for i, f := range zr.File {
+	var failed EntryErrors
+	var workers *zipWorkers
+	if z.Concurrency > 1 {
+		workers = newZipWorkers(ctx, z.Concurrency, handleFile, z.ContinueOnError)
+		defer workers.wait()
+	}
+
+	for _, i := range z.extractOrder(zr.File) {
+		f := zr.File[i]
 		if err := ctx.Err(); err != nil {
 			return err // honor context cancellation
 		}
+		if err := limits.countEntry(); err != nil {
+			return err
+		}
 
 		// ensure filename and comment are UTF-8 encoded
-		z.decodeText(&f.FileHeader)
+		rawName := []byte(f.Name)
+		nameEnc, err := z.decodeText(&f.FileHeader)
+		if err != nil {
+			return fmt.Errorf("decoding text of file %d: %w", i, err)
+		}
+		if z.NormalizeNFC {
+			f.Name = norm.NFC.String(f.Name)
+		}
+		if !filter.includes(f.Name) {
+			continue
+		}
 
 		if fileIsIncluded(skipDirs, f.Name) {
 			continue
@@ -273,15 +656,31 @@ func (z Zip) Extract(ctx context.Context, sourceArchive io.Reader, handleFile Fi
 			FileInfo:      info,
 			Header:        f.FileHeader,
 			NameInArchive: f.Name,
+			RawName:       rawName,
+			NameEncoding:  nameEnc,
+			Comment:       f.Comment,
 			LinkTarget:    linkTarget,
 			Open: func() (fs.File, error) {
-				openedFile, err := f.Open()
+				openedFile, err := z.openFile(f)
 				if err != nil {
 					return nil, err
 				}
 				return fileInArchive{openedFile, info}, nil
 			},
 		}
+		if z.VerifyChecksums {
+			// the zip package computes and checks the CRC-32
+			file = verifyChecksum(file, nil, 0, zip.ErrChecksum)
+		}
+		file = reportProgress(limits.apply(file), int64(f.UncompressedSize64), z.OnProgress)
+		file = transformContents(file, z.Transform)
+
+		if workers != nil && !file.IsDir() {
+			if !workers.handle(i, file) {
+				break
+			}
+			continue
+		}
 
 		err = handleFile(ctx, file)
 		if errors.Is(err, fs.SkipAll) {
@@ -291,32 +690,526 @@ func (z Zip) Extract(ctx context.Context, sourceArchive io.Reader, handleFile Fi
 		} else if err != nil {
 			if z.ContinueOnError {
 				log.Printf("[ERROR] %s: %v", f.Name, err)
+				failed = append(failed, EntryError{Name: f.Name, Err: err})
 				continue
 			}
 			return fmt.Errorf("handling file %d: %s: %w", i, f.Name, err)
 		}
 	}
 
-	return nil
+	if workers != nil {
+		if err := workers.wait(); err != nil {
+			return err
+		}
+		failed = append(failed, workers.entryErrors()...)
+	}
+	return failed.asError()
+}
+
+// extractOrder returns the indexes of files in the order they are to
+// be extracted: the order of the archive, or if extracting concurrently,
+// the directories first, so that they are handled before their contents.
+func (z Zip) extractOrder(files []*zip.File) []int {
+	order := make([]int, 0, len(files))
+	for i := range files {
+		order = append(order, i)
+	}
+	if z.Concurrency > 1 {
+		sort.SliceStable(order, func(a, b int) bool {
+			return files[order[a]].FileInfo().IsDir() && !files[order[b]].FileInfo().IsDir()
+		})
+	}
+	return order
+}
+
+// zipWorkers handles files from a zip archive concurrently. The error
+// it returns is the one for the earliest file in the archive, so that it
+// doesn't depend on how the work is scheduled.
+type zipWorkers struct {
+	jobs   chan zipJob
+	wg     sync.WaitGroup
+	waited bool
+
+	mu      sync.Mutex
+	failed  int   // index of the earliest file that failed or returned fs.SkipAll
+	err     error // the error for that file, or nil for fs.SkipAll
+	skipped []zipJobError
 }
 
-// decodeText decodes the name and comment fields from hdr into UTF-8.
-// It is a no-op if the text is already UTF-8 encoded or if z.TextEncoding
-// is not specified.
-func (z Zip) decodeText(hdr *zip.FileHeader) {
-	if hdr.NonUTF8 && z.TextEncoding != nil {
-		dec := z.TextEncoding.NewDecoder()
-		filename, err := dec.String(hdr.Name)
+type zipJob struct {
+	idx  int
+	file FileInfo
+}
+
+// zipJobError is the error for a file that failed while continuing
+// on errors.
+type zipJobError struct {
+	idx int
+	err EntryError
+}
+
+func newZipWorkers(ctx context.Context, concurrency int, handleFile FileHandler, continueOnError bool) *zipWorkers {
+	w := &zipWorkers{
+		jobs:   make(chan zipJob),
+		failed: math.MaxInt,
+	}
+	for range concurrency {
+		w.wg.Add(1)
+		go func() {
+			defer w.wg.Done()
+			for job := range w.jobs {
+				if w.failedBefore(job.idx) {
+					continue // extraction stops at an earlier file
+				}
+				err := handleFile(ctx, job.file)
+				if err == nil {
+					continue
+				}
+				if errors.Is(err, fs.SkipAll) {
+					err = nil
+				} else if continueOnError {
+					log.Printf("[ERROR] %s: %v", job.file.NameInArchive, err)
+					w.mu.Lock()
+					w.skipped = append(w.skipped, zipJobError{job.idx, EntryError{Name: job.file.NameInArchive, Err: err}})
+					w.mu.Unlock()
+					continue
+				} else {
+					err = fmt.Errorf("handling file %d: %s: %w", job.idx, job.file.NameInArchive, err)
+				}
+				w.mu.Lock()
+				if job.idx < w.failed {
+					w.failed, w.err = job.idx, err
+				}
+				w.mu.Unlock()
+			}
+		}()
+	}
+	return w
+}
+
+// handle queues the file at index idx to be handled. It returns
+// false if extraction has stopped at an earlier file.
+func (w *zipWorkers) handle(idx int, file FileInfo) bool {
+	if w.failedBefore(idx) {
+		return false
+	}
+	w.jobs <- zipJob{idx, file}
+	return true
+}
+
+func (w *zipWorkers) failedBefore(idx int) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.failed < idx
+}
+
+// wait waits for the queued files to be handled and returns the
+// error for the earliest file that failed, if any. It is safe to
+// call more than once.
+func (w *zipWorkers) wait() error {
+	if !w.waited {
+		w.waited = true
+		close(w.jobs)
+		w.wg.Wait()
+	}
+	return w.err
+}
+
+// entryErrors returns the errors for the files that failed while
+// continuing on errors, in archive order, once wait has returned.
+func (w *zipWorkers) entryErrors() EntryErrors {
+	sort.Slice(w.skipped, func(i, j int) bool { return w.skipped[i].idx < w.skipped[j].idx })
+	var errs EntryErrors
+	for _, je := range w.skipped {
+		errs = append(errs, je.err)
+	}
+	return errs
+}
+
+// decodeText decodes the name and comment fields from hdr into UTF-8,
+// returning the encoding the name was decoded from, or nil if it wasn't.
+// It is a no-op if the text is already UTF-8 encoded or if no encoding
+// is specified. If z.FilenameEncoding is set, it is used instead of
+// z.TextEncoding, and an error is returned if the name can't be decoded.
+func (z Zip) decodeText(hdr *zip.FileHeader) (encoding.Encoding, error) {
+	enc := z.nameEncoding(hdr)
+	if enc == nil {
+		return nil, nil
+	}
+	dec := enc.NewDecoder()
+	nameEnc := enc
+	if z.FilenameEncoding != nil {
+		filename, err := DecodeFilename([]byte(hdr.Name), enc)
+		if err != nil {
+			return nil, fmt.Errorf("decoding filename %q: %w", hdr.Name, err)
+		}
+		hdr.Name = filename
+	} else if filename, err := dec.String(hdr.Name); err == nil {
+		hdr.Name = filename
+	} else {
+		nameEnc = nil
+	}
+	if hdr.Comment != "" {
+		comment, err := dec.String(hdr.Comment)
 		if err == nil {
-			hdr.Name = filename
+			hdr.Comment = comment
 		}
-		if hdr.Comment != "" {
-			comment, err := dec.String(hdr.Comment)
-			if err == nil {
-				hdr.Comment = comment
+	}
+	return nameEnc, nil
+}
+
+// nameEncoding returns the encoding decodeText uses for the text of
+// hdr, or nil if the text is not to be decoded.
+func (z Zip) nameEncoding(hdr *zip.FileHeader) encoding.Encoding {
+	if z.FilenameEncoding != nil {
+		// the UTF-8 flag is authoritative for a forced encoding, even
+		// if the name isn't strictly valid UTF-8
+		if hdr.Flags&0x800 != 0 || !hdr.NonUTF8 {
+			return nil
+		}
+		return z.FilenameEncoding
+	}
+	if hdr.NonUTF8 {
+		return z.TextEncoding
+	}
+	return nil
+}
+
+// ZipEntry is an entry in the central directory of a zip archive,
+// as passed to the callback of Zip.WalkEntries.
+type ZipEntry struct {
+	// The name exactly as stored in the archive.
+	RawName []byte
+
+	// The name decoded to UTF-8.
+	Name string
+
+	// Whether the UTF-8 flag (0x800) is set on the entry.
+	UTF8Flag bool
+
+	// The encoding used to decode the name, or nil if
+	// it was not decoded.
+	Encoding encoding.Encoding
+
+	// The file in the archive, which can be opened to
+	// read its contents.
+	File *zip.File
+}
+
+// WalkEntries calls fn for each entry in the central directory of the zip
+// archive, in order. Unlike Extract, the name of each entry is decoded only
+// when the entry is reached, and the raw name is available too. The text
+// encoding is chosen the same way as for Extract. If fn returns an error,
+// the walk stops and the error is returned.
+func (z Zip) WalkEntries(ctx context.Context, sourceArchive io.Reader, fn func(entry ZipEntry) error) error {
+	sra, ok := sourceArchive.(seekReaderAt)
+	if !ok {
+		return fmt.Errorf("input type must be an io.ReaderAt and io.Seeker because of zip format constraints")
+	}
+
+	size, err := streamSizeBySeeking(sra)
+	if err != nil {
+		return fmt.Errorf("determining stream size: %w", err)
+	}
+
+	if z.TextEncoding == nil && z.FilenameEncoding == nil {
+		sr := io.NewSectionReader(sra, 0, size)
+		z.TextEncoding = z.AutoDetectEncoding(ctx, sr)
+	}
+
+	zr, err := zip.NewReader(sra, size)
+	if err != nil {
+		return err
+	}
+
+	for i, f := range zr.File {
+		if err := ctx.Err(); err != nil {
+			return err // honor context cancellation
+		}
+
+		entry := ZipEntry{
+			RawName:  []byte(f.Name),
+			UTF8Flag: f.Flags&0x800 != 0,
+			File:     f,
+		}
+		enc, err := z.decodeText(&f.FileHeader)
+		if err != nil {
+			return fmt.Errorf("decoding text of file %d: %w", i, err)
+		}
+		entry.Name, entry.Encoding = f.Name, enc
+
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Walk calls fn for each file in the archive, in order, without reading
+// their contents (except for the targets of symbolic links), since the
+// entries are listed from the central directory. This is much faster
+// than Extract for listing an archive. The files can still be opened
+// by fn. If fn returns an error, the walk stops and the error is
+// returned; fs.SkipDir and fs.SkipAll work as they do for Extract.
+func (z Zip) Walk(ctx context.Context, sourceArchive io.Reader, fn func(info FileInfo) error) error {
+	z.ContinueOnError = false
+	z.Concurrency = 0
+	return walkArchive(ctx, z, sourceArchive, fn)
+}
+
+// ExtractOne opens the file named name directly through the central
+// directory, implementing the SingleExtractor interface. Filenames are
+// decoded the same way as for Extract before they are compared.
+func (z Zip) ExtractOne(ctx context.Context, sourceArchive io.Reader, name string) (io.ReadCloser, fs.FileInfo, error) {
+	f, i, err := z.findFile(ctx, sourceArchive, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	rc, err := z.openFile(f)
+	if err != nil {
+		return nil, nil, fmt.Errorf("opening file %d: %s: %w", i, f.Name, err)
+	}
+	return entryReader{Reader: rc, closer: rc, bufSize: z.CopyBufferSize}, f.FileInfo(), nil
+}
+
+// OpenRaw returns the contents of the file with the given name in
+// sourceArchive as they are stored, without decompressing them, along
+// with the compression method and the CRC-32 of the uncompressed
+// contents, so that the file can be copied into another archive without
+// compressing it again (see zip.Writer.CreateRaw). Names are compared as
+// by ExtractOne. Encrypted files are returned still encrypted. The
+// archive must not be closed before the contents are read. Like those
+// of ExtractOne, the returned reader implements io.WriterTo.
+func (z Zip) OpenRaw(ctx context.Context, sourceArchive io.Reader, name string) (io.Reader, uint16, uint32, error) {
+	f, i, err := z.findFile(ctx, sourceArchive, name)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	r, err := f.OpenRaw()
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("opening file %d: %s: %w", i, f.Name, err)
+	}
+	return entryReader{Reader: r, bufSize: z.CopyBufferSize}, f.Method, f.CRC32, nil
+}
+
+// Comment returns the comment on the whole zip archive in
+// sourceArchive, as written with ArchiveComment. The comment isn't
+// flagged as UTF-8 or not, so it is decoded with TextEncoding or
+// FilenameEncoding only if it isn't valid UTF-8.
+func (z Zip) Comment(sourceArchive io.Reader) (string, error) {
+	sra, ok := sourceArchive.(seekReaderAt)
+	if !ok {
+		return "", fmt.Errorf("input type must be an io.ReaderAt and io.Seeker because of zip format constraints")
+	}
+
+	size, err := streamSizeBySeeking(sra)
+	if err != nil {
+		return "", fmt.Errorf("determining stream size: %w", err)
+	}
+
+	zr, err := zip.NewReader(sra, size)
+	if err != nil {
+		return "", err
+	}
+
+	enc := z.FilenameEncoding
+	if enc == nil {
+		enc = z.TextEncoding
+	}
+	if enc == nil || utf8.ValidString(zr.Comment) {
+		return zr.Comment, nil
+	}
+	comment, err := enc.NewDecoder().String(zr.Comment)
+	if err != nil {
+		return "", fmt.Errorf("decoding archive comment: %w", err)
+	}
+	return comment, nil
+}
+
+// findFile returns the file with the given name in sourceArchive and
+// its index, for ExtractOne and OpenRaw.
+func (z Zip) findFile(ctx context.Context, sourceArchive io.Reader, name string) (*zip.File, int, error) {
+	sra, ok := sourceArchive.(seekReaderAt)
+	if !ok {
+		return nil, 0, fmt.Errorf("input type must be an io.ReaderAt and io.Seeker because of zip format constraints")
+	}
+
+	size, err := streamSizeBySeeking(sra)
+	if err != nil {
+		return nil, 0, fmt.Errorf("determining stream size: %w", err)
+	}
+
+	if z.TextEncoding == nil && z.FilenameEncoding == nil {
+		sr := io.NewSectionReader(sra, 0, size)
+		z.TextEncoding = z.AutoDetectEncoding(ctx, sr)
+	}
+
+	zr, err := zip.NewReader(sra, size)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	name = path.Clean(name)
+	if z.NormalizeNFC {
+		name = norm.NFC.String(name)
+	}
+	for i, f := range zr.File {
+		if err := ctx.Err(); err != nil {
+			return nil, 0, err // honor context cancellation
+		}
+		if _, err := z.decodeText(&f.FileHeader); err != nil {
+			return nil, 0, fmt.Errorf("decoding text of file %d: %w", i, err)
+		}
+		if z.NormalizeNFC {
+			f.Name = norm.NFC.String(f.Name)
+		}
+		if path.Clean(f.Name) == name {
+			return f, i, nil
+		}
+	}
+	return nil, 0, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+}
+
+// ZipFS returns a read-only file system over the zip archive in r, of the
+// given size, in which non-UTF-8 filenames are presented decoded to UTF-8.
+// Files are opened by their decoded names, which resolve to the original
+// entries. If enc is nil, the encoding is detected from a sample of the
+// non-UTF-8 names; names that fail to decode with a detected encoding are
+// left as-is, but with an explicit enc, an error is returned instead.
+func ZipFS(r io.ReaderAt, size int64, enc encoding.Encoding) (fs.FS, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+
+	strict := enc != nil
+	if enc == nil {
+		enc = detectZipNameEncoding(zr.File)
+	}
+
+	// the reader indexes names the first time it is opened,
+	// so decoding them beforehand makes them the names in the fs
+	for i, f := range zr.File {
+		if f.Flags&0x800 != 0 || !f.NonUTF8 {
+			continue
+		}
+		name, err := DecodeFilename([]byte(f.Name), enc)
+		if err != nil {
+			if strict {
+				return nil, fmt.Errorf("decoding name of file %d: %w", i, err)
+			}
+			continue
+		}
+		f.Name = name
+	}
+
+	return zr, nil
+}
+
+// detectZipNameEncoding detects the encoding of the non-UTF-8 names
+// among files, or returns nil if there are none or it can't be
+// determined.
+func detectZipNameEncoding(files []*zip.File) encoding.Encoding {
+	const maxSampleNames = 64
+	var sample [][]byte
+	for _, f := range files {
+		if f.Flags&0x800 != 0 || !f.NonUTF8 {
+			continue
+		}
+		sample = append(sample, []byte(f.Name))
+		if len(sample) == maxSampleNames {
+			break
+		}
+	}
+	return NewFilenameDecoder(sample).Encoding()
+}
+
+// ZipEncryption is how an entry in a zip archive is encrypted.
+type ZipEncryption int
+
+const (
+	ZipEncryptionNone      ZipEncryption = iota
+	ZipEncryptionZipCrypto               // traditional PKWARE encryption
+	ZipEncryptionAES                     // WinZip AES
+	ZipEncryptionStrong                  // PKWARE strong encryption, which is not supported
+)
+
+func (e ZipEncryption) String() string {
+	switch e {
+	case ZipEncryptionNone:
+		return "none"
+	case ZipEncryptionZipCrypto:
+		return "ZipCrypto"
+	case ZipEncryptionAES:
+		return "AES"
+	case ZipEncryptionStrong:
+		return "strong"
+	}
+	return fmt.Sprintf("ZipEncryption(%d)", int(e))
+}
+
+// ZipEntryInfo describes how an entry in a zip archive is stored,
+// as reported by InspectZip.
+type ZipEntryInfo struct {
+	// The name exactly as stored in the archive.
+	Name string
+
+	// The compression method. For entries encrypted with AES,
+	// it is the actual method, from the AES extra field.
+	Method uint16
+
+	// How the entry is encrypted, and for AES, the key size
+	// in bits (128, 192, or 256).
+	Encryption ZipEncryption
+	AESKeyBits int
+
+	CompressedSize   uint64
+	UncompressedSize uint64
+
+	// The CRC-32 of the contents. Entries encrypted with AE-2
+	// have none, so it is 0.
+	CRC32 uint32
+
+	// Whether the UTF-8 flag (0x800) is set on the entry.
+	UTF8Flag bool
+}
+
+// InspectZip returns how each entry in the zip archive in r, of the
+// given size, is compressed and encrypted, from the central directory,
+// without reading or decrypting any contents.
+func InspectZip(r io.ReaderAt, size int64) ([]ZipEntryInfo, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]ZipEntryInfo, 0, len(zr.File))
+	for i, f := range zr.File {
+		entry := ZipEntryInfo{
+			Name:             f.Name,
+			Method:           f.Method,
+			CompressedSize:   f.CompressedSize64,
+			UncompressedSize: f.UncompressedSize64,
+			CRC32:            f.CRC32,
+			UTF8Flag:         IsUTF8Filename(&f.FileHeader),
+		}
+		switch {
+		case f.Flags&zipFlagEncrypted == 0:
+		case f.Flags&zipFlagStrongEncrypted != 0:
+			entry.Encryption = ZipEncryptionStrong
+		case f.Method == zipMethodAES:
+			_, strength, method, err := parseAESExtra(f.Extra)
+			if err != nil {
+				return nil, fmt.Errorf("file %d: %s: %w", i, f.Name, err)
 			}
+			entry.Encryption, entry.Method = ZipEncryptionAES, method
+			entry.AESKeyBits = 64 + 64*int(strength)
+		default:
+			entry.Encryption = ZipEncryptionZipCrypto
 		}
+		entries = append(entries, entry)
 	}
+	return entries, nil
 }
 
 func (z Zip) getLinkTarget(f *zip.File) (string, error) {
@@ -327,7 +1220,7 @@ func (z Zip) getLinkTarget(f *zip.File) (string, error) {
 	}
 
 	// Open the file and read the link target
-	file, err := f.Open()
+	file, err := z.openFile(f)
 	if err != nil {
 		return "", err
 	}
@@ -369,6 +1262,9 @@ func (z Zip) Insert(ctx context.Context, into io.ReadWriteSeeker, files []FileIn
 		if hdr.Name == "" {
 			hdr.Name = file.Name() // assume base name of file I guess
 		}
+		if !z.ModTime.IsZero() {
+			hdr.Modified = z.ModTime
+		}
 
 		// customize header based on file properties
 		if file.IsDir() {
@@ -393,9 +1289,9 @@ func (z Zip) Insert(ctx context.Context, into io.ReadWriteSeeker, files []FileIn
 
 		// directories have no file body
 		if file.IsDir() {
-			return nil
+			continue
 		}
-		if err := openAndCopyFile(file, w); err != nil {
+		if err := openAndCopyFile(ctx, file, w, z.CopyBufferSize); err != nil {
 			if z.ContinueOnError && ctx.Err() == nil {
 				log.Printf("[ERROR] appending file %d into archive: %s: %v", idx, file.Name(), err)
 				continue
@@ -468,7 +1364,9 @@ var zipHeaders = [][]byte{
 
 // Interface guards
 var (
-	_ Archiver      = Zip{}
-	_ ArchiverAsync = Zip{}
-	_ Extractor     = Zip{}
+	_ Archiver        = Zip{}
+	_ ArchiverAsync   = Zip{}
+	_ Extractor       = Zip{}
+	_ SingleExtractor = Zip{}
+	_ Walker          = Zip{}
 )
@@ -0,0 +1,321 @@
+package archives
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+
+	"github.com/klauspost/compress/flate"
+	"github.com/klauspost/compress/zip"
+)
+
+// Bits in the general purpose flags and other values of zip entries
+// relevant to encryption. See APPNOTE.TXT sections 4.4.4 and 6 and
+// https://www.winzip.com/en/support/aes-encryption/.
+const (
+	zipFlagEncrypted       = 0x1
+	zipFlagDataDescriptor  = 0x8
+	zipFlagStrongEncrypted = 0x40
+
+	// entries encrypted with WinZip AES have this method; the
+	// actual compression method is in the AES extra field
+	zipMethodAES  = 99
+	zipAESExtraID = 0x9901
+)
+
+// openFile opens f for reading. If f is encrypted, it is decrypted
+// with z.Password, using traditional PKWARE encryption (ZipCrypto) or
+// WinZip AES as indicated by the entry. A wrong or missing password
+// results in ErrWrongPassword, either when opening the file or, for
+// ZipCrypto, whose password check is weak, when the checksum of the
+// contents doesn't match after reading them.
+func (z Zip) openFile(f *zip.File) (io.ReadCloser, error) {
+	if f.Flags&zipFlagEncrypted == 0 {
+		return f.Open()
+	}
+	if f.Flags&zipFlagStrongEncrypted != 0 {
+		return nil, fmt.Errorf("strong encryption is not supported: %w", zip.ErrAlgorithm)
+	}
+	raw, err := f.OpenRaw()
+	if err != nil {
+		return nil, err
+	}
+	if f.Method == zipMethodAES {
+		return openAESFile(f, raw, []byte(z.Password))
+	}
+	return openZipCryptoFile(f, raw, []byte(z.Password))
+}
+
+// zipDecompressor returns the decompressor for the given method,
+// or nil if the method is not supported.
+func zipDecompressor(method uint16) zip.Decompressor {
+	switch method {
+	case zip.Store:
+		return io.NopCloser
+	case zip.Deflate:
+		return flate.NewReader
+	}
+	return zipDecompressors[method]
+}
+
+// openZipCryptoFile returns the decrypted and decompressed contents
+// of f, whose raw data is encrypted with traditional PKWARE encryption.
+func openZipCryptoFile(f *zip.File, raw io.Reader, password []byte) (io.ReadCloser, error) {
+	keys := newZipCryptoKeys(password)
+	var header [12]byte
+	if _, err := io.ReadFull(raw, header[:]); err != nil {
+		return nil, fmt.Errorf("reading encryption header: %w", err)
+	}
+	keys.decrypt(header[:])
+
+	// the last byte of the header is the high byte of the CRC, or of
+	// the modification time if the CRC wasn't known when encrypting
+	check := byte(f.CRC32 >> 24)
+	if f.Flags&zipFlagDataDescriptor != 0 {
+		check = byte(f.ModifiedTime >> 8)
+	}
+	if header[11] != check {
+		return nil, ErrWrongPassword
+	}
+
+	src := &zipCryptoReader{r: raw, keys: keys}
+	return newZipDecryptedFile(f.Method, src, f.CRC32, fmt.Errorf("%w: %v", ErrWrongPassword, zip.ErrChecksum))
+}
+
+// zipCryptoKeys is the state of traditional PKWARE decryption.
+type zipCryptoKeys [3]uint32
+
+func newZipCryptoKeys(password []byte) *zipCryptoKeys {
+	keys := &zipCryptoKeys{0x12345678, 0x23456789, 0x34567890}
+	for _, b := range password {
+		keys.update(b)
+	}
+	return keys
+}
+
+func (k *zipCryptoKeys) update(b byte) {
+	k[0] = crc32Update(k[0], b)
+	k[1] += k[0] & 0xff
+	k[1] = k[1]*134775813 + 1
+	k[2] = crc32Update(k[2], byte(k[1]>>24))
+}
+
+// decrypt decrypts buf in place.
+func (k *zipCryptoKeys) decrypt(buf []byte) {
+	for i, c := range buf {
+		temp := k[2]&0xffff | 2
+		buf[i] = c ^ byte((temp*(temp^1))>>8)
+		k.update(buf[i])
+	}
+}
+
+// crc32Update updates crc with b, without the inversions that
+// surround the complete CRC-32 computation.
+func crc32Update(crc uint32, b byte) uint32 {
+	return crc32.IEEETable[byte(crc)^b] ^ crc>>8
+}
+
+type zipCryptoReader struct {
+	r    io.Reader
+	keys *zipCryptoKeys
+}
+
+func (zr *zipCryptoReader) Read(p []byte) (int, error) {
+	n, err := zr.r.Read(p)
+	zr.keys.decrypt(p[:n])
+	return n, err
+}
+
+// openAESFile returns the decrypted and decompressed contents of
+// f, whose raw data is encrypted with WinZip AES.
+func openAESFile(f *zip.File, raw io.Reader, password []byte) (io.ReadCloser, error) {
+	version, strength, method, err := parseAESExtra(f.Extra)
+	if err != nil {
+		return nil, err
+	}
+	if strength < 1 || strength > 3 {
+		return nil, fmt.Errorf("unknown AES strength %d: %w", strength, zip.ErrAlgorithm)
+	}
+	keyLen := 8 + 8*int(strength) // 128, 192, or 256 bits
+	saltLen := keyLen / 2
+	const verifierLen, authCodeLen = 2, 10
+
+	overhead := uint64(saltLen + verifierLen + authCodeLen)
+	if f.CompressedSize64 < overhead {
+		return nil, fmt.Errorf("AES encrypted data is too short: %w", zip.ErrFormat)
+	}
+	header := make([]byte, saltLen+verifierLen)
+	if _, err := io.ReadFull(raw, header); err != nil {
+		return nil, fmt.Errorf("reading encryption header: %w", err)
+	}
+	salt, verifier := header[:saltLen], header[saltLen:]
+
+	keys := pbkdf2SHA1(password, salt, 1000, 2*keyLen+verifierLen)
+	if !bytes.Equal(keys[2*keyLen:], verifier) {
+		return nil, ErrWrongPassword
+	}
+	block, err := aes.NewCipher(keys[:keyLen])
+	if err != nil {
+		return nil, err
+	}
+
+	src := &aesReader{
+		r:     io.LimitReader(raw, int64(f.CompressedSize64-overhead)),
+		raw:   raw,
+		block: block,
+		mac:   hmac.New(sha1.New, keys[keyLen:2*keyLen]),
+		used:  aes.BlockSize,
+	}
+	src.counter[0] = 1
+
+	// AE-2 omits the CRC, relying on the authentication code instead
+	var errChecksum error = zip.ErrChecksum
+	if version == 2 {
+		errChecksum = nil
+	}
+	return newZipDecryptedFile(method, src, f.CRC32, errChecksum)
+}
+
+// parseAESExtra returns the vendor version, key strength, and actual
+// compression method from the AES extra field in extra.
+func parseAESExtra(extra []byte) (version uint16, strength byte, method uint16, err error) {
+	for len(extra) >= 4 {
+		tag := binary.LittleEndian.Uint16(extra)
+		size := int(binary.LittleEndian.Uint16(extra[2:]))
+		extra = extra[4:]
+		if size > len(extra) {
+			break
+		}
+		if tag == zipAESExtraID && size >= 7 {
+			field := extra[:size]
+			return binary.LittleEndian.Uint16(field), field[4], binary.LittleEndian.Uint16(field[5:]), nil
+		}
+		extra = extra[size:]
+	}
+	return 0, 0, 0, fmt.Errorf("missing AES extra field: %w", zip.ErrFormat)
+}
+
+// aesReader decrypts WinZip AES encrypted data, which uses AES in CTR
+// mode with a little-endian counter, and verifies its authentication
+// code once all the data has been read.
+type aesReader struct {
+	r         io.Reader // the encrypted data
+	raw       io.Reader // the encrypted data followed by the authentication code
+	block     cipher.Block
+	mac       hash.Hash
+	counter   [aes.BlockSize]byte
+	keyStream [aes.BlockSize]byte
+	used      int   // bytes of keyStream already used
+	err       error // the result of verifying the authentication code
+}
+
+func (ar *aesReader) Read(p []byte) (int, error) {
+	if ar.err != nil {
+		return 0, ar.err
+	}
+	n, err := ar.r.Read(p)
+	ar.mac.Write(p[:n])
+	for i := range p[:n] {
+		if ar.used == aes.BlockSize {
+			ar.block.Encrypt(ar.keyStream[:], ar.counter[:])
+			ar.used = 0
+			for j := range ar.counter {
+				ar.counter[j]++
+				if ar.counter[j] != 0 {
+					break
+				}
+			}
+		}
+		p[i] ^= ar.keyStream[ar.used]
+		ar.used++
+	}
+	if err == io.EOF {
+		ar.err = io.EOF
+		authCode := make([]byte, 10)
+		if _, err := io.ReadFull(ar.raw, authCode); err != nil {
+			ar.err = fmt.Errorf("reading authentication code: %w", err)
+		} else if !hmac.Equal(ar.mac.Sum(nil)[:len(authCode)], authCode) {
+			ar.err = fmt.Errorf("authentication code mismatch: %w", zip.ErrChecksum)
+		}
+		return n, ar.err
+	}
+	return n, err
+}
+
+// zipDecryptedFile decompresses the decrypted data of a file. It
+// checks the CRC-32 of the contents, returning errChecksum if it
+// doesn't match, unless errChecksum is nil.
+type zipDecryptedFile struct {
+	rc          io.ReadCloser
+	src         io.Reader
+	crc         hash.Hash32
+	wantCRC     uint32
+	errChecksum error
+}
+
+func newZipDecryptedFile(method uint16, src io.Reader, wantCRC uint32, errChecksum error) (io.ReadCloser, error) {
+	decomp := zipDecompressor(method)
+	if decomp == nil {
+		return nil, zip.ErrAlgorithm
+	}
+	rc := decomp(src)
+	if rc == nil {
+		return nil, fmt.Errorf("initializing decompressor for method %d", method)
+	}
+	return &zipDecryptedFile{
+		rc:          rc,
+		src:         src,
+		crc:         crc32.NewIEEE(),
+		wantCRC:     wantCRC,
+		errChecksum: errChecksum,
+	}, nil
+}
+
+func (zf *zipDecryptedFile) Read(p []byte) (int, error) {
+	n, err := zf.rc.Read(p)
+	zf.crc.Write(p[:n])
+	if err == io.EOF {
+		// the decompressor may stop before the end of the data,
+		// which must still be read for it to be authenticated
+		if _, err := io.Copy(io.Discard, zf.src); err != nil {
+			return n, err
+		}
+		if zf.errChecksum != nil && zf.crc.Sum32() != zf.wantCRC {
+			return n, zf.errChecksum
+		}
+	}
+	return n, err
+}
+
+func (zf *zipDecryptedFile) Close() error { return zf.rc.Close() }
+
+// pbkdf2SHA1 derives a key of keyLen bytes from password and salt
+// with PBKDF2 (RFC 8018) using HMAC-SHA1.
+func pbkdf2SHA1(password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(sha1.New, password)
+	var key []byte
+	for block := uint32(1); len(key) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write(binary.BigEndian.AppendUint32(nil, block))
+		u := prf.Sum(nil)
+		t := bytes.Clone(u)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
@@ -0,0 +1,164 @@
+package archives
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zip"
+)
+
+// the most bytes searched for the first local header of an archive
+// being repaired, for archives that begin with a self-extractor
+const zipMaxSFXSize = 1 << 20
+
+// RebuildZipCentralDirectory writes a copy of the zip archive in src,
+// which is size bytes long, to dst with its central directory rebuilt
+// from the local headers of its files, for archives whose central
+// directory is damaged or missing, such as when a download or write
+// was cut short. The local headers are read in order from the first one,
+// which may follow a self-extractor program of up to 1 MiB (copied as
+// is), until one of the central directory records or anything other
+// than a local header is found, or src ends; whatever follows the last
+// file is not copied. An error wrapping zip.ErrFormat is returned if no
+// local header is found.
+//
+// The sizes and CRC-32 of files whose local header defers them to a
+// data descriptor are taken from the descriptor, which is found as in
+// Zip.ExtractStream; this only works for files that are stored or
+// compressed with deflate, and that aren't encrypted. An error is
+// returned if a file is truncated. Information only kept in the
+// central directory, such as modes and comments, is lost.
+func RebuildZipCentralDirectory(src io.ReaderAt, size int64, dst io.Writer) error {
+	sr := io.NewSectionReader(src, 0, size)
+	br := bufio.NewReader(sr)
+	offset := func() uint64 {
+		pos, _ := sr.Seek(0, io.SeekCurrent)
+		return uint64(pos) - uint64(br.Buffered())
+	}
+
+	// the first local header may come after a marker, for the first
+	// file of a split archive, or a program, for self-extracting ones
+	head := make([]byte, min(size, zipMaxSFXSize))
+	n, err := src.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("reading start of archive: %w", err)
+	}
+	first := bytes.Index(head[:n], binary.LittleEndian.AppendUint32(nil, zipLocalFileSignature))
+	if first < 0 {
+		return fmt.Errorf("%w: no local file header found", zip.ErrFormat)
+	}
+	br.Discard(first)
+
+	var dir bytes.Buffer
+	var records uint64
+	for {
+		start := offset()
+		hdr, zip64, err := readZipLocalHeader(br)
+		if err == io.EOF || errors.Is(err, zip.ErrFormat) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("reading local header of file %d: %w", records, err)
+		}
+
+		if hdr.Flags&zipFlagDataDescriptor == 0 {
+			if _, err := io.CopyN(io.Discard, br, int64(hdr.CompressedSize64)); err != nil {
+				return fmt.Errorf("file %d: %s: %w", records, hdr.Name, noEOF(err))
+			}
+		} else {
+			// the contents have to be read to find the descriptor
+			entry, err := newZipEntryReader(br, hdr, zip64)
+			if err != nil {
+				return fmt.Errorf("file %d: %s: %w", records, hdr.Name, err)
+			}
+			if _, err := io.Copy(io.Discard, entry); err != nil {
+				return fmt.Errorf("reading file %d: %s: %w", records, hdr.Name, err)
+			}
+		}
+
+		writeRebuiltCentralDirHeader(&dir, hdr, start)
+		records++
+	}
+
+	if records == 0 {
+		return fmt.Errorf("%w: no readable local file header found", zip.ErrFormat)
+	}
+
+	end := offset()
+	if _, err := io.Copy(dst, io.NewSectionReader(src, 0, int64(end))); err != nil {
+		return fmt.Errorf("copying files: %w", err)
+	}
+	writeZipEnd(&dir, records, uint64(dir.Len()), end, nil)
+	if _, err := dst.Write(dir.Bytes()); err != nil {
+		return fmt.Errorf("writing central directory: %w", err)
+	}
+	return nil
+}
+
+// writeRebuiltCentralDirHeader writes a central directory header to w
+// for the file with the local header hdr, which is at offset.
+func writeRebuiltCentralDirHeader(w *bytes.Buffer, hdr *zip.FileHeader, offset uint64) {
+	le := binary.LittleEndian
+
+	// the zip64 field of the local header is replaced with one for
+	// the central directory, which may also hold the offset
+	var extra []byte
+	for e := hdr.Extra; len(e) >= 4; {
+		size := int(le.Uint16(e[2:]))
+		if len(e) < 4+size {
+			break
+		}
+		if le.Uint16(e) != zip64ExtraID {
+			extra = append(extra, e[:4+size]...)
+		}
+		e = e[4+size:]
+	}
+	var zip64 []byte
+	field := func(v uint64) uint32 {
+		if v < 0xffffffff {
+			return uint32(v)
+		}
+		zip64 = le.AppendUint64(zip64, v)
+		return 0xffffffff
+	}
+	usize := field(hdr.UncompressedSize64)
+	csize := field(hdr.CompressedSize64)
+	off := field(offset)
+	version := hdr.ReaderVersion
+	if len(zip64) > 0 {
+		zip64Field := le.AppendUint16(nil, zip64ExtraID)
+		zip64Field = le.AppendUint16(zip64Field, uint16(len(zip64)))
+		extra = append(append(zip64Field, zip64...), extra...)
+		version = max(version, 45)
+	}
+
+	var attrs uint32
+	if len(hdr.Name) > 0 && hdr.Name[len(hdr.Name)-1] == '/' {
+		attrs = 0x10 // MS-DOS directory attribute
+	}
+
+	rec := le.AppendUint32(nil, zipCentralDirSignature)
+	rec = le.AppendUint16(rec, 20) // version made by: MS-DOS, 2.0
+	rec = le.AppendUint16(rec, version)
+	rec = le.AppendUint16(rec, hdr.Flags)
+	rec = le.AppendUint16(rec, hdr.Method)
+	rec = le.AppendUint16(rec, hdr.ModifiedTime)
+	rec = le.AppendUint16(rec, hdr.ModifiedDate)
+	rec = le.AppendUint32(rec, hdr.CRC32)
+	rec = le.AppendUint32(rec, csize)
+	rec = le.AppendUint32(rec, usize)
+	rec = le.AppendUint16(rec, uint16(len(hdr.Name)))
+	rec = le.AppendUint16(rec, uint16(len(extra)))
+	rec = le.AppendUint16(rec, 0) // comment length
+	rec = le.AppendUint16(rec, 0) // disk number
+	rec = le.AppendUint16(rec, 0) // internal attributes
+	rec = le.AppendUint32(rec, attrs)
+	rec = le.AppendUint32(rec, off)
+	w.Write(rec)
+	w.WriteString(hdr.Name)
+	w.Write(extra)
+}
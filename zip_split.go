@@ -0,0 +1,468 @@
+package archives
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SplitZip is a split (spanned) zip archive, made of volumes named like
+// archive.z01, archive.z02, ..., archive.zip, presented as one logical
+// zip archive. It can be passed to Zip.Extract or ZipFS like any other
+// zip stream. Close it when finished to close the volume files.
+type SplitZip struct {
+	*io.SectionReader
+	files []*os.File
+}
+
+// OpenSplitZip opens the volumes of a split zip archive. Each argument
+// may be the path to a volume or a glob pattern matching volumes, and
+// they may be given in any order, but all of them must belong to the
+// same archive. The volume numbers must be contiguous and end with the
+// .zip volume; otherwise an error naming the first missing volume is
+// returned.
+func OpenSplitZip(volumes ...string) (*SplitZip, error) {
+	paths, err := orderSplitZipVolumes(volumes)
+	if err != nil {
+		return nil, err
+	}
+
+	sz := new(SplitZip)
+	var parts []volumePart
+	var offset int64
+	for _, p := range paths {
+		f, err := os.Open(p)
+		if err != nil {
+			sz.Close()
+			return nil, err
+		}
+		sz.files = append(sz.files, f)
+		info, err := f.Stat()
+		if err != nil {
+			sz.Close()
+			return nil, err
+		}
+		parts = append(parts, volumePart{ReaderAt: f, offset: offset, size: info.Size()})
+		offset += info.Size()
+	}
+
+	ra, size, err := joinSplitZip(parts)
+	if err != nil {
+		sz.Close()
+		if errors.Is(err, errMissingVolumes) {
+			return nil, fmt.Errorf("%w: first missing volume is %s",
+				err, splitZipVolumeName(paths[len(paths)-1], len(paths)-1))
+		}
+		return nil, fmt.Errorf("reading split zip: %w", err)
+	}
+	sz.SectionReader = io.NewSectionReader(ra, 0, size)
+
+	return sz, nil
+}
+
+// Close closes all the volume files.
+func (sz *SplitZip) Close() error {
+	var errs []error
+	for _, f := range sz.files {
+		errs = append(errs, f.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// orderSplitZipVolumes expands any glob patterns in volumes and returns
+// the paths ordered by volume number, with the .zip volume last.
+func orderSplitZipVolumes(volumes []string) ([]string, error) {
+	var paths []string
+	for _, v := range volumes {
+		if !strings.ContainsAny(v, "*?[") {
+			paths = append(paths, v)
+			continue
+		}
+		matches, err := filepath.Glob(v)
+		if err != nil {
+			return nil, fmt.Errorf("expanding volume pattern %s: %w", v, err)
+		}
+		paths = append(paths, matches...)
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no volumes")
+	}
+
+	numbered := make(map[int]string)
+	var last string
+	for _, p := range paths {
+		ext := strings.ToLower(filepath.Ext(p))
+		if ext == ".zip" {
+			if last != "" && last != p {
+				return nil, fmt.Errorf("more than one .zip volume: %s and %s", last, p)
+			}
+			last = p
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimPrefix(ext, ".z"))
+		if !strings.HasPrefix(ext, ".z") || err != nil || n < 1 {
+			return nil, fmt.Errorf("not a split zip volume: %s", p)
+		}
+		numbered[n] = p
+	}
+	if last == "" {
+		return nil, fmt.Errorf("missing final .zip volume")
+	}
+
+	ordered := make([]string, 0, len(numbered)+1)
+	for n := 1; n <= len(numbered); n++ {
+		p, ok := numbered[n]
+		if !ok {
+			return nil, fmt.Errorf("volume numbers are not contiguous: first missing volume is %s",
+				splitZipVolumeName(last, n-1))
+		}
+		ordered = append(ordered, p)
+	}
+	return append(ordered, last), nil
+}
+
+// splitZipVolumeName returns the name of the volume with the given
+// zero-based disk number, for the archive whose last volume is zipPath.
+func splitZipVolumeName(zipPath string, disk int) string {
+	return strings.TrimSuffix(zipPath, filepath.Ext(zipPath)) + fmt.Sprintf(".z%02d", disk+1)
+}
+
+// errMissingVolumes is returned by joinSplitZip when the end of
+// central directory record refers to more disks than were given.
+var errMissingVolumes = errors.New("split zip is missing volumes")
+
+const (
+	zipSpanningSignature     = 0x08074b50
+	zipLocalFileSignature    = 0x04034b50
+	zipCentralDirSignature   = 0x02014b50
+	zipEndSignature          = 0x06054b50
+	zip64EndSignature        = 0x06064b50
+	zip64EndLocatorSignature = 0x07064b50
+	zip64ExtraID             = 0x0001
+	zipEndLen                = 22
+	zip64EndLen              = 56
+	zip64EndLocatorLen       = 20
+	zipCentralDirHeaderLen   = 46
+)
+
+// joinSplitZip returns a reader over the volumes of a split zip joined
+// end to end, with the central directory rewritten so that its offsets,
+// which are relative to the start of each volume, are relative to the
+// start of the joined stream instead. The zip reader can then read it
+// like a regular archive.
+func joinSplitZip(parts []volumePart) (io.ReaderAt, int64, error) {
+	var total int64
+	for _, p := range parts {
+		total += p.size
+	}
+	joined := &multiReaderAt{parts: parts, size: total}
+
+	end, err := readSplitZipEnd(parts[len(parts)-1])
+	if err != nil {
+		return nil, 0, err
+	}
+	if end.disk+1 != uint64(len(parts)) {
+		if end.disk+1 > uint64(len(parts)) {
+			return nil, 0, errMissingVolumes
+		}
+		return nil, 0, fmt.Errorf("archive has %d volumes, but %d were given", end.disk+1, len(parts))
+	}
+	if end.dirDisk >= uint64(len(parts)) {
+		return nil, 0, fmt.Errorf("central directory is on volume %d, which does not exist", end.dirDisk+1)
+	}
+
+	// the first volume starts with the spanning signature, or with a
+	// local file header if the tool didn't write one; the offsets in
+	// the first volume already account for the signature, so it can
+	// stay in place
+	sig := make([]byte, 4)
+	if _, err := parts[0].ReadAt(sig, 0); err != nil {
+		return nil, 0, fmt.Errorf("reading first volume: %w", err)
+	}
+	if s := binary.LittleEndian.Uint32(sig); s != zipSpanningSignature && s != zipLocalFileSignature {
+		return nil, 0, fmt.Errorf("first volume is not the start of a zip archive")
+	}
+
+	dirStart := parts[end.dirDisk].offset + int64(end.dirOffset)
+	dir := make([]byte, end.dirSize)
+	if _, err := joined.ReadAt(dir, dirStart); err != nil {
+		return nil, 0, fmt.Errorf("reading central directory: %w", err)
+	}
+
+	var newDir bytes.Buffer
+	for i := uint64(0); i < end.records; i++ {
+		if dir, err = rewriteCentralDirHeader(&newDir, dir, parts); err != nil {
+			return nil, 0, fmt.Errorf("central directory record %d: %w", i, err)
+		}
+	}
+
+	newDirOffset := uint64(dirStart)
+	writeZipEnd(&newDir, end.records, uint64(newDir.Len()), newDirOffset, end.comment)
+
+	joined.parts = append(trimParts(parts, dirStart), volumePart{
+		ReaderAt: bytes.NewReader(newDir.Bytes()),
+		offset:   dirStart,
+		size:     int64(newDir.Len()),
+	})
+	joined.size = dirStart + int64(newDir.Len())
+
+	return joined, joined.size, nil
+}
+
+// splitZipEnd holds the fields of the end of central directory
+// record (or its zip64 counterpart) that joinSplitZip needs.
+type splitZipEnd struct {
+	disk, dirDisk, records, dirSize, dirOffset uint64
+	comment                                    []byte
+}
+
+// readSplitZipEnd finds and parses the end of central directory
+// record in the last volume.
+func readSplitZipEnd(last volumePart) (splitZipEnd, error) {
+	var end splitZipEnd
+
+	// the record is at the end, followed by a comment of up to 64 KiB
+	bufSize := min(last.size, zipEndLen+0xffff)
+	buf := make([]byte, bufSize)
+	if _, err := last.ReadAt(buf, last.size-bufSize); err != nil && err != io.EOF {
+		return end, err
+	}
+	pos := -1
+	for i := len(buf) - zipEndLen; i >= 0; i-- {
+		if binary.LittleEndian.Uint32(buf[i:]) == zipEndSignature {
+			pos = i
+			break
+		}
+	}
+	if pos < 0 {
+		return end, fmt.Errorf("end of central directory record not found")
+	}
+
+	rec := buf[pos:]
+	end.disk = uint64(binary.LittleEndian.Uint16(rec[4:]))
+	end.dirDisk = uint64(binary.LittleEndian.Uint16(rec[6:]))
+	end.records = uint64(binary.LittleEndian.Uint16(rec[10:]))
+	end.dirSize = uint64(binary.LittleEndian.Uint32(rec[12:]))
+	end.dirOffset = uint64(binary.LittleEndian.Uint32(rec[16:]))
+	commentLen := int(binary.LittleEndian.Uint16(rec[20:]))
+	if zipEndLen+commentLen > len(rec) {
+		return end, fmt.Errorf("invalid comment length")
+	}
+	end.comment = rec[zipEndLen : zipEndLen+commentLen]
+
+	// a zip64 locator, if any, immediately precedes the record
+	if pos < zip64EndLocatorLen {
+		return end, nil
+	}
+	loc := buf[pos-zip64EndLocatorLen : pos]
+	if binary.LittleEndian.Uint32(loc) != zip64EndLocatorSignature {
+		return end, nil
+	}
+	// the zip64 record is normally on the last volume too
+	rec64 := make([]byte, zip64EndLen)
+	rec64Offset := int64(binary.LittleEndian.Uint64(loc[8:]))
+	if _, err := last.ReadAt(rec64, rec64Offset); err != nil {
+		return end, fmt.Errorf("reading zip64 end of central directory record: %w", err)
+	}
+	if binary.LittleEndian.Uint32(rec64) != zip64EndSignature {
+		return end, fmt.Errorf("invalid zip64 end of central directory record")
+	}
+	end.disk = uint64(binary.LittleEndian.Uint32(rec64[16:]))
+	end.dirDisk = uint64(binary.LittleEndian.Uint32(rec64[20:]))
+	end.records = binary.LittleEndian.Uint64(rec64[32:])
+	end.dirSize = binary.LittleEndian.Uint64(rec64[40:])
+	end.dirOffset = binary.LittleEndian.Uint64(rec64[48:])
+
+	return end, nil
+}
+
+// rewriteCentralDirHeader writes the first central directory header in
+// dir to w with its local header offset made relative to the start of
+// the joined volumes, and returns the remainder of dir.
+func rewriteCentralDirHeader(w *bytes.Buffer, dir []byte, parts []volumePart) ([]byte, error) {
+	if len(dir) < zipCentralDirHeaderLen || binary.LittleEndian.Uint32(dir) != zipCentralDirSignature {
+		return nil, fmt.Errorf("invalid central directory header")
+	}
+	hdr := append([]byte(nil), dir[:zipCentralDirHeaderLen]...)
+	nameLen := int(binary.LittleEndian.Uint16(hdr[28:]))
+	extraLen := int(binary.LittleEndian.Uint16(hdr[30:]))
+	commentLen := int(binary.LittleEndian.Uint16(hdr[32:]))
+	recLen := zipCentralDirHeaderLen + nameLen + extraLen + commentLen
+	if len(dir) < recLen {
+		return nil, fmt.Errorf("truncated central directory header")
+	}
+	name := dir[zipCentralDirHeaderLen : zipCentralDirHeaderLen+nameLen]
+	extra := dir[zipCentralDirHeaderLen+nameLen : zipCentralDirHeaderLen+nameLen+extraLen]
+	comment := dir[zipCentralDirHeaderLen+nameLen+extraLen : recLen]
+
+	compressed := uint64(binary.LittleEndian.Uint32(hdr[20:]))
+	uncompressed := uint64(binary.LittleEndian.Uint32(hdr[24:]))
+	disk := uint64(binary.LittleEndian.Uint16(hdr[34:]))
+	offset := uint64(binary.LittleEndian.Uint32(hdr[42:]))
+
+	// pull the real values out of the zip64 extra field, and drop it;
+	// a new one is written below if it's still needed
+	var newExtra []byte
+	for len(extra) >= 4 {
+		id := binary.LittleEndian.Uint16(extra)
+		size := int(binary.LittleEndian.Uint16(extra[2:]))
+		if len(extra) < 4+size {
+			break
+		}
+		field := extra[4 : 4+size]
+		if id != zip64ExtraID {
+			newExtra = append(newExtra, extra[:4+size]...)
+			extra = extra[4+size:]
+			continue
+		}
+		for _, v := range []struct {
+			val  *uint64
+			max  uint64
+			size int
+		}{
+			{&uncompressed, 0xffffffff, 8},
+			{&compressed, 0xffffffff, 8},
+			{&offset, 0xffffffff, 8},
+			{&disk, 0xffff, 4},
+		} {
+			if *v.val != v.max || len(field) < v.size {
+				continue
+			}
+			if v.size == 8 {
+				*v.val = binary.LittleEndian.Uint64(field)
+			} else {
+				*v.val = uint64(binary.LittleEndian.Uint32(field))
+			}
+			field = field[v.size:]
+		}
+		extra = extra[4+size:]
+	}
+
+	if disk >= uint64(len(parts)) {
+		return nil, fmt.Errorf("file %q is on volume %d, which does not exist", name, disk+1)
+	}
+	offset += uint64(parts[disk].offset)
+
+	var zip64 []byte
+	if binary.LittleEndian.Uint32(hdr[24:]) == 0xffffffff {
+		zip64 = binary.LittleEndian.AppendUint64(zip64, uncompressed)
+	}
+	if binary.LittleEndian.Uint32(hdr[20:]) == 0xffffffff {
+		zip64 = binary.LittleEndian.AppendUint64(zip64, compressed)
+	}
+	if offset >= 0xffffffff {
+		zip64 = binary.LittleEndian.AppendUint64(zip64, offset)
+		binary.LittleEndian.PutUint32(hdr[42:], 0xffffffff)
+	} else {
+		binary.LittleEndian.PutUint32(hdr[42:], uint32(offset))
+	}
+	if len(zip64) > 0 {
+		field := binary.LittleEndian.AppendUint16(nil, zip64ExtraID)
+		field = binary.LittleEndian.AppendUint16(field, uint16(len(zip64)))
+		newExtra = append(append(field, zip64...), newExtra...)
+	}
+	binary.LittleEndian.PutUint16(hdr[30:], uint16(len(newExtra)))
+	binary.LittleEndian.PutUint16(hdr[34:], 0) // everything is on one "disk" now
+
+	w.Write(hdr)
+	w.Write(name)
+	w.Write(newExtra)
+	w.Write(comment)
+
+	return dir[recLen:], nil
+}
+
+// writeZipEnd writes an end of central directory record for a single
+// disk archive, preceded by the zip64 record and locator if needed.
+func writeZipEnd(w *bytes.Buffer, records, dirSize, dirOffset uint64, comment []byte) {
+	if records >= 0xffff || dirSize >= 0xffffffff || dirOffset >= 0xffffffff {
+		rec64Offset := dirOffset + dirSize
+		rec64 := binary.LittleEndian.AppendUint32(nil, zip64EndSignature)
+		rec64 = binary.LittleEndian.AppendUint64(rec64, zip64EndLen-12)
+		rec64 = binary.LittleEndian.AppendUint16(rec64, 45) // version made by
+		rec64 = binary.LittleEndian.AppendUint16(rec64, 45) // version needed
+		rec64 = binary.LittleEndian.AppendUint32(rec64, 0)
+		rec64 = binary.LittleEndian.AppendUint32(rec64, 0)
+		rec64 = binary.LittleEndian.AppendUint64(rec64, records)
+		rec64 = binary.LittleEndian.AppendUint64(rec64, records)
+		rec64 = binary.LittleEndian.AppendUint64(rec64, dirSize)
+		rec64 = binary.LittleEndian.AppendUint64(rec64, dirOffset)
+		w.Write(rec64)
+
+		loc := binary.LittleEndian.AppendUint32(nil, zip64EndLocatorSignature)
+		loc = binary.LittleEndian.AppendUint32(loc, 0)
+		loc = binary.LittleEndian.AppendUint64(loc, rec64Offset)
+		loc = binary.LittleEndian.AppendUint32(loc, 1)
+		w.Write(loc)
+
+		records, dirSize, dirOffset = min(records, 0xffff), min(dirSize, 0xffffffff), min(dirOffset, 0xffffffff)
+	}
+
+	rec := binary.LittleEndian.AppendUint32(nil, zipEndSignature)
+	rec = binary.LittleEndian.AppendUint16(rec, 0)
+	rec = binary.LittleEndian.AppendUint16(rec, 0)
+	rec = binary.LittleEndian.AppendUint16(rec, uint16(records))
+	rec = binary.LittleEndian.AppendUint16(rec, uint16(records))
+	rec = binary.LittleEndian.AppendUint32(rec, uint32(dirSize))
+	rec = binary.LittleEndian.AppendUint32(rec, uint32(dirOffset))
+	rec = binary.LittleEndian.AppendUint16(rec, uint16(len(comment)))
+	w.Write(rec)
+	w.Write(comment)
+}
+
+// volumePart is one piece of a multiReaderAt, starting at offset.
+type volumePart struct {
+	io.ReaderAt
+	offset, size int64
+}
+
+// trimParts returns the parts cut off at the absolute offset end.
+func trimParts(parts []volumePart, end int64) []volumePart {
+	var trimmed []volumePart
+	for _, p := range parts {
+		if p.offset >= end {
+			break
+		}
+		p.size = min(p.size, end-p.offset)
+		trimmed = append(trimmed, p)
+	}
+	return trimmed
+}
+
+// multiReaderAt is an io.ReaderAt over parts laid end to end.
+type multiReaderAt struct {
+	parts []volumePart
+	size  int64
+}
+
+func (m *multiReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset")
+	}
+	// find the first part that contains off
+	i := sort.Search(len(m.parts), func(i int) bool {
+		return m.parts[i].offset+m.parts[i].size > off
+	})
+	var n int
+	for ; i < len(m.parts) && n < len(p); i++ {
+		part := m.parts[i]
+		rel := off + int64(n) - part.offset
+		chunk := p[n:min(len(p), n+int(part.size-rel))]
+		read, err := part.ReadAt(chunk, rel)
+		n += read
+		if err != nil && !(err == io.EOF && read == len(chunk)) {
+			return n, err
+		}
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
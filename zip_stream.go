@@ -0,0 +1,427 @@
+package archives
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"math"
+
+	"github.com/klauspost/compress/flate"
+	"github.com/klauspost/compress/zip"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Fields of the local records in a zip archive; the other records are
+// in zip_split.go.
+const (
+	zipDataDescriptorSignature = zipSpanningSignature
+
+	zipLocalHeaderLen       = 30
+	zipDataDescriptor32Len  = 4 + 4 + 4 // CRC-32 and sizes, after the signature
+	zipDataDescriptor64Len  = 4 + 8 + 8
+	zipDataDescriptorMaxLen = 4 + zipDataDescriptor64Len
+)
+
+// ExtractStream extracts files from the zip archive read from stream
+// in a single pass, without seeking, unlike Extract, which reads the
+// central directory at the end of the archive first. The local header
+// before the contents of each file is read instead, which lacks some
+// information: modes other than directories, and so links, comments,
+// and any changes the central directory makes, such as entries it
+// superseded, are not known. Names are decoded with TextEncoding or
+// FilenameEncoding, since there is no sample to detect it from.
+//
+// Entries written by streaming zip writers, whose sizes and CRC-32 are
+// only given in a data descriptor after their contents, are supported
+// whether or not the descriptor has its optional signature, as long
+// as they are stored or compressed with deflate; their sizes are 0
+// (unknown) in the FileInfo. Encrypted entries are not supported.
+//
+// As with Tar, the contents of each file can only be read until
+// handleFile returns, and reading them to the end fails with
+// zip.ErrChecksum if their CRC-32 doesn't match.
+func (z Zip) ExtractStream(ctx context.Context, stream io.Reader, handleFile FileHandler) error {
+	br := bufio.NewReader(stream)
+
+	// important to initialize to non-nil, empty value due to how fileIsIncluded works
+	skipDirs := skipList{}
+	limits := newExtractLimits(z.MaxDecompressedSize, z.MaxEntrySize, z.MaxEntries)
+	filter, err := newPatternFilter(z.IncludePatterns, z.ExcludePatterns)
+	if err != nil {
+		return err
+	}
+	filter.skipMacMetadata = z.SkipMacMetadata
+
+	// the first file of a split archive may begin with a
+	// data descriptor signature as a marker
+	if sig, err := br.Peek(4); err == nil && binary.LittleEndian.Uint32(sig) == zipSpanningSignature {
+		br.Discard(4)
+	}
+
+	for i := 0; ; i++ {
+		if err := ctx.Err(); err != nil {
+			return err // honor context cancellation
+		}
+
+		hdr, zip64, err := readZipLocalHeader(br)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("reading local header of file %d: %w", i, err)
+		}
+		if err := limits.countEntry(); err != nil {
+			return err
+		}
+		entry, err := newZipEntryReader(br, hdr, zip64)
+		if err != nil {
+			return fmt.Errorf("file %d: %s: %w", i, hdr.Name, err)
+		}
+
+		// ensure filename and comment are UTF-8 encoded
+		rawName := []byte(hdr.Name)
+		nameEnc, err := z.decodeText(hdr)
+		if err != nil {
+			return fmt.Errorf("decoding text of file %d: %w", i, err)
+		}
+		if z.NormalizeNFC {
+			hdr.Name = norm.NFC.String(hdr.Name)
+		}
+
+		if filter.includes(hdr.Name) && !fileIsIncluded(skipDirs, hdr.Name) {
+			info := hdr.FileInfo()
+			file := FileInfo{
+				FileInfo:      info,
+				Header:        *hdr,
+				NameInArchive: hdr.Name,
+				RawName:       rawName,
+				NameEncoding:  nameEnc,
+				Open: func() (fs.File, error) {
+					return fileInArchive{io.NopCloser(entry), info}, nil
+				},
+			}
+			file = reportProgress(limits.apply(file), info.Size(), z.OnProgress)
+			file = transformContents(file, z.Transform)
+
+			err = handleFile(ctx, file)
+			if errors.Is(err, fs.SkipAll) {
+				break
+			} else if errors.Is(err, fs.SkipDir) && file.IsDir() {
+				skipDirs.add(hdr.Name)
+			} else if err != nil {
+				return fmt.Errorf("handling file: %s: %w", hdr.Name, err)
+			}
+		}
+
+		// the rest of the contents must be read to find the next
+		// header, and a data descriptor after them
+		if _, err := io.Copy(io.Discard, entry); err != nil {
+			return fmt.Errorf("reading file %d: %s: %w", i, hdr.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// readZipLocalHeader reads the local header of the next file from br,
+// returning it and whether it has zip64 sizes. It returns io.EOF at
+// the central directory, or at the end of the stream.
+func readZipLocalHeader(br *bufio.Reader) (*zip.FileHeader, bool, error) {
+	sig, err := br.Peek(4)
+	if err == io.EOF {
+		return nil, false, io.EOF
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	switch binary.LittleEndian.Uint32(sig) {
+	case zipLocalFileSignature:
+	case zipCentralDirSignature, zipEndSignature, zip64EndSignature:
+		return nil, false, io.EOF
+	default:
+		return nil, false, zip.ErrFormat
+	}
+
+	var buf [zipLocalHeaderLen]byte
+	if _, err := io.ReadFull(br, buf[:]); err != nil {
+		return nil, false, noEOF(err)
+	}
+	le := binary.LittleEndian
+	hdr := &zip.FileHeader{
+		ReaderVersion:      le.Uint16(buf[4:]),
+		Flags:              le.Uint16(buf[6:]),
+		Method:             le.Uint16(buf[8:]),
+		ModifiedTime:       le.Uint16(buf[10:]),
+		ModifiedDate:       le.Uint16(buf[12:]),
+		CRC32:              le.Uint32(buf[14:]),
+		CompressedSize:     le.Uint32(buf[18:]),
+		UncompressedSize:   le.Uint32(buf[22:]),
+		CompressedSize64:   uint64(le.Uint32(buf[18:])),
+		UncompressedSize64: uint64(le.Uint32(buf[22:])),
+	}
+	nameLen, extraLen := int(le.Uint16(buf[26:])), int(le.Uint16(buf[28:]))
+	d := make([]byte, nameLen+extraLen)
+	if _, err := io.ReadFull(br, d); err != nil {
+		return nil, false, noEOF(err)
+	}
+	hdr.Name, hdr.Extra = string(d[:nameLen]), d[nameLen:]
+	hdr.NonUTF8 = hdr.Flags&0x800 == 0
+
+	// the sizes in a zip64 extra field of a local header are
+	// both present, uncompressed first
+	var zip64 bool
+	for extra := hdr.Extra; len(extra) >= 4; {
+		tag, size := le.Uint16(extra), int(le.Uint16(extra[2:]))
+		extra = extra[4:]
+		if len(extra) < size {
+			break
+		}
+		if tag == zip64ExtraID {
+			zip64 = true
+			field := extra[:size]
+			if hdr.UncompressedSize == math.MaxUint32 && len(field) >= 8 {
+				hdr.UncompressedSize64, field = le.Uint64(field), field[8:]
+			}
+			if hdr.CompressedSize == math.MaxUint32 && len(field) >= 8 {
+				hdr.CompressedSize64 = le.Uint64(field)
+			}
+		}
+		extra = extra[size:]
+	}
+
+	return hdr, zip64, nil
+}
+
+// zipEntryReader reads the contents of a file in a zip archive being
+// read as a stream, checking their CRC-32 at the end, which for
+// entries with a data descriptor is read from it.
+type zipEntryReader struct {
+	br    *bufio.Reader
+	hdr   *zip.FileHeader
+	zip64 bool
+
+	raw io.Reader // the compressed contents
+	r   io.Reader // the decompressed contents
+	crc uint32
+	n   uint64
+
+	done bool
+	err  error
+}
+
+func newZipEntryReader(br *bufio.Reader, hdr *zip.FileHeader, zip64 bool) (*zipEntryReader, error) {
+	if hdr.Flags&zipFlagEncrypted != 0 {
+		return nil, fmt.Errorf("encrypted entries can't be read from a stream")
+	}
+	er := &zipEntryReader{br: br, hdr: hdr, zip64: zip64}
+	descriptor := hdr.Flags&zipFlagDataDescriptor != 0
+
+	switch {
+	case !descriptor:
+		er.raw = io.LimitReader(br, int64(hdr.CompressedSize64))
+	case hdr.Method == zip.Store:
+		er.raw = &storedDescriptorReader{br: br, zip64: zip64}
+	case hdr.Method == zip.Deflate:
+		er.raw = br // the compressed data ends itself, and flate doesn't read past it
+	default:
+		return nil, fmt.Errorf("compression method %d can't be read from a stream when sizes follow the contents", hdr.Method)
+	}
+
+	switch hdr.Method {
+	case zip.Store:
+		er.r = er.raw
+	case zip.Deflate:
+		er.r = flate.NewReader(er.raw)
+	default:
+		decomp, ok := zipDecompressors[hdr.Method]
+		if !ok {
+			return nil, zip.ErrAlgorithm
+		}
+		er.r = decomp(er.raw)
+		if er.r == nil {
+			return nil, fmt.Errorf("opening decompressor for method %d", hdr.Method)
+		}
+	}
+	return er, nil
+}
+
+func (er *zipEntryReader) Read(p []byte) (int, error) {
+	if er.done {
+		return 0, er.err
+	}
+	n, err := er.r.Read(p)
+	er.crc = crc32.Update(er.crc, crc32.IEEETable, p[:n])
+	er.n += uint64(n)
+	if err == io.EOF {
+		er.done = true
+		if er.err = er.finish(); er.err == nil {
+			er.err = io.EOF
+		}
+		return n, er.err
+	}
+	if err != nil {
+		er.done, er.err = true, noEOF(err)
+	}
+	return n, er.err
+}
+
+// finish reads what follows the contents, once they have been read,
+// and checks them against the CRC-32 and size.
+func (er *zipEntryReader) finish() error {
+	if er.hdr.Flags&zipFlagDataDescriptor == 0 {
+		// a decompressor may be done before all the data is read
+		if _, err := io.Copy(io.Discard, er.raw); err != nil {
+			return err
+		}
+	} else {
+		crc, csize, usize, err := readZipDataDescriptor(er.br, er.zip64, er.n)
+		if err != nil {
+			return fmt.Errorf("reading data descriptor: %w", err)
+		}
+		er.hdr.CRC32, er.hdr.CompressedSize64, er.hdr.UncompressedSize64 = crc, csize, usize
+	}
+	if er.n != er.hdr.UncompressedSize64 || er.crc != er.hdr.CRC32 {
+		return zip.ErrChecksum
+	}
+	return nil
+}
+
+// readZipDataDescriptor reads the data descriptor after the contents
+// of a file, of which n bytes were decompressed, returning the CRC-32
+// and compressed and uncompressed sizes it records. Its sizes are 8
+// bytes each if the local header has a zip64 field, but some writers
+// (like Go's) also use those for large files without one; so the other
+// length is tried too, and the one whose uncompressed size is n and
+// which is followed by a signature or the end of the stream is used.
+func readZipDataDescriptor(br *bufio.Reader, zip64 bool, n uint64) (uint32, uint64, uint64, error) {
+	le := binary.LittleEndian
+	if sig, err := br.Peek(4); err == nil && le.Uint32(sig) == zipDataDescriptorSignature {
+		br.Discard(4)
+	}
+	lengths := []int{zipDataDescriptor32Len, zipDataDescriptor64Len}
+	if zip64 {
+		lengths[0], lengths[1] = lengths[1], lengths[0]
+	}
+	buf, _ := br.Peek(zipDataDescriptor64Len + 4)
+	fields := func(d []byte) (uint32, uint64, uint64) {
+		if len(d) == zipDataDescriptor64Len {
+			return le.Uint32(d), le.Uint64(d[4:]), le.Uint64(d[12:])
+		}
+		return le.Uint32(d), uint64(le.Uint32(d[4:])), uint64(le.Uint32(d[8:]))
+	}
+	for _, l := range lengths {
+		if len(buf) < l {
+			continue
+		}
+		crc, csize, usize := fields(buf[:l])
+		if usize != n || !zipSignatureNext(buf[l:]) {
+			continue
+		}
+		br.Discard(l)
+		return crc, csize, usize, nil
+	}
+
+	// neither fits, so the sizes or CRC-32 won't match
+	l := lengths[0]
+	if len(buf) < l {
+		return 0, 0, 0, io.ErrUnexpectedEOF
+	}
+	crc, csize, usize := fields(buf[:l])
+	br.Discard(l)
+	return crc, csize, usize, nil
+}
+
+// zipSignatureNext reports whether buf, which is what follows a data
+// descriptor, is empty or begins with the signature of a local header,
+// data descriptor, or central directory record.
+func zipSignatureNext(buf []byte) bool {
+	if len(buf) == 0 {
+		return true
+	}
+	if len(buf) < 4 {
+		return false
+	}
+	switch binary.LittleEndian.Uint32(buf) {
+	case zipLocalFileSignature, zipDataDescriptorSignature, zipCentralDirSignature, zipEndSignature, zip64EndSignature:
+		return true
+	}
+	return false
+}
+
+// storedDescriptorReader reads the contents of a stored (uncompressed)
+// file followed by a data descriptor, whose end is only known by
+// finding a data descriptor right after them that matches them: with
+// or without its signature, whose sizes are the number of bytes read
+// so far, and whose CRC-32 is theirs.
+type storedDescriptorReader struct {
+	br    *bufio.Reader
+	zip64 bool
+	n     uint64
+	crc   uint32
+	done  bool
+}
+
+func (sr *storedDescriptorReader) Read(p []byte) (int, error) {
+	if sr.done {
+		return 0, io.EOF
+	}
+	var i int
+	for ; i < len(p); i++ {
+		if sr.atDescriptor(p[:i]) {
+			sr.done = true
+			break
+		}
+		b, err := sr.br.ReadByte()
+		if err != nil {
+			return i, noEOF(err)
+		}
+		p[i] = b
+	}
+	sr.crc = crc32.Update(sr.crc, crc32.IEEETable, p[:i])
+	sr.n += uint64(i)
+	if sr.done && i == 0 {
+		return 0, io.EOF
+	}
+	return i, nil
+}
+
+// atDescriptor reports whether the data descriptor for the contents
+// read so far, which end with pending, is next.
+func (sr *storedDescriptorReader) atDescriptor(pending []byte) bool {
+	n := sr.n + uint64(len(pending))
+	buf, _ := sr.br.Peek(zipDataDescriptorMaxLen)
+	le := binary.LittleEndian
+	matches := func(d []byte) bool {
+		var csize, usize uint64
+		if sr.zip64 {
+			if len(d) < zipDataDescriptor64Len {
+				return false
+			}
+			csize, usize = le.Uint64(d[4:]), le.Uint64(d[12:])
+		} else {
+			if len(d) < zipDataDescriptor32Len {
+				return false
+			}
+			csize, usize = uint64(le.Uint32(d[4:])), uint64(le.Uint32(d[8:]))
+		}
+		// check the CRC-32 last, since it has to be computed
+		return csize == n && usize == n && le.Uint32(d) == crc32.Update(sr.crc, crc32.IEEETable, pending)
+	}
+	if len(buf) >= 4 && le.Uint32(buf) == zipDataDescriptorSignature && matches(buf[4:]) {
+		return true
+	}
+	return matches(buf)
+}
+
+// noEOF returns io.ErrUnexpectedEOF in place of io.EOF.
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -1,11 +1,30 @@
 package archives
 
 import (
+	stdzip "archive/zip"
+	"bufio"
+	"bytes"
 	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
 	"os"
+	"path/filepath"
 	"reflect"
+	"runtime"
 	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+
+	"github.com/klauspost/compress/zip"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/simplifiedchinese"
 )
 
 func TestZip_ExtractZipWithSymlinks(t *testing.T) {
@@ -36,3 +55,1185 @@ func TestZip_ExtractZipWithSymlinks(t *testing.T) {
 		t.Errorf("expected files to be %v, got %v", expectedFiles, extractedFiles)
 	}
 }
+
+// newTestZip builds an in-memory zip archive containing the given names,
+// writing them as raw, non-UTF-8 bytes unless utf8Flag is set.
+func newTestZip(t *testing.T, utf8Flag bool, names ...string) *bytes.Reader {
+	t.Helper()
+	buf := new(bytes.Buffer)
+	zw := zip.NewWriter(buf)
+	for _, name := range names {
+		hdr := &zip.FileHeader{Name: name, Method: zip.Store}
+		if utf8Flag {
+			hdr.Flags |= 0x800
+		} else {
+			hdr.NonUTF8 = true
+		}
+		w, err := zw.CreateHeader(hdr)
+		checkErr(t, err, "creating header for %q", name)
+		_, err = w.Write([]byte("contents"))
+		checkErr(t, err, "writing %q", name)
+	}
+	checkErr(t, zw.Close(), "closing zip writer")
+	return bytes.NewReader(buf.Bytes())
+}
+
+func TestZip_ExtractFilenameEncoding(t *testing.T) {
+	sjisName, err := japanese.ShiftJIS.NewEncoder().String("テスト.txt")
+	checkErr(t, err, "encoding name")
+
+	var names []string
+	z := Zip{FilenameEncoding: japanese.ShiftJIS}
+	err = z.Extract(context.Background(), newTestZip(t, false, sjisName), func(_ context.Context, f FileInfo) error {
+		names = append(names, f.NameInArchive)
+		return nil
+	})
+	checkErr(t, err, "extracting")
+	if !reflect.DeepEqual(names, []string{"テスト.txt"}) {
+		t.Errorf("expected decoded name, got %q", names)
+	}
+
+	// a forced encoding must not decode names that are flagged as UTF-8
+	names = nil
+	z = Zip{FilenameEncoding: simplifiedchinese.GBK}
+	err = z.Extract(context.Background(), newTestZip(t, true, "テスト.txt"), func(_ context.Context, f FileInfo) error {
+		names = append(names, f.NameInArchive)
+		return nil
+	})
+	checkErr(t, err, "extracting")
+	if !reflect.DeepEqual(names, []string{"テスト.txt"}) {
+		t.Errorf("expected UTF-8 name to be untouched, got %q", names)
+	}
+
+	// bytes that are invalid in the forced encoding are an error
+	z = Zip{FilenameEncoding: japanese.ShiftJIS}
+	err = z.Extract(context.Background(), newTestZip(t, false, "\xa0bad.txt"), func(context.Context, FileInfo) error {
+		return nil
+	})
+	if err == nil {
+		t.Error("expected error decoding invalid filename, got nil")
+	}
+}
+
+func TestZip_ExtractRawName(t *testing.T) {
+	sjisName := mustEncode(t, japanese.ShiftJIS, "テスト.txt")
+
+	var files []FileInfo
+	collect := func(_ context.Context, f FileInfo) error {
+		files = append(files, f)
+		return nil
+	}
+	z := Zip{FilenameEncoding: japanese.ShiftJIS}
+	err := z.Extract(context.Background(), newTestZip(t, false, string(sjisName)), collect)
+	checkErr(t, err, "extracting")
+	if len(files) != 1 {
+		t.Fatalf("expected 1 file, got %d", len(files))
+	}
+	if f := files[0]; !bytes.Equal(f.RawName, sjisName) || f.NameEncoding != japanese.ShiftJIS {
+		t.Errorf("expected raw Shift-JIS name %x and its encoding, got %x and %v", sjisName, f.RawName, f.NameEncoding)
+	}
+
+	// names flagged as UTF-8 aren't decoded
+	files = nil
+	err = z.Extract(context.Background(), newTestZip(t, true, "テスト.txt"), collect)
+	checkErr(t, err, "extracting")
+	if f := files[0]; string(f.RawName) != "テスト.txt" || f.NameEncoding != nil {
+		t.Errorf("expected raw UTF-8 name and no encoding, got %x and %v", f.RawName, f.NameEncoding)
+	}
+}
+
+func TestZip_WalkEntries(t *testing.T) {
+	names := []string{"一.txt", "二.txt", "三.txt"}
+	var raw []string
+	for _, name := range names {
+		b, err := japanese.ShiftJIS.NewEncoder().String(name)
+		checkErr(t, err, "encoding name")
+		raw = append(raw, b)
+	}
+
+	var got []ZipEntry
+	z := Zip{TextEncoding: japanese.ShiftJIS}
+	err := z.WalkEntries(context.Background(), newTestZip(t, false, raw...), func(entry ZipEntry) error {
+		got = append(got, entry)
+		return nil
+	})
+	checkErr(t, err, "walking entries")
+	if len(got) != len(names) {
+		t.Fatalf("expected %d entries, got %d", len(names), len(got))
+	}
+	for i, entry := range got {
+		if entry.Name != names[i] {
+			t.Errorf("entry %d: expected name %q, got %q", i, names[i], entry.Name)
+		}
+		if string(entry.RawName) != raw[i] {
+			t.Errorf("entry %d: expected raw name %x, got %x", i, raw[i], entry.RawName)
+		}
+		if entry.UTF8Flag {
+			t.Errorf("entry %d: expected UTF-8 flag to be unset", i)
+		}
+		if entry.Encoding != japanese.ShiftJIS {
+			t.Errorf("entry %d: expected Shift-JIS encoding, got %v", i, entry.Encoding)
+		}
+	}
+
+	// an error from the callback stops the walk and is returned
+	stop := errors.New("stop")
+	var count int
+	err = z.WalkEntries(context.Background(), newTestZip(t, false, raw...), func(ZipEntry) error {
+		count++
+		return stop
+	})
+	if !errors.Is(err, stop) {
+		t.Errorf("expected callback error, got %v", err)
+	}
+	if count != 1 {
+		t.Errorf("expected walk to stop after 1 entry, got %d", count)
+	}
+}
+
+func TestZip_ArchiveFilenameEncoding(t *testing.T) {
+	fname, info := newTmpTextFile(t, "contents")
+	defer os.Remove(fname)
+	files := func(name string) []FileInfo {
+		return []FileInfo{{FileInfo: info, NameInArchive: name,
+			Open: func() (fs.File, error) { return os.Open(fname) }}}
+	}
+
+	const name = "日本語.txt"
+	var buf bytes.Buffer
+	z := Zip{FilenameEncoding: japanese.ShiftJIS}
+	checkErr(t, z.Archive(context.Background(), &buf, files(name)), "archiving")
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	checkErr(t, err, "reading archive")
+	if len(zr.File) != 1 {
+		t.Fatalf("expected 1 file, got %d", len(zr.File))
+	}
+	hdr := zr.File[0].FileHeader
+	if want := string(mustEncode(t, japanese.ShiftJIS, name)); hdr.Name != want {
+		t.Errorf("expected name %x, got %x", want, hdr.Name)
+	}
+	if IsUTF8ZipHeader(&hdr) {
+		t.Errorf("expected UTF-8 flag to be cleared")
+	}
+
+	// without an encoding, names are written as UTF-8
+	buf.Reset()
+	checkErr(t, Zip{}.Archive(context.Background(), &buf, files(name)), "archiving")
+	zr, err = zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	checkErr(t, err, "reading archive")
+	if hdr := zr.File[0].FileHeader; hdr.Name != name || !IsUTF8ZipHeader(&hdr) {
+		t.Errorf("expected UTF-8 name %q with flag set, got %q (flags %#x)", name, hdr.Name, hdr.Flags)
+	}
+
+	if err := z.Archive(context.Background(), io.Discard, files("한국어.txt")); err == nil {
+		t.Errorf("expected error for name not representable in Shift-JIS")
+	}
+}
+
+func TestZip_ArchiveStoreExtensions(t *testing.T) {
+	fname, info := newTmpTextFile(t, strings.Repeat("compressible ", 100))
+	defer os.Remove(fname)
+	var files []FileInfo
+	for _, name := range []string{"photo.JPG", "notes.txt", "clip.mp4"} {
+		files = append(files, FileInfo{FileInfo: info, NameInArchive: name,
+			Open: func() (fs.File, error) { return os.Open(fname) }})
+	}
+
+	var buf bytes.Buffer
+	z := Zip{Compression: zip.Deflate, StoreExtensions: []string{".jpg", "mp4"}}
+	checkErr(t, z.Archive(context.Background(), &buf, files), "archiving")
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	checkErr(t, err, "reading archive")
+	want := map[string]uint16{"photo.JPG": zip.Store, "notes.txt": zip.Deflate, "clip.mp4": zip.Store}
+	for _, f := range zr.File {
+		if f.Method != want[f.Name] {
+			t.Errorf("%s: expected method %d, got %d", f.Name, want[f.Name], f.Method)
+		}
+	}
+}
+
+func TestZip_ArchiveVersionMadeBy(t *testing.T) {
+	fname, info := newTmpTextFile(t, "contents")
+	defer os.Remove(fname)
+	files := []FileInfo{{FileInfo: info, NameInArchive: "file.txt",
+		Open: func() (fs.File, error) { return os.Open(fname) }}}
+
+	for _, tc := range []struct {
+		name   string
+		z      Zip
+		expect uint16
+	}{
+		{"default", Zip{}, 0x0314},
+		{"version", Zip{VersionMadeBy: 0x033F}, 0x033F},
+		{"MS-DOS", Zip{VersionMadeBy: 20}, 0x0014},
+		{"host", Zip{HostOS: 19}, 0x1314},
+		{"version and host", Zip{VersionMadeBy: 0x033F, HostOS: 10}, 0x0A3F},
+	} {
+		var buf bytes.Buffer
+		checkErr(t, tc.z.Archive(context.Background(), &buf, files), "%s: archiving", tc.name)
+		zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		checkErr(t, err, "%s: reading archive", tc.name)
+		// read from the central directory
+		if got := zr.File[0].CreatorVersion; got != tc.expect {
+			t.Errorf("%s: expected version made by %#04x, got %#04x", tc.name, tc.expect, got)
+		}
+		if got := zr.File[0].ReaderVersion; got != 20 {
+			t.Errorf("%s: expected version needed to extract to be unchanged, got %d", tc.name, got)
+		}
+		rc, err := zr.File[0].Open()
+		checkErr(t, err, "%s: opening file", tc.name)
+		contents, err := io.ReadAll(rc)
+		checkErr(t, err, "%s: reading file", tc.name)
+		rc.Close()
+		if string(contents) != "contents" {
+			t.Errorf("%s: expected contents %q, got %q", tc.name, "contents", contents)
+		}
+	}
+}
+
+func TestZip_ArchiveForceUTF8Flag(t *testing.T) {
+	fname, info := newTmpTextFile(t, "contents")
+	defer os.Remove(fname)
+	files := []FileInfo{{FileInfo: info, NameInArchive: "ascii.txt",
+		Open: func() (fs.File, error) { return os.Open(fname) }}}
+
+	for _, force := range []bool{false, true} {
+		var buf bytes.Buffer
+		checkErr(t, Zip{ForceUTF8Flag: force}.Archive(context.Background(), &buf, files), "archiving")
+		data := buf.Bytes()
+
+		// general purpose flags of the local and central directory headers
+		local := binary.LittleEndian.Uint16(data[6:])
+		cd := bytes.Index(data, []byte("PK\x01\x02"))
+		central := binary.LittleEndian.Uint16(data[cd+8:])
+		for where, flags := range map[string]uint16{"local": local, "central": central} {
+			if set := flags&0x800 != 0; set != force {
+				t.Errorf("force=%t: expected UTF-8 flag set=%t in %s header, got flags %#04x", force, force, where, flags)
+			}
+		}
+	}
+}
+
+func TestZip_EntryComment(t *testing.T) {
+	fname, info := newTmpTextFile(t, "contents")
+	defer os.Remove(fname)
+	file := func(name, comment string) FileInfo {
+		return FileInfo{FileInfo: info, NameInArchive: name, Comment: comment,
+			Open: func() (fs.File, error) { return os.Open(fname) }}
+	}
+	files := []FileInfo{file("plain.txt", "build 1234"), file("unicode.txt", "コメント"), file("none.txt", "")}
+
+	for _, z := range []Zip{{}, {FilenameEncoding: japanese.ShiftJIS}} {
+		var buf bytes.Buffer
+		checkErr(t, z.Archive(context.Background(), &buf, files), "archiving")
+
+		comments := make(map[string]string)
+		err := z.Extract(context.Background(), bytes.NewReader(buf.Bytes()), func(_ context.Context, f FileInfo) error {
+			comments[f.NameInArchive] = f.Comment
+			return nil
+		})
+		checkErr(t, err, "extracting")
+		for _, f := range files {
+			if comments[f.NameInArchive] != f.Comment {
+				t.Errorf("%s: expected comment %q, got %q", f.NameInArchive, f.Comment, comments[f.NameInArchive])
+			}
+		}
+	}
+
+	tooLong := []FileInfo{file("long.txt", strings.Repeat("x", 1<<16))}
+	if err := (Zip{}).Archive(context.Background(), io.Discard, tooLong); err == nil {
+		t.Errorf("expected error for a comment longer than 65535 bytes")
+	}
+}
+
+func TestZip_ArchiveComment(t *testing.T) {
+	fname, info := newTmpTextFile(t, "contents")
+	defer os.Remove(fname)
+	files := []FileInfo{{FileInfo: info, NameInArchive: "file.txt",
+		Open: func() (fs.File, error) { return os.Open(fname) }}}
+
+	for _, z := range []Zip{{ArchiveComment: "release 1.0"}, {ArchiveComment: "リリース", FilenameEncoding: japanese.ShiftJIS}} {
+		var buf bytes.Buffer
+		checkErr(t, z.Archive(context.Background(), &buf, files), "archiving")
+		comment, err := z.Comment(bytes.NewReader(buf.Bytes()))
+		checkErr(t, err, "reading comment")
+		if comment != z.ArchiveComment {
+			t.Errorf("expected comment %q, got %q", z.ArchiveComment, comment)
+		}
+	}
+
+	tooLong := Zip{ArchiveComment: strings.Repeat("x", 1<<16)}
+	if err := tooLong.Archive(context.Background(), io.Discard, files); err == nil {
+		t.Errorf("expected error for an archive comment longer than 65535 bytes")
+	}
+}
+
+func TestStreamingZipWriter(t *testing.T) {
+	fname, info := newTmpTextFile(t, strings.Repeat("streamed contents ", 100))
+	defer os.Remove(fname)
+
+	// a writer that can't seek, like an upload
+	var buf bytes.Buffer
+	sw := NewStreamingZipWriter(struct{ io.Writer }{&buf}, Zip{Compression: zip.Deflate})
+	for _, name := range []string{"first.txt", "dir/second.txt"} {
+		file := FileInfo{FileInfo: info, NameInArchive: name,
+			Open: func() (fs.File, error) { return os.Open(fname) }}
+		checkErr(t, sw.Add(context.Background(), file), "adding %s", name)
+	}
+	checkErr(t, sw.Close(), "closing")
+
+	// readable by the standard library
+	zr, err := stdzip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	checkErr(t, err, "reading archive")
+	if len(zr.File) != 2 {
+		t.Fatalf("expected 2 files, got %d", len(zr.File))
+	}
+	for _, f := range zr.File {
+		if f.Flags&0x08 == 0 {
+			t.Errorf("%s: expected data descriptor flag, got flags %#04x", f.Name, f.Flags)
+		}
+		rc, err := f.Open()
+		checkErr(t, err, "opening %s", f.Name)
+		contents, err := io.ReadAll(rc)
+		rc.Close()
+		checkErr(t, err, "reading %s", f.Name)
+		if string(contents) != strings.Repeat("streamed contents ", 100) {
+			t.Errorf("%s: unexpected contents %q", f.Name, contents)
+		}
+	}
+}
+
+func TestZipFS(t *testing.T) {
+	names := []string{"資料/テスト.txt", "資料/写真.jpg", "説明.txt"}
+	var raw []string
+	for _, name := range names {
+		raw = append(raw, string(mustEncode(t, japanese.ShiftJIS, name)))
+	}
+	archive := newTestZip(t, false, raw...)
+
+	for _, enc := range []encoding.Encoding{japanese.ShiftJIS, nil} {
+		fsys, err := ZipFS(archive, archive.Size(), enc)
+		checkErr(t, err, "creating zip fs")
+
+		var walked []string
+		err = fs.WalkDir(fsys, ".", func(fpath string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			walked = append(walked, fpath)
+			return nil
+		})
+		checkErr(t, err, "walking zip fs")
+		expected := []string{".", "説明.txt", "資料", "資料/テスト.txt", "資料/写真.jpg"}
+		if !reflect.DeepEqual(walked, expected) {
+			t.Errorf("encoding %v: expected %q, got %q", enc, expected, walked)
+		}
+
+		contents, err := fs.ReadFile(fsys, "資料/テスト.txt")
+		checkErr(t, err, "reading file by decoded name")
+		if string(contents) != "contents" {
+			t.Errorf("unexpected contents %q", contents)
+		}
+		info, err := fs.Stat(fsys, "説明.txt")
+		checkErr(t, err, "statting file by decoded name")
+		if info.Name() != "説明.txt" {
+			t.Errorf("expected name 説明.txt, got %q", info.Name())
+		}
+	}
+
+	// names that can't be decoded with an explicit encoding are an error
+	bad := newTestZip(t, false, "\xa0bad.txt")
+	if _, err := ZipFS(bad, bad.Size(), japanese.ShiftJIS); err == nil {
+		t.Errorf("expected error decoding invalid name")
+	}
+}
+
+func TestOpenSplitZip(t *testing.T) {
+	for _, volumes := range [][]string{
+		{"testdata/test-split.z01", "testdata/test-split.zip"},
+		{"testdata/test-split.zip", "testdata/test-split.z01"},
+		{"testdata/test-split.z*"},
+	} {
+		sz, err := OpenSplitZip(volumes...)
+		checkErr(t, err, "opening split zip %v", volumes)
+
+		contents := make(map[string]int)
+		err = Zip{}.Extract(context.Background(), sz, func(_ context.Context, f FileInfo) error {
+			rc, err := f.Open()
+			if err != nil {
+				return err
+			}
+			defer rc.Close()
+			b, err := io.ReadAll(rc)
+			if err != nil {
+				return err
+			}
+			contents[f.NameInArchive] = len(b)
+			if f.NameInArchive == "hello.txt" && string(b) != "hello from a split zip\n" {
+				t.Errorf("unexpected contents of %s: %q", f.NameInArchive, b)
+			}
+			return nil
+		})
+		checkErr(t, err, "extracting split zip %v", volumes)
+		checkErr(t, sz.Close(), "closing split zip")
+
+		expected := map[string]int{"hello.txt": 23, "random.bin": 70000}
+		if !reflect.DeepEqual(contents, expected) {
+			t.Errorf("%v: expected %v, got %v", volumes, expected, contents)
+		}
+	}
+}
+
+func TestOpenSplitZipMissingVolume(t *testing.T) {
+	// the .zip volume says there are two volumes
+	_, err := OpenSplitZip("testdata/test-split.zip")
+	if err == nil || !strings.Contains(err.Error(), "test-split.z01") {
+		t.Errorf("expected error naming missing volume test-split.z01, got %v", err)
+	}
+
+	// gaps in the volume numbers are caught before reading anything
+	_, err = OpenSplitZip("archive.z01", "archive.z03", "archive.zip")
+	if err == nil || !strings.Contains(err.Error(), "archive.z02") {
+		t.Errorf("expected error naming missing volume archive.z02, got %v", err)
+	}
+}
+
+func TestZip_ExtractOne(t *testing.T) {
+	names := []string{"一.txt", "二.txt", "三.txt"}
+	var raw []string
+	for _, name := range names {
+		raw = append(raw, string(mustEncode(t, japanese.ShiftJIS, name)))
+	}
+	archive := newTestZip(t, false, raw...)
+
+	z := Zip{FilenameEncoding: japanese.ShiftJIS}
+	rc, info, err := z.ExtractOne(context.Background(), archive, "二.txt")
+	checkErr(t, err, "extracting one file by decoded name")
+	contents, err := io.ReadAll(rc)
+	checkErr(t, err, "reading file")
+	checkErr(t, rc.Close(), "closing file")
+	if info.Name() != "二.txt" || string(contents) != "contents" {
+		t.Errorf("unexpected file %q with contents %q", info.Name(), contents)
+	}
+
+	if _, _, err := z.ExtractOne(context.Background(), archive, raw[1]); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected raw name not to match, got %v", err)
+	}
+
+	// a name stored decomposed is found by the composed name Extract lists
+	nfd := newTestZip(t, true, "cafe\u0301.txt")
+	z = Zip{NormalizeNFC: true}
+	for _, name := range []string{"caf\u00e9.txt", "cafe\u0301.txt"} {
+		rc, info, err := z.ExtractOne(context.Background(), nfd, name)
+		checkErr(t, err, "extracting %q from archive with decomposed name", name)
+		rc.Close()
+		if info.Name() != "caf\u00e9.txt" {
+			t.Errorf("expected composed name, got %q", info.Name())
+		}
+	}
+}
+
+func TestZip_OpenRaw(t *testing.T) {
+	content := []byte(strings.Repeat("copied verbatim between archives\n", 1000))
+	file, err := FileFromReader("dir/file.txt", 0644, bytes.NewReader(content))
+	checkErr(t, err, "creating file")
+	src, err := ArchiveToBytes(context.Background(), Zip{Compression: zip.Deflate}, []FileInfo{file})
+	checkErr(t, err, "archiving")
+
+	r, method, crc, err := Zip{}.OpenRaw(context.Background(), bytes.NewReader(src), "dir/file.txt")
+	checkErr(t, err, "opening raw file")
+	raw, err := io.ReadAll(r)
+	checkErr(t, err, "reading raw file")
+	if method != zip.Deflate || len(raw) >= len(content) {
+		t.Fatalf("expected deflated contents, got method %d with %d bytes", method, len(raw))
+	}
+
+	var dst bytes.Buffer
+	zw := zip.NewWriter(&dst)
+	w, err := zw.CreateRaw(&zip.FileHeader{
+		Name:               "copy.txt",
+		Method:             method,
+		CRC32:              crc,
+		CompressedSize64:   uint64(len(raw)),
+		UncompressedSize64: uint64(len(content)),
+	})
+	checkErr(t, err, "creating raw entry")
+	_, err = w.Write(raw)
+	checkErr(t, err, "writing raw entry")
+	checkErr(t, zw.Close(), "closing zip writer")
+
+	zr, err := zip.NewReader(bytes.NewReader(dst.Bytes()), int64(dst.Len()))
+	checkErr(t, err, "reading copy")
+	if got := zr.File[0].CRC32; got != crc32.ChecksumIEEE(content) || got != crc {
+		t.Errorf("expected CRC %08x, got %08x", crc, got)
+	}
+	rc, err := zr.File[0].Open()
+	checkErr(t, err, "opening copied file")
+	copied, err := io.ReadAll(rc) // verifies the checksum
+	checkErr(t, err, "reading copied file")
+	if !bytes.Equal(copied, content) {
+		t.Error("copied file differs from original")
+	}
+
+	if _, _, _, err := (Zip{}).OpenRaw(context.Background(), bytes.NewReader(src), "missing.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected fs.ErrNotExist, got %v", err)
+	}
+}
+
+func TestZip_Password(t *testing.T) {
+	// testdata/test-zipcrypto.zip was created with Info-ZIP:
+	//   zip test-zipcrypto.zip plain.txt
+	//   zip -0 -P password test-zipcrypto.zip stored.txt
+	//   zip -P password test-zipcrypto.zip deflated.txt
+	// and testdata/test-aes.zip with github.com/yeka/zip, which writes
+	// AE-2 entries; aes128.txt is stored and aes256.txt is deflated
+	tests := []struct {
+		fname    string
+		expected map[string]string
+	}{
+		{"test-zipcrypto.zip", map[string]string{
+			"plain.txt":    "not encrypted\n",
+			"stored.txt":   "encrypted with ZipCrypto\n",
+			"deflated.txt": strings.Repeat("compressible ZipCrypto contents. ", 60) + "\n",
+		}},
+		{"test-aes.zip", map[string]string{
+			"aes128.txt": "encrypted with AES-128\n",
+			"aes256.txt": strings.Repeat("compressible contents, encrypted with AES. ", 50),
+			"plain.txt":  "not encrypted\n",
+		}},
+	}
+	for _, test := range tests {
+		extract := func(password string) (map[string]string, map[string]error) {
+			f, err := os.Open(filepath.Join("testdata", test.fname))
+			checkErr(t, err, "opening %s", test.fname)
+			defer f.Close()
+
+			got, errs := make(map[string]string), make(map[string]error)
+			err = Zip{Password: password}.Extract(context.Background(), f, func(_ context.Context, info FileInfo) error {
+				rc, err := info.Open()
+				if err != nil {
+					errs[info.NameInArchive] = err
+					return nil
+				}
+				defer rc.Close()
+				data, err := io.ReadAll(rc)
+				if err != nil {
+					errs[info.NameInArchive] = err
+					return nil
+				}
+				got[info.NameInArchive] = string(data)
+				return nil
+			})
+			checkErr(t, err, "%s: extracting", test.fname)
+			return got, errs
+		}
+
+		got, errs := extract("password")
+		for name, err := range errs {
+			t.Errorf("%s: %s: unexpected error: %v", test.fname, name, err)
+		}
+		for name, want := range test.expected {
+			if got[name] != want {
+				t.Errorf("%s: %s: expected %q, got %q", test.fname, name, want, got[name])
+			}
+		}
+
+		got, errs = extract("notpassword")
+		if len(got) != 1 || got["plain.txt"] != "not encrypted\n" {
+			t.Errorf("%s: expected only the unencrypted file with a wrong password, got %q", test.fname, got)
+		}
+		for name, err := range errs {
+			if !errors.Is(err, ErrWrongPassword) {
+				t.Errorf("%s: %s: expected ErrWrongPassword, got: %v", test.fname, name, err)
+			}
+		}
+	}
+}
+
+// zeroReader reads an endless stream of zero bytes.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+func TestZip_SizeLimits(t *testing.T) {
+	// a small archive with one highly compressible 1 GB entry
+	const bombSize = 1 << 30
+	buf := new(bytes.Buffer)
+	zw := zip.NewWriter(buf)
+	w, err := zw.CreateHeader(&zip.FileHeader{Name: "small.txt", Method: zip.Deflate})
+	checkErr(t, err, "creating header")
+	_, err = io.WriteString(w, "just a small file\n")
+	checkErr(t, err, "writing small file")
+	w, err = zw.CreateHeader(&zip.FileHeader{Name: "bomb.bin", Method: zip.Deflate})
+	checkErr(t, err, "creating header")
+	_, err = io.CopyN(w, zeroReader{}, bombSize)
+	checkErr(t, err, "writing bomb")
+	checkErr(t, zw.Close(), "closing zip writer")
+	archive := bytes.NewReader(buf.Bytes())
+
+	const limit = 10 << 20
+	for _, z := range []Zip{{MaxEntrySize: limit}, {MaxDecompressedSize: limit}} {
+		var read int64 // of the bomb alone with the entry limit, or of both files
+		err := z.Extract(context.Background(), archive, func(_ context.Context, info FileInfo) error {
+			f, err := info.Open()
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			n, err := io.Copy(io.Discard, f)
+			if z.MaxDecompressedSize > 0 || info.Name() == "bomb.bin" {
+				read += n
+			}
+			return err
+		})
+		if !errors.Is(err, ErrSizeLimitExceeded) {
+			t.Errorf("%+v: expected ErrSizeLimitExceeded, got: %v", z, err)
+		}
+		if read > limit {
+			t.Errorf("%+v: read %d bytes, more than the limit", z, read)
+		}
+	}
+
+	// within the limits, extraction is unaffected
+	z := Zip{MaxEntrySize: 100, MaxDecompressedSize: 100}
+	err = z.Extract(context.Background(), archive, func(_ context.Context, info FileInfo) error {
+		if info.Name() != "small.txt" {
+			return fs.SkipAll
+		}
+		f, err := info.Open()
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(io.Discard, f)
+		return err
+	})
+	checkErr(t, err, "extracting within the limits")
+}
+
+func TestZip_ExtractConcurrently(t *testing.T) {
+	// directories come after their contents in the archive, but
+	// must still be handled first
+	buf := new(bytes.Buffer)
+	zw := zip.NewWriter(buf)
+	var expected []string
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("dir%d/file%d.txt", i%3, i)
+		w, err := zw.Create(name)
+		checkErr(t, err, "creating %s", name)
+		_, err = io.WriteString(w, name)
+		checkErr(t, err, "writing %s", name)
+		expected = append(expected, name)
+	}
+	for i := 0; i < 3; i++ {
+		name := fmt.Sprintf("dir%d/", i)
+		_, err := zw.Create(name)
+		checkErr(t, err, "creating %s", name)
+		expected = append(expected, name)
+	}
+	checkErr(t, zw.Close(), "closing zip writer")
+	archive := bytes.NewReader(buf.Bytes())
+
+	dest := t.TempDir()
+	var mu sync.Mutex
+	var got []string
+	err := Zip{Concurrency: 4}.Extract(context.Background(), archive, func(_ context.Context, info FileInfo) error {
+		target := filepath.Join(dest, filepath.FromSlash(info.NameInArchive))
+		if info.IsDir() {
+			if err := os.Mkdir(target, 0755); err != nil {
+				return err
+			}
+		} else {
+			f, err := info.Open()
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			contents, err := io.ReadAll(f)
+			if err != nil {
+				return err
+			}
+			if string(contents) != info.NameInArchive {
+				return fmt.Errorf("unexpected contents %q", contents)
+			}
+			if err := os.WriteFile(target, contents, 0644); err != nil {
+				return err
+			}
+		}
+		mu.Lock()
+		got = append(got, info.NameInArchive)
+		mu.Unlock()
+		return nil
+	})
+	checkErr(t, err, "extracting concurrently")
+	sort.Strings(got)
+	sort.Strings(expected)
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected files %q, got %q", expected, got)
+	}
+
+	// the error is for the earliest failing file, however the work is scheduled
+	for range 20 {
+		err := Zip{Concurrency: 8}.Extract(context.Background(), archive, func(_ context.Context, info FileInfo) error {
+			if info.NameInArchive == "dir1/file4.txt" || info.NameInArchive == "dir2/file14.txt" {
+				return errors.New("failed")
+			}
+			return nil
+		})
+		if err == nil || !strings.Contains(err.Error(), "dir1/file4.txt") {
+			t.Fatalf("expected error for the earliest failing file, got: %v", err)
+		}
+	}
+}
+
+// BenchmarkZip_Extract compares extracting a 2 GB archive serially
+// and concurrently. Creating the archive takes a while.
+func BenchmarkZip_Extract(b *testing.B) {
+	const numFiles, fileSize = 32, 64 << 20
+	fname := filepath.Join(b.TempDir(), "bench.zip")
+	out, err := os.Create(fname)
+	if err != nil {
+		b.Fatal(err)
+	}
+	zw := zip.NewWriter(out)
+	line := make([]byte, 0, 64)
+	for i := 0; i < numFiles; i++ {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: fmt.Sprintf("file%d.txt", i), Method: zip.Deflate})
+		if err != nil {
+			b.Fatal(err)
+		}
+		bw := bufio.NewWriter(w)
+		for n := 0; n < fileSize; n += len(line) {
+			line = strconv.AppendInt(line[:0], int64(n)*2654435761%1000003, 36)
+			line = append(line, " some words to compress\n"...)
+			bw.Write(line)
+		}
+		if err := bw.Flush(); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		b.Fatal(err)
+	}
+	if err := out.Close(); err != nil {
+		b.Fatal(err)
+	}
+
+	discard := func(_ context.Context, info FileInfo) error {
+		f, err := info.Open()
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(io.Discard, f)
+		return err
+	}
+	for _, concurrency := range []int{1, max(2, runtime.NumCPU())} {
+		b.Run(fmt.Sprintf("concurrency=%d", concurrency), func(b *testing.B) {
+			f, err := os.Open(fname)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer f.Close()
+			b.SetBytes(numFiles * fileSize)
+			for i := 0; i < b.N; i++ {
+				if err := (Zip{Concurrency: concurrency}).Extract(context.Background(), f, discard); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestZip_ArchiveZip64(t *testing.T) {
+	// more entries than fit in the original end of central directory record
+	const numFiles = 1<<16 + 10
+	files := make([]FileInfo, 0, numFiles)
+	for i := 0; i < numFiles; i++ {
+		file, err := FileFromReader(fmt.Sprintf("dir%d/file%d.txt", i%100, i), 0644, strings.NewReader(strconv.Itoa(i)))
+		checkErr(t, err, "creating file %d", i)
+		files = append(files, file)
+	}
+	archived, err := ArchiveToBytes(context.Background(), Zip{}, files)
+	checkErr(t, err, "archiving")
+
+	// the end of central directory record gives up on the count, and
+	// defers to the ZIP64 record and locator that precede it
+	const eocdLen, locatorLen = 22, 20
+	if len(archived) < eocdLen+locatorLen+56 {
+		t.Fatalf("archive is too small: %d bytes", len(archived))
+	}
+	eocd := archived[len(archived)-eocdLen:]
+	if !bytes.HasPrefix(eocd, []byte("PK\x05\x06")) || binary.LittleEndian.Uint16(eocd[10:]) != 0xffff {
+		t.Errorf("expected end of central directory record deferring to ZIP64, got %x", eocd)
+	}
+	if locator := archived[len(archived)-eocdLen-locatorLen:]; !bytes.HasPrefix(locator, []byte("PK\x06\x07")) {
+		t.Errorf("expected ZIP64 end of central directory locator")
+	}
+
+	var count int
+	err = Zip{}.Extract(context.Background(), bytes.NewReader(archived), func(_ context.Context, info FileInfo) error {
+		if want := fmt.Sprintf("dir%d/file%d.txt", count%100, count); info.NameInArchive != want {
+			return fmt.Errorf("expected entry %d to be %s, got %s", count, want, info.NameInArchive)
+		}
+		f, err := info.Open()
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		contents, err := io.ReadAll(f)
+		if err != nil {
+			return err
+		}
+		if string(contents) != strconv.Itoa(count) {
+			return fmt.Errorf("unexpected contents of %s: %q", info.NameInArchive, contents)
+		}
+		count++
+		return nil
+	})
+	checkErr(t, err, "extracting")
+	if count != numFiles {
+		t.Errorf("expected %d files, got %d", numFiles, count)
+	}
+}
+
+func TestZip_VerifyChecksums(t *testing.T) {
+	buf := new(bytes.Buffer)
+	zw := zip.NewWriter(buf)
+	for _, name := range []string{"good.txt", "corrupt.txt"} {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store})
+		checkErr(t, err, "creating header")
+		_, err = io.WriteString(w, "contents of "+name)
+		checkErr(t, err, "writing file")
+	}
+	checkErr(t, zw.Close(), "closing zip writer")
+
+	// flip a bit in the stored contents of the second file
+	data := buf.Bytes()
+	i := bytes.LastIndex(data, []byte("contents of corrupt.txt"))
+	data[i] ^= 0x01
+
+	read := make(map[string]error)
+	err := Zip{VerifyChecksums: true, ContinueOnError: true}.Extract(context.Background(), bytes.NewReader(data), func(_ context.Context, info FileInfo) error {
+		f, err := info.Open()
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(io.Discard, f)
+		read[info.NameInArchive] = err
+		return err
+	})
+	var failed EntryErrors
+	if !errors.As(err, &failed) || len(failed) != 1 || failed[0].Name != "corrupt.txt" {
+		t.Errorf("expected only the corrupt file to fail, got: %v", err)
+	}
+	if err := read["good.txt"]; err != nil {
+		t.Errorf("expected good file to be read without error, got: %v", err)
+	}
+	if err := read["corrupt.txt"]; !errors.Is(err, ErrChecksumMismatch) || !strings.Contains(err.Error(), "corrupt.txt") {
+		t.Errorf("expected ErrChecksumMismatch naming the corrupt file, got: %v", err)
+	}
+}
+
+func TestZip_ExtractStream(t *testing.T) {
+	contents := strings.Repeat("streamed contents ", 100)
+	crc := crc32.ChecksumIEEE([]byte(contents))
+
+	// written by a streaming writer, with signed data descriptors
+	var streamed bytes.Buffer
+	zw := zip.NewWriter(&streamed)
+	for _, method := range []uint16{zip.Deflate, zip.Store} {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: fmt.Sprintf("method%d.txt", method), Method: method})
+		checkErr(t, err, "creating header")
+		_, err = w.Write([]byte(contents))
+		checkErr(t, err, "writing contents")
+	}
+	checkErr(t, zw.Close(), "closing zip writer")
+
+	// a stored entry whose data descriptor has no signature
+	le := binary.LittleEndian
+	var unsigned []byte
+	unsigned = le.AppendUint32(unsigned, zipLocalFileSignature)
+	unsigned = le.AppendUint16(unsigned, 20)                    // version needed
+	unsigned = le.AppendUint16(unsigned, zipFlagDataDescriptor) // flags
+	unsigned = le.AppendUint16(unsigned, zip.Store)
+	unsigned = append(unsigned, make([]byte, 4+4+4+4)...) // time, date, CRC-32, sizes
+	unsigned = le.AppendUint16(unsigned, uint16(len("unsigned.txt")))
+	unsigned = le.AppendUint16(unsigned, 0)
+	unsigned = append(unsigned, "unsigned.txt"...)
+	unsigned = append(unsigned, contents...)
+	unsigned = le.AppendUint32(unsigned, crc)
+	unsigned = le.AppendUint32(unsigned, uint32(len(contents)))
+	unsigned = le.AppendUint32(unsigned, uint32(len(contents)))
+	unsigned = le.AppendUint32(unsigned, zipEndSignature)
+
+	// the deflated entry again, with the 8-byte sizes of a zip64 data
+	// descriptor but no zip64 field, as Go writes them for large files
+	next := bytes.Index(streamed.Bytes()[4:], le.AppendUint32(nil, zipLocalFileSignature)) + 4
+	desc := streamed.Bytes()[next-12 : next]
+	wide := append([]byte(nil), streamed.Bytes()[:next-8]...)
+	wide = le.AppendUint64(wide, uint64(le.Uint32(desc[4:])))
+	wide = le.AppendUint64(wide, uint64(le.Uint32(desc[8:])))
+	wide = append(wide, streamed.Bytes()[next:]...)
+
+	for _, tc := range []struct {
+		archive []byte
+		names   []string
+	}{
+		{streamed.Bytes(), []string{"method8.txt", "method0.txt"}},
+		{unsigned, []string{"unsigned.txt"}},
+		{wide, []string{"method8.txt", "method0.txt"}},
+	} {
+		var names []string
+		// a reader that can't seek
+		err := Zip{}.ExtractStream(context.Background(), struct{ io.Reader }{bytes.NewReader(tc.archive)}, func(_ context.Context, f FileInfo) error {
+			names = append(names, f.NameInArchive)
+			rc, err := f.Open()
+			checkErr(t, err, "opening %s", f.NameInArchive)
+			defer rc.Close()
+			got, err := io.ReadAll(rc)
+			checkErr(t, err, "reading %s", f.NameInArchive)
+			if string(got) != contents {
+				t.Errorf("%s: unexpected contents %q", f.NameInArchive, got)
+			}
+			return nil
+		})
+		checkErr(t, err, "extracting stream")
+		if !reflect.DeepEqual(names, tc.names) {
+			t.Errorf("expected files %q, got %q", tc.names, names)
+		}
+	}
+
+	// an entry with the wrong CRC-32 fails, even if it isn't read
+	var corrupted []byte
+	corrupted = le.AppendUint32(corrupted, zipLocalFileSignature)
+	corrupted = le.AppendUint16(corrupted, 20)
+	corrupted = le.AppendUint16(corrupted, 0)
+	corrupted = le.AppendUint16(corrupted, zip.Store)
+	corrupted = le.AppendUint32(corrupted, 0)
+	corrupted = le.AppendUint32(corrupted, crc^1)
+	corrupted = le.AppendUint32(corrupted, uint32(len(contents)))
+	corrupted = le.AppendUint32(corrupted, uint32(len(contents)))
+	corrupted = le.AppendUint16(corrupted, uint16(len("corrupted.txt")))
+	corrupted = le.AppendUint16(corrupted, 0)
+	corrupted = append(corrupted, "corrupted.txt"...)
+	corrupted = append(corrupted, contents...)
+	err := Zip{}.ExtractStream(context.Background(), bytes.NewReader(corrupted), func(context.Context, FileInfo) error { return nil })
+	if !errors.Is(err, zip.ErrChecksum) {
+		t.Errorf("expected checksum error, got %v", err)
+	}
+}
+
+func TestZip_ContinueOnError(t *testing.T) {
+	names := []string{"a.txt", "b.txt", "corrupt.txt", "c.txt", "d.txt"}
+	buf := new(bytes.Buffer)
+	zw := zip.NewWriter(buf)
+	for _, name := range names {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store})
+		checkErr(t, err, "creating header")
+		_, err = io.WriteString(w, "contents of "+name)
+		checkErr(t, err, "writing file")
+	}
+	checkErr(t, zw.Close(), "closing zip writer")
+	data := buf.Bytes()
+	data[bytes.LastIndex(data, []byte("contents of corrupt.txt"))] ^= 0x01
+
+	for _, concurrency := range []int{0, 3} {
+		var mu sync.Mutex
+		var extracted []string
+		z := Zip{ContinueOnError: true, Concurrency: concurrency}
+		err := z.Extract(context.Background(), bytes.NewReader(data), func(_ context.Context, info FileInfo) error {
+			f, err := info.Open()
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			if _, err := io.Copy(io.Discard, f); err != nil {
+				return err
+			}
+			mu.Lock()
+			extracted = append(extracted, info.NameInArchive)
+			mu.Unlock()
+			return nil
+		})
+
+		var failed EntryErrors
+		if !errors.As(err, &failed) {
+			t.Fatalf("concurrency=%d: expected EntryErrors, got %v", concurrency, err)
+		}
+		if len(failed) != 1 || failed[0].Name != "corrupt.txt" || !errors.Is(err, zip.ErrChecksum) {
+			t.Errorf("concurrency=%d: expected the corrupt file to fail its checksum, got %v", concurrency, err)
+		}
+		sort.Strings(extracted)
+		if expected := []string{"a.txt", "b.txt", "c.txt", "d.txt"}; !reflect.DeepEqual(extracted, expected) {
+			t.Errorf("concurrency=%d: expected good files %q to be extracted, got %q", concurrency, expected, extracted)
+		}
+	}
+}
+
+func TestInspectZip(t *testing.T) {
+	for _, tc := range []struct {
+		fname    string
+		expected []ZipEntryInfo
+	}{
+		{"test-zipcrypto.zip", []ZipEntryInfo{
+			{Name: "plain.txt", Method: zip.Store, CompressedSize: 14, UncompressedSize: 14, CRC32: 0x06a8af7a},
+			{Name: "stored.txt", Method: zip.Store, Encryption: ZipEncryptionZipCrypto, CompressedSize: 37, UncompressedSize: 25, CRC32: 0x085df910},
+			{Name: "deflated.txt", Method: zip.Deflate, Encryption: ZipEncryptionZipCrypto, CompressedSize: 66, UncompressedSize: 1981, CRC32: 0xc324bf32},
+		}},
+		{"test-aes.zip", []ZipEntryInfo{
+			{Name: "aes128.txt", Method: zip.Store, Encryption: ZipEncryptionAES, AESKeyBits: 128, CompressedSize: 43, UncompressedSize: 23},
+			{Name: "aes256.txt", Method: zip.Deflate, Encryption: ZipEncryptionAES, AESKeyBits: 256, CompressedSize: 93, UncompressedSize: 2150},
+			{Name: "plain.txt", Method: zip.Deflate, CompressedSize: 21, UncompressedSize: 14, CRC32: 0x06a8af7a},
+		}},
+	} {
+		data, err := os.ReadFile(filepath.Join("testdata", tc.fname))
+		checkErr(t, err, "reading %s", tc.fname)
+		entries, err := InspectZip(bytes.NewReader(data), int64(len(data)))
+		checkErr(t, err, "inspecting %s", tc.fname)
+		if !reflect.DeepEqual(entries, tc.expected) {
+			t.Errorf("%s: expected %+v, got %+v", tc.fname, tc.expected, entries)
+		}
+	}
+
+	// the UTF-8 flag is reported as set
+	zr := newTestZip(t, true, "名前.txt")
+	entries, err := InspectZip(zr, zr.Size())
+	checkErr(t, err, "inspecting")
+	if len(entries) != 1 || !entries[0].UTF8Flag {
+		t.Errorf("expected the UTF-8 flag to be set, got %+v", entries)
+	}
+}
+
+func TestZip_SkipMacMetadata(t *testing.T) {
+	// laid out as by the Archive Utility of macOS, but without
+	// the entries of the directories
+	names := []string{
+		"photos/a.jpg", "photos/._b.jpg", "photos/.hidden",
+		"__MACOSX/photos/._a.jpg", "__MACOSX/._photos",
+	}
+	extracted := func(format Zip) []string {
+		dest := t.TempDir()
+		checkErr(t, ExtractToFS(context.Background(), format, newTestZip(t, true, names...), OSWritableFS(dest)), "extracting")
+		var found []string
+		err := filepath.WalkDir(dest, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || path == dest {
+				return err
+			}
+			rel, err := filepath.Rel(dest, path)
+			found = append(found, filepath.ToSlash(rel))
+			return err
+		})
+		checkErr(t, err, "walking destination")
+		return found
+	}
+
+	if actual := extracted(Zip{}); len(actual) != 8 {
+		t.Errorf("expected all entries to be extracted by default, got %q", actual)
+	}
+	expected := []string{"photos", "photos/.hidden", "photos/a.jpg"}
+	if actual := extracted(Zip{SkipMacMetadata: true}); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %q, got %q", expected, actual)
+	}
+}
+
+func TestRebuildZipCentralDirectory(t *testing.T) {
+	contents := map[string]string{
+		"deflated.txt": strings.Repeat("compressed with deflate ", 100),
+		"stored.txt":   "stored, with a data descriptor",
+		"raw.txt":      "sizes in the local header",
+		"dir/":         "",
+	}
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.Create("deflated.txt")
+	checkErr(t, err, "creating deflated file")
+	io.WriteString(w, contents["deflated.txt"])
+	w, err = zw.CreateHeader(&zip.FileHeader{Name: "stored.txt", Method: zip.Store})
+	checkErr(t, err, "creating stored file")
+	io.WriteString(w, contents["stored.txt"])
+	raw := contents["raw.txt"]
+	w, err = zw.CreateRaw(&zip.FileHeader{
+		Name:               "raw.txt",
+		Method:             zip.Store,
+		CRC32:              crc32.ChecksumIEEE([]byte(raw)),
+		CompressedSize64:   uint64(len(raw)),
+		UncompressedSize64: uint64(len(raw)),
+	})
+	checkErr(t, err, "creating raw file")
+	io.WriteString(w, raw)
+	_, err = zw.Create("dir/")
+	checkErr(t, err, "creating directory")
+	checkErr(t, zw.Close(), "closing zip writer")
+
+	// chop off all but the start of the central directory
+	archive := buf.Bytes()
+	dirOffset := int(binary.LittleEndian.Uint32(archive[len(archive)-zipEndLen+16:]))
+	truncated := archive[:dirOffset+10]
+	if _, err := zip.NewReader(bytes.NewReader(truncated), int64(len(truncated))); err == nil {
+		t.Fatal("expected truncated zip not to be readable")
+	}
+
+	var rebuilt bytes.Buffer
+	err = RebuildZipCentralDirectory(bytes.NewReader(truncated), int64(len(truncated)), &rebuilt)
+	checkErr(t, err, "rebuilding central directory")
+	zr, err := zip.NewReader(bytes.NewReader(rebuilt.Bytes()), int64(rebuilt.Len()))
+	checkErr(t, err, "reading rebuilt zip")
+	actual := make(map[string]string)
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		checkErr(t, err, "opening %s", f.Name)
+		b, err := io.ReadAll(rc) // fails if the CRC-32 is wrong
+		checkErr(t, err, "reading %s", f.Name)
+		rc.Close()
+		actual[f.Name] = string(b)
+		if f.Name == "dir/" && !f.FileInfo().IsDir() {
+			t.Errorf("expected %s to be a directory", f.Name)
+		}
+	}
+	if !reflect.DeepEqual(actual, contents) {
+		t.Errorf("expected %q, got %q", contents, actual)
+	}
+
+	// a file cut short can't be recovered
+	err = RebuildZipCentralDirectory(bytes.NewReader(archive[:40]), 40, io.Discard)
+	if err == nil {
+		t.Error("expected error for a truncated file")
+	}
+
+	// nor can anything that isn't a zip archive
+	notZip := []byte(strings.Repeat("not a zip archive ", 10))
+	err = RebuildZipCentralDirectory(bytes.NewReader(notZip), int64(len(notZip)), io.Discard)
+	if !errors.Is(err, zip.ErrFormat) {
+		t.Errorf("expected format error for a file that isn't a zip archive, got %v", err)
+	}
+
+	// the program at the start of a self-extracting archive is kept
+	stub := append([]byte("MZ"), make([]byte, 5000)...)
+	sfx := append(stub, truncated...)
+	rebuilt.Reset()
+	err = RebuildZipCentralDirectory(bytes.NewReader(sfx), int64(len(sfx)), &rebuilt)
+	checkErr(t, err, "rebuilding central directory of self-extracting archive")
+	if !bytes.HasPrefix(rebuilt.Bytes(), stub) {
+		t.Error("expected the self-extractor to be kept")
+	}
+	zr, err = zip.NewReader(bytes.NewReader(rebuilt.Bytes()), int64(rebuilt.Len()))
+	checkErr(t, err, "reading rebuilt self-extracting zip")
+	if len(zr.File) != len(contents) {
+		t.Fatalf("expected %d files, got %d", len(contents), len(zr.File))
+	}
+	rc, err := zr.File[0].Open()
+	checkErr(t, err, "opening %s", zr.File[0].Name)
+	b, err := io.ReadAll(rc)
+	checkErr(t, err, "reading %s", zr.File[0].Name)
+	rc.Close()
+	if string(b) != contents[zr.File[0].Name] {
+		t.Errorf("%s: unexpected contents %q", zr.File[0].Name, b)
+	}
+}
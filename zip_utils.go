@@ -1,9 +1,18 @@
 package archives
 
 import (
+	stdzip "archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
 	"unicode/utf8"
 
+	"github.com/klauspost/compress/zip"
+	"github.com/saintfish/chardet"
 	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
 	"golang.org/x/text/encoding/japanese"
 	"golang.org/x/text/encoding/korean"
 	"golang.org/x/text/encoding/simplifiedchinese"
@@ -12,45 +21,100 @@ import (
 )
 
 // GetEncodingByName converts a string encoding name to an encoding.Encoding
+//
+// Shift-JIS is always decoded as its Microsoft variant, CP932 (also known
+// as Windows-31J), which adds the NEC and IBM extension characters and is
+// what Japanese Windows writes; it can't be told apart from plain Shift-JIS
+// in practice, so the names of both map to japanese.ShiftJIS, which
+// implements CP932.
+//
+// Encodings registered with RegisterEncoding take precedence over the
+// built-in names.
 func GetEncodingByName(name string) encoding.Encoding {
+	encodingsMu.RLock()
+	enc, ok := encodings[name]
+	encodingsMu.RUnlock()
+	if ok {
+		return enc
+	}
+
 	switch name {
-	case "shift-jis", "shiftjis", "sjis", "japanese":
+	case "shift-jis", "shiftjis", "sjis", "japanese", "cp932", "windows-31j", "ms932":
 		return japanese.ShiftJIS
 	case "euc-jp", "eucjp":
 		return japanese.EUCJP
 	case "euc-kr", "euckr", "korean":
 		return korean.EUCKR
-	case "gbk", "gb18030", "gb2312", "simplified-chinese":
+	case "gbk", "gb2312", "simplified-chinese":
 		return simplifiedchinese.GBK
+	case "gb18030":
+		return simplifiedchinese.GB18030
 	case "big5", "traditional-chinese":
 		return traditionalchinese.Big5
+	case "windows-1252", "cp1252":
+		return charmap.Windows1252
+	case "iso-8859-1", "latin1":
+		return charmap.ISO8859_1
+	case "cp437", "ibm437", "dos":
+		return charmap.CodePage437
 	case "utf-16le", "windows":
 		return unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM)
+	case "utf-16be", "utf16be":
+		return unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM)
 	case "utf-8", "utf8":
 		return nil // No encoding needed for UTF-8
 	}
 	return nil
 }
 
+// RegisterEncoding makes enc available by name to GetEncodingByName,
+// replacing any encoding registered by that name before, or a built-in
+// one. It is safe to call concurrently with extractions.
+func RegisterEncoding(name string, enc encoding.Encoding) {
+	encodingsMu.Lock()
+	defer encodingsMu.Unlock()
+	encodings[name] = enc
+}
+
+// UnregisterEncoding removes the encoding registered by name with
+// RegisterEncoding, restoring the built-in one, if any.
+func UnregisterEncoding(name string) {
+	encodingsMu.Lock()
+	defer encodingsMu.Unlock()
+	delete(encodings, name)
+}
+
+var (
+	encodingsMu sync.RWMutex
+	encodings   = make(map[string]encoding.Encoding)
+)
+
 // GetEncodingFromCharset converts a charset name to an encoding.Encoding
 func GetEncodingFromCharset(charset string, language string) encoding.Encoding {
 	switch charset {
-	case "Shift_JIS", "SJIS", "shift-jis", "sjis":
+	case "Shift_JIS", "SJIS", "shift-jis", "sjis", "CP932", "cp932", "Windows-31J", "windows-31j", "MS932", "ms932":
 		return japanese.ShiftJIS
 	case "EUC-JP", "eucjp":
 		return japanese.EUCJP
 	case "EUC-KR", "euckr":
 		return korean.EUCKR
-	case "GB18030", "GBK", "GB2312", "gb18030", "gbk", "gb2312":
+	case "GBK", "GB2312", "gbk", "gb2312":
 		return simplifiedchinese.GBK
+	case "GB18030", "GB-18030", "gb18030":
+		// GB18030 is a superset of GBK with four-byte sequences GBK can't decode
+		return simplifiedchinese.GB18030
 	case "Big5", "big5":
 		return traditionalchinese.Big5
 	case "UTF-16", "utf-16", "UTF-16LE", "utf-16le":
 		return unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM)
-	case "windows-1252", "iso-8859-1":
-		// No direct support, but often these western encodings are not problematic
-		// when used with Go's Unicode support
-		return nil
+	case "UTF-16BE", "utf-16be":
+		return unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM)
+	case "windows-1252", "WINDOWS-1252":
+		return charmap.Windows1252
+	case "iso-8859-1", "ISO-8859-1":
+		return charmap.ISO8859_1
+	case "IBM437", "ibm437", "CP437", "cp437":
+		return charmap.CodePage437
 	case "ASCII", "US-ASCII", "ascii":
 		return nil // ASCII is a subset of UTF-8
 	}
@@ -80,21 +144,480 @@ func GetFallbackEncodings() []encoding.Encoding {
 	}
 }
 
-// DetectEncoding analyzes the provided string to determine its encoding
-// It tries encodings in this order: UTF-8, Shift-JIS, GBK
-func DetectEncoding(data []byte) encoding.Encoding {
+// EncodingCandidate is a possible text encoding of some bytes, as
+// reported by DetectEncodingCandidates
+type EncodingCandidate struct {
+	// The encoding to decode the bytes with; nil means no decoding
+	// is needed (UTF-8)
+	Encoding encoding.Encoding
+
+	// The name of the detected charset, e.g. "Shift_JIS"
+	Charset string
+
+	// The detected language, e.g. "ja", if known
+	Language string
+
+	// How confident the detection is, from 0 to 1
+	Confidence float64
+}
+
+// Confidence values assigned to candidates found by the byte-pattern
+// heuristics; they are deliberately lower than any chardet result
+const (
+	japaneseHeuristicConfidence = 0.09
+	koreanHeuristicConfidence   = 0.08
+	chineseHeuristicConfidence  = 0.07
+)
+
+// chardet is unreliable on short inputs such as filenames; below this
+// confidence, DetectEncoding prefers the byte-pattern heuristics
+const minDetectionConfidence = 0.5
+
+// DetectEncodingCandidates returns the likely encodings of data, sorted by
+// descending confidence. Candidates come from chardet first, then from
+// byte-pattern heuristics, which are ranked lower. Ties are broken by the
+// order of GetFallbackEncodings. Charsets without a supported encoding are
+// omitted. Empty input yields an empty slice. UTF-16 text, recognized by
+// its byte order mark or by the zero bytes of ASCII characters, is the
+// only candidate.
+func DetectEncodingCandidates(data []byte) ([]EncodingCandidate, error) {
+	candidates := []EncodingCandidate{}
 	if len(data) == 0 {
-		return nil
+		return candidates, nil
+	}
+
+	// checked first, since ASCII text in UTF-16 is valid UTF-8
+	if enc, charset, ok := detectUTF16(data); ok {
+		return append(candidates, EncodingCandidate{Encoding: enc, Charset: charset, Confidence: 1}), nil
 	}
 
-	// First try: Check if it's valid UTF-8
 	if utf8.Valid(data) {
-		return nil // UTF-8 is valid, no encoding needed
+		return append(candidates, EncodingCandidate{Charset: "UTF-8", Confidence: 1}), nil
+	}
+
+	seen := make(map[encoding.Encoding]bool)
+	results, err := chardet.NewTextDetector().DetectAll(data)
+	if err != nil && !errors.Is(err, chardet.NotDetectedError) {
+		return nil, err
+	}
+	for _, result := range results {
+		enc := GetEncodingFromCharset(result.Charset, result.Language)
+		if enc == nil || seen[enc] {
+			continue
+		}
+		seen[enc] = true
+		candidates = append(candidates, EncodingCandidate{
+			Encoding:   enc,
+			Charset:    result.Charset,
+			Language:   result.Language,
+			Confidence: float64(result.Confidence) / 100,
+		})
 	}
 
-	// If not UTF-8, default to ShiftJIS as most common for ZIP files
-	// We don't attempt further detection since we don't have raw bytes
-	return japanese.ShiftJIS
+	// add the heuristic hits after chardet's, unless chardet already found them
+	heuristics := []struct {
+		match     func([]byte) bool
+		candidate EncodingCandidate
+	}{
+		{containsJapaneseBytes, EncodingCandidate{japanese.ShiftJIS, "Shift_JIS", "ja", japaneseHeuristicConfidence}},
+		{containsEUCJPBytes, EncodingCandidate{japanese.EUCJP, "EUC-JP", "ja", japaneseHeuristicConfidence}},
+		{containsKoreanBytes, EncodingCandidate{korean.EUCKR, "EUC-KR", "ko", koreanHeuristicConfidence}},
+		{containsChineseBytes, EncodingCandidate{simplifiedchinese.GBK, "GBK", "zh", chineseHeuristicConfidence}},
+	}
+	for _, h := range heuristics {
+		if !seen[h.candidate.Encoding] && h.match(data) {
+			seen[h.candidate.Encoding] = true
+			candidates = append(candidates, h.candidate)
+		}
+	}
+
+	// chardet runs its recognizers concurrently, so the order of equally
+	// confident results varies; make it deterministic
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].Confidence != candidates[j].Confidence {
+			return candidates[i].Confidence > candidates[j].Confidence
+		}
+		return encodingRank(candidates[i].Encoding) < encodingRank(candidates[j].Encoding)
+	})
+
+	return candidates, nil
+}
+
+// detectUTF16 reports whether data is UTF-16 text, returning its
+// encoding and charset. Text that starts with a byte order mark is
+// decoded with the mark removed. Otherwise, text is taken to be UTF-16
+// if, as with ASCII characters, most pairs of bytes have a zero byte,
+// which is the second of the pair in little endian and the first in
+// big endian; zero bytes don't appear in text in other encodings.
+func detectUTF16(data []byte) (encoding.Encoding, string, bool) {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xff, 0xfe}):
+		return unicode.UTF16(unicode.LittleEndian, unicode.UseBOM), "UTF-16LE", true
+	case bytes.HasPrefix(data, []byte{0xfe, 0xff}):
+		return unicode.UTF16(unicode.BigEndian, unicode.UseBOM), "UTF-16BE", true
+	}
+	if len(data)%2 != 0 {
+		return nil, "", false
+	}
+	var zerosFirst, zerosSecond int
+	for i := 0; i < len(data); i += 2 {
+		if data[i] == 0 {
+			zerosFirst++
+		}
+		if data[i+1] == 0 {
+			zerosSecond++
+		}
+	}
+	pairs := len(data) / 2
+	switch {
+	case zerosSecond*2 >= pairs && zerosFirst*4 < zerosSecond:
+		return unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM), "UTF-16LE", true
+	case zerosFirst*2 >= pairs && zerosSecond*4 < zerosFirst:
+		return unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM), "UTF-16BE", true
+	}
+	return nil, "", false
+}
+
+// encodingRank returns the position of enc in GetFallbackEncodings,
+// or the length of that list if enc is not in it
+func encodingRank(enc encoding.Encoding) int {
+	fallbacks := GetFallbackEncodings()
+	for i, fallback := range fallbacks {
+		if fallback == enc {
+			return i
+		}
+	}
+	return len(fallbacks)
+}
+
+// DefaultFallbackEncoding is the encoding assumed for non-UTF-8 text when
+// its encoding can't be detected. It defaults to Shift-JIS as the most
+// common encoding of non-UTF-8 ZIP filenames. Setting it to nil reproduces
+// the behavior of the standard library, which leaves the raw bytes as-is;
+// DetectEncoding then returns ErrEncodingUndetermined instead.
+var DefaultFallbackEncoding encoding.Encoding = japanese.ShiftJIS
+
+// ErrEncodingUndetermined is returned by DetectEncoding when the encoding
+// can't be detected and DefaultFallbackEncoding is nil.
+var ErrEncodingUndetermined = errors.New("text encoding could not be determined")
+
+// DetectEncoding analyzes the provided bytes to determine their encoding
+// It returns nil for UTF-8, UTF-16 in the endianness of its byte order
+// mark or of its zero bytes, otherwise the most likely candidate from
+// DetectEncodingCandidates; if chardet is not confident, the byte-pattern
+// heuristics are tried in order: EUC-JP (only if its kana markers
+// outnumber the Shift-JIS ones), Shift-JIS, EUC-KR, GBK. If there are no
+// candidates at all, DefaultFallbackEncoding is returned.
+func DetectEncoding(data []byte) (encoding.Encoding, error) {
+	return DetectEncodingSample(data, 0)
+}
+
+// DefaultEncodingSampleSize is a recommended sample size for
+// DetectEncodingSample: enough text for reliable detection of typical
+// filenames, while keeping detection fast on large inputs.
+const DefaultEncodingSampleSize = 4096
+
+// DetectEncodingSample is like DetectEncoding, but only examines up to
+// maxBytes of data, or all of it if maxBytes <= 0. The sample is cut
+// after the last separator, such as a newline, space, or '.', that
+// fits, so no multi-byte character is split. Detection is faster and
+// more stable on large inputs, such as the names of thousands of
+// files, but too small a sample hurts its accuracy;
+// DefaultEncodingSampleSize is a good choice.
+func DetectEncodingSample(data []byte, maxBytes int) (encoding.Encoding, error) {
+	enc, _, err := detectEncoding(data, maxBytes)
+	return enc, err
+}
+
+// DetectEncodingWithLanguage is like DetectEncoding, but also returns the
+// ISO 639-1 code of the language of the text, such as "ja", when an
+// encoding other than UTF-8 is chosen. If chardet doesn't report the
+// language, the language the encoding is typically used for is returned;
+// it is only empty for encodings like Windows-1252 that many languages
+// share.
+func DetectEncodingWithLanguage(data []byte) (encoding.Encoding, string, error) {
+	return detectEncoding(data, 0)
+}
+
+func detectEncoding(data []byte, maxBytes int) (encoding.Encoding, string, error) {
+	if maxBytes > 0 && len(data) > maxBytes {
+		sample := data[:maxBytes]
+		if i := lastBoundaryByte(sample); i >= 0 {
+			sample = sample[:i+1]
+		}
+		data = sample
+	}
+	if len(data) == 0 {
+		return nil, "", nil
+	}
+
+	candidates, err := DetectEncodingCandidates(data)
+	if err != nil || len(candidates) == 0 {
+		if DefaultFallbackEncoding == nil {
+			return nil, "", ErrEncodingUndetermined
+		}
+		return DefaultFallbackEncoding, encodingLanguage(DefaultFallbackEncoding), nil
+	}
+	best := candidates[0]
+	if best.Language == "" {
+		best.Language = encodingLanguage(best.Encoding)
+	}
+	if best.Confidence >= minDetectionConfidence {
+		return best.Encoding, best.Language, nil
+	}
+
+	switch {
+	case eucJPMarkers(data) > shiftJISMarkers(data):
+		return japanese.EUCJP, "ja", nil
+	case containsJapaneseBytes(data):
+		return japanese.ShiftJIS, "ja", nil
+	case containsKoreanBytes(data):
+		return korean.EUCKR, "ko", nil
+	case containsChineseBytes(data):
+		return simplifiedchinese.GBK, "zh", nil
+	}
+	return best.Encoding, best.Language, nil
+}
+
+// encodingLanguage returns the language enc is used for, or "" if
+// it isn't specific to one.
+func encodingLanguage(enc encoding.Encoding) string {
+	switch enc {
+	case japanese.ShiftJIS, japanese.EUCJP, japanese.ISO2022JP:
+		return "ja"
+	case korean.EUCKR:
+		return "ko"
+	case simplifiedchinese.GBK, simplifiedchinese.GB18030, simplifiedchinese.HZGB2312, traditionalchinese.Big5:
+		return "zh"
+	}
+	return ""
+}
+
+// lastBoundaryByte returns the index of the last byte of data below
+// 0x30, such as a newline, space, '.' or '/', or -1 if there is none.
+// Such a byte always ends a character in the encodings detected; other
+// ASCII bytes don't, since they can be the trail bytes of Shift-JIS,
+// Big5 and GBK, and the second and fourth bytes of GB18030.
+func lastBoundaryByte(data []byte) int {
+	for i := len(data) - 1; i >= 0; i-- {
+		if data[i] < 0x30 {
+			return i
+		}
+	}
+	return -1
+}
+
+// containsJapaneseBytes reports whether data is well-formed Shift-JIS
+// with at least one lead byte in 0x81-0x9F, a range that EUC-based
+// encodings never use for lead bytes
+func containsJapaneseBytes(data []byte) bool {
+	return shiftJISMarkers(data) > 0
+}
+
+// shiftJISMarkers returns the number of double-byte characters with a
+// lead byte in 0x81-0x9F, or 0 if data is not well-formed Shift-JIS
+func shiftJISMarkers(data []byte) int {
+	var found int
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		switch {
+		case c < 0x80, c >= 0xA1 && c <= 0xDF: // ASCII or half-width katakana
+		case c >= 0x81 && c <= 0x9F, c >= 0xE0 && c <= 0xEF:
+			if i+1 >= len(data) {
+				return 0
+			}
+			t := data[i+1]
+			if t < 0x40 || t == 0x7F || t > 0xFC {
+				return 0
+			}
+			if c <= 0x9F {
+				found++
+			}
+			i++
+		default:
+			return 0
+		}
+	}
+	return found
+}
+
+// containsEUCJPBytes reports whether data is well-formed EUC-JP with at
+// least one kana character, which sets it apart from other EUC encodings
+func containsEUCJPBytes(data []byte) bool {
+	return eucJPMarkers(data) > 0
+}
+
+// eucJPMarkers returns the number of hiragana and katakana characters
+// (lead byte 0xA4 or 0xA5, or the 0x8E single shift for half-width
+// katakana), or 0 if data is not well-formed EUC-JP
+func eucJPMarkers(data []byte) int {
+	var found int
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		switch {
+		case c < 0x80:
+		case c == 0x8E: // half-width katakana
+			if i+1 >= len(data) || data[i+1] < 0xA1 || data[i+1] > 0xDF {
+				return 0
+			}
+			found++
+			i++
+		case c == 0x8F: // JIS X 0212, three bytes
+			if i+2 >= len(data) || data[i+1] < 0xA1 || data[i+2] < 0xA1 ||
+				data[i+1] == 0xFF || data[i+2] == 0xFF {
+				return 0
+			}
+			i += 2
+		case c >= 0xA1 && c <= 0xFE:
+			if i+1 >= len(data) || data[i+1] < 0xA1 || data[i+1] == 0xFF {
+				return 0
+			}
+			if c == 0xA4 || c == 0xA5 {
+				found++
+			}
+			i++
+		default:
+			return 0
+		}
+	}
+	return found
+}
+
+// containsChineseBytes reports whether data is well-formed GBK
+// containing at least one double-byte character
+func containsChineseBytes(data []byte) bool {
+	var found bool
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		switch {
+		case c < 0x80:
+		case c >= 0x81 && c <= 0xFE:
+			if i+1 >= len(data) {
+				return false
+			}
+			t := data[i+1]
+			if t < 0x40 || t == 0x7F || t == 0xFF {
+				return false
+			}
+			found = true
+			i++
+		default:
+			return false
+		}
+	}
+	return found
+}
+
+// containsKoreanBytes reports whether data is well-formed EUC-KR
+// containing at least one Hangul syllable
+func containsKoreanBytes(data []byte) bool {
+	var found bool
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		switch {
+		case c < 0x80:
+		case c >= 0xA1 && c <= 0xFE:
+			if i+1 >= len(data) {
+				return false
+			}
+			t := data[i+1]
+			if t < 0xA1 || t == 0xFF {
+				return false
+			}
+			if c >= 0xB0 && c <= 0xC8 {
+				found = true
+			}
+			i++
+		default:
+			return false
+		}
+	}
+	return found
+}
+
+// DecodeFilename decodes the raw bytes of a filename with enc into a
+// UTF-8 string. If enc is nil, the bytes are returned unchanged. Bytes
+// that are invalid in enc result in an error instead of a partially
+// decoded name.
+func DecodeFilename(raw []byte, enc encoding.Encoding) (string, error) {
+	if enc == nil {
+		return string(raw), nil
+	}
+	decoded, err := enc.NewDecoder().Bytes(raw)
+	if err != nil {
+		return "", err
+	}
+	// decoders replace invalid bytes with U+FFFD rather than failing
+	if !utf8.Valid(decoded) ||
+		bytes.Contains(decoded, []byte("\uFFFD")) && !bytes.Contains(raw, []byte("\uFFFD")) {
+		return "", fmt.Errorf("invalid byte sequence for encoding %v", enc)
+	}
+	return string(decoded), nil
+}
+
+// FilenameDecoder decodes the non-UTF-8 filenames of an archive with
+// one encoding, detected once from a sample of them, so that all the
+// names are decoded the same way and detection doesn't run again for
+// each of possibly thousands of entries.
+type FilenameDecoder struct {
+	enc encoding.Encoding
+}
+
+// NewFilenameDecoder returns a FilenameDecoder for the archive whose
+// raw non-UTF-8 names include sample. Up to DefaultEncodingSampleSize
+// bytes of the sample are examined. If the sample is empty or its
+// encoding can't be determined, names are left as they are.
+func NewFilenameDecoder(sample [][]byte) *FilenameDecoder {
+	joined := bytes.Join(sample, []byte("\n"))
+	if len(joined) == 0 {
+		return &FilenameDecoder{}
+	}
+	enc, err := DetectEncodingSample(joined, DefaultEncodingSampleSize)
+	if err != nil {
+		return &FilenameDecoder{}
+	}
+	return &FilenameDecoder{enc: enc}
+}
+
+// Encoding returns the encoding names are decoded from, or nil if
+// they are left as they are.
+func (d *FilenameDecoder) Encoding() encoding.Encoding { return d.enc }
+
+// Decode returns the name raw decoded to UTF-8. Names with the UTF-8
+// flag set, such as bit 11 in a zip header, are returned unchanged, as
+// are names that are not valid in the encoding.
+func (d *FilenameDecoder) Decode(raw []byte, utf8Flag bool) string {
+	name, _ := d.decode(raw, utf8Flag)
+	return name
+}
+
+// decode is like Decode, but also returns the encoding the name was
+// decoded from, or nil if it was left unchanged.
+func (d *FilenameDecoder) decode(raw []byte, utf8Flag bool) (string, encoding.Encoding) {
+	if utf8Flag || d.enc == nil {
+		return string(raw), nil
+	}
+	name, err := DecodeFilename(raw, d.enc)
+	if err != nil {
+		return string(raw), nil
+	}
+	return name, d.enc
+}
+
+// EncodeFilename encodes a UTF-8 filename with enc, which is useful for
+// writing archives with names in a legacy encoding. If enc is nil, the
+// name is returned as UTF-8. Names containing characters that enc can't
+// represent result in an error.
+func EncodeFilename(name string, enc encoding.Encoding) ([]byte, error) {
+	if enc == nil {
+		return []byte(name), nil
+	}
+	return enc.NewEncoder().Bytes([]byte(name))
+}
+
+// IsUTF8ZipHeader checks if the UTF-8 flag (0x800) is set on a ZIP file header
+func IsUTF8ZipHeader(h *zip.FileHeader) bool {
+	return h.Flags&0x800 != 0
 }
 
 // IsUTF8Filename checks if a filename in an archive uses UTF-8 encoding
@@ -104,6 +627,14 @@ func IsUTF8Filename(fileHeader interface{}) bool {
 	isUTF8 := true
 
 	// Check for ZIP-specific header fields
+	switch header := fileHeader.(type) {
+	case *zip.FileHeader:
+		return IsUTF8ZipHeader(header)
+	case zip.FileHeader: // as set on FileInfo.Header by Zip.Extract
+		return IsUTF8ZipHeader(&header)
+	case *stdzip.FileHeader:
+		return header.Flags&0x800 != 0
+	}
 	if header, ok := fileHeader.(interface{ GetFlags() uint16 }); ok {
 		// Check if UTF-8 flag (0x800) is set in flag bits
 		isUTF8 = (header.GetFlags() & 0x800) != 0
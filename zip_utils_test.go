@@ -0,0 +1,440 @@
+package archives
+
+import (
+	stdzip "archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/klauspost/compress/zip"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/korean"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/encoding/unicode"
+)
+
+func mustEncode(t *testing.T, enc encoding.Encoding, s string) []byte {
+	t.Helper()
+	b, err := enc.NewEncoder().Bytes([]byte(s))
+	checkErr(t, err, "encoding %q", s)
+	return b
+}
+
+func TestDetectEncodingCandidates(t *testing.T) {
+	candidates, err := DetectEncodingCandidates(nil)
+	checkErr(t, err, "detecting empty input")
+	if candidates == nil || len(candidates) != 0 {
+		t.Errorf("expected empty, non-nil slice for empty input, got %#v", candidates)
+	}
+
+	candidates, err = DetectEncodingCandidates([]byte("plain.txt"))
+	checkErr(t, err, "detecting UTF-8 input")
+	if len(candidates) != 1 || candidates[0].Encoding != nil || candidates[0].Charset != "UTF-8" {
+		t.Errorf("expected a single UTF-8 candidate, got %+v", candidates)
+	}
+
+	data := mustEncode(t, japanese.ShiftJIS, "新しいフォルダ/画像ファイル.jpg")
+	candidates, err = DetectEncodingCandidates(data)
+	checkErr(t, err, "detecting Shift-JIS input")
+	if len(candidates) == 0 {
+		t.Fatal("expected candidates for Shift-JIS input")
+	}
+	if candidates[0].Encoding != japanese.ShiftJIS || candidates[0].Language != "ja" {
+		t.Errorf("expected Shift-JIS to be the top candidate, got %+v", candidates[0])
+	}
+	for i := 1; i < len(candidates); i++ {
+		if candidates[i].Confidence > candidates[i-1].Confidence {
+			t.Errorf("candidates not sorted by descending confidence: %+v", candidates)
+		}
+	}
+}
+
+func TestDetectEncoding(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		input  []byte
+		expect encoding.Encoding
+	}{
+		{name: "empty", input: nil, expect: nil},
+		{name: "utf-8", input: []byte("日本語.txt"), expect: nil},
+		{name: "shift-jis", input: mustEncode(t, japanese.ShiftJIS, "日本語のファイル名.txt"), expect: japanese.ShiftJIS},
+		{name: "euc-kr", input: mustEncode(t, korean.EUCKR, "한국어 파일.txt"), expect: korean.EUCKR},
+		// the half-width katakana use the 0x8E single shift, which is
+		// also a valid Shift-JIS lead byte
+		{name: "euc-jp", input: mustEncode(t, japanese.EUCJP, "ﾃｽﾄです.txt"), expect: japanese.EUCJP},
+		{name: "euc-jp kana", input: mustEncode(t, japanese.EUCJP, "テスト.txt"), expect: japanese.EUCJP},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// chardet is nondeterministic about ties, so run a few times
+			for i := 0; i < 10; i++ {
+				got, err := DetectEncoding(tc.input)
+				checkErr(t, err, "detecting encoding")
+				if got != tc.expect {
+					t.Fatalf("expected %v, got %v", tc.expect, got)
+				}
+			}
+		})
+	}
+}
+
+func TestDetectEncodingWithLanguage(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		input []byte
+		enc   encoding.Encoding
+		lang  string
+	}{
+		{name: "utf-8", input: []byte("日本語.txt"), enc: nil, lang: ""},
+		{name: "shift-jis", input: mustEncode(t, japanese.ShiftJIS, "日本語のファイル名.txt"), enc: japanese.ShiftJIS, lang: "ja"},
+		{name: "euc-jp", input: mustEncode(t, japanese.EUCJP, "テスト.txt"), enc: japanese.EUCJP, lang: "ja"},
+		{name: "euc-kr", input: mustEncode(t, korean.EUCKR, "한국어 파일.txt"), enc: korean.EUCKR, lang: "ko"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			enc, lang, err := DetectEncodingWithLanguage(tc.input)
+			checkErr(t, err, "detecting encoding")
+			if enc != tc.enc || lang != tc.lang {
+				t.Errorf("expected %v (%q), got %v (%q)", tc.enc, tc.lang, enc, lang)
+			}
+		})
+	}
+
+	// the language of the fallback encoding is reported too
+	enc, lang, err := DetectEncodingWithLanguage([]byte{0xff})
+	checkErr(t, err, "detecting undetectable encoding")
+	if enc != DefaultFallbackEncoding || lang != encodingLanguage(DefaultFallbackEncoding) {
+		t.Errorf("expected fallback encoding with its language, got %v (%q)", enc, lang)
+	}
+}
+
+func TestCP932(t *testing.T) {
+	for _, name := range []string{"cp932", "windows-31j", "ms932"} {
+		if GetEncodingByName(name) != japanese.ShiftJIS {
+			t.Errorf("expected %s to map to Shift-JIS", name)
+		}
+	}
+	for _, charset := range []string{"CP932", "Windows-31J", "MS932"} {
+		if GetEncodingFromCharset(charset, "") != japanese.ShiftJIS {
+			t.Errorf("expected %s charset to map to Shift-JIS", charset)
+		}
+	}
+
+	// NEC and IBM extension characters, and the Microsoft mappings of
+	// the wave dash and minus sign
+	for _, tc := range []struct {
+		raw    []byte
+		expect string
+	}{
+		{[]byte("\x87\x40.txt"), "\u2460.txt"},       // circled digit one
+		{[]byte("\xfa\x40.txt"), "\u2170.txt"},       // small roman numeral one
+		{[]byte("\xed\x40.txt"), "\u7e8a.txt"},       // NEC-selected IBM extension kanji
+		{[]byte("\x81\x60\x81\x7c"), "\uff5e\uff0d"}, // fullwidth tilde and hyphen-minus
+	} {
+		decoded, err := DecodeFilename(tc.raw, GetEncodingByName("cp932"))
+		checkErr(t, err, "decoding %x", tc.raw)
+		if decoded != tc.expect {
+			t.Errorf("%x: expected %q, got %q", tc.raw, tc.expect, decoded)
+		}
+	}
+}
+
+func TestRegisterEncoding(t *testing.T) {
+	RegisterEncoding("ibm-pc", charmap.CodePage437)
+	defer UnregisterEncoding("ibm-pc")
+
+	// a DOS-era name, with é as 0x82 and a box-drawing character
+	var names []string
+	z := Zip{FilenameEncoding: GetEncodingByName("ibm-pc")}
+	err := z.Extract(context.Background(), newTestZip(t, false, "caf\x82\xc4.txt"), func(_ context.Context, f FileInfo) error {
+		names = append(names, f.NameInArchive)
+		return nil
+	})
+	checkErr(t, err, "extracting")
+	if len(names) != 1 || names[0] != "café─.txt" {
+		t.Errorf("expected name decoded as CP437, got %q", names)
+	}
+
+	// registered encodings take precedence over built-in ones until removed
+	RegisterEncoding("latin1", charmap.CodePage437)
+	if GetEncodingByName("latin1") != charmap.CodePage437 {
+		t.Error("expected registered encoding to replace built-in one")
+	}
+	UnregisterEncoding("latin1")
+	if GetEncodingByName("latin1") != charmap.ISO8859_1 {
+		t.Error("expected built-in encoding after unregistering")
+	}
+}
+
+func TestGB18030DistinctFromGBK(t *testing.T) {
+	if GetEncodingByName("gb18030") != simplifiedchinese.GB18030 {
+		t.Error("expected gb18030 to map to GB18030")
+	}
+	if GetEncodingFromCharset("GB18030", "") != simplifiedchinese.GB18030 {
+		t.Error("expected GB18030 charset to map to GB18030")
+	}
+	for _, name := range []string{"gbk", "gb2312"} {
+		if GetEncodingByName(name) != simplifiedchinese.GBK {
+			t.Errorf("expected %s to map to GBK", name)
+		}
+	}
+
+	// U+1F600 is only representable as a four-byte GB18030 sequence
+	const name = "表情\U0001F600.txt"
+	raw := mustEncode(t, simplifiedchinese.GB18030, name)
+
+	decoded, err := GetEncodingByName("gb18030").NewDecoder().String(string(raw))
+	checkErr(t, err, "decoding with GB18030")
+	if decoded != name {
+		t.Errorf("GB18030: expected %q, got %q", name, decoded)
+	}
+
+	decoded, err = GetEncodingByName("gbk").NewDecoder().String(string(raw))
+	if err == nil && decoded == name {
+		t.Errorf("GBK unexpectedly decoded four-byte sequence: %q", decoded)
+	}
+}
+
+func TestWesternCharsets(t *testing.T) {
+	raw := []byte("caf\xe8\xe9.txt")
+	for _, charset := range []string{"windows-1252", "iso-8859-1"} {
+		enc := GetEncodingFromCharset(charset, "")
+		if enc == nil {
+			t.Fatalf("%s: expected an encoding, got nil", charset)
+		}
+		decoded, err := enc.NewDecoder().Bytes(raw)
+		checkErr(t, err, "decoding with %s", charset)
+		if string(decoded) != "cafèé.txt" {
+			t.Errorf("%s: expected %q, got %q", charset, "cafèé.txt", decoded)
+		}
+	}
+	if enc := GetEncodingFromCharset("ASCII", ""); enc != nil {
+		t.Errorf("expected nil encoding for ASCII, got %v", enc)
+	}
+}
+
+func TestCP437(t *testing.T) {
+	for _, name := range []string{"cp437", "ibm437", "dos"} {
+		if GetEncodingByName(name) != charmap.CodePage437 {
+			t.Errorf("expected %s to map to CP437", name)
+		}
+	}
+	for _, charset := range []string{"IBM437", "CP437"} {
+		if GetEncodingFromCharset(charset, "") != charmap.CodePage437 {
+			t.Errorf("expected %s charset to map to CP437", charset)
+		}
+	}
+
+	decoded, err := DecodeFilename([]byte("caf\x82.txt"), GetEncodingByName("cp437"))
+	checkErr(t, err, "decoding")
+	if decoded != "café.txt" {
+		t.Errorf("expected %q, got %q", "café.txt", decoded)
+	}
+}
+
+func TestUTF16(t *testing.T) {
+	le := unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM)
+	be := unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM)
+	for _, name := range []string{"utf-16be", "utf16be"} {
+		if GetEncodingByName(name) != be {
+			t.Errorf("expected %s to map to UTF-16BE", name)
+		}
+	}
+	if GetEncodingFromCharset("UTF-16BE", "") != be {
+		t.Error("expected UTF-16BE charset to map to UTF-16BE")
+	}
+
+	const name = "テスト-file.txt"
+	for _, tc := range []struct {
+		desc    string
+		data    []byte
+		charset string
+	}{
+		{"little endian with BOM", append([]byte{0xff, 0xfe}, mustEncode(t, le, name)...), "UTF-16LE"},
+		{"big endian with BOM", append([]byte{0xfe, 0xff}, mustEncode(t, be, name)...), "UTF-16BE"},
+		{"little endian without BOM", mustEncode(t, le, name), "UTF-16LE"},
+		{"big endian without BOM", mustEncode(t, be, name), "UTF-16BE"},
+	} {
+		candidates, err := DetectEncodingCandidates(tc.data)
+		checkErr(t, err, "%s: detecting candidates", tc.desc)
+		if len(candidates) != 1 || candidates[0].Charset != tc.charset {
+			t.Errorf("%s: expected only %s, got %+v", tc.desc, tc.charset, candidates)
+		}
+		enc, err := DetectEncoding(tc.data)
+		checkErr(t, err, "%s: detecting", tc.desc)
+		decoded, err := DecodeFilename(tc.data, enc)
+		checkErr(t, err, "%s: decoding", tc.desc)
+		if decoded != name {
+			t.Errorf("%s: expected %q, got %q", tc.desc, name, decoded)
+		}
+	}
+
+	// text in other encodings has no zero bytes
+	if enc, _, ok := detectUTF16(mustEncode(t, japanese.ShiftJIS, "テスト.txt")); ok {
+		t.Errorf("expected Shift-JIS not to be detected as UTF-16, got %v", enc)
+	}
+}
+
+func TestDetectEncodingSample(t *testing.T) {
+	name := mustEncode(t, japanese.ShiftJIS, "日本語のファイル名.txt\n")
+	data := bytes.Repeat(name, 100)
+
+	// cut in the middle of a double-byte character
+	enc, err := DetectEncodingSample(data, len(name)+3)
+	checkErr(t, err, "detecting sample")
+	if enc != japanese.ShiftJIS {
+		t.Errorf("expected Shift-JIS, got %v", enc)
+	}
+
+	// bytes past the sample are ignored
+	enc, err = DetectEncodingSample(append(bytes.Clone(name), bytes.Repeat([]byte{0xff}, 1000)...), len(name))
+	checkErr(t, err, "detecting sample")
+	if enc != japanese.ShiftJIS {
+		t.Errorf("expected Shift-JIS from the sample alone, got %v", enc)
+	}
+
+	// ASCII digits and letters can be inside multi-byte characters
+	for _, tc := range []struct {
+		enc  encoding.Encoding
+		text string
+	}{
+		{simplifiedchinese.GB18030, "文件 \U00020000"}, // 0x95 0x32 0x82 0x36
+		{japanese.ShiftJIS, "資料 ソ"},                  // 0x83 0x5C
+	} {
+		encoded := mustEncode(t, tc.enc, tc.text)
+		if i := lastBoundaryByte(encoded); i < 0 || encoded[i] != ' ' {
+			t.Errorf("%v: expected the sample to be cut at the space, got %d in %x", tc.enc, i, encoded)
+		}
+	}
+
+	// no limit is the same as DetectEncoding
+	want, err := DetectEncoding(data)
+	checkErr(t, err, "detecting")
+	if enc, _ := DetectEncodingSample(data, 0); enc != want {
+		t.Errorf("expected %v without a limit, got %v", want, enc)
+	}
+}
+
+func TestDefaultFallbackEncoding(t *testing.T) {
+	defer func(enc encoding.Encoding) { DefaultFallbackEncoding = enc }(DefaultFallbackEncoding)
+
+	// not valid in any supported multi-byte encoding, and too short for chardet
+	undetectable := []byte{0xff}
+
+	enc, err := DetectEncoding(undetectable)
+	checkErr(t, err, "detecting with default fallback")
+	if enc != japanese.ShiftJIS {
+		t.Errorf("expected Shift-JIS fallback by default, got %v", enc)
+	}
+
+	DefaultFallbackEncoding = simplifiedchinese.GBK
+	enc, err = DetectEncoding(undetectable)
+	checkErr(t, err, "detecting with GBK fallback")
+	if enc != simplifiedchinese.GBK {
+		t.Errorf("expected GBK fallback, got %v", enc)
+	}
+
+	DefaultFallbackEncoding = nil
+	enc, err = DetectEncoding(undetectable)
+	if !errors.Is(err, ErrEncodingUndetermined) {
+		t.Errorf("expected ErrEncodingUndetermined, got %v (encoding %v)", err, enc)
+	}
+}
+
+func TestIsUTF8ZipHeader(t *testing.T) {
+	flagged := &zip.FileHeader{Name: "a.txt", Flags: 0x800}
+	unflagged := &zip.FileHeader{Name: "a.txt"}
+
+	if !IsUTF8ZipHeader(flagged) {
+		t.Error("expected header with flag bit to be UTF-8")
+	}
+	if IsUTF8ZipHeader(unflagged) {
+		t.Error("expected header without flag bit not to be UTF-8")
+	}
+
+	for i, tc := range []struct {
+		header any
+		expect bool
+	}{
+		{header: flagged, expect: true},
+		{header: unflagged, expect: false},
+		{header: *flagged, expect: true},
+		{header: *unflagged, expect: false},
+		{header: &stdzip.FileHeader{Flags: 0x800}, expect: true},
+		{header: &stdzip.FileHeader{}, expect: false},
+		{header: nil, expect: true},
+	} {
+		if actual := IsUTF8Filename(tc.header); actual != tc.expect {
+			t.Errorf("Test %d (%T): expected %t, got %t", i, tc.header, tc.expect, actual)
+		}
+	}
+}
+
+func TestDecodeEncodeFilename(t *testing.T) {
+	const name = "日本語のファイル名.txt"
+	raw := mustEncode(t, japanese.ShiftJIS, name)
+
+	decoded, err := DecodeFilename(raw, japanese.ShiftJIS)
+	checkErr(t, err, "decoding filename")
+	if decoded != name {
+		t.Errorf("expected %q, got %q", name, decoded)
+	}
+
+	decoded, err = DecodeFilename(raw, nil)
+	checkErr(t, err, "decoding filename without encoding")
+	if decoded != string(raw) {
+		t.Errorf("expected raw bytes to be unchanged, got %q", decoded)
+	}
+
+	if decoded, err := DecodeFilename([]byte("\xa0bad.txt"), japanese.ShiftJIS); err == nil {
+		t.Errorf("expected error decoding invalid bytes, got %q", decoded)
+	}
+
+	encoded, err := EncodeFilename(name, japanese.ShiftJIS)
+	checkErr(t, err, "encoding filename")
+	if string(encoded) != string(raw) {
+		t.Errorf("expected %x, got %x", raw, encoded)
+	}
+
+	encoded, err = EncodeFilename(name, nil)
+	checkErr(t, err, "encoding filename without encoding")
+	if string(encoded) != name {
+		t.Errorf("expected UTF-8 name to be unchanged, got %q", encoded)
+	}
+
+	if encoded, err := EncodeFilename("한국어.txt", japanese.ShiftJIS); err == nil {
+		t.Errorf("expected error encoding unrepresentable name, got %x", encoded)
+	}
+}
+
+func TestFilenameDecoder(t *testing.T) {
+	// short names on their own are easily mistaken for other encodings
+	words := []string{"資料", "写真", "ア", "新しいフォルダ", "メモ", "表"}
+	var names []string
+	var raw [][]byte
+	for i := range 5000 {
+		name := fmt.Sprintf("%s%d.txt", words[i%len(words)], i)
+		names = append(names, name)
+		raw = append(raw, mustEncode(t, japanese.ShiftJIS, name))
+	}
+
+	d := NewFilenameDecoder(raw[:64])
+	if d.Encoding() != japanese.ShiftJIS {
+		t.Fatalf("expected Shift-JIS, got %v", d.Encoding())
+	}
+	for i, r := range raw {
+		if actual := d.Decode(r, false); actual != names[i] {
+			t.Fatalf("name %d: expected %q, got %q", i, names[i], actual)
+		}
+	}
+	if actual := d.Decode([]byte("日本語.txt"), true); actual != "日本語.txt" {
+		t.Errorf("expected name with the UTF-8 flag to be unchanged, got %q", actual)
+	}
+
+	// without a sample, names are left as they are
+	if actual := NewFilenameDecoder(nil).Decode(raw[0], false); actual != string(raw[0]) {
+		t.Errorf("expected name to be unchanged, got %q", actual)
+	}
+}
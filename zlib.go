@@ -12,8 +12,15 @@ func init() {
 	RegisterFormat(Zlib{})
 }
 
+// DefaultZlibLevel is the zlib compression level used
+// when Zlib.CompressionLevel is 0.
+const DefaultZlibLevel = 6
+
 // Zlib facilitates zlib compression.
 type Zlib struct {
+	// Zlib compression level, as for Gz. If 0 or -1, DefaultZlibLevel
+	// is used rather than no compression; -2 and lower select
+	// Huffman-only encoding, and levels above 9 are clamped to 9.
 	CompressionLevel int
 }
 
@@ -41,9 +48,9 @@ func (zz Zlib) Match(_ context.Context, filename string, stream io.Reader) (Matc
 }
 
 func (zz Zlib) OpenWriter(w io.Writer) (io.WriteCloser, error) {
-	level := zz.CompressionLevel
-	if level == 0 {
-		level = zlib.DefaultCompression
+	level := max(zlib.HuffmanOnly, min(zz.CompressionLevel, zlib.BestCompression))
+	if level == 0 || level == zlib.DefaultCompression {
+		level = DefaultZlibLevel
 	}
 	return zlib.NewWriterLevel(w, level)
 }
@@ -1,8 +1,10 @@
 package archives
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"encoding/binary"
 	"io"
 	"strings"
 
@@ -13,14 +15,48 @@ func init() {
 	RegisterFormat(Zstd{})
 }
 
+// DefaultZstdLevel is the zstd compression level used
+// when Zstd.CompressionLevel is 0.
+const DefaultZstdLevel = 3
+
 // Zstd facilitates Zstandard compression.
 type Zstd struct {
+	// Zstandard compression level, from 1 (fastest) to 19
+	// (best), as for the zstd command. It is mapped to the
+	// closest of the levels the encoder supports. If 0, the
+	// DefaultZstdLevel is used. Levels out of range are
+	// clamped. EncoderOptions take precedence over it.
+	CompressionLevel int
+
 	EncoderOptions []zstd.EOption
 	DecoderOptions []zstd.DOption
+
+	// The largest window size, in bytes, that the decoder
+	// accepts; frames made with `zstd --long=N` need 1<<N. If
+	// 0, the library's safe default, zstd.MaxWindowSize, is
+	// used. DecoderOptions take precedence over it.
+	WindowSizeLimit uint64
+
+	// An optional dictionary in the zstd dictionary format, as
+	// made by `zstd --train` or zstd.BuildDict. It is used for
+	// both compression and decompression; data compressed with
+	// a dictionary can only be decompressed with the same one.
+	Dictionary []byte
+
+	// Skippable frames, which carry metadata rather than
+	// compressed data, are always skipped when decompressing.
+	// If set, OnSkippableFrame is called with the magic number
+	// (0x184D2A50 to 0x184D2A5F) and a reader of the contents
+	// of each one, as they are reached; it can only be read
+	// until OnSkippableFrame returns, and the rest is skipped.
+	// The contents aren't held in memory, since their size,
+	// which can be up to 4 GiB, comes from the stream.
+	OnSkippableFrame func(magic uint32, frame io.Reader)
 }
 
-func (Zstd) Extension() string { return ".zst" }
-func (Zstd) MediaType() string { return "application/zstd" }
+func (Zstd) Extension() string      { return ".zst" }
+func (Zstd) MediaType() string      { return "application/zstd" }
+func (Zstd) magicNumbers() [][]byte { return [][]byte{zstdHeader} }
 
 func (zs Zstd) Match(_ context.Context, filename string, stream io.Reader) (MatchResult, error) {
 	var mr MatchResult
@@ -41,11 +77,29 @@ func (zs Zstd) Match(_ context.Context, filename string, stream io.Reader) (Matc
 }
 
 func (zs Zstd) OpenWriter(w io.Writer) (io.WriteCloser, error) {
-	return zstd.NewWriter(w, zs.EncoderOptions...)
+	opts := zs.EncoderOptions
+	if zs.CompressionLevel != 0 {
+		level := zstd.EncoderLevelFromZstd(max(1, min(zs.CompressionLevel, 19)))
+		opts = append([]zstd.EOption{zstd.WithEncoderLevel(level)}, opts...)
+	}
+	if len(zs.Dictionary) > 0 {
+		opts = append(opts[:len(opts):len(opts)], zstd.WithEncoderDict(zs.Dictionary))
+	}
+	return zstd.NewWriter(w, opts...)
 }
 
 func (zs Zstd) OpenReader(r io.Reader) (io.ReadCloser, error) {
-	zr, err := zstd.NewReader(r, zs.DecoderOptions...)
+	opts := zs.DecoderOptions
+	if zs.WindowSizeLimit != 0 {
+		opts = append([]zstd.DOption{zstd.WithDecoderMaxWindow(zs.WindowSizeLimit)}, opts...)
+	}
+	if len(zs.Dictionary) > 0 {
+		opts = append(opts[:len(opts):len(opts)], zstd.WithDecoderDicts(zs.Dictionary))
+	}
+	if zs.OnSkippableFrame != nil {
+		r = &zstdSkippableReader{br: bufio.NewReader(r), onFrame: zs.OnSkippableFrame}
+	}
+	zr, err := zstd.NewReader(r, opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -61,6 +115,141 @@ func (ec errorCloser) Close() error {
 	return nil
 }
 
+// zstdSkippableReader reads a stream of zstd frames, passing the
+// compressed frames through and calling onFrame with the skippable
+// frames, which it removes. Compressed frames are followed through
+// their block headers to find where they end, since their length isn't
+// recorded. Anything it doesn't recognize, from there on, is passed
+// through for the decoder to report.
+type zstdSkippableReader struct {
+	br      *bufio.Reader
+	onFrame func(magic uint32, frame io.Reader)
+
+	pending   []byte // headers read, not yet passed through
+	remaining int64  // bytes of the current block or checksum to pass through
+
+	inFrame, lastBlock, checksum bool
+	passThrough                  bool
+}
+
+func (zr *zstdSkippableReader) Read(p []byte) (int, error) {
+	for len(zr.pending) == 0 && zr.remaining == 0 && !zr.passThrough {
+		if err := zr.next(); err != nil {
+			return 0, err
+		}
+	}
+	if len(zr.pending) > 0 {
+		n := copy(p, zr.pending)
+		zr.pending = zr.pending[n:]
+		return n, nil
+	}
+	if zr.passThrough {
+		return zr.br.Read(p)
+	}
+	if int64(len(p)) > zr.remaining {
+		p = p[:zr.remaining]
+	}
+	n, err := zr.br.Read(p)
+	zr.remaining -= int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// next reads the header of what follows the current block: another
+// block, the checksum of the frame, or the next frame.
+func (zr *zstdSkippableReader) next() error {
+	le := binary.LittleEndian
+	if zr.inFrame {
+		if zr.lastBlock {
+			zr.inFrame = false
+			if zr.checksum {
+				zr.remaining = 4
+			}
+			return nil
+		}
+		hdr, err := zr.br.Peek(3)
+		if err != nil {
+			zr.passThrough = true
+			return nil
+		}
+		block := uint32(hdr[0]) | uint32(hdr[1])<<8 | uint32(hdr[2])<<16
+		zr.lastBlock = block&1 != 0
+		switch size := int64(block >> 3); (block >> 1) & 3 {
+		case 0, 2: // raw and compressed blocks
+			zr.remaining = size
+		case 1: // RLE blocks, of one byte
+			zr.remaining = 1
+		default:
+			zr.passThrough = true
+			return nil
+		}
+		zr.pending = make([]byte, 3)
+		_, err = io.ReadFull(zr.br, zr.pending)
+		return err
+	}
+
+	magic, err := zr.br.Peek(4)
+	if len(magic) == 0 && err == io.EOF {
+		return io.EOF
+	}
+	if err != nil {
+		zr.passThrough = true
+		return nil
+	}
+	switch m := le.Uint32(magic); {
+	case m&0xfffffff0 == zstdSkippableFrameMagic:
+		var hdr [8]byte
+		if _, err := io.ReadFull(zr.br, hdr[:]); err != nil {
+			return io.ErrUnexpectedEOF
+		}
+		frame := &io.LimitedReader{R: zr.br, N: int64(le.Uint32(hdr[4:]))}
+		zr.onFrame(m, frame)
+		if _, err := io.Copy(io.Discard, frame); err != nil {
+			return err
+		}
+		if frame.N > 0 {
+			return io.ErrUnexpectedEOF
+		}
+		return nil
+
+	case bytes.Equal(magic, zstdHeader):
+		fhd, err := zr.br.Peek(5)
+		if err != nil {
+			zr.passThrough = true
+			return nil
+		}
+		desc := fhd[4]
+		singleSegment := desc&0x20 != 0
+		n := 5 + []int{0, 1, 2, 4}[desc&3] // dictionary ID
+		switch fcs := desc >> 6; {
+		case fcs == 0 && singleSegment:
+			n++
+		case fcs > 0:
+			n += 1 << fcs // 2, 4, or 8 bytes
+		}
+		if !singleSegment {
+			n++ // window descriptor
+		}
+		hdr, err := zr.br.Peek(n)
+		if err != nil {
+			zr.passThrough = true
+			return nil
+		}
+		zr.pending = bytes.Clone(hdr)
+		zr.br.Discard(n)
+		zr.inFrame, zr.lastBlock, zr.checksum = true, false, desc&0x04 != 0
+		return nil
+	}
+
+	zr.passThrough = true
+	return nil
+}
+
+// the magic numbers of skippable frames, whose low 4 bits vary
+const zstdSkippableFrameMagic = 0x184d2a50
+
 // magic number at the beginning of Zstandard files
 // https://github.com/facebook/zstd/blob/6211bfee5ec24dc825c11751c33aa31d618b5f10/doc/zstd_compression_format.md
 var zstdHeader = []byte{0x28, 0xb5, 0x2f, 0xfd}
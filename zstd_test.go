@@ -0,0 +1,134 @@
+package archives
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestZstd_Dictionary(t *testing.T) {
+	sample := func(i int) []byte {
+		return []byte(fmt.Sprintf(`{"id":%d,"type":"user","name":"user%d","email":"user%d@example.com","active":true,"roles":["reader","writer"]}`, i, i, i))
+	}
+	var samples [][]byte
+	for i := 0; i < 200; i++ {
+		samples = append(samples, sample(i))
+	}
+	var history []byte
+	for _, s := range samples[:50] {
+		history = append(history, s...)
+	}
+	dict, err := zstd.BuildDict(zstd.BuildDictOptions{
+		ID:       1,
+		Contents: samples,
+		History:  history,
+		Offsets:  [3]int{1, 4, 8},
+	})
+	checkErr(t, err, "building dictionary")
+
+	input := sample(5000)
+	withDict := compress(t, ".zst", input, Zstd{Dictionary: dict}.OpenWriter)
+	withoutDict := compress(t, ".zst", input, Zstd{}.OpenWriter)
+	if len(withDict) >= len(withoutDict)/2 {
+		t.Errorf("expected dictionary to at least halve the output: %d bytes with, %d without", len(withDict), len(withoutDict))
+	}
+
+	r, err := Zstd{Dictionary: dict}.OpenReader(bytes.NewReader(withDict))
+	checkErr(t, err, "opening reader with dictionary")
+	output, err := io.ReadAll(r)
+	checkErr(t, err, "decompressing with dictionary")
+	r.Close()
+	if !bytes.Equal(output, input) {
+		t.Errorf("expected %q, got %q", input, output)
+	}
+
+	r, err = Zstd{}.OpenReader(bytes.NewReader(withDict))
+	checkErr(t, err, "opening reader without dictionary")
+	if _, err := io.ReadAll(r); err == nil {
+		t.Errorf("expected error decompressing without the dictionary")
+	}
+	r.Close()
+}
+
+func TestZstd_WindowSizeLimit(t *testing.T) {
+	// as made by `zstd --long=27`
+	const window = 1 << 27
+	input := bytes.Repeat([]byte("long-distance matching "), 50000)
+	compressed := compress(t, ".zst", input, Zstd{
+		EncoderOptions: []zstd.EOption{zstd.WithWindowSize(window)},
+	}.OpenWriter)
+	var hdr zstd.Header
+	checkErr(t, hdr.Decode(compressed), "decoding frame header")
+	if hdr.WindowSize != window {
+		t.Fatalf("expected window size %d, got %d", window, hdr.WindowSize)
+	}
+
+	for _, tc := range []struct {
+		limit  uint64
+		expect bool
+	}{
+		{0, true},
+		{window, true},
+		{1 << 31, true},
+		{window / 2, false},
+	} {
+		r, err := Zstd{WindowSizeLimit: tc.limit}.OpenReader(bytes.NewReader(compressed))
+		checkErr(t, err, "opening reader with limit %d", tc.limit)
+		output, err := io.ReadAll(r)
+		r.Close()
+		if tc.expect {
+			checkErr(t, err, "decompressing with limit %d", tc.limit)
+			if !bytes.Equal(output, input) {
+				t.Errorf("limit %d: decompressed %d bytes, expected %d", tc.limit, len(output), len(input))
+			}
+		} else if err == nil {
+			t.Errorf("limit %d: expected error decompressing frame with larger window", tc.limit)
+		}
+	}
+}
+
+func TestZstd_SkippableFrames(t *testing.T) {
+	first := append(bytes.Repeat([]byte("the first frame, in several blocks. "), 20000), make([]byte, 300<<10)...) // and RLE blocks
+	second := []byte("the second frame")
+	metadata := []byte("metadata between the frames")
+
+	var stream []byte
+	stream = append(stream, compress(t, ".zst", first, Zstd{}.OpenWriter)...)
+	stream = binary.LittleEndian.AppendUint32(stream, 0x184d2a53)
+	stream = binary.LittleEndian.AppendUint32(stream, uint32(len(metadata)))
+	stream = append(stream, metadata...)
+	stream = append(stream, compress(t, ".zst", second, Zstd{EncoderOptions: []zstd.EOption{zstd.WithEncoderCRC(false)}}.OpenWriter)...)
+	expected := append(bytes.Clone(first), second...)
+
+	type frame struct {
+		magic uint32
+		data  string
+	}
+	var frames []frame
+	for _, format := range []Zstd{
+		{},
+		{OnSkippableFrame: func(magic uint32, r io.Reader) {
+			data, err := io.ReadAll(r)
+			checkErr(t, err, "reading skippable frame")
+			frames = append(frames, frame{magic, string(data)})
+		}},
+		// what isn't read is skipped
+		{OnSkippableFrame: func(uint32, io.Reader) {}},
+	} {
+		r, err := format.OpenReader(bytes.NewReader(stream))
+		checkErr(t, err, "opening reader")
+		output, err := io.ReadAll(r)
+		checkErr(t, err, "decompressing")
+		r.Close()
+		if !bytes.Equal(output, expected) {
+			t.Errorf("expected both frames, %d bytes, got %d bytes", len(expected), len(output))
+		}
+	}
+	if len(frames) != 1 || frames[0] != (frame{0x184d2a53, string(metadata)}) {
+		t.Errorf("expected the skippable frame to be reported, got %+v", frames)
+	}
+}